@@ -0,0 +1,461 @@
+package main
+
+/* Admin command line, for break-glass access when the api is locked down.
+Subcommands work directly on the configured database with the same validations as the api.
+
+	userauth user create|list|delete|set-role|reset-password|unlock|import|export
+	userauth token issue|inspect|revoke
+	userauth keys rotate
+	userauth migrate status|up|down
+
+Every subcommand takes -o table|json for the output format */
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"github.com/eensymachines-in/webapi-userauth/models"
+	"github.com/golang-jwt/jwt"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	cliUsage = `usage: userauth <command> <subcommand> [flags]
+	user create -name -email -pass [-role]
+	user list [-skip] [-limit]
+	user delete -id
+	user set-role -id -role
+	user reset-password -id -pass
+	user unlock -id
+	user import -file [-format] [-policy skip|upsert] [-dry-run] [-prehashed]
+	user export [-file] [-format]
+	token issue -id
+	token inspect -token
+	token revoke -id
+	keys rotate
+	migrate status
+	migrate up [-to] [-dry-run]
+	migrate down [-to] [-dry-run]
+all subcommands accept -o table|json`
+	cliActor = "cli" // actor in the audit trail for changes made from the command line
+)
+
+// cliCmd : one subcommand, gets the parsed flags and the connected database
+type cliCmd struct {
+	flags func(fs *flag.FlagSet) // declares the flags of the subcommand
+	run   func(db *mongo.Database, out *cliOutput) error
+}
+
+// cliOutput : prints either as a table or json, as asked for on the command line
+type cliOutput struct {
+	w      io.Writer
+	format string
+}
+
+// print : v is printed as json, or else the table function writes out the rows
+func (co *cliOutput) print(v interface{}, header string, rows func(tw *tabwriter.Writer)) error {
+	if co.format == "json" {
+		enc := json.NewEncoder(co.w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	tw := tabwriter.NewWriter(co.w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, header)
+	rows(tw)
+	return tw.Flush()
+}
+
+func (co *cliOutput) users(usrs ...models.User) error {
+	views := make([]models.AdminView, len(usrs))
+	for i, u := range usrs {
+		views[i] = models.AdminView(u)
+	}
+	return co.print(views, "ID\tNAME\tEMAIL\tROLE\tSTATUS\tTELEGID", func(tw *tabwriter.Writer) {
+		for _, u := range usrs {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%d\n", u.Id.Hex(), u.Name, u.Email, u.Role, u.CurrentStatus(), u.TelegID)
+		}
+	})
+}
+
+// migration : prints the steps that ran, even when one of them failed, and audits the ones applied
+func (co *cliOutput) migration(db *mongo.Database, report *models.MigrationReport, herr httperr.HttpErr) error {
+	if report != nil {
+		for _, step := range report.Steps {
+			if !report.DryRun && step.Error == "" {
+				auditEvent(db, "migrations", step.Direction, cliActor, fmt.Sprint(step.Version), map[string]string{"name": step.Name, "affected": fmt.Sprint(step.Affected)})
+			}
+		}
+		if err := co.print(report, "VERSION\tNAME\tDIRECTION\tAFFECTED\tERROR", func(tw *tabwriter.Writer) {
+			for _, s := range report.Steps {
+				fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%s\n", s.Version, s.Name, s.Direction, s.Affected, s.Error)
+			}
+		}); err != nil {
+			return err
+		}
+	}
+	return cliErr(herr)
+}
+
+// cliErr : HttpErr as a plain error for the command line, the internal error is logged (stderr) for the operator
+func cliErr(herr httperr.HttpErr) error {
+	if herr == nil {
+		return nil
+	}
+	herr.Log(log.WithFields(log.Fields{"stack": "cli"}))
+	return errors.New(herr.ClientErrData())
+}
+
+func cliCommands() map[string]map[string]func() *cliCmd {
+	var (
+		name, email, pass, id, token string
+		role, to                     int
+		skip, limit                  int64
+		file, format, policy         string
+		dryRun, preHashed            bool
+	)
+	// format from the flag, else from the file extension
+	bulkFormat := func() models.BulkFormat {
+		if format != "" {
+			return models.BulkFormat(format)
+		}
+		return models.BulkFormat(strings.TrimPrefix(filepath.Ext(file), "."))
+	}
+	withUser := func(db *mongo.Database, then func(uc *models.UsersCollection, usr *models.User) error) error {
+		uc := models.UsersCollection{DbColl: db.Collection("users")}
+		usr := models.User{}
+		if err := cliErr(uc.LookupUser(id, &usr)); err != nil {
+			return err
+		}
+		return then(&uc, &usr)
+	}
+	idFlag := func(fs *flag.FlagSet) { fs.StringVar(&id, "id", "", "hex id or email of the user") }
+	return map[string]map[string]func() *cliCmd{
+		"user": {
+			"create": func() *cliCmd {
+				return &cliCmd{
+					flags: func(fs *flag.FlagSet) {
+						fs.StringVar(&name, "name", "", "name of the user")
+						fs.StringVar(&email, "email", "", "email of the user")
+						fs.StringVar(&pass, "pass", "", "password of the user")
+						fs.IntVar(&role, "role", int(models.EndUser), "0-superuser 1-admin 2-enduser 3-guest")
+					},
+					run: func(db *mongo.Database, out *cliOutput) error {
+						uc := models.UsersCollection{DbColl: db.Collection("users")}
+						usr := models.User{Name: models.UserName(name), Email: models.UserEmail(email), Auth: pass, Role: models.UserRole(role)}
+						if err := cliErr(uc.NewUser(&usr)); err != nil {
+							return err
+						}
+						auditEvent(db, "users", "create", cliActor, usr.Id.Hex(), map[string]string{"role": fmt.Sprint(usr.Role)})
+						return out.users(usr)
+					},
+				}
+			},
+			"list": func() *cliCmd {
+				return &cliCmd{
+					flags: func(fs *flag.FlagSet) {
+						fs.Int64Var(&skip, "skip", 0, "users to skip")
+						fs.Int64Var(&limit, "limit", 0, "max users to list, 0 for all")
+					},
+					run: func(db *mongo.Database, out *cliOutput) error {
+						uc := models.UsersCollection{DbColl: db.Collection("users")}
+						usrs, herr := uc.ListUsers(skip, limit)
+						if err := cliErr(herr); err != nil {
+							return err
+						}
+						return out.users(usrs...)
+					},
+				}
+			},
+			"delete": func() *cliCmd {
+				return &cliCmd{flags: idFlag, run: func(db *mongo.Database, out *cliOutput) error {
+					return withUser(db, func(uc *models.UsersCollection, usr *models.User) error {
+						if err := cliErr(uc.DeleteUser(usr.Id.Hex())); err != nil {
+							return err
+						}
+						auditEvent(db, "users", "delete", cliActor, usr.Id.Hex(), nil)
+						return out.users(*usr)
+					})
+				}}
+			},
+			"set-role": func() *cliCmd {
+				return &cliCmd{
+					flags: func(fs *flag.FlagSet) {
+						idFlag(fs)
+						fs.IntVar(&role, "role", -1, "0-superuser 1-admin 2-enduser 3-guest")
+					},
+					run: func(db *mongo.Database, out *cliOutput) error {
+						return withUser(db, func(uc *models.UsersCollection, usr *models.User) error {
+							if role < 0 {
+								return fmt.Errorf("-role is required")
+							}
+							if err := cliErr(uc.AssignRole(usr.Id.Hex(), models.UserRole(role))); err != nil {
+								return err
+							}
+							auditEvent(db, "users", "role", cliActor, usr.Id.Hex(), map[string]string{"from": fmt.Sprint(usr.Role), "to": fmt.Sprint(role)})
+							usr.Role = models.UserRole(role)
+							return out.users(*usr)
+						})
+					},
+				}
+			},
+			"reset-password": func() *cliCmd {
+				return &cliCmd{
+					flags: func(fs *flag.FlagSet) {
+						idFlag(fs)
+						fs.StringVar(&pass, "pass", "", "new password of the user")
+					},
+					run: func(db *mongo.Database, out *cliOutput) error {
+						return withUser(db, func(uc *models.UsersCollection, usr *models.User) error {
+							if pass == "" {
+								return fmt.Errorf("-pass is required")
+							}
+							if err := cliErr(uc.EditUser(usr.Id.Hex(), "", pass, 0)); err != nil {
+								return err
+							}
+							if err := cliErr(uc.RevokeTokens(usr.Id.Hex())); err != nil {
+								return err
+							}
+							auditEvent(db, "users", "reset-password", cliActor, usr.Id.Hex(), nil)
+							return out.users(*usr)
+						})
+					},
+				}
+			},
+			"unlock": func() *cliCmd {
+				return &cliCmd{flags: idFlag, run: func(db *mongo.Database, out *cliOutput) error {
+					return withUser(db, func(uc *models.UsersCollection, usr *models.User) error {
+						if err := cliErr(uc.AssignStatus(usr.Id.Hex(), models.StatusActive, "unlocked from command line", 0)); err != nil {
+							return err
+						}
+						auditEvent(db, "users", "status", cliActor, usr.Id.Hex(), map[string]string{"status": string(models.StatusActive)})
+						usr.Status, usr.StatusReason = models.StatusActive, "unlocked from command line"
+						return out.users(*usr)
+					})
+				}}
+			},
+			"import": func() *cliCmd {
+				return &cliCmd{
+					flags: func(fs *flag.FlagSet) {
+						fs.StringVar(&file, "file", "", "file to import")
+						fs.StringVar(&format, "format", "", "json|ndjson|csv, from the file extension if not given")
+						fs.StringVar(&policy, "policy", string(models.PolicySkip), "skip|upsert for users already registered")
+						fs.BoolVar(&dryRun, "dry-run", false, "only validate and report")
+						fs.BoolVar(&preHashed, "prehashed", false, "passwords in the file are bcrypt hashes")
+					},
+					run: func(db *mongo.Database, out *cliOutput) error {
+						f, err := os.Open(file)
+						if err != nil {
+							return err
+						}
+						defer f.Close()
+						uc := models.UsersCollection{DbColl: db.Collection("users")}
+						report, herr := uc.ImportUsers(f, models.ImportOptions{
+							Format: bulkFormat(), Policy: models.ImportPolicy(policy), DryRun: dryRun, PreHashed: preHashed, CallerRole: models.SuperUser, // superusers are not imported, set-role them after
+						})
+						if err := cliErr(herr); err != nil {
+							return err
+						}
+						if !dryRun {
+							for _, row := range report.Rows {
+								if row.Result == "created" || row.Result == "updated" {
+									auditEvent(db, "users", "import-"+row.Result, cliActor, row.Email, nil)
+								}
+							}
+						}
+						return out.print(report, "ROW\tEMAIL\tRESULT\tERROR", func(tw *tabwriter.Writer) {
+							for _, row := range report.Rows {
+								fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", row.Row, row.Email, row.Result, row.Error)
+							}
+							fmt.Fprintf(tw, "\ntotal %d, created %d, updated %d, skipped %d, invalid %d, failed %d, dry run %v\n",
+								report.Total, report.Created, report.Updated, report.Skipped, report.Invalid, report.Failed, report.DryRun)
+						})
+					},
+				}
+			},
+			"export": func() *cliCmd {
+				return &cliCmd{
+					flags: func(fs *flag.FlagSet) {
+						fs.StringVar(&file, "file", "", "file to export to, stdout if not given")
+						fs.StringVar(&format, "format", "", "json|ndjson|csv, from the file extension if not given")
+					},
+					run: func(db *mongo.Database, out *cliOutput) error {
+						w := out.w
+						if file != "" {
+							f, err := os.Create(file)
+							if err != nil {
+								return err
+							}
+							defer f.Close()
+							w = f
+						}
+						if format == "" && file == "" {
+							format = string(models.FormatJSON)
+						}
+						uc := models.UsersCollection{DbColl: db.Collection("users")}
+						return cliErr(uc.ExportUsers(w, bulkFormat()))
+					},
+				}
+			},
+		},
+		"token": {
+			"issue": func() *cliCmd {
+				return &cliCmd{flags: idFlag, run: func(db *mongo.Database, out *cliOutput) error {
+					return withUser(db, func(uc *models.UsersCollection, usr *models.User) error {
+						if err := cliErr(models.AccountStatusErr(usr)); err != nil {
+							return err
+						}
+						if err := cliErr(uc.IssueToken(usr)); err != nil {
+							return err
+						}
+						auditEvent(db, "auth", "token-issued", cliActor, usr.Id.Hex(), nil)
+						return out.print(map[string]string{"authtok": usr.AuthTok}, "TOKEN", func(tw *tabwriter.Writer) {
+							fmt.Fprintln(tw, usr.AuthTok)
+						})
+					})
+				}}
+			},
+			"inspect": func() *cliCmd {
+				return &cliCmd{
+					flags: func(fs *flag.FlagSet) { fs.StringVar(&token, "token", "", "token to inspect") },
+					run: func(db *mongo.Database, out *cliOutput) error {
+						claims := models.CustomClaims{}
+						jTok, _, err := new(jwt.Parser).ParseUnverified(strings.TrimPrefix(token, "Bearer "), &claims)
+						if err != nil {
+							return fmt.Errorf("token cannot be read: %s", err)
+						}
+						uc := models.UsersCollection{DbColl: db.Collection("users")}
+						valid, reason := true, ""
+						if _, herr := uc.AuthorizeClaims(token); herr != nil {
+							valid, reason = false, herr.ClientErrData()
+						}
+						result := map[string]interface{}{"kid": jTok.Header["kid"], "claims": claims, "valid": valid, "reason": reason}
+						return out.print(result, "USER\tROLE\tISSUED\tEXPIRES\tKID\tVALID", func(tw *tabwriter.Writer) {
+							fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%v\t%v %s\n", claims.User, claims.UserRole,
+								time.Unix(claims.IssuedAt, 0).Format(time.RFC3339), time.Unix(claims.ExpiresAt, 0).Format(time.RFC3339), jTok.Header["kid"], valid, reason)
+						})
+					},
+				}
+			},
+			"revoke": func() *cliCmd {
+				return &cliCmd{flags: idFlag, run: func(db *mongo.Database, out *cliOutput) error {
+					return withUser(db, func(uc *models.UsersCollection, usr *models.User) error {
+						if err := cliErr(uc.RevokeTokens(usr.Id.Hex())); err != nil {
+							return err
+						}
+						auditEvent(db, "auth", "tokens-revoked", cliActor, usr.Id.Hex(), nil)
+						return out.users(*usr)
+					})
+				}}
+			},
+		},
+		"keys": {
+			"rotate": func() *cliCmd {
+				return &cliCmd{flags: func(fs *flag.FlagSet) {}, run: func(db *mongo.Database, out *cliOutput) error {
+					uc := models.UsersCollection{DbColl: db.Collection("users")}
+					kid, herr := uc.RotateSigningKey()
+					if err := cliErr(herr); err != nil {
+						return err
+					}
+					auditEvent(db, "keys", "rotate", cliActor, kid, nil)
+					// ID token keys are rotated along, relying parties pick the new one from the JWKS
+					idKid, herr := uc.RotateIDTokenKey()
+					if err := cliErr(herr); err != nil {
+						return err
+					}
+					auditEvent(db, "keys", "rotate-id", cliActor, idKid, nil)
+					return out.print(map[string]string{"kid": kid, "id_kid": idKid}, "KID\tID KID", func(tw *tabwriter.Writer) {
+						fmt.Fprintf(tw, "%s\t%s\n", kid, idKid)
+					})
+				}}
+			},
+		},
+		"migrate": {
+			"status": func() *cliCmd {
+				return &cliCmd{flags: func(fs *flag.FlagSet) {}, run: func(db *mongo.Database, out *cliOutput) error {
+					m := models.Migrator{Db: db, Migrations: models.Migrations}
+					status, herr := m.Status()
+					if err := cliErr(herr); err != nil {
+						return err
+					}
+					return out.print(status, "VERSION\tNAME\tAPPLIED", func(tw *tabwriter.Writer) {
+						for _, s := range status {
+							applied := "-"
+							if s.Applied {
+								applied = time.Unix(s.AppliedAt, 0).Format(time.RFC3339)
+							}
+							fmt.Fprintf(tw, "%d\t%s\t%s\n", s.Version, s.Name, applied)
+						}
+					})
+				}}
+			},
+			"up": func() *cliCmd {
+				return &cliCmd{
+					flags: func(fs *flag.FlagSet) {
+						fs.IntVar(&to, "to", 0, "version to migrate upto, 0 for the latest")
+						fs.BoolVar(&dryRun, "dry-run", false, "only count the documents that would change")
+					},
+					run: func(db *mongo.Database, out *cliOutput) error {
+						m := models.Migrator{Db: db, Migrations: models.Migrations}
+						report, herr := m.Up(to, dryRun)
+						return out.migration(db, report, herr)
+					},
+				}
+			},
+			"down": func() *cliCmd {
+				return &cliCmd{
+					flags: func(fs *flag.FlagSet) {
+						fs.IntVar(&to, "to", -1, "version to revert to, 0 reverts all, -1 only the latest")
+						fs.BoolVar(&dryRun, "dry-run", false, "only count the documents that would change")
+					},
+					run: func(db *mongo.Database, out *cliOutput) error {
+						m := models.Migrator{Db: db, Migrations: models.Migrations}
+						report, herr := m.Down(to, dryRun)
+						return out.migration(db, report, herr)
+					},
+				}
+			},
+		},
+	}
+}
+
+// runCLI : runs the subcommand from the command line args (without the program name), sends back the exit code
+func runCLI(args []string) int {
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, cliUsage)
+		return 2
+	}
+	newCmd, ok := cliCommands()[args[0]][args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %s %s\n%s\n", args[0], args[1], cliUsage)
+		return 2
+	}
+	cmd := newCmd()
+	out := &cliOutput{w: os.Stdout}
+	fs := flag.NewFlagSet(strings.Join(args[:2], " "), flag.ContinueOnError)
+	fs.StringVar(&out.format, "o", "table", "output format table|json")
+	cmd.flags(fs)
+	if err := fs.Parse(args[2:]); err != nil {
+		return 2
+	}
+	client, db, err := connectDatabase()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to connect database: %s\n", err)
+		return 1
+	}
+	defer client.Disconnect(context.Background())
+	if err := cmd.run(db, out); err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s: %s\n", args[0], args[1], err)
+		return 1
+	}
+	return 0
+}
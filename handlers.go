@@ -1,17 +1,2019 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/eensymachines-in/errx/httperr"
 	"github.com/eensymachines-in/webapi-userauth/models"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
+// RequireRole : middleware that lets through only requests carrying a valid token with role at or above the one required.
+// Roles are ordered with SuperUser as the lowest value, hence the <= comparison.
+// Claims of the caller are set on the context as "claims" for the downstream handlers.
+// Tokens of oauth clients get through only when the scope granted holds one of the scopes of the route, routes without any are closed to them.
+// Has to be used after the mongo connect middleware, on abort it closes the client since the handler wont be reached.
+func RequireRole(role models.UserRole, scopes ...models.Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		val, _ := c.Get("mongo-client")
+		mongoClient := val.(*mongo.Client)
+		val, _ = c.Get("mongo-database")
+		db := val.(*mongo.Database)
+		uc := models.UsersCollection{DbColl: db.Collection("users")}
+
+		claims, err := uc.AuthorizeClaims(c.Request.Header.Get("Authorization"))
+		if err == nil && claims.UserRole > role {
+			err = httperr.ErrForbidden(fmt.Errorf("user %s with role %d cannot access, requires %d", claims.User, claims.UserRole, role))
+		} else if err == nil && !clientScoped(claims, scopes) {
+			err = httperr.ErrForbidden(fmt.Errorf("client %s was not granted the scope for %s %s", claims.ClientID, c.Request.Method, c.FullPath()))
+		}
+		if err != nil {
+			mongoClient.Disconnect(context.Background())
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "RequireRole",
+			}))
+			return
+		}
+		c.Set("claims", claims)
+	}
+}
+
+// clientScoped : tokens the account got for itself are not scoped, tokens of oauth clients need one of the scopes
+func clientScoped(claims *models.CustomClaims, scopes []models.Permission) bool {
+	if claims.ClientID == "" {
+		return true
+	}
+	for _, s := range scopes {
+		if claims.ScopeGrants(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// SessionCookie : middleware that lets the access token of a browser session in from its cookie, as if it were sent in the Authorization header.
+// State changing requests have to send the CSRF token of the session in X-CSRF-Token, cookies that arent valid session tokens are ignored.
+// Requests with an Authorization header are left as they are. Has to be used after the mongo connect middleware
+// GET on cookieConsentRoutes is not let in, those act for the account and have to be POSTed with the CSRF token.
+func SessionCookie(c *gin.Context) {
+	tok, _ := c.Cookie(sessionCookies.Access)
+	if tok == "" || c.GetHeader("Authorization") != "" {
+		return
+	}
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		if !cookieConsentRoutes[c.FullPath()] {
+			c.Request.Header.Set("Authorization", "Bearer "+tok)
+		}
+		return
+	}
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+
+	valid, err := uc.CheckCSRF(tok, c.GetHeader("X-CSRF-Token"))
+	if err != nil {
+		mongoClient.Disconnect(context.Background())
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "SessionCookie",
+		}))
+		return
+	}
+	if valid {
+		c.Request.Header.Set("Authorization", "Bearer "+tok)
+	}
+}
+
+// CredentialedCORS : CORS for the front ends in corsOrigins that send the session cookies, used in place of utilities.CORS when CORS_ORIGINS is set.
+// Browsers do not send cookies to a wildcard origin, hence the origin is echoed back only when it is one of corsOrigins
+func CredentialedCORS(c *gin.Context) {
+	c.Header("Vary", "Origin")
+	origin := c.GetHeader("Origin")
+	for _, o := range corsOrigins {
+		if o == origin {
+			c.Header("Access-Control-Allow-Origin", origin)
+			c.Header("Access-Control-Allow-Credentials", "true")
+			c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			c.Header("Access-Control-Allow-Headers", "Authorization, Content-Type, Accept, X-CSRF-Token")
+			c.Header("Access-Control-Expose-Headers", "X-CSRF-Token")
+			break
+		}
+	}
+	c.Header("Content-Type", "application/json")
+	if c.Request.Method == http.MethodOptions {
+		c.AbortWithStatus(http.StatusOK) // preflight, origin not allowed gets no allow headers and the browser stops there
+		return
+	}
+	c.Next()
+}
+
+// RequireOrgRole : middleware that lets through platform admins, and the accounts acting in an org with org role at or above the one required.
+// For routes with the :org param, the token has to be acting in that org. Tokens of oauth clients are not let through. Sets "claims" as RequireRole does.
+func RequireOrgRole(role models.UserRole) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		val, _ := c.Get("mongo-client")
+		mongoClient := val.(*mongo.Client)
+		val, _ = c.Get("mongo-database")
+		db := val.(*mongo.Database)
+		uc := models.UsersCollection{DbColl: db.Collection("users")}
+
+		claims, err := uc.AuthorizeClaims(c.Request.Header.Get("Authorization"))
+		if err == nil && !clientScoped(claims, nil) {
+			err = httperr.ErrForbidden(fmt.Errorf("client %s cannot act on orgs", claims.ClientID))
+		} else if err == nil && claims.UserRole > models.Admin {
+			if claims.Org == "" || claims.OrgRole > role {
+				err = httperr.ErrForbidden(fmt.Errorf("user %s with org role %d cannot access, requires %d", claims.User, claims.OrgRole, role))
+			} else if org := c.Param("org"); org != "" && org != claims.Org {
+				err = httperr.ErrForbidden(fmt.Errorf("user %s is acting in org %s and not %s", claims.User, claims.Org, org))
+			}
+		}
+		if err != nil {
+			mongoClient.Disconnect(context.Background())
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "RequireOrgRole",
+			}))
+			return
+		}
+		c.Set("claims", claims)
+	}
+}
+
+// orgScope : org admins see only the members of the org they are acting in, platform admins see all.
+// Sends back the role of the caller to check grants against, SuperUser for platform admins
+func orgScope(c *gin.Context, uc *models.UsersCollection) models.UserRole {
+	val, _ := c.Get("claims")
+	claims := val.(*models.CustomClaims)
+	if claims.UserRole <= models.Admin {
+		return models.SuperUser
+	}
+	uc.Org, _ = primitive.ObjectIDFromHex(claims.Org)
+	return claims.OrgRole
+}
+
+// callerClaims : claims of the caller if the request has a valid token, nil otherwise.
+// For handlers that are open to all but respond differently to an authorized caller
+func callerClaims(c *gin.Context, uc *models.UsersCollection) *models.CustomClaims {
+	if val, ok := c.Get("claims"); ok {
+		return val.(*models.CustomClaims)
+	}
+	tok := c.Request.Header.Get("Authorization")
+	if tok == "" {
+		return nil
+	}
+	claims, err := uc.AuthorizeClaims(tok)
+	if err != nil {
+		return nil
+	}
+	c.Set("claims", claims)
+	return claims
+}
+
+// auditActor : identity of the caller as known from the token, else the fallback
+func auditActor(c *gin.Context, fallback string) string {
+	if val, ok := c.Get("claims"); ok {
+		claims := val.(*models.CustomClaims)
+		if claims.User == "" && claims.ClientID != "" {
+			return "client:" + claims.ClientID // client credentials, no account behind the token
+		}
+		return claims.User
+	}
+	return fallback
+}
+
+// auditEvent : appends to the audit trail, failure to audit is logged but does not fail the request
+func auditEvent(db *mongo.Database, stream, action, actor, subject string, details map[string]string) {
+	ac := models.AuditCollection{DbColl: db.Collection("audit")}
+	if err := ac.Append(&models.AuditRecord{Stream: stream, Action: action, Actor: actor, Subject: subject, Details: details}); err != nil {
+		err.Log(log.WithFields(log.Fields{
+			"stack":  "auditEvent",
+			"stream": stream,
+			"action": action,
+		}))
+	}
+}
+
+// HndlAuditVerify : walks the hash chain of an audit stream and reports the first broken link
+// Responds 200 with the report even when the chain is broken, report.intact is what the caller should look at
+func HndlAuditVerify(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	ac := models.AuditCollection{DbColl: db.Collection("audit")}
+	defer mongoClient.Disconnect(context.Background())
+
+	report, err := ac.Verify(c.Param("stream"))
+	if err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlAuditVerify",
+		}))
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusOK, report)
+}
+
+// HndlRestoreUser : admin brings back a soft deleted account within the restore window
+func HndlRestoreUser(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	defer mongoClient.Disconnect(context.Background())
+
+	usrId := c.Param("id")
+	if err := uc.RestoreUser(usrId); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlRestoreUser",
+		}))
+		return
+	}
+	auditEvent(db, "users", "restore", auditActor(c, "anonymous"), usrId, nil)
+	usr := models.User{}
+	if err := uc.FindUser(usrId, &usr); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlRestoreUser",
+		}))
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusOK, usr)
+}
+
+// selfOrAdmin : the caller is either the account holder or an admin with a role strictly above that of the account.
+// Client credentials tokens have no account and are never the holder
+func selfOrAdmin(c *gin.Context, usr *models.User) httperr.HttpErr {
+	val, _ := c.Get("claims")
+	claims := val.(*models.CustomClaims)
+	if claims.User != "" && claims.User == string(usr.Email) {
+		return nil
+	}
+	if claims.UserRole <= models.Admin && claims.UserRole < usr.Role {
+		return nil
+	}
+	return httperr.ErrForbidden(fmt.Errorf("%s cannot act on the account %s", claims.User, usr.Email))
+}
+
+// HndlUserStatus : admin changes the account status, suspend/lock/disable/reactivate
+//
+/*
+	PATCH /users/:id/status
+	{"status": "suspended", "reason": "repeated abuse", "until": 1735689600}
+*/
+func HndlUserStatus(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	defer mongoClient.Disconnect(context.Background())
+
+	payload := struct {
+		Status models.UserStatus `json:"status"`
+		Reason string            `json:"reason"`
+		Until  int64             `json:"until"`
+	}{}
+	if err := httperr.ErrBinding(c.ShouldBind(&payload)); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlUserStatus",
+		}))
+		return
+	}
+	usrId := c.Param("id")
+	val, _ = c.Get("claims")
+	claims := val.(*models.CustomClaims)
+	if err := uc.SetStatus(usrId, payload.Status, payload.Reason, payload.Until, claims.UserRole); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlUserStatus",
+		}))
+		return
+	}
+	auditEvent(db, "users", "status", auditActor(c, "anonymous"), usrId, map[string]string{"status": string(payload.Status), "until": fmt.Sprint(payload.Until)})
+	usr := models.User{}
+	if err := uc.FindUser(usrId, &usr); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlUserStatus",
+		}))
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusOK, models.AdminView(usr))
+}
+
+// HndlExportUser : account holder or admin on their behalf downloads all personal data held against the account
+// ?format=zip for an archive, json otherwise
+func HndlExportUser(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	ac := models.AuditCollection{DbColl: db.Collection("audit")}
+	defer mongoClient.Disconnect(context.Background())
+
+	usr := models.User{}
+	if err := uc.FindUser(c.Param("id"), &usr); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlExportUser",
+		}))
+		return
+	}
+	if err := selfOrAdmin(c, &usr); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlExportUser",
+		}))
+		return
+	}
+	export, err := uc.ExportPersonalData(usr.Id.Hex(), &ac)
+	if err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlExportUser",
+		}))
+		return
+	}
+	auditEvent(db, "users", "export", auditActor(c, "anonymous"), usr.Id.Hex(), nil)
+	if c.Query("format") == "zip" {
+		c.Header("Content-Type", "application/zip")
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.zip\"", usr.Id.Hex()))
+		c.Status(http.StatusOK)
+		if err := export.WriteZip(c.Writer); err != nil {
+			log.WithFields(log.Fields{"stack": "HndlExportUser"}).Errorf("failed writing zip archive %s", err)
+		}
+		c.Abort()
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusOK, export)
+}
+
+// HndlEraseUser : account holder or admin on their behalf erases personal data of the account
+func HndlEraseUser(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	ac := models.AuditCollection{DbColl: db.Collection("audit")}
+	defer mongoClient.Disconnect(context.Background())
+
+	usr := models.User{}
+	if err := uc.FindUser(c.Param("id"), &usr); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlEraseUser",
+		}))
+		return
+	}
+	if err := selfOrAdmin(c, &usr); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlEraseUser",
+		}))
+		return
+	}
+	actor := auditActor(c, "anonymous")
+	if actor == string(usr.Email) {
+		actor = usr.Id.Hex() // self erasure, the email is about to be anonymized anyway
+	}
+	if err := uc.ErasePersonalData(usr.Id.Hex(), &ac, avatarStore(db)); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlEraseUser",
+		}))
+		return
+	}
+	auditEvent(db, "users", "erase", actor, usr.Id.Hex(), nil)
+	c.AbortWithStatus(http.StatusOK)
+}
+
+// HndlUserRole : admin changes the role of an account strictly below their own, tokens of the account are revoked
+//
+/*
+	PATCH /users/:id/role
+	{"role": 1}
+*/
+func HndlUserRole(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	defer mongoClient.Disconnect(context.Background())
+
+	val, _ = c.Get("claims")
+	claims := val.(*models.CustomClaims)
+	payload := struct {
+		Role models.UserRole `json:"role"`
+	}{}
+	if err := httperr.ErrBinding(c.ShouldBind(&payload)); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlUserRole",
+		}))
+		return
+	}
+	usrId := c.Param("id")
+	usr := models.User{}
+	if err := uc.FindUser(usrId, &usr); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlUserRole",
+		}))
+		return
+	}
+	if err := uc.SetRole(usrId, payload.Role, claims.UserRole); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlUserRole",
+		}))
+		return
+	}
+	auditEvent(db, "users", "role", claims.User, usrId, map[string]string{"from": fmt.Sprint(usr.Role), "to": fmt.Sprint(payload.Role)})
+	usr.Role = payload.Role
+	c.AbortWithStatusJSON(http.StatusOK, models.AdminView(usr))
+}
+
+// HndlSetup : creates the first superuser against the one time setup token logged at startup
+//
+/*
+	POST /setup
+	{"token": "<from the log>", "name": "Niranjan Awati", "email": "kneerunjun@gmail.com", "auth": "jun%41993"}
+*/
+func HndlSetup(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	defer mongoClient.Disconnect(context.Background())
+
+	payload := struct {
+		Token string `json:"token"`
+		Name  string `json:"name"`
+		Email string `json:"email"`
+		Auth  string `json:"auth"`
+	}{}
+	if err := httperr.ErrBinding(c.ShouldBind(&payload)); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlSetup",
+		}))
+		return
+	}
+	usr := models.User{Name: models.UserName(payload.Name), Email: models.UserEmail(payload.Email), Auth: payload.Auth}
+	if err := uc.RedeemSetupToken(payload.Token, &usr); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlSetup",
+		}))
+		return
+	}
+	auditEvent(db, "users", "bootstrap", usr.Id.Hex(), usr.Id.Hex(), nil)
+	c.AbortWithStatusJSON(http.StatusOK, models.AdminView(usr))
+}
+
+// bulkFormat : format from the query, else from the content type/accept header
+func bulkFormat(c *gin.Context, header string) models.BulkFormat {
+	if f := c.Query("format"); f != "" {
+		return models.BulkFormat(f)
+	}
+	ct := c.GetHeader(header)
+	switch {
+	case strings.Contains(ct, "csv"):
+		return models.FormatCSV
+	case strings.Contains(ct, "ndjson"):
+		return models.FormatNDJSON
+	}
+	return models.FormatJSON
+}
+
+// HndlImportUsers : admin imports users in bulk from the request body, report has the outcome of each row
+// ?format=json|ndjson|csv&policy=skip|upsert&dryrun=true&prehashed=true
+func HndlImportUsers(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	defer mongoClient.Disconnect(context.Background())
+
+	val, _ = c.Get("claims")
+	claims := val.(*models.CustomClaims)
+	opts := models.ImportOptions{
+		Format:     bulkFormat(c, "Content-Type"),
+		Policy:     models.ImportPolicy(c.Query("policy")),
+		DryRun:     c.Query("dryrun") == "true",
+		PreHashed:  c.Query("prehashed") == "true",
+		CallerRole: claims.UserRole,
+	}
+	report, err := uc.ImportUsers(c.Request.Body, opts)
+	if err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlImportUsers",
+		}))
+		return
+	}
+	if !opts.DryRun {
+		for _, row := range report.Rows {
+			if row.Result == "created" || row.Result == "updated" {
+				auditEvent(db, "users", "import-"+row.Result, claims.User, row.Email, nil)
+			}
+		}
+	}
+	c.AbortWithStatusJSON(http.StatusOK, report)
+}
+
+// HndlExportUsers : admin downloads all the users, without password hashes. Org admins get only the members of their org
+// ?format=json|ndjson|csv
+func HndlExportUsers(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	defer mongoClient.Disconnect(context.Background())
+	orgScope(c, &uc)
+
+	format := bulkFormat(c, "Accept")
+	if !format.IsValid() {
+		httperr.HttpErrOrOkDispatch(c, httperr.ErrInvalidParam(fmt.Errorf("invalid export format %s", format)), log.WithFields(log.Fields{
+			"stack": "HndlExportUsers",
+		}))
+		return
+	}
+	contentTypes := map[models.BulkFormat]string{models.FormatJSON: "application/json", models.FormatNDJSON: "application/x-ndjson", models.FormatCSV: "text/csv"}
+	buf := &bytes.Buffer{} // buffered, so that a failure midway can still be sent as an error
+	if err := uc.ExportUsers(buf, format); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlExportUsers",
+		}))
+		return
+	}
+	val, _ = c.Get("claims")
+	auditEvent(db, "users", "export-all", val.(*models.CustomClaims).User, "all", map[string]string{"format": string(format)})
+	c.Header("Content-Type", contentTypes[format]) // CORS middleware has already set it to json
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"users.%s\"", format))
+	c.Data(http.StatusOK, contentTypes[format], buf.Bytes())
+	c.Abort()
+}
+
+// HndlBatchUsers : admin runs a batch of delete, suspend, set-role, set-telegid operations against accounts by email or id
+// ?atomic=true applies all of them or none, report has the outcome of each operation
+// Responds 200 with the report even when operations fail, report.committed is what the caller should look at for atomic batches
+func HndlBatchUsers(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	defer mongoClient.Disconnect(context.Background())
+
+	payload := struct {
+		Ops []models.BatchOp `json:"ops"`
+	}{}
+	if err := httperr.ErrBinding(c.ShouldBind(&payload)); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlBatchUsers",
+		}))
+		return
+	}
+	val, _ = c.Get("claims")
+	claims := val.(*models.CustomClaims)
+	report, err := uc.RunBatch(payload.Ops, claims.UserRole, c.Query("atomic") == "true")
+	if err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlBatchUsers",
+		}))
+		return
+	}
+	for _, item := range report.Items {
+		if item.Result == "skipped" {
+			continue
+		}
+		subject := item.Id
+		if subject == "" {
+			subject = item.Target
+		}
+		auditEvent(db, "users", "batch-"+item.Op, claims.User, subject, map[string]string{"result": item.Result, "atomic": fmt.Sprint(report.Atomic), "error": item.Error})
+	}
+	c.AbortWithStatusJSON(http.StatusOK, report)
+}
+
+// HndlAdminUsers : admin creates an account with any role at or below their own
+// Org admins create accounts in their org, the role is then the org role and the account itself is an EndUser
+// ?action=create	: admin sets the password, account is active right away
+// ?action=invite	: account is pending, a one time link to set the password is sent to the account holder
+func HndlAdminUsers(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	defer mongoClient.Disconnect(context.Background())
+
+	val, _ = c.Get("claims")
+	claims := val.(*models.CustomClaims)
+	payload := struct {
+		models.User
+		Role *models.UserRole // has to be sent, zero is SuperUser. Hides the Role of the account when binding
+	}{}
+	if err := httperr.ErrBinding(c.ShouldBind(&payload)); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlAdminUsers",
+		}))
+		return
+	}
+	if payload.Role == nil {
+		httperr.HttpErrOrOkDispatch(c, httperr.ErrInvalidParam(fmt.Errorf("role of the account is required")), log.WithFields(log.Fields{
+			"stack": "HndlAdminUsers",
+		}))
+		return
+	}
+	usr := payload.User
+	usr.Role = *payload.Role
+	callerRole := claims.UserRole
+	if orgScope(c, &uc) != models.SuperUser {
+		callerRole = claims.OrgRole
+	}
+	if usr.Role < callerRole {
+		httperr.HttpErrOrOkDispatch(c, httperr.ErrForbidden(fmt.Errorf("%s cannot create user with role %d above own", claims.User, usr.Role)), log.WithFields(log.Fields{
+			"stack": "HndlAdminUsers",
+		}))
+		return
+	}
+	if !uc.Org.IsZero() {
+		if !models.IsValidOrgRole(usr.Role) {
+			httperr.HttpErrOrOkDispatch(c, httperr.ErrInvalidParam(fmt.Errorf("invalid org role %d", usr.Role)), log.WithFields(log.Fields{
+				"stack": "HndlAdminUsers",
+			}))
+			return
+		}
+		usr.Orgs, usr.Role = []models.OrgMember{{Org: uc.Org, Role: usr.Role}}, models.EndUser
+	}
+	// account state is never for the client to set
+	usr.Status, usr.StatusReason, usr.StatusUntil, usr.DeletedAt = "", "", 0, 0
+	switch c.Query("action") {
+	case "create":
+		if err := uc.NewUser(&usr); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlAdminUsers",
+			}))
+			return
+		}
+		auditEvent(db, "users", "create", claims.User, usr.Id.Hex(), map[string]string{"role": fmt.Sprint(usr.Role)})
+	case "invite":
+		tok, err := uc.InviteUser(&usr)
+		if err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlAdminUsers",
+			}))
+			return
+		}
+		auditEvent(db, "users", "invite", claims.User, usr.Id.Hex(), map[string]string{"role": fmt.Sprint(usr.Role)})
+		body := fmt.Sprintf("Hello %s,\nYou have been invited by %s. Set your password here to activate your account, the link can be used only once and expires in %s:\n%s/%s", usr.Name, claims.User, models.InviteTTL, inviteURL, tok)
+		if err := notifier.Notify(usr.Email, "You are invited", body); err != nil {
+			// account is created, admin can invite again after deleting it
+			log.WithFields(log.Fields{"stack": "HndlAdminUsers", "user": usr.Id.Hex()}).Errorf("failed to send invitation %s", err)
+		}
+	default:
+		c.AbortWithStatus(http.StatusMethodNotAllowed)
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusOK, models.AdminView(usr))
+}
+
+// HndlAcceptInvite : invited account holder sets the password with the one time token, which activates the account
+//
+/*
+	POST /invitations/:token
+	{"auth": "ClearTextPassword"}
+*/
+func HndlAcceptInvite(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	defer mongoClient.Disconnect(context.Background())
+
+	payload := models.User{}
+	if err := httperr.ErrBinding(c.ShouldBind(&payload)); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlAcceptInvite",
+		}))
+		return
+	}
+	usr := models.User{}
+	if err := uc.AcceptInvite(c.Param("token"), payload.Auth, &usr); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlAcceptInvite",
+		}))
+		return
+	}
+	auditEvent(db, "users", "invite-accepted", usr.Id.Hex(), usr.Id.Hex(), nil)
+	c.AbortWithStatusJSON(http.StatusOK, usr)
+}
+
+// HndlEmailChange : account holder, or admin on their behalf, asks to change the email of the account
+// Confirmation link goes to the new email and a notice to the current one, email changes only once the link is used
+//
+/*
+	POST /users/:id/email
+	{"email": "johndoe@newemployer.com"}
+*/
+func HndlEmailChange(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	defer mongoClient.Disconnect(context.Background())
+
+	payload := struct {
+		Email models.UserEmail `json:"email"`
+	}{}
+	if err := httperr.ErrBinding(c.ShouldBind(&payload)); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlEmailChange",
+		}))
+		return
+	}
+	usr := models.User{}
+	if err := uc.FindUser(c.Param("id"), &usr); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlEmailChange",
+		}))
+		return
+	}
+	if err := selfOrAdmin(c, &usr); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlEmailChange",
+		}))
+		return
+	}
+	tok, err := uc.RequestEmailChange(usr.Id.Hex(), payload.Email, &usr)
+	if err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlEmailChange",
+		}))
+		return
+	}
+	auditEvent(db, "users", "email-change-requested", auditActor(c, "anonymous"), usr.Id.Hex(), nil)
+	body := fmt.Sprintf("Hello %s,\nConfirm this as the new email of your account here, the link can be used only once and expires in %s:\n%s/%s", usr.Name, models.EmailChangeTTL, emailChangeURL, tok)
+	if err := notifier.Notify(usr.PendingEmail, "Confirm your new email", body); err != nil {
+		log.WithFields(log.Fields{"stack": "HndlEmailChange", "user": usr.Id.Hex()}).Errorf("failed to send email change confirmation %s", err)
+	}
+	body = fmt.Sprintf("Hello %s,\nA change of email for your account was requested. Your email stays as is till the change is confirmed from the new email. If it wasnt you, change your password.", usr.Name)
+	if err := notifier.Notify(usr.Email, "Your email is being changed", body); err != nil {
+		log.WithFields(log.Fields{"stack": "HndlEmailChange", "user": usr.Id.Hex()}).Errorf("failed to send email change notice %s", err)
+	}
+	c.AbortWithStatusJSON(http.StatusAccepted, usr)
+}
+
+// HndlConfirmEmailChange : link sent to the new email confirms the change, account has to login again with the new email
+//
+/*
+	POST /email-change/:token
+*/
+func HndlConfirmEmailChange(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	defer mongoClient.Disconnect(context.Background())
+
+	usr := models.User{}
+	if err := uc.ConfirmEmailChange(c.Param("token"), &usr); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlConfirmEmailChange",
+		}))
+		return
+	}
+	auditEvent(db, "users", "email-changed", usr.Id.Hex(), usr.Id.Hex(), nil)
+	c.AbortWithStatusJSON(http.StatusOK, usr)
+}
+
+// HndlUserProfile : account holder, or admin on their behalf, changes phone, locale, timezone and attributes
+// Account holders can set only the attributes that are user editable, empty string clears a field and null clears an attribute
+//
+/*
+	PATCH /users/:id/profile
+	{"phone": "+919856321470", "timezone": "Asia/Kolkata", "attributes": {"farm_id": "FRM-0042", "units": "metric"}}
+*/
+func HndlUserProfile(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	ac := models.AttributesCollection{DbColl: db.Collection("attributes")}
+	defer mongoClient.Disconnect(context.Background())
+
+	payload := struct {
+		models.ProfilePatch
+		Attributes map[string]interface{} `json:"attributes"`
+	}{}
+	if err := httperr.ErrBinding(c.ShouldBind(&payload)); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlUserProfile",
+		}))
+		return
+	}
+	usr := models.User{}
+	if err := uc.FindUser(c.Param("id"), &usr); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlUserProfile",
+		}))
+		return
+	}
+	if err := selfOrAdmin(c, &usr); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlUserProfile",
+		}))
+		return
+	}
+	val, _ = c.Get("claims")
+	byAdmin := val.(*models.CustomClaims).UserRole <= models.Admin
+	if payload.Phone != nil || payload.Locale != nil || payload.Timezone != nil {
+		if err := uc.EditProfile(usr.Id.Hex(), payload.ProfilePatch); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlUserProfile",
+			}))
+			return
+		}
+	}
+	if len(payload.Attributes) > 0 {
+		schema, err := ac.Schema()
+		if err == nil {
+			err = uc.SetAttributes(usr.Id.Hex(), payload.Attributes, schema, byAdmin)
+		}
+		if err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlUserProfile",
+			}))
+			return
+		}
+	}
+	auditEvent(db, "users", "profile", auditActor(c, "anonymous"), usr.Id.Hex(), nil)
+	if err := uc.FindUser(usr.Id.Hex(), &usr); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlUserProfile",
+		}))
+		return
+	}
+	if byAdmin {
+		c.AbortWithStatusJSON(http.StatusOK, models.AdminView(usr))
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusOK, usr)
+}
+
+// HndlAttributes : schema of the attributes, anyone logged in can read it while only admins define or remove keys
+//
+/*
+	GET /attributes
+	PUT /admin/attributes/:key
+	{"type": "string", "user_editable": true, "enum": ["metric", "imperial"]}
+	DELETE /admin/attributes/:key
+*/
+func HndlAttributes(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	ac := models.AttributesCollection{DbColl: db.Collection("attributes")}
+	defer mongoClient.Disconnect(context.Background())
+
+	val, _ = c.Get("claims")
+	actor := val.(*models.CustomClaims).User
+	switch c.Request.Method {
+	case "GET":
+		schema, err := ac.Schema()
+		if err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlAttributes/GET",
+			}))
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusOK, schema)
+	case "PUT":
+		def := models.AttributeDef{}
+		if err := httperr.ErrBinding(c.ShouldBind(&def)); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlAttributes/PUT",
+			}))
+			return
+		}
+		def.Key = c.Param("key")
+		if err := ac.DefineAttribute(def); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlAttributes/PUT",
+			}))
+			return
+		}
+		auditEvent(db, "attributes", "define", actor, def.Key, map[string]string{"type": string(def.Type), "user_editable": fmt.Sprint(def.UserEditable)})
+		c.AbortWithStatusJSON(http.StatusOK, def)
+	case "DELETE":
+		if err := ac.RemoveAttribute(c.Param("key")); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlAttributes/DELETE",
+			}))
+			return
+		}
+		auditEvent(db, "attributes", "remove", actor, c.Param("key"), nil)
+		c.AbortWithStatus(http.StatusOK)
+	default:
+		c.AbortWithStatus(http.StatusMethodNotAllowed)
+	}
+}
+
+// HndlAvatar : account holder, or admin on their behalf, uploads or removes the profile picture. Anyone can get it.
+// Upload is the raw PNG/JPEG body or the field "avatar" of a multipart form.
+//
+/*
+	PUT /users/:id/avatar
+	DELETE /users/:id/avatar
+	GET /users/:id/avatar?size=64
+*/
+func HndlAvatar(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	store := avatarStore(db)
+	defer mongoClient.Disconnect(context.Background())
+
+	if c.Request.Method == "GET" {
+		size, _ := strconv.Atoi(c.Query("size"))
+		blob, err := models.AvatarBlob(c.Param("id"), size, store)
+		if err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlAvatar/GET",
+			}))
+			return
+		}
+		etag := fmt.Sprintf(`"%x-%x"`, blob.ModTime.UnixNano(), len(blob.Data))
+		// url on the account changes with every upload, so only the versioned one is safe to cache for long
+		if c.Query("v") != "" {
+			c.Header("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			c.Header("Cache-Control", "public, max-age=300")
+		}
+		c.Header("ETag", etag)
+		c.Header("Last-Modified", blob.ModTime.UTC().Format(http.TimeFormat))
+		if c.GetHeader("If-None-Match") == etag {
+			c.AbortWithStatus(http.StatusNotModified)
+			return
+		}
+		c.Header("Content-Type", blob.ContentType) // CORS middleware has it as json
+		c.Data(http.StatusOK, blob.ContentType, blob.Data)
+		c.Abort()
+		return
+	}
+	usr := models.User{}
+	if err := uc.FindUser(c.Param("id"), &usr); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlAvatar",
+		}))
+		return
+	}
+	if err := selfOrAdmin(c, &usr); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlAvatar",
+		}))
+		return
+	}
+	actor := auditActor(c, "anonymous")
+	switch c.Request.Method {
+	case "PUT":
+		data, err := avatarUpload(c)
+		if err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlAvatar/PUT",
+			}))
+			return
+		}
+		url, err := uc.SetAvatar(usr.Id.Hex(), data, store)
+		if err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlAvatar/PUT",
+			}))
+			return
+		}
+		auditEvent(db, "users", "avatar", actor, usr.Id.Hex(), nil)
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{"avatar": url})
+	case "DELETE":
+		if err := uc.RemoveAvatar(usr.Id.Hex(), store); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlAvatar/DELETE",
+			}))
+			return
+		}
+		auditEvent(db, "users", "avatar-remove", actor, usr.Id.Hex(), nil)
+		c.AbortWithStatus(http.StatusOK)
+	default:
+		c.AbortWithStatus(http.StatusMethodNotAllowed)
+	}
+}
+
+// avatarUpload : image bytes from the request, reading no more than what the limit allows
+func avatarUpload(c *gin.Context) ([]byte, httperr.HttpErr) {
+	// multipart adds its own boundaries and headers over the image
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, models.AvatarMaxBytes+64<<10)
+	body := io.Reader(c.Request.Body)
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		fh, err := c.FormFile("avatar")
+		if err != nil {
+			return nil, httperr.ErrInvalidParam(fmt.Errorf("avatar image is missing from the form: %s", err))
+		}
+		f, err := fh.Open()
+		if err != nil {
+			return nil, httperr.ErrInvalidParam(err)
+		}
+		defer f.Close()
+		body = f
+	}
+	data, err := io.ReadAll(io.LimitReader(body, models.AvatarMaxBytes+1))
+	if err != nil {
+		return nil, httperr.ErrInvalidParam(fmt.Errorf("failed to read the avatar image: %s", err))
+	}
+	if int64(len(data)) > models.AvatarMaxBytes {
+		return nil, httperr.ErrInvalidParam(fmt.Errorf("image should be at most %d bytes", models.AvatarMaxBytes))
+	}
+	return data, nil
+}
+
+// HndlOrgs : platform admins create and list the orgs
+//
+/*
+	POST /admin/orgs
+	{"name": "Green Acres", "slug": "green-acres"}
+	GET /admin/orgs
+*/
+func HndlOrgs(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	oc := models.OrgsCollection{DbColl: db.Collection("orgs")}
+	defer mongoClient.Disconnect(context.Background())
+
+	switch c.Request.Method {
+	case "GET":
+		orgs, err := oc.ListOrgs(nil)
+		if err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlOrgs/GET",
+			}))
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusOK, orgs)
+	case "POST":
+		org := models.Org{}
+		if err := httperr.ErrBinding(c.ShouldBind(&org)); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlOrgs/POST",
+			}))
+			return
+		}
+		if err := oc.NewOrg(&org); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlOrgs/POST",
+			}))
+			return
+		}
+		auditEvent(db, "orgs", "create", auditActor(c, "anonymous"), org.Id.Hex(), map[string]string{"slug": org.Slug})
+		c.AbortWithStatusJSON(http.StatusOK, org)
+	default:
+		c.AbortWithStatus(http.StatusMethodNotAllowed)
+	}
+}
+
+// HndlMyOrgs : orgs the caller is a member of, with the role in each
+func HndlMyOrgs(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	oc := models.OrgsCollection{DbColl: db.Collection("orgs")}
+	defer mongoClient.Disconnect(context.Background())
+
+	usr := models.User{}
+	if err := uc.LookupUser(auditActor(c, ""), &usr); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlMyOrgs",
+		}))
+		return
+	}
+	ids := []primitive.ObjectID{}
+	for _, m := range usr.Orgs {
+		ids = append(ids, m.Org)
+	}
+	orgs, err := oc.ListOrgs(ids)
+	if err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlMyOrgs",
+		}))
+		return
+	}
+	type orgRole struct {
+		models.Org
+		Role models.UserRole `json:"role"`
+	}
+	result := []orgRole{}
+	for _, org := range orgs {
+		result = append(result, orgRole{Org: org, Role: usr.Membership(org.Id.Hex()).Role})
+	}
+	c.AbortWithStatusJSON(http.StatusOK, result)
+}
+
+// HndlSwitchOrg : new token for the caller acting in another org they are a member of
+//
+/*
+	POST /orgs/:org/token
+*/
+func HndlSwitchOrg(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	defer mongoClient.Disconnect(context.Background())
+
+	usr := models.User{}
+	if err := uc.LookupUser(auditActor(c, ""), &usr); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlSwitchOrg",
+		}))
+		return
+	}
+	usr.ActiveOrg = c.Param("org")
+	if err := uc.IssueToken(&usr); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlSwitchOrg",
+		}))
+		return
+	}
+	auditEvent(db, "auth", "switch-org", usr.Id.Hex(), usr.Id.Hex(), map[string]string{"org": usr.ActiveOrg})
+	c.AbortWithStatusJSON(http.StatusOK, usr)
+}
+
+// HndlOrgMembers : org admins, or platform admins, list the members of the org and add, change or remove members
+//
+/*
+	GET /orgs/:org/members?skip=0&limit=50
+	PUT /orgs/:org/members/:id
+	{"role": 2}
+	DELETE /orgs/:org/members/:id
+*/
+func HndlOrgMembers(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	oc := models.OrgsCollection{DbColl: db.Collection("orgs")}
+	defer mongoClient.Disconnect(context.Background())
+
+	org := models.Org{}
+	if err := oc.FindOrg(c.Param("org"), &org); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlOrgMembers",
+		}))
+		return
+	}
+	callerRole := orgScope(c, &uc)
+	actor := auditActor(c, "anonymous")
+	switch c.Request.Method {
+	case "GET":
+		skip, _ := strconv.ParseInt(c.Query("skip"), 10, 64)
+		limit, _ := strconv.ParseInt(c.Query("limit"), 10, 64)
+		uc.Org = org.Id
+		usrs, err := uc.ListUsers(skip, limit)
+		if err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlOrgMembers/GET",
+			}))
+			return
+		}
+		views := make([]models.AdminView, len(usrs))
+		for i, usr := range usrs {
+			views[i] = models.AdminView(usr)
+		}
+		c.AbortWithStatusJSON(http.StatusOK, views)
+	case "PUT":
+		payload := struct {
+			Role models.UserRole `json:"role"`
+		}{}
+		if err := httperr.ErrBinding(c.ShouldBind(&payload)); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlOrgMembers/PUT",
+			}))
+			return
+		}
+		uc.Org = primitive.NilObjectID // accounts not yet in the org can be added
+		if err := uc.SetMembership(org.Id.Hex(), c.Param("id"), payload.Role, callerRole); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlOrgMembers/PUT",
+			}))
+			return
+		}
+		auditEvent(db, "orgs", "member-set", actor, c.Param("id"), map[string]string{"org": org.Id.Hex(), "role": fmt.Sprint(payload.Role)})
+		c.AbortWithStatus(http.StatusOK)
+	case "DELETE":
+		if err := uc.RemoveMembership(org.Id.Hex(), c.Param("id"), callerRole); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlOrgMembers/DELETE",
+			}))
+			return
+		}
+		auditEvent(db, "orgs", "member-remove", actor, c.Param("id"), map[string]string{"org": org.Id.Hex()})
+		c.AbortWithStatus(http.StatusOK)
+	default:
+		c.AbortWithStatus(http.StatusMethodNotAllowed)
+	}
+}
+
+// HndlGroups : admins manage the groups, a group can grant a role only strictly below that of the admin
+//
+/*
+	GET /admin/groups
+	POST /admin/groups
+	{"name": "pond-operators", "permissions": ["devices:read", "devices:write"], "role": 2}
+	GET /admin/groups/:gid
+	PUT /admin/groups/:gid
+	DELETE /admin/groups/:gid
+*/
+func HndlGroups(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	gc := models.GroupsCollection{DbColl: db.Collection("groups")}
+	defer mongoClient.Disconnect(context.Background())
+
+	val, _ = c.Get("claims")
+	claims := val.(*models.CustomClaims)
+	gid := c.Param("gid")
+	switch {
+	case c.Request.Method == "GET" && gid == "":
+		groups, err := gc.ListGroups(nil)
+		if err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlGroups/GET",
+			}))
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusOK, groups)
+	case c.Request.Method == "GET":
+		g := models.Group{}
+		if err := gc.FindGroup(gid, &g); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlGroups/GET",
+			}))
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusOK, g)
+	case c.Request.Method == "POST" || c.Request.Method == "PUT":
+		g := models.Group{}
+		if err := httperr.ErrBinding(c.ShouldBind(&g)); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlGroups/" + c.Request.Method,
+			}))
+			return
+		}
+		var err httperr.HttpErr
+		action := "create"
+		if c.Request.Method == "POST" {
+			err = gc.NewGroup(&g, claims.UserRole)
+		} else {
+			action = "update"
+			if g.Id, err = groupID(gid); err == nil {
+				err = gc.UpdateGroup(&g, claims.UserRole, &uc)
+			}
+		}
+		if err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlGroups/" + c.Request.Method,
+			}))
+			return
+		}
+		details := map[string]string{"name": g.Name, "permissions": fmt.Sprint(g.Permissions)}
+		if g.Role != nil {
+			details["role"] = fmt.Sprint(*g.Role)
+		}
+		auditEvent(db, "groups", action, claims.User, g.Id.Hex(), details)
+		c.AbortWithStatusJSON(http.StatusOK, g)
+	case c.Request.Method == "DELETE":
+		if err := gc.RemoveGroup(gid, claims.UserRole, &uc); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlGroups/DELETE",
+			}))
+			return
+		}
+		auditEvent(db, "groups", "remove", claims.User, gid, nil)
+		c.AbortWithStatus(http.StatusOK)
+	default:
+		c.AbortWithStatus(http.StatusMethodNotAllowed)
+	}
+}
+
+// groupID : object id of the group from the route param
+func groupID(gid string) (primitive.ObjectID, httperr.HttpErr) {
+	oid, err := primitive.ObjectIDFromHex(gid)
+	if err != nil {
+		return oid, httperr.ErrInvalidParam(fmt.Errorf("invalid group id %s", gid))
+	}
+	return oid, nil
+}
+
+// HndlGroupMembers : admin adds an account to the group or takes it out
+//
+/*
+	PUT /admin/groups/:gid/members/:id
+	DELETE /admin/groups/:gid/members/:id
+*/
+func HndlGroupMembers(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	gc := models.GroupsCollection{DbColl: db.Collection("groups")}
+	defer mongoClient.Disconnect(context.Background())
+
+	val, _ = c.Get("claims")
+	claims := val.(*models.CustomClaims)
+	member := c.Request.Method == "PUT"
+	if err := uc.SetGroupMember(c.Param("gid"), c.Param("id"), member, &gc, claims.UserRole); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlGroupMembers",
+		}))
+		return
+	}
+	action := "member-add"
+	if !member {
+		action = "member-remove"
+	}
+	auditEvent(db, "groups", action, claims.User, c.Param("id"), map[string]string{"group": c.Param("gid")})
+	c.AbortWithStatus(http.StatusOK)
+}
+
+// HndlUserPermissions : admin sets the direct grants of an account, or gets its effective permissions along with where they come from
+//
+/*
+	PUT /admin/users/:id/permissions
+	{"permissions": ["reports:export"]}
+	GET /admin/users/:id/permissions
+*/
+func HndlUserPermissions(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	defer mongoClient.Disconnect(context.Background())
+
+	if c.Request.Method == "PUT" {
+		payload := struct {
+			Permissions []models.Permission `json:"permissions"`
+		}{}
+		if err := httperr.ErrBinding(c.ShouldBind(&payload)); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlUserPermissions/PUT",
+			}))
+			return
+		}
+		val, _ = c.Get("claims")
+		claims := val.(*models.CustomClaims)
+		if err := uc.SetPermissions(c.Param("id"), payload.Permissions, claims.UserRole); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlUserPermissions/PUT",
+			}))
+			return
+		}
+		auditEvent(db, "users", "permissions", claims.User, c.Param("id"), map[string]string{"permissions": fmt.Sprint(payload.Permissions)})
+	}
+	usr := models.User{}
+	if err := uc.FindUser(c.Param("id"), &usr); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlUserPermissions",
+		}))
+		return
+	}
+	ep, err := uc.Effective(&usr)
+	if err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlUserPermissions",
+		}))
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusOK, ep)
+}
+
+// oauthDispatch : errors of the oauth endpoints go out as {"error", "error_description"} per RFC 6749, and not as err_data
+func oauthDispatch(c *gin.Context, err httperr.HttpErr, le *log.Entry) {
+	err.Log(le)
+	code := "invalid_request"
+	if oe, ok := err.(*models.OAuthError); ok {
+		code = oe.Code
+	} else if err.HttpStatusCode() >= http.StatusInternalServerError {
+		code = "server_error"
+	}
+	if code == "invalid_client" {
+		c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	c.AbortWithStatusJSON(err.HttpStatusCode(), gin.H{"error": code, "error_description": err.ClientErrData()})
+}
+
+// oauthClient : authenticates the client from the basic auth header, else from client_id and client_secret in the form
+func oauthClient(c *gin.Context, occ *models.OAuthClientsCollection) (*models.OAuthClient, httperr.HttpErr) {
+	id, secret, ok := c.Request.BasicAuth()
+	if ok {
+		// credentials are form encoded before they are put in the header, RFC 6749 2.3.1
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = c.PostForm("client_id"), c.PostForm("client_secret")
+	}
+	return occ.AuthenticateClient(id, secret)
+}
+
+// HndlOAuthAuthorize : account holder approves the client, redirects back to the client with the authorization code.
+// Caller is the front end acting for the logged in account, with Accept: application/json it gets the redirect as {"redirect_to"} instead of a 302
+// Once the redirect uri is known to be registered, errors are redirected to the client with error and state
+//
+/*
+	GET /oauth/authorize?response_type=code&client_id=..&redirect_uri=..&scope=role:enduser%20devices:read&state=..&code_challenge=..&code_challenge_method=S256
+	Authorization: Bearer <token of the account>
+
+	POST /oauth/authorize, same params in the form, from a browser session that has the cookies
+	X-CSRF-Token: <csrf token of the session>
+*/
+func HndlOAuthAuthorize(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	occ := models.OAuthClientsCollection{DbColl: db.Collection("oauth_clients")}
+	defer mongoClient.Disconnect(context.Background())
+
+	req := models.AuthorizeRequest{}
+	if err := httperr.ErrBinding(c.ShouldBind(&req)); err != nil {
+		oauthDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlOAuthAuthorize",
+		}))
+		return
+	}
+	cl, redirect, err := occ.ResolveAuthorize(&req)
+	if err != nil {
+		oauthDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlOAuthAuthorize",
+		}))
+		return
+	}
+	val, _ = c.Get("claims")
+	claims := val.(*models.CustomClaims)
+	usr := models.User{}
+	if claims.ClientID != "" {
+		err = models.OAuthErr("access_denied", fmt.Errorf("tokens issued to clients cannot authorize other clients"))
+	} else if err = uc.LookupUser(claims.User, &usr); err == nil {
+		var code string
+		if code, err = uc.IssueCode(&req, cl, &usr); err == nil {
+			auditEvent(db, "oauth", "authorize", usr.Id.Hex(), usr.Id.Hex(), map[string]string{"client": cl.Id, "scope": req.Scope})
+			oauthRedirect(c, redirect, url.Values{"code": {code}}, req.State)
+			return
+		}
+	}
+	err.Log(log.WithFields(log.Fields{"stack": "HndlOAuthAuthorize"}))
+	q := url.Values{"error": {"server_error"}}
+	if oe, ok := err.(*models.OAuthError); ok {
+		q.Set("error", oe.Code)
+		q.Set("error_description", oe.ClientErrData())
+	}
+	oauthRedirect(c, redirect, q, req.State)
+}
+
+// oauthRedirect : back to the client with the params and state added to the query of the redirect uri
+func oauthRedirect(c *gin.Context, redirect string, params url.Values, state string) {
+	u, _ := url.Parse(redirect) // registered redirect uris are valid
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	if state != "" {
+		q.Set("state", state)
+	}
+	u.RawQuery = q.Encode()
+	if strings.Contains(c.GetHeader("Accept"), "application/json") {
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{"redirect_to": u.String()})
+		return
+	}
+	c.Redirect(http.StatusFound, u.String())
+	c.Abort()
+}
+
+// HndlOAuthToken : token endpoint, form encoded as in RFC 6749. Clients authenticate with basic auth or client_id/client_secret in the form
+//
+/*
+	POST /oauth/token
+	grant_type=authorization_code&code=..&redirect_uri=..&code_verifier=..
+	grant_type=refresh_token&refresh_token=..&scope=..
+	grant_type=client_credentials&scope=..
+*/
+func HndlOAuthToken(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	occ := models.OAuthClientsCollection{DbColl: db.Collection("oauth_clients")}
+	defer mongoClient.Disconnect(context.Background())
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+	cl, err := oauthClient(c, &occ)
+	if err != nil {
+		oauthDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlOAuthToken",
+		}))
+		return
+	}
+	grant := c.PostForm("grant_type")
+	var tok *models.OAuthToken
+	switch {
+	case grant == "":
+		err = models.OAuthErr("invalid_request", fmt.Errorf("missing grant_type"))
+	case grant != models.GrantAuthorizationCode && grant != models.GrantRefreshToken && grant != models.GrantClientCredentials:
+		err = models.OAuthErr("unsupported_grant_type", fmt.Errorf("unsupported grant_type %s", grant))
+	case !cl.HasGrant(grant):
+		err = models.OAuthErr("unauthorized_client", fmt.Errorf("client %s cannot use %s", cl.Id, grant))
+	case grant == models.GrantAuthorizationCode:
+		tok, err = uc.ExchangeCode(cl, c.PostForm("code"), c.PostForm("redirect_uri"), c.PostForm("code_verifier"))
+	case grant == models.GrantRefreshToken:
+		tok, err = uc.RefreshGrant(cl, c.PostForm("refresh_token"), c.PostForm("scope"))
+	default:
+		tok, err = uc.ClientCredentialsGrant(cl, c.PostForm("scope"))
+	}
+	if err != nil {
+		oauthDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlOAuthToken",
+			"grant": grant,
+		}))
+		return
+	}
+	auditEvent(db, "oauth", "token", "client:"+cl.Id, cl.Id, map[string]string{"grant": grant, "scope": tok.Scope})
+	c.AbortWithStatusJSON(http.StatusOK, tok)
+}
+
+// HndlOAuthRevoke : client revokes its refresh or access token, RFC 7009. Responds 200 even for tokens that are unknown
+//
+/*
+	POST /oauth/revoke
+	token=..
+*/
+func HndlOAuthRevoke(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	occ := models.OAuthClientsCollection{DbColl: db.Collection("oauth_clients")}
+	defer mongoClient.Disconnect(context.Background())
+
+	cl, err := oauthClient(c, &occ)
+	if err == nil {
+		err = uc.RevokeOAuthToken(cl, c.PostForm("token"))
+	}
+	if err != nil {
+		oauthDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlOAuthRevoke",
+		}))
+		return
+	}
+	c.AbortWithStatus(http.StatusOK)
+}
+
+// HndlOAuthIntrospect : state of a token for the services behind this one, RFC 7662.
+// Caller is a confidential oauth client (basic auth or form credentials) or an admin with its own bearer token, public clients cannot introspect
+//
+/*
+	POST /oauth/introspect
+	Authorization: Basic <client_id:client_secret>
+	token=..&token_type_hint=access_token
+*/
+func HndlOAuthIntrospect(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	occ := models.OAuthClientsCollection{DbColl: db.Collection("oauth_clients")}
+	defer mongoClient.Disconnect(context.Background())
+
+	var err httperr.HttpErr
+	if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		var claims *models.CustomClaims
+		if claims, err = uc.AuthorizeClaims(auth); err != nil && err.HttpStatusCode() < http.StatusInternalServerError {
+			err = models.OAuthErr("invalid_client", fmt.Errorf("bearer token of the caller is not valid"))
+		} else if err == nil && (claims.ClientID != "" || claims.UserRole > models.Admin) {
+			err = models.OAuthErr("unauthorized_client", fmt.Errorf("only admins can introspect with their own token"))
+		}
+	} else {
+		var cl *models.OAuthClient
+		if cl, err = oauthClient(c, &occ); err == nil && cl.Public {
+			err = models.OAuthErr("unauthorized_client", fmt.Errorf("public client %s cannot introspect tokens", cl.Id))
+		}
+	}
+	var result *models.Introspection
+	if err == nil {
+		result, err = uc.Introspect(c.PostForm("token"), c.PostForm("token_type_hint"))
+	}
+	if err != nil {
+		oauthDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlOAuthIntrospect",
+		}))
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+	c.AbortWithStatusJSON(http.StatusOK, result)
+}
+
+// HndlOAuthClients : admin registers the oauth clients, client secret is in the response only when registering or rotating
+//
+/*
+	GET /admin/oauth/clients
+	POST /admin/oauth/clients
+	{"name": "Pond analytics", "redirect_uris": ["https://vendor.example/cb"], "grants": ["authorization_code", "refresh_token"], "scopes": ["role:enduser", "devices:read"]}
+	DELETE /admin/oauth/clients/:cid
+	POST /admin/oauth/clients/:cid/secret
+*/
+func HndlOAuthClients(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	occ := models.OAuthClientsCollection{DbColl: db.Collection("oauth_clients")}
+	defer mongoClient.Disconnect(context.Background())
+
+	val, _ = c.Get("claims")
+	claims := val.(*models.CustomClaims)
+	cid := c.Param("cid")
+	switch {
+	case c.Request.Method == "GET":
+		clients, err := occ.ListClients()
+		if err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlOAuthClients/GET",
+			}))
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusOK, clients)
+	case c.Request.Method == "POST" && cid == "":
+		cl := models.OAuthClient{}
+		if err := httperr.ErrBinding(c.ShouldBind(&cl)); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlOAuthClients/POST",
+			}))
+			return
+		}
+		secret, err := occ.RegisterClient(&cl, claims.UserRole)
+		if err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlOAuthClients/POST",
+			}))
+			return
+		}
+		auditEvent(db, "oauth", "client-register", auditActor(c, ""), cl.Id, map[string]string{"name": cl.Name, "grants": fmt.Sprint(cl.Grants), "scopes": fmt.Sprint(cl.Scopes)})
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{"client": cl, "client_secret": secret})
+	case c.Request.Method == "POST":
+		secret, err := occ.RotateSecret(cid)
+		if err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlOAuthClients/POST",
+			}))
+			return
+		}
+		auditEvent(db, "oauth", "client-secret", auditActor(c, ""), cid, nil)
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{"client_id": cid, "client_secret": secret})
+	case c.Request.Method == "DELETE":
+		if err := occ.RemoveClient(cid); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlOAuthClients/DELETE",
+			}))
+			return
+		}
+		auditEvent(db, "oauth", "client-remove", auditActor(c, ""), cid, nil)
+		c.AbortWithStatus(http.StatusOK)
+	default:
+		c.AbortWithStatus(http.StatusMethodNotAllowed)
+	}
+}
+
+// HndlOIDCDiscovery : provider metadata for the relying parties, endpoints are relative to OIDC_ISSUER
+//
+/*
+	GET /.well-known/openid-configuration
+*/
+func HndlOIDCDiscovery(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=3600")
+	c.AbortWithStatusJSON(http.StatusOK, models.OIDCDiscovery())
+}
+
+// HndlJWKS : public keys for verifying the ID tokens
+//
+/*
+	GET /oauth/jwks
+*/
+func HndlJWKS(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	defer mongoClient.Disconnect(context.Background())
+
+	keys, err := uc.JWKS()
+	if err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlJWKS",
+		}))
+		return
+	}
+	c.Header("Cache-Control", "public, max-age=300") // short, relying parties have to pick up rotated keys
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+// HndlUserInfo : claims of the account for an access token issued with the openid scope
+//
+/*
+	GET /oauth/userinfo
+	Authorization: Bearer <access token>
+*/
+func HndlUserInfo(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	defer mongoClient.Disconnect(context.Background())
+
+	claims, err := uc.AuthorizeClaims(c.Request.Header.Get("Authorization"))
+	if err != nil {
+		err = models.OAuthErr("invalid_token", fmt.Errorf("%s", err.ClientErrData()))
+	}
+	var info map[string]interface{}
+	if err == nil {
+		info, err = uc.UserInfo(claims)
+	}
+	if err != nil {
+		if oe, ok := err.(*models.OAuthError); ok && (oe.Code == "invalid_token" || oe.Code == "insufficient_scope") {
+			c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer error="%s"`, oe.Code))
+		}
+		oauthDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlUserInfo",
+		}))
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	c.AbortWithStatusJSON(http.StatusOK, info)
+}
+
+// HndlOAuthLogout : end session, signs the account out of the client the id_token_hint was issued to, else the client of the bearer token.
+// Only the tokens at that client are revoked, a browser session of the caller is ended too. POST only, with the session cookie
+// it needs the CSRF token as all the other cookie requests. Sends the user agent back to post_logout_redirect_uri
+// only if its registered for the client the hint was issued to
+//
+/*
+	POST /oauth/logout
+	Content-Type: application/x-www-form-urlencoded
+	id_token_hint=..&post_logout_redirect_uri=https://vendor.example/bye&state=..
+*/
+func HndlOAuthLogout(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	occ := models.OAuthClientsCollection{DbColl: db.Collection("oauth_clients")}
+	defer mongoClient.Disconnect(context.Background())
+
+	var sub, aud string
+	var err httperr.HttpErr
+	claims := callerClaims(c, &uc)
+	if claims != nil && claims.User != "" {
+		usr := models.User{}
+		if err = uc.LookupUser(claims.User, &usr); err == nil {
+			sub, aud = usr.Id.Hex(), claims.ClientID
+		}
+	}
+	if hint := c.Request.PostFormValue("id_token_hint"); err == nil && hint != "" {
+		var hintSub string
+		hintSub, aud, err = uc.ParseIDTokenHint(hint)
+		if err == nil && sub != "" && sub != hintSub {
+			err = models.OAuthErr("invalid_request", fmt.Errorf("id_token_hint is of another account"))
+		}
+		sub = hintSub
+	}
+	session := claims != nil && claims.CSRF != ""
+	if err == nil && aud == "" && !session {
+		err = models.OAuthErr("invalid_request", fmt.Errorf("missing id_token_hint"))
+	}
+	redirect := c.Request.PostFormValue("post_logout_redirect_uri")
+	if err == nil && redirect != "" {
+		cl := models.OAuthClient{}
+		err = models.OAuthErr("invalid_request", fmt.Errorf("post_logout_redirect_uri %s is not registered for the client", redirect))
+		if aud != "" && occ.FindClient(aud, &cl) == nil {
+			for _, uri := range cl.PostLogoutRedirectURIs {
+				if uri == redirect {
+					err = nil
+				}
+			}
+		}
+	}
+	if err == nil && aud != "" {
+		err = uc.LogoutClient(aud, sub)
+	}
+	if err == nil && session {
+		err = uc.EndTokenSession(claims)
+	}
+	if err != nil {
+		oauthDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlOAuthLogout",
+		}))
+		return
+	}
+	if session {
+		clearSessionCookies(c)
+	}
+	auditEvent(db, "oauth", "logout", sub, sub, map[string]string{"client": aud})
+	if redirect != "" {
+		oauthRedirect(c, redirect, url.Values{}, c.Request.PostFormValue("state"))
+		return
+	}
+	c.AbortWithStatus(http.StatusOK)
+}
+
+// HndlIdentityProviders : providers an account can login with, for the login page to list
+//
+/*
+	GET /federation
+*/
+func HndlIdentityProviders(c *gin.Context) {
+	result := []gin.H{}
+	for name := range models.IdentityProviders {
+		result = append(result, gin.H{"name": name, "login": fmt.Sprintf("%s/%s/login", models.FederationCallbackURL, name)})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i]["name"].(string) < result[j]["name"].(string) })
+	c.AbortWithStatusJSON(http.StatusOK, result)
+}
+
+// HndlFederation : login with an identity provider, sends the user agent to the provider which sends it back to the callback.
+// Callback responds with the account and its token as the login does, or redirects to FEDERATION_REDIRECT with the token in the fragment
+//
+/*
+	GET /federation/:idp/login
+	GET /federation/:idp/callback?code=..&state=..
+*/
+func HndlFederation(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	defer mongoClient.Disconnect(context.Background())
+
+	idp := c.Param("idp")
+	if strings.HasSuffix(c.Request.URL.Path, "/login") {
+		redirect, browser, err := uc.BeginFederation(idp, primitive.NilObjectID)
+		if err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlFederation/login",
+			}))
+			return
+		}
+		setFederationCookie(c, browser, models.FederationStateTTL)
+		oauthRedirect(c, redirect, url.Values{}, "")
+		return
+	}
+	if e := c.Query("error"); e != "" {
+		httperr.HttpErrOrOkDispatch(c, httperr.ErrForbidden(fmt.Errorf("%s declined the login: %s %s", idp, e, c.Query("error_description"))), log.WithFields(log.Fields{
+			"stack": "HndlFederation/callback",
+		}))
+		return
+	}
+	browser, _ := c.Cookie(federationCookie)
+	setFederationCookie(c, "", -1) // state is good for one callback, whatever the outcome
+	usr, how, err := uc.CompleteFederation(idp, c.Query("state"), browser, c.Query("code"))
+	if err != nil {
+		auditEvent(db, "auth", "login-failed", "federation:"+idp, "federation:"+idp, nil)
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlFederation/callback",
+		}))
+		return
+	}
+	details := map[string]string{"provider": idp}
+	if how != models.FederatedLogin {
+		auditEvent(db, "users", "identity-"+how, usr.Id.Hex(), usr.Id.Hex(), details)
+	}
+	auditEvent(db, "auth", "login", usr.Id.Hex(), usr.Id.Hex(), details)
+	if federationRedirect != "" {
+		// fragment is not sent to servers, the token stays with the front end
+		frag := url.Values{"authtok": {usr.AuthTok}, "result": {how}}
+		c.Redirect(http.StatusFound, federationRedirect+"#"+frag.Encode())
+		c.Abort()
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusOK, usr)
+}
+
+// setFederationCookie : binds the login at the provider to the browser that started it, Lax since the provider sends the browser back with a top level GET.
+// maxAge below 0 clears it
+func setFederationCookie(c *gin.Context, browser string, maxAge time.Duration) {
+	if maxAge < 0 {
+		maxAge = -time.Second
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name: federationCookie, Value: browser, Path: "/api/federation", Domain: sessionCookies.Domain, MaxAge: int(maxAge.Seconds()),
+		HttpOnly: true, Secure: sessionCookies.Secure, SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// HndlIdentities : identities linked to the account. Account holder can link another, admins can only list and unlink
+//
+/*
+	GET /users/:id/identities
+	POST /users/:id/identities/:idp
+	DELETE /users/:id/identities/:idp
+*/
+func HndlIdentities(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	defer mongoClient.Disconnect(context.Background())
+
+	usr := models.User{}
+	if err := uc.FindUser(c.Param("id"), &usr); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlIdentities",
+		}))
+		return
+	}
+	if err := selfOrAdmin(c, &usr); err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlIdentities",
+		}))
+		return
+	}
+	switch c.Request.Method {
+	case "GET":
+		identities := usr.Identities
+		if identities == nil {
+			identities = []models.ExternalIdentity{}
+		}
+		c.AbortWithStatusJSON(http.StatusOK, identities)
+	case "POST":
+		val, _ = c.Get("claims")
+		if claims := val.(*models.CustomClaims); claims.User != string(usr.Email) {
+			httperr.HttpErrOrOkDispatch(c, httperr.ErrForbidden(fmt.Errorf("%s cannot link identities to %s", claims.User, usr.Email)), log.WithFields(log.Fields{
+				"stack": "HndlIdentities/POST",
+			}))
+			return
+		}
+		redirect, browser, err := uc.BeginFederation(c.Param("idp"), usr.Id)
+		if err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlIdentities/POST",
+			}))
+			return
+		}
+		setFederationCookie(c, browser, models.FederationStateTTL)
+		c.AbortWithStatusJSON(http.StatusOK, gin.H{"redirect_to": redirect})
+	case "DELETE":
+		if err := uc.UnlinkIdentity(usr.Id.Hex(), c.Param("idp")); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlIdentities/DELETE",
+			}))
+			return
+		}
+		auditEvent(db, "users", "identity-unlinked", auditActor(c, usr.Id.Hex()), usr.Id.Hex(), map[string]string{"provider": c.Param("idp")})
+		c.AbortWithStatus(http.StatusOK)
+	default:
+		c.AbortWithStatus(http.StatusMethodNotAllowed)
+	}
+}
+
 func HndlAUser(c *gin.Context) {
 	// --------- mongo connections
 	val, _ := c.Get("mongo-client")
@@ -43,15 +2045,33 @@ func HndlAUser(c *gin.Context) {
 	}
 	if c.Request.Method == "GET" {
 		// trying to get the single user i
+		if claims := callerClaims(c, &uc); claims != nil && claims.UserRole <= models.Admin {
+			c.AbortWithStatusJSON(http.StatusOK, models.AdminView(usr))
+			return
+		}
 		c.AbortWithStatusJSON(http.StatusOK, usr)
 	} else if c.Request.Method == "DELETE" {
+		if err := selfOrAdmin(c, &usr); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlAUser/DELETE",
+			}))
+			return
+		}
 		if err := uc.DeleteUser(usr.Id.Hex()); err != nil {
 			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
 				"stack": "HndlAUser/DELETE",
 			}))
 			return
 		}
+		auditEvent(db, "users", "delete", auditActor(c, usr.Id.Hex()), usr.Id.Hex(), nil)
 	} else if c.Request.Method == "PATCH" {
+		// password of the account is for the holder to change, or an admin above it
+		if err := selfOrAdmin(c, &usr); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlAUser/PATCH",
+			}))
+			return
+		}
 		/* Incase the default /empty value fo the user, they would NOT be patched,
 		validation thoughb happens for non-zero values */
 		if err := uc.EditUser(string(usr.Email), string(usr.Name), usr.Auth, usr.TelegID); err != nil {
@@ -60,12 +2080,174 @@ func HndlAUser(c *gin.Context) {
 			}))
 			return
 		}
+		auditEvent(db, "users", "edit", auditActor(c, usr.Id.Hex()), usr.Id.Hex(), nil)
+	}
+}
+
+// forwardedHeader : first of the headers that is set, Traefik sends X-Forwarded-* while nginx is usually set up with X-Original-*
+func forwardedHeader(c *gin.Context, keys ...string) string {
+	for _, k := range keys {
+		if v := c.GetHeader(k); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// HndlForwardAuth : reverse proxy asks if the request can go upstream, policy is from FORWARD_AUTH_POLICY.
+// 200 with the X-User-* identity headers, else 401/403. Token is from the Authorization header or the cookie forwardAuthCookie
+// Browsers without a valid token are redirected to forwardAuthLogin when set, with the url they asked for in rd.
+// nginx auth_request does not pass on redirects, use error_page 401 there instead
+//
+/*
+	Traefik : forwardAuth.address=http://auth:8080/api/forward-auth, forwardAuth.authResponseHeaders=X-User-Id,X-User-Email,X-User-Role
+	nginx	: location = /auth { proxy_pass http://auth:8080/api/forward-auth; proxy_set_header X-Original-URI $request_uri; proxy_set_header X-Original-Method $request_method; proxy_set_header X-Forwarded-Host $host; }
+*/
+func HndlForwardAuth(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	defer mongoClient.Disconnect(context.Background())
+
+	req := models.ForwardRequest{
+		Host:   forwardedHeader(c, "X-Forwarded-Host", "X-Original-Host"),
+		Method: forwardedHeader(c, "X-Forwarded-Method", "X-Original-Method"),
+		URI:    forwardedHeader(c, "X-Forwarded-Uri", "X-Original-URI"),
+		Token:  c.GetHeader("Authorization"),
+	}
+	if req.Host == "" {
+		req.Host = c.Request.Host
+	}
+	if req.Token == "" {
+		req.Token, _ = c.Cookie(forwardAuthCookie)
+	}
+	if req.Method == "" || req.URI == "" {
+		httperr.HttpErrOrOkDispatch(c, httperr.ErrInvalidParam(fmt.Errorf("proxy did not send the method and uri of the request")), log.WithFields(log.Fields{
+			"stack": "HndlForwardAuth",
+		}))
+		return
+	}
+	claims, usr, err := uc.ForwardAuth(&req)
+	if err != nil {
+		if err.HttpStatusCode() == http.StatusUnauthorized {
+			if forwardAuthLogin != "" && strings.Contains(c.GetHeader("Accept"), "text/html") {
+				proto := forwardedHeader(c, "X-Forwarded-Proto")
+				if proto == "" {
+					proto = "https"
+				}
+				sep := "?"
+				if strings.Contains(forwardAuthLogin, "?") {
+					sep = "&"
+				}
+				c.Redirect(http.StatusFound, forwardAuthLogin+sep+"rd="+url.QueryEscape(proto+"://"+req.Host+req.URI))
+				c.Abort()
+				return
+			}
+			c.Header("WWW-Authenticate", `Bearer realm="forward-auth"`)
+		}
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlForwardAuth",
+		}))
+		return
+	}
+	if claims != nil {
+		identityHeaders(c, claims, usr)
+	}
+	c.AbortWithStatus(http.StatusOK)
+}
+
+// identityHeaders : identity of the authorized token as headers, so that the proxy in front (nginx auth_request, Traefik forwardAuth) can pass them on upstream.
+// usr is nil for client credentials tokens, X-Client-Id is then the only identity
+func identityHeaders(c *gin.Context, claims *models.CustomClaims, usr *models.User) {
+	c.Header("X-User-Role", strconv.Itoa(int(claims.UserRole)))
+	if claims.ClientID != "" {
+		c.Header("X-Client-Id", claims.ClientID)
+	}
+	if usr != nil {
+		c.Header("X-User-Id", usr.Id.Hex())
+		c.Header("X-User-Email", string(usr.Email))
+	}
+	if claims.Org != "" {
+		c.Header("X-User-Org", claims.Org)
+		c.Header("X-User-Org-Role", strconv.Itoa(int(claims.OrgRole)))
+	}
+}
+
+// setSessionCookies : access token on usr.AuthTok and the refresh token as HttpOnly cookies, refresh cookie goes only to the sessions endpoints.
+// CSRF cookie is for the pages on the same site to read, empty csrf leaves it as it is
+func setSessionCookies(c *gin.Context, usr *models.User, refresh, csrf string) {
+	set := func(name, value, path string, maxAge time.Duration, httpOnly bool) {
+		http.SetCookie(c.Writer, &http.Cookie{
+			Name: name, Value: value, Path: path, Domain: sessionCookies.Domain, MaxAge: int(maxAge.Seconds()),
+			HttpOnly: httpOnly, Secure: sessionCookies.Secure, SameSite: sessionCookies.SameSite,
+		})
+	}
+	set(sessionCookies.Access, usr.AuthTok, "/", models.TokenTTL, true)
+	set(sessionCookies.Refresh, refresh, "/api/sessions", models.SessionTTL, true)
+	if csrf != "" {
+		set(sessionCookies.CSRF, csrf, "/", models.SessionTTL, false)
+		c.Header("X-CSRF-Token", csrf) // front ends on another origin cannot read the cookie
+	}
+}
+
+// clearSessionCookies : logout, cookies are expired right away
+func clearSessionCookies(c *gin.Context) {
+	for name, path := range map[string]string{sessionCookies.Access: "/", sessionCookies.Refresh: "/api/sessions", sessionCookies.CSRF: "/"} {
+		http.SetCookie(c.Writer, &http.Cookie{
+			Name: name, Path: path, Domain: sessionCookies.Domain, MaxAge: -1,
+			HttpOnly: name != sessionCookies.CSRF, Secure: sessionCookies.Secure, SameSite: sessionCookies.SameSite,
+		})
+	}
+}
+
+// HndlSessions : browser sessions started with POST /users?action=auth&session=cookie.
+// Refresh rotates the refresh cookie and sets a new access cookie, delete is the logout. Both need the CSRF token of the session
+//
+/*
+	POST /sessions/refresh
+	X-CSRF-Token: <from the login>
+	DELETE /sessions
+	X-CSRF-Token: <from the login>
+*/
+func HndlSessions(c *gin.Context) {
+	val, _ := c.Get("mongo-client")
+	mongoClient := val.(*mongo.Client)
+	val, _ = c.Get("mongo-database")
+	db := val.(*mongo.Database)
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	defer mongoClient.Disconnect(context.Background())
+
+	refresh, _ := c.Cookie(sessionCookies.Refresh)
+	csrf := c.GetHeader("X-CSRF-Token")
+	if c.Request.Method == http.MethodDelete {
+		if err := uc.EndSession(refresh, csrf); err != nil {
+			httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+				"stack": "HndlSessions/DELETE",
+			}))
+			return
+		}
+		clearSessionCookies(c)
+		c.AbortWithStatus(http.StatusOK)
+		return
+	}
+	usr, sess, err := uc.RefreshSession(refresh, csrf)
+	if err != nil {
+		httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+			"stack": "HndlSessions/POST",
+		}))
+		return
 	}
+	setSessionCookies(c, usr, sess.Refresh, csrf)
+	usr.AuthTok = "" // stays in the cookie
+	c.AbortWithStatusJSON(http.StatusOK, usr)
 }
 
 // HndlLstUsers : handles list of users, can post a new user
-// Can login when POST, action=auth
-// Can authorize when GET action=auth
+// Can login when POST, action=auth. With session=cookie the tokens are set as cookies for a browser session, see HndlSessions
+// Can authorize when GET action=auth, identity of the token is in the X-User-* headers.
+// With ?profile=true or Accept: application/json the account and the claims are sent back as {"user", "claims"}
 // for all other purposes it will ne method not allowed
 func HndlLstUsers(c *gin.Context) {
 	// --------- request binding
@@ -90,17 +2272,34 @@ func HndlLstUsers(c *gin.Context) {
 			return
 		}
 		if action == "auth" {
+			usr.ActiveOrg = c.Query("org") // token acts in this org, else the first org of the account
 			err := uc.Authenticate(&usr)
 			if err != nil {
+				auditEvent(db, "auth", "login-failed", string(usr.Email), string(usr.Email), nil)
 				httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
 					"stack": "HndlUserAuth",
 				}))
 				return
 			}
+			if c.Query("session") == "cookie" {
+				// browser session, tokens go in HttpOnly cookies and not in the response
+				sess, err := uc.StartSession(&usr)
+				if err != nil {
+					httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
+						"stack": "HndlUserAuth",
+					}))
+					return
+				}
+				setSessionCookies(c, &usr, sess.Refresh, sess.CSRF)
+				usr.AuthTok = ""
+			}
+			auditEvent(db, "auth", "login", usr.Id.Hex(), usr.Id.Hex(), nil)
 			// time to send back the token
 			c.AbortWithStatusJSON(http.StatusOK, usr)
 		} else if action == "create" {
 			usr.Role = models.EndUser // when creating new user the role will always be EndUser
+			// account state is never for the client to set
+			usr.Status, usr.StatusReason, usr.StatusUntil, usr.DeletedAt = models.StatusActive, "", 0, 0
 			err = uc.NewUser(&usr)
 			if err != nil {
 				httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
@@ -108,6 +2307,7 @@ func HndlLstUsers(c *gin.Context) {
 				}))
 				return
 			}
+			auditEvent(db, "users", "create", usr.Id.Hex(), usr.Id.Hex(), nil)
 			c.AbortWithStatusJSON(http.StatusOK, &usr)
 		} else {
 			c.AbortWithStatus(http.StatusMethodNotAllowed) // on all other cases method is not allowed.
@@ -121,13 +2321,19 @@ func HndlLstUsers(c *gin.Context) {
 				}))
 				return
 			} else {
-				err := uc.Authorize(tok) // user fields would be empty per say since its only the token you are authorizing
+				claims, usr, err := uc.AuthorizeUser(tok)
 				if err != nil {
 					httperr.HttpErrOrOkDispatch(c, err, log.WithFields(log.Fields{
 						"stack": "HndlUserAuth",
 					}))
 					return
 				}
+				identityHeaders(c, claims, usr)
+				if profile, _ := strconv.ParseBool(c.Query("profile")); profile || strings.Contains(c.GetHeader("Accept"), "application/json") {
+					// saves the calling service from looking up the account, usr is nil for client credentials
+					c.AbortWithStatusJSON(http.StatusOK, gin.H{"user": usr, "claims": claims})
+					return
+				}
 				c.AbortWithStatus(http.StatusOK)
 			}
 		} else {
@@ -6,13 +6,25 @@ uses http rest over json to define endpoints that can be called to modiufy users
 author		:kneerunjun@gmail.com
 */
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/eensymachines-in/utilities"
+	"github.com/eensymachines-in/webapi-userauth/models"
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	DATABASE_NAME = "aquaponics" // all the collections of the service are in this database
 )
 
 // AppEnviron : Object defined for containing all the environment variables.
@@ -22,10 +34,163 @@ type AppEnviron struct {
 	MongoPass string `json:"MONGO_PASS"`
 }
 
+// sessionCookieConfig : names and attributes of the cookies of browser sessions
+type sessionCookieConfig struct {
+	Access   string
+	Refresh  string
+	CSRF     string
+	Domain   string
+	Secure   bool
+	SameSite http.SameSite
+}
+
 var (
-	environ = AppEnviron{} // instance of the app environment, gets  populated in the init functio
+	environ       = AppEnviron{} // instance of the app environment, gets  populated in the init functio
+	purgeInterval = time.Hour    // how often the background maintenance runs - purging deleted accounts, ending suspensions
+	// messages to account holders go out through this, logged unless SMTP is configured
+	notifier       models.Notifier = &models.LogNotifier{}
+	inviteURL                      = "http://localhost:8080/api/invitations"  // invitation token is appended to this in the link sent out
+	emailChangeURL                 = "http://localhost:8080/api/email-change" // email change token is appended to this in the link sent out
+	// thumbnails of the profile pictures, on the local disk unless AVATAR_STORE=gridfs
+	avatarStore = func(db *mongo.Database) models.BlobStore { return &models.LocalBlobStore{Dir: "./data"} }
+	// front end that federated logins land on with the token in the fragment, the callback responds with json if not set
+	federationRedirect = ""
+	// browser that starts a login at an identity provider carries this cookie to the callback
+	federationCookie = "fedstate"
+	// forward auth reads the token from this cookie when there isnt an Authorization header
+	forwardAuthCookie = "authtok"
+	// browsers without a valid token are sent here by forward auth, with the url they asked for in rd. 401 if not set
+	forwardAuthLogin = ""
+	// cookies of browser sessions, Secure unless SESSION_COOKIE_SECURE=false for local development over http
+	sessionCookies = sessionCookieConfig{Access: "authtok", Refresh: "refreshtok", CSRF: "csrftok", Secure: true, SameSite: http.SameSiteLaxMode}
+	// routes a GET cannot reach on the session cookie alone, cross site navigations carry Lax cookies. Browsers consent with a POST and the CSRF token
+	cookieConsentRoutes = map[string]bool{"/api/oauth/authorize": true}
+	// front ends that can make credentialed requests, any origin can make requests without credentials when empty
+	corsOrigins = []string{}
 )
 
+// durationEnv : optional environment variable that is a time.Duration, default if not set, fatal if set but unreadable
+func durationEnv(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("invalid duration for environment variable %s: %s", key, err)
+	}
+	return d
+}
+
+// connectDatabase : direct connection to the database for work that happens outside of a request, caller disconnects the client
+func connectDatabase() (*mongo.Client, *mongo.Database, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(fmt.Sprintf("mongodb://%s:%s@%s", environ.MongoUsr, environ.MongoPass, environ.MongoSrvr)))
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, client.Database(DATABASE_NAME), nil
+}
+
+// ensureIndexes : indexes the service relies on for correctness are created at startup, idempotent
+func ensureIndexes() error {
+	client, db, err := connectDatabase()
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+	ac := models.AuditCollection{DbColl: db.Collection("audit")}
+	if err := ac.EnsureIndexes(); err != nil {
+		return err
+	}
+	oc := models.OrgsCollection{DbColl: db.Collection("orgs")}
+	if err := oc.EnsureIndexes(); err != nil {
+		return err
+	}
+	gc := models.GroupsCollection{DbColl: db.Collection("groups")}
+	if err := gc.EnsureIndexes(); err != nil {
+		return err
+	}
+	occ := models.OAuthClientsCollection{DbColl: db.Collection("oauth_clients")}
+	if err := occ.EnsureIndexes(); err != nil {
+		return err
+	}
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	if err := uc.EnsureFederationIndexes(); err != nil {
+		return err
+	}
+	if err := uc.EnsureSessionIndexes(); err != nil {
+		return err
+	}
+	return uc.EnsureIndexes()
+}
+
+// runMigrations : brings the database schema upto the latest migration, waits for another instance that is migrating
+func runMigrations() error {
+	client, db, err := connectDatabase()
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+	m := models.Migrator{Db: db, Migrations: models.Migrations, Wait: models.MigrationLockTTL}
+	report, herr := m.Up(0, false)
+	if herr != nil {
+		herr.Log(log.WithFields(log.Fields{"stack": "runMigrations"}))
+		return fmt.Errorf("failed to migrate the database")
+	}
+	for _, step := range report.Steps {
+		log.WithFields(log.Fields{"version": step.Version, "affected": step.Affected}).Infof("applied migration %s", step.Name)
+		auditEvent(db, "migrations", step.Direction, "system", fmt.Sprint(step.Version), map[string]string{"name": step.Name, "affected": fmt.Sprint(step.Affected)})
+	}
+	return nil
+}
+
+// bootstrapSuperUser : a fresh deployment has no superuser, creates one from BOOTSTRAP_* environment if set
+// else logs a one time setup token that can be exchanged for the superuser account on /api/setup
+func bootstrapSuperUser() error {
+	client, db, err := connectDatabase()
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(context.Background())
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	le := log.WithFields(log.Fields{"stack": "bootstrapSuperUser"})
+	has, herr := uc.HasSuperUser()
+	if herr != nil {
+		herr.Log(le)
+		return fmt.Errorf("failed to check for superuser")
+	}
+	if has {
+		if herr := uc.ClearSetupToken(); herr != nil {
+			herr.Log(le)
+			return fmt.Errorf("failed to clear setup token")
+		}
+		return nil
+	}
+	if os.Getenv("BOOTSTRAP_EMAIL") != "" {
+		usr := models.User{
+			Name:  models.UserName(os.Getenv("BOOTSTRAP_NAME")),
+			Email: models.UserEmail(os.Getenv("BOOTSTRAP_EMAIL")),
+			Auth:  os.Getenv("BOOTSTRAP_PASS"),
+		}
+		if herr := uc.BootstrapSuperUser(&usr); herr != nil {
+			herr.Log(le)
+			return fmt.Errorf("failed to bootstrap superuser %s, check BOOTSTRAP_NAME/BOOTSTRAP_EMAIL/BOOTSTRAP_PASS", usr.Email)
+		}
+		auditEvent(db, "users", "bootstrap", "system", usr.Id.Hex(), nil)
+		log.WithFields(log.Fields{"email": usr.Email}).Warn("bootstrapped the first superuser from environment")
+		return nil
+	}
+	tok, herr := uc.NewSetupToken()
+	if herr != nil {
+		herr.Log(le)
+		return fmt.Errorf("failed to generate setup token")
+	}
+	log.WithFields(log.Fields{"setup_token": tok}).Warn("No superuser exists, POST /api/setup with this token to create one. Token works only once")
+	return nil
+}
+
 func init() {
 	log.SetFormatter(&log.TextFormatter{
 		DisableColors: false,
@@ -34,6 +199,9 @@ func init() {
 	})
 	log.SetReportCaller(false)
 	log.SetOutput(os.Stdout)
+	if len(os.Args) > 1 {
+		log.SetOutput(os.Stderr) // command line, stdout is for the command output
+	}
 	log.SetLevel(log.InfoLevel) // default is info level, if verbose then trace
 
 	/* -------------------  Reading in the environment */
@@ -51,34 +219,207 @@ func init() {
 	if err := json.Unmarshal(byt, &environ); err != nil {
 		log.Fatalf("failed to read in the environment variables %s", err)
 	}
+	// checkpoints and digests of the audit trail cannot be keyed with anything that ships in the source
+	if models.AuditSecret = os.Getenv("AUDIT_SECRET"); models.AuditSecret == "" {
+		log.Fatal("AUDIT_SECRET is missing, the audit trail cannot be signed without it")
+	}
 	log.Info("All environment vars as expected...")
+	models.DeleteRetention = durationEnv("DELETE_RETENTION", models.DeleteRetention)
+	purgeInterval = durationEnv("PURGE_INTERVAL", purgeInterval)
+	models.InviteTTL = durationEnv("INVITE_TTL", models.InviteTTL)
+	if v := os.Getenv("INVITE_URL"); v != "" {
+		inviteURL = v
+	}
+	models.EmailChangeTTL = durationEnv("EMAIL_CHANGE_TTL", models.EmailChangeTTL)
+	models.OAuthCodeTTL = durationEnv("OAUTH_CODE_TTL", models.OAuthCodeTTL)
+	models.RefreshTokenTTL = durationEnv("REFRESH_TOKEN_TTL", models.RefreshTokenTTL)
+	models.IDTokenTTL = durationEnv("ID_TOKEN_TTL", models.IDTokenTTL)
+	if v := os.Getenv("OIDC_ISSUER"); v != "" {
+		models.OIDCIssuer = strings.TrimSuffix(v, "/")
+	}
+	if v := os.Getenv("EMAIL_CHANGE_URL"); v != "" {
+		emailChangeURL = v
+	}
+	switch os.Getenv("AVATAR_STORE") {
+	case "gridfs":
+		avatarStore = func(db *mongo.Database) models.BlobStore { return &models.GridFSBlobStore{Db: db, Bucket: "avatars"} }
+	case "", "local":
+		if dir := os.Getenv("AVATAR_DIR"); dir != "" {
+			avatarStore = func(db *mongo.Database) models.BlobStore { return &models.LocalBlobStore{Dir: dir} }
+		}
+	default:
+		log.Fatalf("invalid AVATAR_STORE %s, should be local or gridfs", os.Getenv("AVATAR_STORE"))
+	}
+	if v := os.Getenv("AVATAR_URL_PREFIX"); v != "" {
+		models.AvatarURLPrefix = v
+	}
+	if v := os.Getenv("IDP_CONFIG"); v != "" {
+		if err := models.LoadIdentityProviders(v); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if v := os.Getenv("FEDERATION_CALLBACK_URL"); v != "" {
+		models.FederationCallbackURL = strings.TrimSuffix(v, "/")
+	}
+	federationRedirect = os.Getenv("FEDERATION_REDIRECT")
+	if v := os.Getenv("FORWARD_AUTH_POLICY"); v != "" {
+		if err := models.LoadForwardAuthPolicy(v); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if v := os.Getenv("FORWARD_AUTH_COOKIE"); v != "" {
+		forwardAuthCookie = v
+	}
+	forwardAuthLogin = os.Getenv("FORWARD_AUTH_LOGIN")
+	models.SessionTTL = durationEnv("SESSION_TTL", models.SessionTTL)
+	sessionCookies.Domain = os.Getenv("SESSION_COOKIE_DOMAIN")
+	if v := os.Getenv("SESSION_COOKIE_SECURE"); v != "" {
+		secure, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid SESSION_COOKIE_SECURE %s, should be true or false", v)
+		}
+		sessionCookies.Secure = secure
+	}
+	switch strings.ToLower(os.Getenv("SESSION_COOKIE_SAMESITE")) {
+	case "", "lax":
+		sessionCookies.SameSite = http.SameSiteLaxMode
+	case "strict":
+		sessionCookies.SameSite = http.SameSiteStrictMode
+	case "none":
+		// front end on another site, browsers only take it along with Secure
+		sessionCookies.SameSite, sessionCookies.Secure = http.SameSiteNoneMode, true
+	default:
+		log.Fatalf("invalid SESSION_COOKIE_SAMESITE %s, should be lax, strict or none", os.Getenv("SESSION_COOKIE_SAMESITE"))
+	}
+	for _, o := range strings.Split(os.Getenv("CORS_ORIGINS"), ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			corsOrigins = append(corsOrigins, strings.TrimSuffix(o, "/"))
+		}
+	}
+	if v := os.Getenv("SMTP_HOST"); v != "" {
+		notifier = &models.SMTPNotifier{Host: v, User: os.Getenv("SMTP_USER"), Pass: os.Getenv("SMTP_PASS"), From: os.Getenv("SMTP_FROM")}
+	}
 
 	/* ----------------- Ping test for the database or go burst */
 	if err := utilities.MongoPingTest(environ.MongoSrvr, environ.MongoUsr, environ.MongoPass); err != nil {
 		log.Fatal(err)
 	}
+	if err := ensureIndexes(); err != nil {
+		log.Fatal(err)
+	}
+	// MIGRATE_ON_START=false leaves it to the command line, migrate command itself decides what to run
+	if os.Getenv("MIGRATE_ON_START") != "false" && !(len(os.Args) > 1 && os.Args[1] == "migrate") {
+		if err := runMigrations(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := bootstrapSuperUser(); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCLI(os.Args[1:]))
+	}
 	log.Info("Starting the userauth service")
 	defer log.Warn("Closing the userauth service")
+	go runMaintenance(purgeInterval)
 	gin.SetMode(gin.DebugMode)
 	r := gin.Default()
-	api := r.Group("/api").Use(utilities.CORS)
+	cors := utilities.CORS
+	if len(corsOrigins) > 0 {
+		cors = CredentialedCORS // front ends that send the session cookies
+	}
+	api := r.Group("/api").Use(cors)
 	api.GET("/ping", func(ctx *gin.Context) {
 		ctx.AbortWithStatusJSON(http.StatusOK, gin.H{
 			"data": "If you can see this the webapi-userauth service is running",
 		})
 	})
+	/* OpenID Connect provider metadata, at the issuer url */
+	api.GET("/.well-known/openid-configuration", HndlOIDCDiscovery)
 	/* Login authentication for user, sends back a jwt token  */
 	// ?action=login
 	// ?action=create
-	users := api.Use(utilities.MongoConnect(environ.MongoSrvr, environ.MongoUsr, environ.MongoPass, "aquaponics"))
+	users := api.Use(utilities.MongoConnect(environ.MongoSrvr, environ.MongoUsr, environ.MongoPass, DATABASE_NAME))
+	/* Reverse proxies in front of the internal dashboards ask here before every request, policy is in FORWARD_AUTH_POLICY.
+	Registered ahead of SessionCookie, it reads the cookie on its own and the proxied requests do not carry the CSRF token */
+	users.Any("/forward-auth", HndlForwardAuth)
+	users.Use(SessionCookie)
 	users.POST("/users", HndlLstUsers)
 	users.GET("/users", HndlLstUsers)
 	/* Single user operations  */
 	users.GET("/users/:id", HndlAUser)
-	users.DELETE("/users/:id", HndlAUser)
-	users.PATCH("/users/:id", HndlAUser)
+	users.DELETE("/users/:id", RequireRole(models.Guest), HndlAUser)
+	users.PATCH("/users/:id", RequireRole(models.Guest), HndlAUser)
+	users.POST("/users/:id/restore", RequireRole(models.Admin), HndlRestoreUser)
+	users.PATCH("/users/:id/status", RequireRole(models.Admin), HndlUserStatus)
+	users.PATCH("/users/:id/role", RequireRole(models.Admin), HndlUserRole)
+	/* Data subject requests, account holder or admin on their behalf */
+	users.GET("/users/:id/export", RequireRole(models.Guest), HndlExportUser)
+	users.POST("/users/:id/erase", RequireRole(models.Guest), HndlEraseUser)
+	/* Admin creating accounts of any role, ?action=create|invite */
+	users.POST("/admin/users", RequireOrgRole(models.Admin), HndlAdminUsers)
+	users.POST("/admin/users/import", RequireRole(models.Admin), HndlImportUsers)
+	users.POST("/admin/users/batch", RequireRole(models.Admin), HndlBatchUsers)
+	users.GET("/admin/users/export", RequireOrgRole(models.Admin), HndlExportUsers)
+	users.POST("/invitations/:token", HndlAcceptInvite)
+	users.POST("/users/:id/email", RequireRole(models.Guest), HndlEmailChange)
+	users.PATCH("/users/:id/profile", RequireRole(models.Guest), HndlUserProfile)
+	users.PUT("/users/:id/avatar", RequireRole(models.Guest), HndlAvatar)
+	users.DELETE("/users/:id/avatar", RequireRole(models.Guest), HndlAvatar)
+	users.GET("/users/:id/avatar", HndlAvatar)
+	users.GET("/attributes", RequireRole(models.Guest, "attributes:read"), HndlAttributes)
+	users.PUT("/admin/attributes/:key", RequireRole(models.Admin), HndlAttributes)
+	users.DELETE("/admin/attributes/:key", RequireRole(models.Admin), HndlAttributes)
+	users.POST("/email-change/:token", HndlConfirmEmailChange)
+	/* Orgs, platform admins manage all of them while org admins manage the members of their own */
+	users.POST("/admin/orgs", RequireRole(models.Admin), HndlOrgs)
+	users.GET("/admin/orgs", RequireRole(models.Admin), HndlOrgs)
+	users.GET("/orgs", RequireRole(models.Guest, "orgs:read"), HndlMyOrgs)
+	users.POST("/orgs/:org/token", RequireRole(models.Guest), HndlSwitchOrg)
+	users.GET("/orgs/:org/members", RequireOrgRole(models.Admin), HndlOrgMembers)
+	users.PUT("/orgs/:org/members/:id", RequireOrgRole(models.Admin), HndlOrgMembers)
+	users.DELETE("/orgs/:org/members/:id", RequireOrgRole(models.Admin), HndlOrgMembers)
+	/* Groups for granting permissions and roles in bulk */
+	users.GET("/admin/groups", RequireRole(models.Admin), HndlGroups)
+	users.POST("/admin/groups", RequireRole(models.Admin), HndlGroups)
+	users.GET("/admin/groups/:gid", RequireRole(models.Admin), HndlGroups)
+	users.PUT("/admin/groups/:gid", RequireRole(models.Admin), HndlGroups)
+	users.DELETE("/admin/groups/:gid", RequireRole(models.Admin), HndlGroups)
+	users.PUT("/admin/groups/:gid/members/:id", RequireRole(models.Admin), HndlGroupMembers)
+	users.DELETE("/admin/groups/:gid/members/:id", RequireRole(models.Admin), HndlGroupMembers)
+	users.GET("/admin/users/:id/permissions", RequireRole(models.Admin), HndlUserPermissions)
+	users.PUT("/admin/users/:id/permissions", RequireRole(models.Admin), HndlUserPermissions)
+	/* OAuth 2.0 for third party integrations, clients are registered by the admins.
+	Their tokens reach only the routes that name a scope in RequireRole, and only with that scope granted */
+	users.GET("/oauth/authorize", RequireRole(models.Guest), HndlOAuthAuthorize)
+	users.POST("/oauth/authorize", RequireRole(models.Guest), HndlOAuthAuthorize)
+	users.POST("/oauth/token", HndlOAuthToken)
+	users.POST("/oauth/revoke", HndlOAuthRevoke)
+	users.POST("/oauth/introspect", HndlOAuthIntrospect)
+	users.GET("/oauth/jwks", HndlJWKS)
+	users.GET("/oauth/userinfo", HndlUserInfo)
+	users.POST("/oauth/userinfo", HndlUserInfo)
+	users.POST("/oauth/logout", HndlOAuthLogout)
+	users.GET("/admin/oauth/clients", RequireRole(models.Admin), HndlOAuthClients)
+	users.POST("/admin/oauth/clients", RequireRole(models.Admin), HndlOAuthClients)
+	users.DELETE("/admin/oauth/clients/:cid", RequireRole(models.Admin), HndlOAuthClients)
+	users.POST("/admin/oauth/clients/:cid/secret", RequireRole(models.Admin), HndlOAuthClients)
+	/* Login with external identity providers, configured in IDP_CONFIG */
+	users.GET("/federation", HndlIdentityProviders)
+	users.GET("/federation/:idp/login", HndlFederation)
+	users.GET("/federation/:idp/callback", HndlFederation)
+	users.GET("/users/:id/identities", RequireRole(models.Guest, "identities:read"), HndlIdentities)
+	users.POST("/users/:id/identities/:idp", RequireRole(models.Guest), HndlIdentities)
+	users.DELETE("/users/:id/identities/:idp", RequireRole(models.Guest), HndlIdentities)
+	/* Browser sessions, tokens in HttpOnly cookies. Login is POST /users?action=auth&session=cookie */
+	users.POST("/sessions/refresh", HndlSessions)
+	users.DELETE("/sessions", HndlSessions)
+	/* First superuser on a fresh deployment, against the setup token from the log */
+	users.POST("/setup", HndlSetup)
+	/* Audit trail, walks the hash chain of the stream */
+	users.GET("/audit/:stream/verify", RequireRole(models.Admin), HndlAuditVerify)
 	log.Fatal(r.Run(":8080"))
 }
@@ -0,0 +1,68 @@
+package main
+
+/* Background housekeeping that runs alongside the http server on a ticker.
+Each run makes its own database connection since there is no request to piggy back on. */
+import (
+	"context"
+	"time"
+
+	"github.com/eensymachines-in/webapi-userauth/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// runMaintenance : blocking, runs all the housekeeping once every interval. Call as a go routine
+func runMaintenance(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for range tick.C {
+		purgeDeletedUsers()
+		reactivateSuspended()
+	}
+}
+
+// reactivateSuspended : accounts whose suspension has expired are made active
+func reactivateSuspended() {
+	client, db, err := connectDatabase()
+	if err != nil {
+		log.WithFields(log.Fields{"stack": "reactivateSuspended"}).Errorf("failed to connect database %s", err)
+		return
+	}
+	defer client.Disconnect(context.Background())
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	count, herr := uc.ReactivateExpired()
+	if herr != nil {
+		herr.Log(log.WithFields(log.Fields{"stack": "reactivateSuspended"}))
+		return
+	}
+	if count > 0 {
+		log.WithFields(log.Fields{"count": count}).Info("reactivated accounts with expired suspension")
+	}
+}
+
+// purgeDeletedUsers : hard deletes accounts past their restore window, their avatars with them, and anonymizes them in the audit trail
+func purgeDeletedUsers() {
+	client, db, err := connectDatabase()
+	if err != nil {
+		log.WithFields(log.Fields{"stack": "purgeDeletedUsers"}).Errorf("failed to connect database %s", err)
+		return
+	}
+	defer client.Disconnect(context.Background())
+	uc := models.UsersCollection{DbColl: db.Collection("users")}
+	ac := models.AuditCollection{DbColl: db.Collection("audit")}
+	purged, herr := uc.PurgeDeleted()
+	if herr != nil {
+		herr.Log(log.WithFields(log.Fields{"stack": "purgeDeletedUsers"}))
+	}
+	for _, usr := range purged {
+		if _, herr := ac.Anonymize(usr.Id.Hex(), string(usr.Email)); herr != nil {
+			herr.Log(log.WithFields(log.Fields{"stack": "purgeDeletedUsers"}))
+		}
+		if herr := models.DeleteAvatarBlobs(usr.Id.Hex(), avatarStore(db)); herr != nil {
+			herr.Log(log.WithFields(log.Fields{"stack": "purgeDeletedUsers"}))
+		}
+		auditEvent(db, "users", "purge", "system", models.AnonymizedRef, nil)
+	}
+	if len(purged) > 0 {
+		log.WithFields(log.Fields{"count": len(purged)}).Info("purged deleted accounts")
+	}
+}
@@ -0,0 +1,176 @@
+package models
+
+/* =========================
+project 		: ipatio-web
+date			: October 2026
+author			: kneerunjun@gmail.com
+Copyrights		: Eensy Machines
+About			: Schema of the free form attributes on the account (ex: farm id, preferred units).
+Admins define the keys, their types and if the account holder can edit them. Values are validated against the schema on every write.
+============================*/
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type AttributeType string
+
+const (
+	AttrString AttributeType = "string"
+	AttrNumber AttributeType = "number"
+	AttrBool   AttributeType = "bool"
+)
+
+var attrKeyRegex = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+
+// AttributeDef : definition of one attribute key
+type AttributeDef struct {
+	Key          string        `bson:"_id" json:"key"`
+	Type         AttributeType `bson:"type" json:"type"`
+	Description  string        `bson:"description,omitempty" json:"description,omitempty"`
+	UserEditable bool          `bson:"usereditable" json:"user_editable"`         // account holder can set it, else only the admins
+	Enum         []string      `bson:"enum,omitempty" json:"enum,omitempty"`      // allowed values of a string attribute
+	MaxLen       int           `bson:"maxlen,omitempty" json:"max_len,omitempty"` // of a string attribute, 0 is no limit
+	Min          *float64      `bson:"min,omitempty" json:"min,omitempty"`        // of a number attribute
+	Max          *float64      `bson:"max,omitempty" json:"max,omitempty"`        // of a number attribute
+}
+
+func (ad AttributeDef) IsValid() bool {
+	if !attrKeyRegex.MatchString(ad.Key) || ad.MaxLen < 0 {
+		return false
+	}
+	if ad.Min != nil && ad.Max != nil && *ad.Min > *ad.Max {
+		return false
+	}
+	return ad.Type == AttrString || ad.Type == AttrNumber || ad.Type == AttrBool
+}
+
+// Check : value is of the type and within the limits of the definition
+func (ad AttributeDef) Check(v interface{}) error {
+	switch ad.Type {
+	case AttrString:
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s should be a string", ad.Key)
+		}
+		if ad.MaxLen > 0 && len(s) > ad.MaxLen {
+			return fmt.Errorf("%s should be at most %d long", ad.Key, ad.MaxLen)
+		}
+		if len(ad.Enum) > 0 {
+			for _, e := range ad.Enum {
+				if e == s {
+					return nil
+				}
+			}
+			return fmt.Errorf("%s should be one of %v", ad.Key, ad.Enum)
+		}
+	case AttrNumber:
+		n, ok := v.(float64) // numbers from json
+		if !ok {
+			return fmt.Errorf("%s should be a number", ad.Key)
+		}
+		if (ad.Min != nil && n < *ad.Min) || (ad.Max != nil && n > *ad.Max) {
+			return fmt.Errorf("%s is out of range", ad.Key)
+		}
+	case AttrBool:
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s should be true or false", ad.Key)
+		}
+	}
+	return nil
+}
+
+// AttributesCollection : the attribute schema, a document per key
+type AttributesCollection struct {
+	DbColl *mongo.Collection
+}
+
+// Schema : all the attribute definitions by key
+func (ac *AttributesCollection) Schema() (map[string]AttributeDef, httperr.HttpErr) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cur, err := ac.DbColl.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, httperr.ErrDBQuery(err)
+	}
+	defs := []AttributeDef{}
+	if err := cur.All(ctx, &defs); err != nil {
+		return nil, httperr.ErrDBQuery(err)
+	}
+	schema := map[string]AttributeDef{}
+	for _, d := range defs {
+		schema[d.Key] = d
+	}
+	return schema, nil
+}
+
+// DefineAttribute : adds the attribute key or replaces its definition.
+// Values already set are not checked against the new definition, but any change to them will be
+func (ac *AttributesCollection) DefineAttribute(def AttributeDef) httperr.HttpErr {
+	if !def.IsValid() {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid definition of attribute %s", def.Key))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := ac.DbColl.ReplaceOne(ctx, bson.M{"_id": def.Key}, def, options.Replace().SetUpsert(true)); err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed DefineAttribute : %s", err))
+	}
+	return nil
+}
+
+// RemoveAttribute : key can no longer be set, values already set stay on the accounts till they are cleared
+func (ac *AttributesCollection) RemoveAttribute(key string) httperr.HttpErr {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := ac.DbColl.DeleteOne(ctx, bson.M{"_id": key})
+	if err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed RemoveAttribute : %s", err))
+	}
+	if result.DeletedCount == 0 {
+		return httperr.ErrResourceNotFound(fmt.Errorf("attribute %s is not defined", key))
+	}
+	return nil
+}
+
+// SetAttributes : sets the attributes of the account as per the schema, nil value clears the attribute.
+// Account holders (byAdmin false) can only set the keys that are user editable, admins can set any that are defined.
+// Values removed from the schema can still be cleared.
+//
+/*
+	schema, _ := ac.Schema()
+	err := uc.SetAttributes(usrIdHex, map[string]interface{}{"farm_id": "FRM-0042", "units": "metric"}, schema, false)
+*/
+func (u *UsersCollection) SetAttributes(objIdHex string, attrs map[string]interface{}, schema map[string]AttributeDef, byAdmin bool) httperr.HttpErr {
+	if len(attrs) == 0 {
+		return httperr.ErrInvalidParam(errors.New("no attributes to set"))
+	}
+	set, unset := bson.M{}, bson.M{}
+	for key, v := range attrs {
+		def, defined := schema[key]
+		if defined && !byAdmin && !def.UserEditable {
+			return httperr.ErrForbidden(fmt.Errorf("attribute %s can only be set by the admins", key))
+		}
+		if v == nil {
+			if attrKeyRegex.MatchString(key) {
+				unset["attributes."+key] = ""
+				continue
+			}
+		}
+		if !defined {
+			return httperr.ErrInvalidParam(fmt.Errorf("attribute %s is not defined", key))
+		}
+		if err := def.Check(v); err != nil {
+			return httperr.ErrInvalidParam(err)
+		}
+		set["attributes."+key] = v
+	}
+	return u.updateProfile(objIdHex, set, unset)
+}
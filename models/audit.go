@@ -0,0 +1,313 @@
+package models
+
+/* =========================
+project 		: ipatio-web
+date			: October 2026
+author			: kneerunjun@gmail.com
+Copyrights		: Eensy Machines
+About			: Tamper evident audit trail. Each record carries the hash of the previous record in the same stream (hash chain),
+and every AuditCheckpointEvery records a checkpoint signed with AuditSecret is stored alongside. The head of each stream is signed on every append
+so that deleting the latest records is caught as well. Verify walks the chain and reports the first broken link.
+Actor and Subject are committed to the chain only as keyed digests so that they can later be anonymized without breaking the chain.
+============================*/
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	AuditCheckpointEvery int64  = 100 // a signed checkpoint is written after every so many records in a stream
+	AuditSecret          string       // key for the checkpoints and the actor/subject digests, from AUDIT_SECRET. Never the token signing key
+)
+
+const (
+	AnonymizedRef = "anonymized" // plain text actor/subject is replaced with this once the account is purged
+)
+
+const (
+	auditAppendRetries = 5 // concurrent appends to the same stream race for the next seq, loser retries
+)
+
+// AuditRecord : single link in the audit hash chain of a stream
+type AuditRecord struct {
+	Id         primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	Stream     string             `bson:"stream" json:"stream"`
+	Seq        int64              `bson:"seq" json:"seq"`
+	At         int64              `bson:"at" json:"at"` // unix milliseconds, not a bson date since that would alter precision and hence the hash
+	Action     string             `bson:"action" json:"action"`
+	Actor      string             `bson:"actor" json:"actor"`     // plain text, can be anonymized
+	Subject    string             `bson:"subject" json:"subject"` // plain text, can be anonymized
+	ActorRef   string             `bson:"actorref" json:"-"`      // keyed digest of actor, part of the hash
+	SubjectRef string             `bson:"subjectref" json:"-"`    // keyed digest of subject, part of the hash
+	Details    map[string]string  `bson:"details,omitempty" json:"details,omitempty"`
+	PrevHash   string             `bson:"prevhash" json:"prevhash"`
+	Hash       string             `bson:"hash" json:"hash"`
+}
+
+// AuditCheckpoint : signed snapshot of the chain head at a given seq
+type AuditCheckpoint struct {
+	Stream string `bson:"stream" json:"stream"`
+	Seq    int64  `bson:"seq" json:"seq"`
+	Hash   string `bson:"hash" json:"hash"`
+	At     int64  `bson:"at" json:"at"`
+	Sig    string `bson:"sig" json:"sig"`
+}
+
+// AuditVerifyReport : outcome of walking the chain of one stream
+type AuditVerifyReport struct {
+	Stream      string `json:"stream"`
+	Records     int64  `json:"records"`
+	Checkpoints int64  `json:"checkpoints"`
+	Intact      bool   `json:"intact"`
+	BrokenAt    int64  `json:"broken_at,omitempty"` // seq of the first broken link
+	Reason      string `json:"reason,omitempty"`
+}
+
+// AuditCollection : audit records, their checkpoints and the signed heads of the streams are in sibling collections
+type AuditCollection struct {
+	DbColl *mongo.Collection
+}
+
+// auditDigest : keyed digest of personal references in the audit record
+func auditDigest(s string) string {
+	mac := hmac.New(sha256.New, []byte(AuditSecret))
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ComputeHash : hash of the record as committed to the chain, excludes plain text actor/subject and the hash itself
+func (ar *AuditRecord) ComputeHash() string {
+	keys := make([]string, 0, len(ar.Details))
+	for k := range ar.Details {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	details := make([]string, 0, len(keys))
+	for _, k := range keys {
+		details = append(details, fmt.Sprintf("%s=%s", k, ar.Details[k]))
+	}
+	h := sha256.Sum256([]byte(strings.Join([]string{
+		ar.Stream, fmt.Sprint(ar.Seq), fmt.Sprint(ar.At), ar.Action, ar.ActorRef, ar.SubjectRef, strings.Join(details, "&"), ar.PrevHash,
+	}, "\n")))
+	return hex.EncodeToString(h[:])
+}
+
+func (cp *AuditCheckpoint) signature() string {
+	mac := hmac.New(sha256.New, []byte(AuditSecret))
+	mac.Write([]byte(fmt.Sprintf("%s|%d|%s|%d", cp.Stream, cp.Seq, cp.Hash, cp.At)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (ac *AuditCollection) checkpoints() *mongo.Collection {
+	return ac.DbColl.Database().Collection(ac.DbColl.Name() + "_checkpoints")
+}
+
+// heads : signed head of each stream by the stream name, same as a checkpoint but moved along with every append
+func (ac *AuditCollection) heads() *mongo.Collection {
+	return ac.DbColl.Database().Collection(ac.DbColl.Name() + "_heads")
+}
+
+// signHead : moves the signed head of the stream to the record, unless a concurrent append already moved it further
+func (ac *AuditCollection) signHead(ctx context.Context, rec *AuditRecord) httperr.HttpErr {
+	head := AuditCheckpoint{Stream: rec.Stream, Seq: rec.Seq, Hash: rec.Hash, At: time.Now().UnixMilli()}
+	head.Sig = head.signature()
+	_, err := ac.heads().UpdateOne(ctx, bson.M{"_id": rec.Stream, "seq": bson.M{"$lt": rec.Seq}}, bson.M{"$set": head}, options.Update().SetUpsert(true))
+	if err != nil && !mongo.IsDuplicateKeyError(err) { // duplicate is when the head is already past this record
+		return httperr.ErrDBQuery(err)
+	}
+	return nil
+}
+
+// EnsureIndexes : seq is unique per stream, which is what serializes concurrent appends
+func (ac *AuditCollection) EnsureIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := ac.DbColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "stream", Value: 1}, {Key: "seq", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		return fmt.Errorf("failed to create audit index: %s", err)
+	}
+	if _, err := ac.checkpoints().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "stream", Value: 1}, {Key: "seq", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}); err != nil {
+		return fmt.Errorf("failed to create audit checkpoint index: %s", err)
+	}
+	return nil
+}
+
+// Append : links a new record at the head of the stream. Seq, hashes and the timestamp are filled in here.
+//
+/*
+	ac := models.AuditCollection{DbColl: db.Collection("audit")}
+	err := ac.Append(&models.AuditRecord{Stream: "users", Action: "delete", Actor: adminID, Subject: usrID})
+*/
+func (ac *AuditCollection) Append(rec *AuditRecord) httperr.HttpErr {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	rec.ActorRef = auditDigest(rec.Actor)
+	rec.SubjectRef = auditDigest(rec.Subject)
+	for i := 0; i < auditAppendRetries; i++ {
+		head := AuditRecord{}
+		err := ac.DbColl.FindOne(ctx, bson.M{"stream": rec.Stream}, options.FindOne().SetSort(bson.M{"seq": -1})).Decode(&head)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return httperr.ErrDBQuery(err)
+		}
+		rec.Id = primitive.NilObjectID
+		rec.Seq = head.Seq + 1
+		rec.PrevHash = head.Hash
+		rec.At = time.Now().UnixMilli()
+		rec.Hash = rec.ComputeHash()
+		_, err = ac.DbColl.InsertOne(ctx, rec)
+		if mongo.IsDuplicateKeyError(err) {
+			continue // someone else took this seq, try again on the new head
+		}
+		if err != nil {
+			return httperr.ErrDBQuery(err)
+		}
+		if err := ac.signHead(ctx, rec); err != nil {
+			return err
+		}
+		if AuditCheckpointEvery > 0 && rec.Seq%AuditCheckpointEvery == 0 {
+			return ac.Checkpoint(rec.Stream)
+		}
+		return nil
+	}
+	return httperr.ErrDBQuery(fmt.Errorf("failed to append audit record to %s after %d attempts", rec.Stream, auditAppendRetries))
+}
+
+// Checkpoint : signs the current head of the stream, no-op on an empty stream or if the head is already checkpointed
+func (ac *AuditCollection) Checkpoint(stream string) httperr.HttpErr {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	head := AuditRecord{}
+	err := ac.DbColl.FindOne(ctx, bson.M{"stream": stream}, options.FindOne().SetSort(bson.M{"seq": -1})).Decode(&head)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	} else if err != nil {
+		return httperr.ErrDBQuery(err)
+	}
+	cp := AuditCheckpoint{Stream: stream, Seq: head.Seq, Hash: head.Hash, At: time.Now().UnixMilli()}
+	cp.Sig = cp.signature()
+	if _, err := ac.checkpoints().InsertOne(ctx, cp); err != nil && !mongo.IsDuplicateKeyError(err) {
+		return httperr.ErrDBQuery(err)
+	}
+	return nil
+}
+
+// Verify : walks the stream from the first record and reports the first link that is broken.
+// A link is broken when a record is missing (gap in seq), altered (hash mismatch), re-linked (prevhash mismatch),
+// or when a signed checkpoint or the signed head does not agree with the chain. Records deleted from the tail are caught by the head.
+func (ac *AuditCollection) Verify(stream string) (*AuditVerifyReport, httperr.HttpErr) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	report := &AuditVerifyReport{Stream: stream, Intact: true}
+	broken := func(seq int64, reason string) (*AuditVerifyReport, httperr.HttpErr) {
+		report.Intact = false
+		report.BrokenAt = seq
+		report.Reason = reason
+		return report, nil
+	}
+	/* checkpoints first, so that the chain walk can compare against them */
+	cpCur, err := ac.checkpoints().Find(ctx, bson.M{"stream": stream}, options.Find().SetSort(bson.M{"seq": 1}))
+	if err != nil {
+		return nil, httperr.ErrDBQuery(err)
+	}
+	cps := []AuditCheckpoint{}
+	if err := cpCur.All(ctx, &cps); err != nil {
+		return nil, httperr.ErrDBQuery(err)
+	}
+	report.Checkpoints = int64(len(cps))
+	cpAt := map[int64]AuditCheckpoint{}
+	for _, cp := range cps {
+		if !hmac.Equal([]byte(cp.Sig), []byte(cp.signature())) {
+			return broken(cp.Seq, "checkpoint signature is invalid")
+		}
+		cpAt[cp.Seq] = cp
+	}
+	cur, err := ac.DbColl.Find(ctx, bson.M{"stream": stream}, options.Find().SetSort(bson.M{"seq": 1}))
+	if err != nil {
+		return nil, httperr.ErrDBQuery(err)
+	}
+	defer cur.Close(ctx)
+	prev, expect := "", int64(1)
+	for cur.Next(ctx) {
+		rec := AuditRecord{}
+		if err := cur.Decode(&rec); err != nil {
+			return nil, httperr.ErrBinding(err)
+		}
+		if rec.Seq != expect {
+			return broken(expect, fmt.Sprintf("record missing, next record found is %d", rec.Seq))
+		}
+		if rec.PrevHash != prev {
+			return broken(rec.Seq, "previous hash does not match the preceding record")
+		}
+		if rec.ComputeHash() != rec.Hash {
+			return broken(rec.Seq, "record content does not match its hash")
+		}
+		if (rec.Actor != AnonymizedRef && auditDigest(rec.Actor) != rec.ActorRef) || (rec.Subject != AnonymizedRef && auditDigest(rec.Subject) != rec.SubjectRef) {
+			return broken(rec.Seq, "actor or subject does not match its committed digest")
+		}
+		if cp, ok := cpAt[rec.Seq]; ok && cp.Hash != rec.Hash {
+			return broken(rec.Seq, "record does not match the signed checkpoint")
+		}
+		prev = rec.Hash
+		report.Records++
+		expect++
+	}
+	if err := cur.Err(); err != nil {
+		return nil, httperr.ErrDBQuery(err)
+	}
+	if len(cps) > 0 && cps[len(cps)-1].Seq >= expect {
+		return broken(expect, fmt.Sprintf("chain ends before signed checkpoint %d, tail was truncated", cps[len(cps)-1].Seq))
+	}
+	head := AuditCheckpoint{}
+	err = ac.heads().FindOne(ctx, bson.M{"_id": stream}).Decode(&head)
+	if err == mongo.ErrNoDocuments {
+		if report.Records > 0 {
+			return broken(expect-1, "signed head of the stream is missing")
+		}
+		return report, nil
+	} else if err != nil {
+		return nil, httperr.ErrDBQuery(err)
+	}
+	if !hmac.Equal([]byte(head.Sig), []byte(head.signature())) || head.Stream != stream {
+		return broken(head.Seq, "signature of the stream head is invalid")
+	}
+	if head.Seq >= expect {
+		return broken(expect, fmt.Sprintf("chain ends before the signed head %d, tail was truncated", head.Seq))
+	}
+	if head.Seq != expect-1 || head.Hash != prev {
+		return broken(head.Seq, "chain does not end at the signed head")
+	}
+	return report, nil
+}
+
+// Anonymize : replaces the plain text actor/subject that match any of the refs (typically id hex and email of a purged account)
+// Since only the digests are part of the hash, the chain stays intact.
+func (ac *AuditCollection) Anonymize(refs ...string) (int64, httperr.HttpErr) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	var count int64
+	for _, field := range []string{"actor", "subject"} {
+		result, err := ac.DbColl.UpdateMany(ctx, bson.M{field: bson.M{"$in": refs}}, bson.M{"$set": bson.M{field: AnonymizedRef}})
+		if err != nil {
+			return count, httperr.ErrDBQuery(err)
+		}
+		count += result.ModifiedCount
+	}
+	return count, nil
+}
@@ -0,0 +1,183 @@
+package models
+
+/* =========================
+project 		: ipatio-web
+date			: October 2026
+author			: kneerunjun@gmail.com
+Copyrights		: Eensy Machines
+About			: Profile picture of the account. Uploads are PNG or JPEG, cropped to a square from the center and scaled down to fixed sizes.
+Only the thumbnails are kept in the blob store, the account has the url they are served from, versioned by the time of upload.
+============================*/
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"time"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	AvatarMaxBytes  int64 = 2 << 20        // of the upload
+	AvatarMaxPixels       = 4096           // on either side of the upload, image is decoded only within this
+	AvatarSizes           = []int{64, 256} // side of the square thumbnails, ascending
+	AvatarURLPrefix       = "/api/users"   // avatar of the account is served from <prefix>/<id>/avatar
+)
+
+func avatarKey(objIdHex string, size int) string {
+	return fmt.Sprintf("avatars/%s/%d", objIdHex, size)
+}
+
+// Thumbnails : square thumbnails of the image in AvatarSizes, encoded in the format of the upload.
+// Images smaller than a size are scaled up
+func Thumbnails(data []byte) (map[int][]byte, string, error) {
+	if int64(len(data)) > AvatarMaxBytes {
+		return nil, "", fmt.Errorf("image should be at most %d bytes", AvatarMaxBytes)
+	}
+	contentType := http.DetectContentType(data)
+	if contentType != "image/png" && contentType != "image/jpeg" {
+		return nil, "", fmt.Errorf("image should be png or jpeg, not %s", contentType)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid image: %s", err)
+	}
+	if cfg.Width < 1 || cfg.Height < 1 || cfg.Width > AvatarMaxPixels || cfg.Height > AvatarMaxPixels {
+		return nil, "", fmt.Errorf("image should be at most %dx%d pixels", AvatarMaxPixels, AvatarMaxPixels)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid image: %s", err)
+	}
+	// square from the center, in RGBA so the scaling works on the pixels directly
+	b := img.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	origin := image.Pt(b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2)
+	square := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(square, square.Bounds(), img, origin, draw.Src)
+
+	result := map[int][]byte{}
+	for _, size := range AvatarSizes {
+		buf := bytes.Buffer{}
+		thumb := scaleSquare(square, size)
+		if contentType == "image/png" {
+			err = png.Encode(&buf, thumb)
+		} else {
+			err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to encode thumbnail: %s", err)
+		}
+		result[size] = buf.Bytes()
+	}
+	return result, contentType, nil
+}
+
+// scaleSquare : box filter, each pixel of the thumbnail is the average of the pixels of the source it covers
+func scaleSquare(src *image.RGBA, size int) *image.RGBA {
+	side := src.Bounds().Dx()
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	span := func(i int) (int, int) {
+		from, to := i*side/size, (i+1)*side/size
+		if to <= from { // scaling up
+			to = from + 1
+		}
+		return from, to
+	}
+	for y := 0; y < size; y++ {
+		y0, y1 := span(y)
+		for x := 0; x < size; x++ {
+			x0, x1 := span(x)
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					for c := 0; c < 4; c++ {
+						sum[c] += int(row[sx*4+c])
+					}
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			off := y*dst.Stride + x*4
+			for c := 0; c < 4; c++ {
+				dst.Pix[off+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return dst
+}
+
+// SetAvatar : stores the thumbnails of the image and sets the avatar url of the account, replaces the avatar if any
+//
+/*
+	url, err := uc.SetAvatar(usrIdHex, imgBytes, &models.LocalBlobStore{Dir: "./data"})
+*/
+func (u *UsersCollection) SetAvatar(objIdHex string, data []byte, store BlobStore) (string, httperr.HttpErr) {
+	if _, err := primitive.ObjectIDFromHex(objIdHex); err != nil {
+		return "", httperr.ErrInvalidParam(err)
+	}
+	thumbs, contentType, err := Thumbnails(data)
+	if err != nil {
+		return "", httperr.ErrInvalidParam(err)
+	}
+	for size, thumb := range thumbs {
+		if err := store.Put(avatarKey(objIdHex, size), contentType, thumb); err != nil {
+			return "", httperr.ErrDBQuery(fmt.Errorf("failed to store avatar : %s", err))
+		}
+	}
+	// version in the url lets the clients cache the avatar for long
+	url := fmt.Sprintf("%s/%s/avatar?v=%d", AvatarURLPrefix, objIdHex, time.Now().Unix())
+	if err := u.updateProfile(objIdHex, bson.M{"avatar": url}, nil); err != nil {
+		return "", err
+	}
+	return url, nil
+}
+
+// RemoveAvatar : clears the avatar url of the account and deletes the thumbnails
+func (u *UsersCollection) RemoveAvatar(objIdHex string, store BlobStore) httperr.HttpErr {
+	if err := u.updateProfile(objIdHex, bson.M{}, bson.M{"avatar": ""}); err != nil {
+		return err
+	}
+	return DeleteAvatarBlobs(objIdHex, store)
+}
+
+// DeleteAvatarBlobs : deletes the thumbnails without touching the account, for accounts that are being erased
+func DeleteAvatarBlobs(objIdHex string, store BlobStore) httperr.HttpErr {
+	for _, size := range AvatarSizes {
+		if err := store.Delete(avatarKey(objIdHex, size)); err != nil {
+			return httperr.ErrDBQuery(fmt.Errorf("failed to delete avatar : %s", err))
+		}
+	}
+	return nil
+}
+
+// AvatarBlob : smallest thumbnail of the account that is at least the size asked for, else the largest
+func AvatarBlob(objIdHex string, size int, store BlobStore) (*Blob, httperr.HttpErr) {
+	if _, err := primitive.ObjectIDFromHex(objIdHex); err != nil {
+		return nil, httperr.ErrInvalidParam(err)
+	}
+	pick := AvatarSizes[len(AvatarSizes)-1]
+	for _, s := range AvatarSizes {
+		if s >= size {
+			pick = s
+			break
+		}
+	}
+	blob, err := store.Get(avatarKey(objIdHex, pick))
+	if errors.Is(err, ErrBlobNotFound) {
+		return nil, httperr.ErrResourceNotFound(fmt.Errorf("user account %s has no avatar", objIdHex))
+	} else if err != nil {
+		return nil, httperr.ErrDBQuery(fmt.Errorf("failed to get avatar : %s", err))
+	}
+	return blob, nil
+}
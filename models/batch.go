@@ -0,0 +1,177 @@
+package models
+
+/* =========================
+project 		: ipatio-web
+date			: October 2026
+author			: kneerunjun@gmail.com
+Copyrights		: Eensy Machines
+About			: Batch of operations on user accounts, each addressed by email or id.
+Operations run one after the other and the outcome of each is reported back.
+Atomic batches run in a database transaction, either all operations are applied or none.
+Mongo needs a replica set for transactions, on a standalone server atomic batches fail as a whole.
+============================*/
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	BatchDelete     = "delete"      // soft delete the account
+	BatchSuspend    = "suspend"     // suspend with reason, until is optional
+	BatchSetRole    = "set-role"    // change the role, same escalation guards as SetRole
+	BatchSetTelegID = "set-telegid" // change the telegram id
+)
+
+var BatchMaxOps = 500 // largest batch accepted in one go
+
+// errBatchItem : aborts the transaction when one of the operations fails
+var errBatchItem = errors.New("batch operation failed")
+
+type BatchOp struct {
+	Op      string    `json:"op"`
+	Target  string    `json:"target"` // email or hex id of the account
+	Role    *UserRole `json:"role,omitempty"`
+	TelegID int64     `json:"telegid,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+	Until   int64     `json:"until,omitempty"`
+}
+
+// BatchItemResult : outcome of a single operation, Index is 0 based position in the batch
+type BatchItemResult struct {
+	Index  int    `json:"index"`
+	Op     string `json:"op"`
+	Target string `json:"target"`
+	Id     string `json:"id,omitempty"` // hex id of the account the target resolved to
+	Result string `json:"result"`       // done|failed|rolledback|skipped
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type BatchReport struct {
+	Atomic    bool              `json:"atomic"`
+	Committed bool              `json:"committed"` // false when an atomic batch was rolled back
+	Total     int               `json:"total"`
+	Done      int               `json:"done"`
+	Failed    int               `json:"failed"`
+	Items     []BatchItemResult `json:"items"`
+}
+
+func (br *BatchReport) add(i int, op BatchOp, id string, err httperr.HttpErr) {
+	item := BatchItemResult{Index: i, Op: op.Op, Target: op.Target, Id: id, Result: "done"}
+	if err != nil {
+		item.Result, item.Status, item.Error = "failed", err.HttpStatusCode(), err.ClientErrData()
+		br.Failed++
+	} else {
+		br.Done++
+	}
+	br.Items = append(br.Items, item)
+}
+
+// rollback : operations applied before the failing one are undone, the ones after were never attempted
+func (br *BatchReport) rollback() {
+	for i := range br.Items {
+		if br.Items[i].Result == "done" {
+			br.Items[i].Result = "rolledback"
+		}
+	}
+	br.Done = 0
+	br.Committed = false
+}
+
+// applyOp : resolves the target account and applies the operation on it.
+// Caller can only operate on accounts that are strictly below their own role.
+func (u *UsersCollection) applyOp(op BatchOp, callerRole UserRole) (string, httperr.HttpErr) {
+	target := User{}
+	if err := u.LookupUser(op.Target, &target); err != nil {
+		return "", err
+	}
+	id := target.Id.Hex()
+	if target.Role <= callerRole {
+		return id, httperr.ErrForbidden(fmt.Errorf("role %d cannot %s account %s with role %d", callerRole, op.Op, target.Email, target.Role))
+	}
+	switch op.Op {
+	case BatchDelete:
+		return id, u.DeleteUser(id)
+	case BatchSuspend:
+		return id, u.SetStatus(id, StatusSuspended, op.Reason, op.Until, callerRole)
+	case BatchSetRole:
+		if op.Role == nil {
+			return id, httperr.ErrInvalidParam(fmt.Errorf("role missing for %s", op.Op))
+		}
+		return id, u.SetRole(id, *op.Role, callerRole)
+	case BatchSetTelegID:
+		if op.TelegID == 0 {
+			return id, httperr.ErrInvalidParam(fmt.Errorf("telegid missing for %s", op.Op))
+		}
+		return id, u.EditUser(id, "", "", op.TelegID)
+	}
+	return id, httperr.ErrInvalidParam(fmt.Errorf("unknown batch operation %s", op.Op))
+}
+
+// RunBatch : applies the operations in order on behalf of the caller and reports the outcome of each.
+// When not atomic, a failing operation does not stop the ones after it.
+// When atomic, the first failing operation rolls back the whole batch and the remaining are skipped.
+//
+/*
+	claims := c.MustGet("claims").(*models.CustomClaims)
+	report, err := uc.RunBatch([]models.BatchOp{{Op: models.BatchDelete, Target: "johndoe@gmail.com"}}, claims.UserRole, true)
+*/
+func (u *UsersCollection) RunBatch(ops []BatchOp, callerRole UserRole, atomic bool) (*BatchReport, httperr.HttpErr) {
+	if len(ops) == 0 || len(ops) > BatchMaxOps {
+		return nil, httperr.ErrInvalidParam(fmt.Errorf("batch should have 1-%d operations, got %d", BatchMaxOps, len(ops)))
+	}
+	run := func(uc *UsersCollection, report *BatchReport) bool {
+		for i, op := range ops {
+			id, err := uc.applyOp(op, callerRole)
+			if err != nil {
+				err.Log(logrus.WithFields(logrus.Fields{
+					"stack":  "RunBatch",
+					"op":     op.Op,
+					"target": op.Target,
+				}))
+			}
+			report.add(i, op, id, err)
+			if err != nil && atomic {
+				for j := i + 1; j < len(ops); j++ {
+					report.Items = append(report.Items, BatchItemResult{Index: j, Op: ops[j].Op, Target: ops[j].Target, Result: "skipped"})
+				}
+				return false
+			}
+		}
+		return true
+	}
+	if !atomic {
+		report := &BatchReport{Total: len(ops), Committed: true}
+		run(u, report)
+		return report, nil
+	}
+
+	ctx, cancel := context.WithTimeout(u.ctx(), 60*time.Second)
+	defer cancel()
+	sess, err := u.DbColl.Database().Client().StartSession()
+	if err != nil {
+		return nil, httperr.ErrDBQuery(fmt.Errorf("failed RunBatch : %s", err))
+	}
+	defer sess.EndSession(ctx)
+	var report *BatchReport
+	_, err = sess.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		report = &BatchReport{Atomic: true, Total: len(ops), Committed: true} // callback is retried on transient errors, each attempt reports afresh
+		if !run(&UsersCollection{DbColl: u.DbColl, Ctx: sc}, report) {
+			return nil, errBatchItem
+		}
+		return nil, nil
+	})
+	if errors.Is(err, errBatchItem) {
+		report.rollback()
+		return report, nil
+	} else if err != nil {
+		return nil, httperr.ErrDBQuery(fmt.Errorf("failed RunBatch, atomic batches need a replica set : %s", err))
+	}
+	return report, nil
+}
@@ -0,0 +1,189 @@
+package models
+
+/* =========================
+project 		: ipatio-web
+date			: October 2026
+author			: kneerunjun@gmail.com
+Copyrights		: Eensy Machines
+About			: Storage for binary blobs (avatars) behind an interface, either on the local filesystem or GridFS in the database.
+Blobs are small enough to be handled in memory. Keys are slash separated paths, avatars/<id>/<size>
+============================*/
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+type Blob struct {
+	Data        []byte
+	ContentType string
+	ModTime     time.Time
+}
+
+// BlobStore : Put replaces the blob under the key if any, Delete of a missing key is not an error
+type BlobStore interface {
+	Put(key, contentType string, data []byte) error
+	Get(key string) (*Blob, error) // ErrBlobNotFound when missing
+	Delete(key string) error
+}
+
+// LocalBlobStore : blobs as files under Dir, the content type is kept in a .type file alongside
+type LocalBlobStore struct {
+	Dir string
+}
+
+func (lb *LocalBlobStore) path(key string) (string, error) {
+	if key == "" || strings.Contains(key, "..") || strings.HasPrefix(key, "/") {
+		return "", fmt.Errorf("invalid blob key %s", key)
+	}
+	return filepath.Join(lb.Dir, filepath.FromSlash(key)), nil
+}
+
+func (lb *LocalBlobStore) Put(key, contentType string, data []byte) error {
+	p, err := lb.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(p+".type", []byte(contentType), 0o644); err != nil {
+		return err
+	}
+	// written aside and renamed, readers never see a partial blob
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func (lb *LocalBlobStore) Get(key string) (*Blob, error) {
+	p, err := lb.path(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	ct, err := os.ReadFile(p + ".type")
+	if err != nil {
+		return nil, err
+	}
+	return &Blob{Data: data, ContentType: string(ct), ModTime: info.ModTime()}, nil
+}
+
+func (lb *LocalBlobStore) Delete(key string) error {
+	p, err := lb.path(key)
+	if err != nil {
+		return err
+	}
+	for _, f := range []string{p, p + ".type"} {
+		if err := os.Remove(f); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// GridFSBlobStore : blobs in the GridFS bucket of the database, key is the filename and the content type is in the metadata
+type GridFSBlobStore struct {
+	Db     *mongo.Database
+	Bucket string // name of the bucket, default fs
+}
+
+func (gb *GridFSBlobStore) bucket() (*gridfs.Bucket, error) {
+	opts := options.GridFSBucket()
+	if gb.Bucket != "" {
+		opts.SetName(gb.Bucket)
+	}
+	b, err := gridfs.NewBucket(gb.Db, opts)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	b.SetReadDeadline(deadline)
+	b.SetWriteDeadline(deadline)
+	return b, nil
+}
+
+func (gb *GridFSBlobStore) Put(key, contentType string, data []byte) error {
+	b, err := gb.bucket()
+	if err != nil {
+		return err
+	}
+	// new one is in before the old ones go, readers see either of them
+	id, err := b.UploadFromStream(key, bytes.NewReader(data), options.GridFSUpload().SetMetadata(bson.M{"contenttype": contentType}))
+	if err != nil {
+		return err
+	}
+	return gb.deleteAll(b, bson.M{"filename": key, "_id": bson.M{"$ne": id}})
+}
+
+func (gb *GridFSBlobStore) Get(key string) (*Blob, error) {
+	b, err := gb.bucket()
+	if err != nil {
+		return nil, err
+	}
+	ds, err := b.OpenDownloadStreamByName(key) // latest revision
+	if errors.Is(err, gridfs.ErrFileNotFound) {
+		return nil, ErrBlobNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	defer ds.Close()
+	data, err := io.ReadAll(ds)
+	if err != nil {
+		return nil, err
+	}
+	file := ds.GetFile()
+	ct, _ := file.Metadata.Lookup("contenttype").StringValueOK()
+	return &Blob{Data: data, ContentType: ct, ModTime: file.UploadDate}, nil
+}
+
+func (gb *GridFSBlobStore) Delete(key string) error {
+	b, err := gb.bucket()
+	if err != nil {
+		return err
+	}
+	return gb.deleteAll(b, bson.M{"filename": key})
+}
+
+func (gb *GridFSBlobStore) deleteAll(b *gridfs.Bucket, flt bson.M) error {
+	cur, err := b.Find(flt)
+	if err != nil {
+		return err
+	}
+	files := []struct {
+		ID interface{} `bson:"_id"`
+	}{}
+	if err := cur.All(context.Background(), &files); err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := b.Delete(f.ID); err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package models
+
+/* =========================
+project 		: ipatio-web
+date			: October 2026
+author			: kneerunjun@gmail.com
+Copyrights		: Eensy Machines
+About			: First superuser on a fresh deployment. Either created from configuration at startup,
+or by redeeming a one time setup token that is printed in the log. Only the hash of the setup token is stored.
+============================*/
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	setupTokenID = "superuser" // there is only ever one setup token
+)
+
+func (u *UsersCollection) setup() *mongo.Collection {
+	return u.DbColl.Database().Collection("setup")
+}
+
+// HasSuperUser : checks if there is at least one superuser that isnt deleted
+func (u *UsersCollection) HasSuperUser() (bool, httperr.HttpErr) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	count, err := u.DbColl.CountDocuments(ctx, notDeleted(bson.M{"role": SuperUser}))
+	if err != nil {
+		return false, httperr.ErrDBQuery(err)
+	}
+	return count > 0, nil
+}
+
+// BootstrapSuperUser : creates the account as superuser, only if there isnt one already
+func (u *UsersCollection) BootstrapSuperUser(usr *User) httperr.HttpErr {
+	has, err := u.HasSuperUser()
+	if err != nil {
+		return err
+	}
+	if has {
+		return httperr.DuplicateResourceErr(fmt.Errorf("superuser already exists"))
+	}
+	usr.Role = SuperUser
+	usr.Status = StatusActive
+	return u.NewUser(usr)
+}
+
+// NewSetupToken : generates the one time token to create the first superuser, replaces any earlier token
+func (u *UsersCollection) NewSetupToken() (string, httperr.HttpErr) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tok, hash, err := OneTimeToken()
+	if err != nil {
+		return "", AuthTokenErr(err)
+	}
+	_, err = u.setup().ReplaceOne(ctx, bson.M{"_id": setupTokenID}, bson.M{"_id": setupTokenID, "hash": hash, "at": time.Now().Unix()}, options.Replace().SetUpsert(true))
+	if err != nil {
+		return "", httperr.ErrDBQuery(fmt.Errorf("failed NewSetupToken : %s", err))
+	}
+	return tok, nil
+}
+
+// RedeemSetupToken : creates the first superuser against the setup token. The token is consumed on success, it cannot be used again.
+// Incase the account fails validation the token is put back so that the setup can be attempted again
+func (u *UsersCollection) RedeemSetupToken(tok string, usr *User) httperr.HttpErr {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	setupDoc := bson.M{}
+	err := u.setup().FindOneAndDelete(ctx, bson.M{"_id": setupTokenID, "hash": TokenHash(tok)}).Decode(&setupDoc)
+	if err == mongo.ErrNoDocuments {
+		return httperr.ErrForbidden(fmt.Errorf("setup token is invalid or already used"))
+	} else if err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed RedeemSetupToken : %s", err))
+	}
+	if herr := u.BootstrapSuperUser(usr); herr != nil {
+		if _, err := u.setup().InsertOne(ctx, setupDoc); err != nil {
+			return httperr.ErrDBQuery(fmt.Errorf("failed to restore setup token : %s", err))
+		}
+		return herr
+	}
+	return nil
+}
+
+// ClearSetupToken : once there is a superuser the setup token is of no use
+func (u *UsersCollection) ClearSetupToken() httperr.HttpErr {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := u.setup().DeleteOne(ctx, bson.M{"_id": setupTokenID}); err != nil {
+		return httperr.ErrDBQuery(err)
+	}
+	return nil
+}
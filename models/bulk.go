@@ -0,0 +1,377 @@
+package models
+
+/* =========================
+project 		: ipatio-web
+date			: October 2026
+author			: kneerunjun@gmail.com
+Copyrights		: Eensy Machines
+About			: Bulk import and export of users in JSON array, NDJSON and CSV.
+Each row on import is validated as in NewUser, and the outcome of each row is reported back.
+Export never has the password hashes.
+============================*/
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type BulkFormat string
+
+const (
+	FormatJSON   BulkFormat = "json"   // array of user objects
+	FormatNDJSON BulkFormat = "ndjson" // one user object per line
+	FormatCSV    BulkFormat = "csv"    // header row followed by a row per user
+)
+
+func (bf BulkFormat) IsValid() bool {
+	return bf == FormatJSON || bf == FormatNDJSON || bf == FormatCSV
+}
+
+// ImportPolicy : what to do when the email of the row is already registered
+type ImportPolicy string
+
+const (
+	PolicySkip   ImportPolicy = "skip"   // leave the registered account as is
+	PolicyUpsert ImportPolicy = "upsert" // update name, role, telegid and password of the registered account
+)
+
+// columns of the csv, in this order on export. On import the header row decides the order
+var csvColumns = []string{"id", "name", "email", "role", "telegid", "status", "auth"}
+
+type ImportOptions struct {
+	Format     BulkFormat
+	Policy     ImportPolicy
+	DryRun     bool     // validates and reports what would happen, nothing is written
+	PreHashed  bool     // auth is a bcrypt hash and not the clear text password
+	CallerRole UserRole // rows and the accounts they update have to be strictly below this, as for SetRole
+}
+
+// ImportRowResult : outcome of a single row, Row is 1 based and does not count the csv header
+type ImportRowResult struct {
+	Row    int    `json:"row"`
+	Email  string `json:"email"`
+	Result string `json:"result"` // created|updated|skipped|invalid|failed
+	Error  string `json:"error,omitempty"`
+}
+
+type ImportReport struct {
+	DryRun  bool              `json:"dry_run"`
+	Total   int               `json:"total"`
+	Created int               `json:"created"`
+	Updated int               `json:"updated"`
+	Skipped int               `json:"skipped"`
+	Invalid int               `json:"invalid"`
+	Failed  int               `json:"failed"`
+	Rows    []ImportRowResult `json:"rows"`
+}
+
+func (ir *ImportReport) add(row int, email, result string, err error) {
+	rr := ImportRowResult{Row: row, Email: email, Result: result}
+	if err != nil {
+		rr.Error = err.Error()
+	}
+	switch result {
+	case "created":
+		ir.Created++
+	case "updated":
+		ir.Updated++
+	case "skipped":
+		ir.Skipped++
+	case "invalid":
+		ir.Invalid++
+	case "failed":
+		ir.Failed++
+	}
+	ir.Total++
+	ir.Rows = append(ir.Rows, rr)
+}
+
+// importRow : user as read from the input, or why it could not be read
+type importRow struct {
+	usr User
+	err error
+}
+
+// decodeUsers : reads all the rows from the input in the given format.
+// A row that cannot be read is reported as such without failing the rest, except for a malformed json array which fails as a whole
+func decodeUsers(r io.Reader, format BulkFormat) ([]importRow, error) {
+	rows := []importRow{}
+	switch format {
+	case FormatJSON:
+		raw := []json.RawMessage{}
+		if err := json.NewDecoder(r).Decode(&raw); err != nil {
+			return nil, fmt.Errorf("input is not a json array: %s", err)
+		}
+		for _, item := range raw {
+			rows = append(rows, jsonUser(item))
+		}
+	case FormatNDJSON:
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			rows = append(rows, jsonUser([]byte(line)))
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed reading ndjson: %s", err)
+		}
+	case FormatCSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = -1
+		header, err := cr.Read()
+		if err != nil {
+			return nil, fmt.Errorf("failed reading csv header: %s", err)
+		}
+		col := map[string]int{}
+		for i, h := range header {
+			col[strings.ToLower(strings.TrimSpace(h))] = i
+		}
+		for _, required := range []string{"name", "email"} {
+			if _, ok := col[required]; !ok {
+				return nil, fmt.Errorf("csv header is missing column %s", required)
+			}
+		}
+		for {
+			rec, err := cr.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				rows = append(rows, importRow{err: err})
+				continue
+			}
+			rows = append(rows, csvUser(rec, col))
+		}
+	default:
+		return nil, fmt.Errorf("unknown format %s", format)
+	}
+	return rows, nil
+}
+
+// jsonUser : only the fields that are for import are taken from the object, account state is never imported
+func jsonUser(item []byte) importRow {
+	in := User{Role: EndUser}
+	if err := json.Unmarshal(item, &in); err != nil {
+		return importRow{err: err}
+	}
+	return importRow{usr: User{Name: in.Name, Email: in.Email, Role: in.Role, TelegID: in.TelegID, Auth: in.Auth}}
+}
+
+func csvUser(rec []string, col map[string]int) importRow {
+	field := func(name string) string {
+		if i, ok := col[name]; ok && i < len(rec) {
+			return strings.TrimSpace(rec[i])
+		}
+		return ""
+	}
+	usr := User{Name: UserName(field("name")), Email: UserEmail(field("email")), Auth: field("auth"), Role: EndUser}
+	if v := field("role"); v != "" {
+		role, err := strconv.ParseUint(v, 10, 8)
+		if err != nil {
+			return importRow{usr: usr, err: fmt.Errorf("invalid role %s", v)}
+		}
+		usr.Role = UserRole(role)
+	}
+	if v := field("telegid"); v != "" {
+		telegid, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return importRow{usr: usr, err: fmt.Errorf("invalid telegid %s", v)}
+		}
+		usr.TelegID = telegid
+	}
+	return importRow{usr: usr}
+}
+
+// validateImport : same rules as NewUser
+func validateImport(usr *User, opts ImportOptions) error {
+	if !UserName(usr.Name).IsValid() {
+		return fmt.Errorf("invalid name")
+	}
+	email, err := usr.Email.Normalize()
+	if err != nil {
+		return fmt.Errorf("invalid email")
+	}
+	usr.Email = email
+	if !usr.Role.IsValid() {
+		return fmt.Errorf("invalid role %d", usr.Role)
+	}
+	if usr.Role <= opts.CallerRole {
+		return fmt.Errorf("role %d is not below that of the importer", usr.Role)
+	}
+	if usr.Auth == "" {
+		return nil // no password on upsert keeps the one registered, on insert its caught later
+	}
+	if opts.PreHashed {
+		if _, err := bcrypt.Cost([]byte(usr.Auth)); err != nil {
+			return fmt.Errorf("auth is not a bcrypt hash")
+		}
+		return nil
+	}
+	if !UserPassword(usr.Auth).IsValid() {
+		return fmt.Errorf("invalid password")
+	}
+	return nil
+}
+
+// hashImport : clear text password is hashed only right before writing, its the slow part of the import
+func hashImport(usr *User, opts ImportOptions) error {
+	if usr.Auth == "" || opts.PreHashed {
+		return nil
+	}
+	hash, err := UserPassword(usr.Auth).StringHash()
+	if err != nil {
+		return fmt.Errorf("failed to hash password")
+	}
+	usr.Auth = hash
+	return nil
+}
+
+// ImportUsers : reads users from the input and registers them, row by row. Rows that fail do not stop the import.
+// Error is returned only when the input as a whole cannot be read, everything else is in the report
+//
+/*
+	report, err := uc.ImportUsers(f, models.ImportOptions{Format: models.FormatCSV, Policy: models.PolicySkip, CallerRole: claims.UserRole})
+*/
+func (u *UsersCollection) ImportUsers(r io.Reader, opts ImportOptions) (*ImportReport, httperr.HttpErr) {
+	if !opts.Format.IsValid() {
+		return nil, httperr.ErrInvalidParam(fmt.Errorf("invalid import format %s", opts.Format))
+	}
+	if opts.Policy == "" {
+		opts.Policy = PolicySkip
+	}
+	if opts.Policy != PolicySkip && opts.Policy != PolicyUpsert {
+		return nil, httperr.ErrInvalidParam(fmt.Errorf("invalid import policy %s", opts.Policy))
+	}
+	rows, err := decodeUsers(r, opts.Format)
+	if err != nil {
+		return nil, httperr.ErrBinding(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	report := &ImportReport{DryRun: opts.DryRun, Rows: []ImportRowResult{}}
+	seen := map[UserEmail]bool{} // for a dry run, rows earlier in the same input count as registered
+	for i, row := range rows {
+		usr := row.usr
+		if row.err != nil {
+			report.add(i+1, string(usr.Email), "invalid", row.err)
+			continue
+		}
+		if err := validateImport(&usr, opts); err != nil {
+			report.add(i+1, string(usr.Email), "invalid", err)
+			continue
+		}
+		existing := User{}
+		err := u.DbColl.FindOne(ctx, notDeleted(bson.M{"email": usr.Email})).Decode(&existing)
+		if err != nil && err != mongo.ErrNoDocuments {
+			report.add(i+1, string(usr.Email), "failed", err)
+			continue
+		}
+		found := err == nil
+		registered := found || (opts.DryRun && seen[usr.Email])
+		seen[usr.Email] = true
+		switch {
+		case found && existing.Role <= opts.CallerRole:
+			report.add(i+1, string(usr.Email), "invalid", fmt.Errorf("registered account has a role not below that of the importer"))
+		case registered && opts.Policy == PolicySkip:
+			report.add(i+1, string(usr.Email), "skipped", fmt.Errorf("already registered"))
+		case registered:
+			if !opts.DryRun {
+				if err := hashImport(&usr, opts); err != nil {
+					report.add(i+1, string(usr.Email), "failed", err)
+					continue
+				}
+				patch := bson.M{"name": usr.Name, "role": usr.Role, "telegid": usr.TelegID, "updatedat": time.Now().Unix()}
+				if usr.Auth != "" {
+					patch["auth"] = usr.Auth
+				}
+				if _, err := u.DbColl.UpdateOne(ctx, bson.M{"_id": existing.Id}, bson.M{"$set": patch}); err != nil {
+					report.add(i+1, string(usr.Email), "failed", err)
+					continue
+				}
+				if found && (usr.Auth != "" || usr.Role != existing.Role) {
+					// tokens carry the role and were got with the old password
+					if err := u.RevokeTokens(existing.Id.Hex()); err != nil {
+						report.add(i+1, string(usr.Email), "failed", fmt.Errorf("updated but tokens not revoked: %v", err.ClientErrData()))
+						continue
+					}
+				}
+			}
+			report.add(i+1, string(usr.Email), "updated", nil)
+		case usr.Auth == "":
+			report.add(i+1, string(usr.Email), "invalid", fmt.Errorf("password is required for new accounts"))
+		default:
+			usr.Id = primitive.NilObjectID
+			usr.Status = StatusActive
+			usr.CreatedAt, usr.UpdatedAt = time.Now().Unix(), time.Now().Unix()
+			if !opts.DryRun {
+				if err := hashImport(&usr, opts); err != nil {
+					report.add(i+1, string(usr.Email), "failed", err)
+					continue
+				}
+				if _, err := u.DbColl.InsertOne(ctx, usr); mongo.IsDuplicateKeyError(err) {
+					report.add(i+1, string(usr.Email), "skipped", fmt.Errorf("already registered"))
+					continue
+				} else if err != nil {
+					report.add(i+1, string(usr.Email), "failed", err)
+					continue
+				}
+			}
+			report.add(i+1, string(usr.Email), "created", nil)
+		}
+	}
+	return report, nil
+}
+
+// ExportUsers : writes out all the accounts that arent deleted, in the given format. Password hashes are never exported
+func (u *UsersCollection) ExportUsers(w io.Writer, format BulkFormat) httperr.HttpErr {
+	if !format.IsValid() {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid export format %s", format))
+	}
+	usrs, herr := u.ListUsers(0, 0)
+	if herr != nil {
+		return herr
+	}
+	var err error
+	switch format {
+	case FormatJSON:
+		views := make([]AdminView, len(usrs))
+		for i, usr := range usrs {
+			views[i] = AdminView(usr)
+		}
+		err = json.NewEncoder(w).Encode(views)
+	case FormatNDJSON:
+		enc := json.NewEncoder(w)
+		for _, usr := range usrs {
+			if err = enc.Encode(AdminView(usr)); err != nil {
+				break
+			}
+		}
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		cw.Write(csvColumns[:len(csvColumns)-1]) // no auth column
+		for _, usr := range usrs {
+			cw.Write([]string{usr.Id.Hex(), string(usr.Name), string(usr.Email), fmt.Sprint(usr.Role), fmt.Sprint(usr.TelegID), string(usr.CurrentStatus())})
+		}
+		cw.Flush()
+		err = cw.Error()
+	}
+	if err != nil {
+		return httperr.ErrUnMarshal(fmt.Errorf("failed ExportUsers : %s", err))
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package models
+
+/* =========================
+project 		: ipatio-web
+date			: October 2026
+author			: kneerunjun@gmail.com
+Copyrights		: Eensy Machines
+About			: Email is the identity of the account, its validated and normalized the same way wherever its used.
+Parsing is as in RFC 5322 (no display names, no quoted local parts), international domains are stored in their ascii (punycode) form.
+Emails are lowercased, and for the domains that ignore the +tag of the local part the tag is dropped.
+============================*/
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/net/idna"
+)
+
+// PlusFoldingDomains : domains that deliver local+tag@domain to local@domain, the tag is dropped when normalizing
+var PlusFoldingDomains = map[string]bool{
+	"gmail.com":      true,
+	"googlemail.com": true,
+	"outlook.com":    true,
+	"hotmail.com":    true,
+	"icloud.com":     true,
+	"fastmail.com":   true,
+	"protonmail.com": true,
+}
+
+// Normalize : validated email in the form its stored and looked up
+//
+/*
+	e, err := models.UserEmail("First.Last+News@GMail.com").Normalize() // first.last@gmail.com
+	e, err = models.UserEmail("ivan@почта.рф").Normalize() // ivan@xn--80a1acny.xn--p1ai
+*/
+func (ue UserEmail) Normalize() (UserEmail, error) {
+	raw := strings.TrimSpace(string(ue))
+	if len(raw) > 254 || strings.ContainsAny(raw, `"<>`) {
+		return "", fmt.Errorf("invalid email %s", raw)
+	}
+	addr, err := mail.ParseAddress(raw)
+	if err != nil || addr.Name != "" || addr.Address != raw {
+		return "", fmt.Errorf("invalid email %s", raw)
+	}
+	at := strings.LastIndex(addr.Address, "@")
+	local, domain := strings.ToLower(addr.Address[:at]), addr.Address[at+1:]
+	if len(local) == 0 || len(local) > 64 {
+		return "", fmt.Errorf("invalid local part of email %s", raw)
+	}
+	domain, err = idna.Lookup.ToASCII(strings.ToLower(domain))
+	if err != nil || !strings.Contains(domain, ".") || strings.HasSuffix(domain, ".") {
+		return "", fmt.Errorf("invalid domain of email %s", raw)
+	}
+	if PlusFoldingDomains[domain] {
+		if plus := strings.Index(local, "+"); plus > 0 {
+			local = local[:plus]
+		}
+	}
+	return UserEmail(local + "@" + domain), nil
+}
+
+// EmailCollisions : normalized emails that more than one account normalizes to, with the emails as stored.
+// These have to be resolved (deleted/changed) before the emails can be normalized
+func EmailCollisions(ctx context.Context, coll *mongo.Collection) (map[UserEmail][]UserEmail, error) {
+	cur, err := coll.Find(ctx, bson.M{}) // soft deleted accounts hold on to the email as well
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	byNormal := map[UserEmail][]UserEmail{}
+	for cur.Next(ctx) {
+		usr := User{}
+		if err := cur.Decode(&usr); err != nil {
+			return nil, err
+		}
+		normal, err := usr.Email.Normalize()
+		if err != nil {
+			continue // left as is, cannot collide with a valid one
+		}
+		byNormal[normal] = append(byNormal[normal], usr.Email)
+	}
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+	for normal, emails := range byNormal {
+		if len(emails) < 2 {
+			delete(byNormal, normal)
+		}
+	}
+	return byNormal, nil
+}
+
+// normalizeEmails : migration that stores the normalized email for all the accounts.
+// Fails without changing anything if any two accounts would end up with the same email
+func normalizeEmails(ctx context.Context, db *mongo.Database, dryRun bool) (int64, error) {
+	coll := db.Collection("users")
+	collisions, err := EmailCollisions(ctx, coll)
+	if err != nil {
+		return 0, err
+	}
+	if len(collisions) > 0 {
+		list := []string{}
+		for normal, emails := range collisions {
+			list = append(list, fmt.Sprintf("%s <- %v", normal, emails))
+		}
+		return 0, fmt.Errorf("%d emails collide once normalized, resolve them and migrate again: %s", len(collisions), strings.Join(list, "; "))
+	}
+	cur, err := coll.Find(ctx, bson.M{})
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+	var changed int64
+	for cur.Next(ctx) {
+		usr := User{}
+		if err := cur.Decode(&usr); err != nil {
+			return changed, err
+		}
+		normal, err := usr.Email.Normalize()
+		if err != nil || normal == usr.Email {
+			continue
+		}
+		changed++
+		if dryRun {
+			continue
+		}
+		if _, err := coll.UpdateOne(ctx, bson.M{"_id": usr.Id}, bson.M{"$set": bson.M{"email": normal}}); err != nil {
+			return changed, err
+		}
+	}
+	return changed, cur.Err()
+}
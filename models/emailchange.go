@@ -0,0 +1,100 @@
+package models
+
+/* =========================
+project 		: ipatio-web
+date			: October 2026
+author			: kneerunjun@gmail.com
+Copyrights		: Eensy Machines
+About			: Email change - account holder asks for a new email, which takes effect only once the one time token sent to the new email is used.
+Tokens issued to the account before the change are revoked, since they carry the old email.
+============================*/
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	EmailChangeTTL = 24 * time.Hour // email change links expire after this
+)
+
+// RequestEmailChange : records the new email as pending against the account, sends back the one time token that confirms it.
+// A request made again replaces the earlier one. Email is checked for duplicates here, and again on confirmation
+//
+/*
+	usr := models.User{}
+	tok, err := uc.RequestEmailChange(usrIdHex, "johndoe@newemployer.com", &usr)
+	notifier.Notify(usr.PendingEmail, "Confirm your new email", fmt.Sprintf("%s/%s", emailChangeURL, tok))
+	notifier.Notify(usr.Email, "Your email is being changed", "...")
+*/
+func (u *UsersCollection) RequestEmailChange(objIdHex string, newEmail UserEmail, result *User) (string, httperr.HttpErr) {
+	email, err := newEmail.Normalize()
+	if err != nil {
+		return "", httperr.ErrInvalidParam(fmt.Errorf("invalid email for user"))
+	}
+	if err := u.FindUser(objIdHex, result); err != nil {
+		return "", err
+	}
+	if result.Email == email {
+		return "", httperr.ErrInvalidParam(fmt.Errorf("new email is the same as the current one"))
+	}
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	cnt, err := u.DbColl.CountDocuments(ctx, bson.M{"email": email})
+	if err != nil {
+		return "", httperr.ErrDBQuery(err)
+	}
+	if cnt != 0 {
+		return "", httperr.DuplicateResourceErr(fmt.Errorf("email %s already registered", email))
+	}
+	tok, hash, err := OneTimeToken()
+	if err != nil {
+		return "", AuthTokenErr(err)
+	}
+	result.PendingEmail, result.EmailChangeHash, result.EmailChangeExp = email, hash, time.Now().Add(EmailChangeTTL).Unix()
+	_, err = u.DbColl.UpdateOne(ctx, bson.M{"_id": result.Id}, bson.M{"$set": bson.M{
+		"pendingemail": result.PendingEmail,
+		"emailchghash": result.EmailChangeHash,
+		"emailchgexp":  result.EmailChangeExp,
+	}})
+	if err != nil {
+		return "", httperr.ErrDBQuery(fmt.Errorf("failed RequestEmailChange : %s", err))
+	}
+	return tok, nil
+}
+
+// ConfirmEmailChange : switches the account to the pending email, the token cannot be used again.
+// Fails as duplicate if the email was registered by another account in the meantime, tokens of the account are revoked
+func (u *UsersCollection) ConfirmEmailChange(tok string, result *User) httperr.HttpErr {
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	hash := TokenHash(tok)
+	err := u.DbColl.FindOne(ctx, notDeleted(bson.M{"emailchghash": hash, "emailchgexp": bson.M{"$gt": time.Now().Unix()}})).Decode(result)
+	if err == mongo.ErrNoDocuments {
+		return httperr.ErrResourceNotFound(fmt.Errorf("email change is invalid, used or expired"))
+	} else if err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed ConfirmEmailChange : %s", err))
+	}
+	now := time.Now().Unix()
+	updated, err := u.DbColl.UpdateOne(ctx, bson.M{"_id": result.Id, "emailchghash": hash}, bson.M{
+		"$set":   bson.M{"email": result.PendingEmail, "emailverifiedat": now},
+		"$unset": bson.M{"pendingemail": "", "emailchghash": "", "emailchgexp": ""},
+		"$inc":   bson.M{"tokgen": 1},
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return httperr.DuplicateResourceErr(fmt.Errorf("email %s already registered", result.PendingEmail))
+	} else if err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed ConfirmEmailChange : %s", err))
+	}
+	if updated.MatchedCount == 0 {
+		return httperr.ErrResourceNotFound(fmt.Errorf("email change is invalid, used or expired"))
+	}
+	result.Email, result.EmailVerifiedAt = result.PendingEmail, now
+	result.TokenGen++
+	result.PendingEmail, result.EmailChangeHash, result.EmailChangeExp = "", "", 0
+	return nil
+}
@@ -20,8 +20,57 @@ var (
 	AuthTokenErr = func(e error) httperr.HttpErr {
 		return (&eGenTokenFail{}).SetInternal(e)
 	}
+	// account status does not allow login / access
+	SuspendedAccErr = func(e error) httperr.HttpErr {
+		return (&eAccSuspended{}).SetInternal(e)
+	}
+	LockedAccErr = func(e error) httperr.HttpErr {
+		return (&eAccLocked{}).SetInternal(e)
+	}
+	PendingAccErr = func(e error) httperr.HttpErr {
+		return (&eAccPending{}).SetInternal(e)
+	}
+	DisabledAccErr = func(e error) httperr.HttpErr {
+		return (&eAccDisabled{}).SetInternal(e)
+	}
+	// the only superuser cannot be demoted/deleted
+	LastSuperUserErr = func(e error) httperr.HttpErr {
+		return (&eLastSuperUser{}).SetInternal(e)
+	}
+	// another instance holds the migrations lock
+	MigrationLockedErr = func(e error) httperr.HttpErr {
+		return (&eMigrationLocked{}).SetInternal(e)
+	}
+	// identity provider could not be reached or sent back something that cannot be trusted
+	FederationErr = func(e error) httperr.HttpErr {
+		return (&eFederation{}).SetInternal(e)
+	}
+	// session cookie sent without the CSRF token of the session
+	CSRFErr = func(e error) httperr.HttpErr {
+		return (&eCSRF{}).SetInternal(e)
+	}
+	// errors of the oauth endpoints, code is as in RFC 6749 ex: invalid_grant, invalid_client
+	OAuthErr = func(code string, e error) httperr.HttpErr {
+		return (&OAuthError{Code: code}).SetInternal(e)
+	}
 )
 
+// AccountStatusErr : error corresponding to the status of the account, nil for active accounts
+func AccountStatusErr(usr *User) httperr.HttpErr {
+	e := fmt.Errorf("account %s is %s", usr.Email, usr.CurrentStatus())
+	switch usr.CurrentStatus() {
+	case StatusSuspended:
+		return SuspendedAccErr(e)
+	case StatusLocked:
+		return LockedAccErr(e)
+	case StatusPending:
+		return PendingAccErr(e)
+	case StatusDisabled:
+		return DisabledAccErr(e)
+	}
+	return nil
+}
+
 type eInvalidToken struct {
 	Internal error
 }
@@ -34,6 +83,44 @@ type eGenTokenFail struct {
 	Internal error
 }
 
+type eAccSuspended struct {
+	Internal error
+}
+
+type eAccLocked struct {
+	Internal error
+}
+
+type eAccPending struct {
+	Internal error
+}
+
+type eAccDisabled struct {
+	Internal error
+}
+
+type eLastSuperUser struct {
+	Internal error
+}
+
+type eMigrationLocked struct {
+	Internal error
+}
+
+type eFederation struct {
+	Internal error
+}
+
+type eCSRF struct {
+	Internal error
+}
+
+// OAuthError : exported so the oauth endpoints can send it back as {"error", "error_description"}
+type OAuthError struct {
+	Code     string
+	Internal error
+}
+
 func (it *eInvalidToken) Error() string {
 	return fmt.Sprintf("Failed to generate token: %s", it.Internal)
 }
@@ -103,3 +190,219 @@ func (gt *eGenTokenFail) ClientErrData() string {
 func (gt *eGenTokenFail) HttpStatusCode() int {
 	return http.StatusInternalServerError
 }
+
+func (as *eAccSuspended) Error() string {
+	return fmt.Sprintf("Account suspended: %s", as.Internal)
+}
+func (as *eAccSuspended) SetInternal(ie error) httperr.HttpErr {
+	if ie == nil {
+		return nil
+	}
+	as.Internal = ie
+	return as
+}
+func (as *eAccSuspended) Log(le *log.Entry) httperr.HttpErr {
+	le.WithFields(log.Fields{
+		"internal_err": as.Internal,
+	}).Error("account suspended")
+	return as
+}
+func (as *eAccSuspended) ClientErrData() string {
+	return "Your account has been suspended, contact an admin for details"
+}
+func (as *eAccSuspended) HttpStatusCode() int {
+	return http.StatusForbidden
+}
+
+func (al *eAccLocked) Error() string {
+	return fmt.Sprintf("Account locked: %s", al.Internal)
+}
+func (al *eAccLocked) SetInternal(ie error) httperr.HttpErr {
+	if ie == nil {
+		return nil
+	}
+	al.Internal = ie
+	return al
+}
+func (al *eAccLocked) Log(le *log.Entry) httperr.HttpErr {
+	le.WithFields(log.Fields{
+		"internal_err": al.Internal,
+	}).Error("account locked")
+	return al
+}
+func (al *eAccLocked) ClientErrData() string {
+	return "Your account is locked, contact an admin to unlock it"
+}
+func (al *eAccLocked) HttpStatusCode() int {
+	return http.StatusLocked
+}
+
+func (ap *eAccPending) Error() string {
+	return fmt.Sprintf("Account pending: %s", ap.Internal)
+}
+func (ap *eAccPending) SetInternal(ie error) httperr.HttpErr {
+	if ie == nil {
+		return nil
+	}
+	ap.Internal = ie
+	return ap
+}
+func (ap *eAccPending) Log(le *log.Entry) httperr.HttpErr {
+	le.WithFields(log.Fields{
+		"internal_err": ap.Internal,
+	}).Error("account pending activation")
+	return ap
+}
+func (ap *eAccPending) ClientErrData() string {
+	return "Your account isnt activated yet, complete the activation and try again"
+}
+func (ap *eAccPending) HttpStatusCode() int {
+	return http.StatusForbidden
+}
+
+func (ad *eAccDisabled) Error() string {
+	return fmt.Sprintf("Account disabled: %s", ad.Internal)
+}
+func (ad *eAccDisabled) SetInternal(ie error) httperr.HttpErr {
+	if ie == nil {
+		return nil
+	}
+	ad.Internal = ie
+	return ad
+}
+func (ad *eAccDisabled) Log(le *log.Entry) httperr.HttpErr {
+	le.WithFields(log.Fields{
+		"internal_err": ad.Internal,
+	}).Error("account disabled")
+	return ad
+}
+func (ad *eAccDisabled) ClientErrData() string {
+	return "Your account has been disabled"
+}
+func (ad *eAccDisabled) HttpStatusCode() int {
+	return http.StatusForbidden
+}
+
+func (ls *eLastSuperUser) Error() string {
+	return fmt.Sprintf("Last superuser: %s", ls.Internal)
+}
+func (ls *eLastSuperUser) SetInternal(ie error) httperr.HttpErr {
+	if ie == nil {
+		return nil
+	}
+	ls.Internal = ie
+	return ls
+}
+func (ls *eLastSuperUser) Log(le *log.Entry) httperr.HttpErr {
+	le.WithFields(log.Fields{
+		"internal_err": ls.Internal,
+	}).Error("attempt to remove the last superuser")
+	return ls
+}
+func (ls *eLastSuperUser) ClientErrData() string {
+	return "This is the only superuser account, it cannot be demoted or deleted"
+}
+func (ls *eLastSuperUser) HttpStatusCode() int {
+	return http.StatusConflict
+}
+
+func (ml *eMigrationLocked) Error() string {
+	return fmt.Sprintf("Migrations locked: %s", ml.Internal)
+}
+func (ml *eMigrationLocked) SetInternal(ie error) httperr.HttpErr {
+	if ie == nil {
+		return nil
+	}
+	ml.Internal = ie
+	return ml
+}
+func (ml *eMigrationLocked) Log(le *log.Entry) httperr.HttpErr {
+	le.WithFields(log.Fields{
+		"internal_err": ml.Internal,
+	}).Error("migrations are locked")
+	return ml
+}
+func (ml *eMigrationLocked) ClientErrData() string {
+	return "Migrations are running elsewhere, try again once they are done"
+}
+func (ml *eMigrationLocked) HttpStatusCode() int {
+	return http.StatusConflict
+}
+
+func (fe *eFederation) Error() string {
+	return fmt.Sprintf("Federated login failed: %s", fe.Internal)
+}
+func (fe *eFederation) SetInternal(ie error) httperr.HttpErr {
+	if ie == nil {
+		return nil
+	}
+	fe.Internal = ie
+	return fe
+}
+func (fe *eFederation) Log(le *log.Entry) httperr.HttpErr {
+	le.WithFields(log.Fields{
+		"internal_err": fe.Internal,
+	}).Error("federated login failed")
+	return fe
+}
+func (fe *eFederation) ClientErrData() string {
+	return "Failed to sign in with the identity provider, try again or use another way to login"
+}
+func (fe *eFederation) HttpStatusCode() int {
+	return http.StatusBadGateway
+}
+
+func (ec *eCSRF) Error() string {
+	return fmt.Sprintf("CSRF check failed: %s", ec.Internal)
+}
+func (ec *eCSRF) SetInternal(ie error) httperr.HttpErr {
+	if ie == nil {
+		return nil
+	}
+	ec.Internal = ie
+	return ec
+}
+func (ec *eCSRF) Log(le *log.Entry) httperr.HttpErr {
+	le.WithFields(log.Fields{
+		"internal_err": ec.Internal,
+	}).Error("csrf check failed")
+	return ec
+}
+func (ec *eCSRF) ClientErrData() string {
+	return "Request did not carry the CSRF token of your session, reload the page and try again"
+}
+func (ec *eCSRF) HttpStatusCode() int {
+	return http.StatusForbidden
+}
+
+func (oe *OAuthError) Error() string {
+	return fmt.Sprintf("%s: %s", oe.Code, oe.Internal)
+}
+func (oe *OAuthError) SetInternal(ie error) httperr.HttpErr {
+	if ie == nil {
+		return nil
+	}
+	oe.Internal = ie
+	return oe
+}
+func (oe *OAuthError) Log(le *log.Entry) httperr.HttpErr {
+	le.WithFields(log.Fields{
+		"internal_err": oe.Internal,
+		"code":         oe.Code,
+	}).Error("oauth request failed")
+	return oe
+}
+func (oe *OAuthError) ClientErrData() string {
+	return oe.Internal.Error() // description of what was wrong with the request, meant for the client developer
+}
+func (oe *OAuthError) HttpStatusCode() int {
+	switch oe.Code {
+	case "invalid_client", "invalid_token":
+		return http.StatusUnauthorized
+	case "access_denied", "insufficient_scope":
+		return http.StatusForbidden
+	case "server_error":
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,534 @@
+package models
+
+/* =========================
+project 		: ipatio-web
+date			: October 2026
+author			: kneerunjun@gmail.com
+Copyrights		: Eensy Machines
+About			: Login with external OpenID Connect providers (Google Workspace, Microsoft ..), configured from a json file.
+An external identity (issuer + subject) is linked to an account either by the account holder from a logged in session, or on the first login
+when the provider vouches for the email of an existing account that has itself verified the email. Providers can provision accounts just in time with a default role.
+Accounts provisioned this way have no password, their last identity cannot be unlinked.
+============================*/
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"github.com/golang-jwt/jwt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	FederatedLogin       = "login"       // identity was already linked
+	FederatedLinked      = "linked"      // identity linked to an existing account
+	FederatedProvisioned = "provisioned" // account created for the identity
+)
+
+var (
+	// callback of a provider is <this>/<provider>/callback, its what has to be registered with the provider
+	FederationCallbackURL = "http://localhost:8080/api/federation"
+	FederationStateTTL    = 10 * time.Minute // login at the provider has to be completed within this
+	IdentityProviders     = map[string]*IdentityProvider{}
+	idpNameRegex          = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,31}$`)
+)
+
+// ExternalIdentity : account at an identity provider linked to the account here, issuer and subject identify it
+type ExternalIdentity struct {
+	Provider string    `bson:"provider" json:"provider"`
+	Issuer   string    `bson:"issuer" json:"issuer"`
+	Subject  string    `bson:"subject" json:"subject"`
+	Email    UserEmail `bson:"email,omitempty" json:"email,omitempty"` // as the provider had it when linked, for display
+	LinkedAt int64     `bson:"linkedat" json:"linked_at"`
+}
+
+// IdentityProvider : upstream OIDC provider as configured, its endpoints are discovered from the issuer
+type IdentityProvider struct {
+	Name          string       `json:"name"` // as in the urls ex: google
+	Issuer        string       `json:"issuer"`
+	ClientID      string       `json:"client_id"`
+	ClientSecret  string       `json:"client_secret"`
+	Scopes        []string     `json:"scopes"`         // openid email profile if not set
+	AutoProvision bool         `json:"auto_provision"` // accounts are created on the first login
+	DefaultRole   UserRole     `json:"default_role"`   // of the accounts provisioned, EndUser or Guest
+	Domains       []string     `json:"domains"`        // only emails of these domains are provisioned or linked by email, any if empty
+	HTTPClient    *http.Client `json:"-"`
+
+	mu   sync.Mutex
+	meta *providerMeta
+	keys map[string]*rsa.PublicKey // by kid, from the jwks of the provider
+}
+
+// providerMeta : what is needed from the discovery document of the provider
+type providerMeta struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// ExternalClaims : what the provider says about the account, from its verified ID token
+type ExternalClaims struct {
+	Issuer        string
+	Subject       string
+	Email         UserEmail
+	EmailVerified bool
+	Name          string
+}
+
+// LoadIdentityProviders : providers from the json file, which is a list of IdentityProvider
+func LoadIdentityProviders(path string) error {
+	byt, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read identity providers: %s", err)
+	}
+	providers := []*IdentityProvider{}
+	if err := json.Unmarshal(byt, &providers); err != nil {
+		return fmt.Errorf("failed to read identity providers: %s", err)
+	}
+	result := map[string]*IdentityProvider{}
+	for _, p := range providers {
+		if err := p.validate(); err != nil {
+			return err
+		}
+		if _, ok := result[p.Name]; ok {
+			return fmt.Errorf("identity provider %s is configured twice", p.Name)
+		}
+		result[p.Name] = p
+	}
+	IdentityProviders = result
+	return nil
+}
+
+func (p *IdentityProvider) validate() error {
+	if !idpNameRegex.MatchString(p.Name) {
+		return fmt.Errorf("invalid identity provider name %s, should be 2-32 lowercase letters, digits and -", p.Name)
+	}
+	p.Issuer = strings.TrimSuffix(p.Issuer, "/")
+	if !validRedirectURI(p.Issuer) || p.ClientID == "" {
+		return fmt.Errorf("identity provider %s needs an https issuer and client_id", p.Name)
+	}
+	if p.AutoProvision && (p.DefaultRole < EndUser || !p.DefaultRole.IsValid()) {
+		return fmt.Errorf("identity provider %s can provision only EndUser or Guest accounts", p.Name)
+	}
+	if len(p.Scopes) == 0 {
+		p.Scopes = []string{"openid", "email", "profile"}
+	}
+	return nil
+}
+
+// CallbackURL : where the provider sends the user agent back with the code
+func (p *IdentityProvider) CallbackURL() string {
+	return FederationCallbackURL + "/" + p.Name + "/callback"
+}
+
+// allowsDomain : email is of one of the domains of the provider
+func (p *IdentityProvider) allowsDomain(email UserEmail) bool {
+	if len(p.Domains) == 0 {
+		return true
+	}
+	at := strings.LastIndex(string(email), "@")
+	for _, d := range p.Domains {
+		if at >= 0 && strings.EqualFold(string(email)[at+1:], d) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *IdentityProvider) getJSON(uri string, result interface{}) error {
+	client := p.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Get(uri)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded %d", uri, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// discover : endpoints of the provider, fetched once
+func (p *IdentityProvider) discover() (*providerMeta, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta != nil {
+		return p.meta, nil
+	}
+	meta := &providerMeta{}
+	if err := p.getJSON(p.Issuer+"/.well-known/openid-configuration", meta); err != nil {
+		return nil, fmt.Errorf("discovery of %s failed: %s", p.Name, err)
+	}
+	if strings.TrimSuffix(meta.Issuer, "/") != p.Issuer || meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery of %s is incomplete or for another issuer", p.Name)
+	}
+	p.meta = meta
+	return meta, nil
+}
+
+// publicKey : key of the provider for verifying its ID tokens, jwks is fetched again for a kid not seen before since the provider may have rotated
+func (p *IdentityProvider) publicKey(kid string) (*rsa.PublicKey, error) {
+	meta, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	jwks := struct {
+		Keys []JWK `json:"keys"`
+	}{}
+	if err := p.getJSON(meta.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("jwks of %s failed: %s", p.Name, err)
+	}
+	p.keys = map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		p.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown key %s of %s", kid, p.Name)
+}
+
+// exchange : code for the ID token of the account at the provider, the ID token is verified
+func (p *IdentityProvider) exchange(code, verifier, nonce string) (*ExternalClaims, error) {
+	meta, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	client := p.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.PostForm(meta.TokenEndpoint, url.Values{
+		"grant_type":    {GrantAuthorizationCode},
+		"code":          {code},
+		"redirect_uri":  {p.CallbackURL()},
+		"code_verifier": {verifier},
+		"client_id":     {p.ClientID},
+		"client_secret": {p.ClientSecret},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("token request to %s failed: %s", p.Name, err)
+	}
+	defer resp.Body.Close()
+	tok := struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil || resp.StatusCode != http.StatusOK || tok.IDToken == "" {
+		return nil, fmt.Errorf("token request to %s responded %d %s", p.Name, resp.StatusCode, tok.Error)
+	}
+	return p.verifyIDToken(tok.IDToken, nonce)
+}
+
+// verifyIDToken : signature against the jwks of the provider, issuer, audience, expiry and the nonce sent in the authorization request
+func (p *IdentityProvider) verifyIDToken(raw, nonce string) (*ExternalClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method %s", t.Header["alg"])
+		}
+		kid, _ := t.Header["kid"].(string)
+		return p.publicKey(kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token from %s: %s", p.Name, err)
+	}
+	if !claims.VerifyIssuer(p.Issuer, true) || !claims.VerifyAudience(p.ClientID, true) {
+		return nil, fmt.Errorf("ID token from %s is for another issuer or audience", p.Name)
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, fmt.Errorf("ID token from %s has the wrong nonce", p.Name)
+	}
+	ext := &ExternalClaims{Issuer: p.Issuer}
+	ext.Subject, _ = claims["sub"].(string)
+	if ext.Subject == "" {
+		return nil, fmt.Errorf("ID token from %s has no subject", p.Name)
+	}
+	email, _ := claims["email"].(string)
+	ext.Email = UserEmail(email)
+	switch v := claims["email_verified"].(type) { // some providers send it as a string
+	case bool:
+		ext.EmailVerified = v
+	case string:
+		ext.EmailVerified = v == "true"
+	}
+	ext.Name, _ = claims["name"].(string)
+	return ext, nil
+}
+
+// federationState : login at the provider in progress, by the hash of the state sent along
+type federationState struct {
+	Hash     string             `bson:"_id"`
+	Provider string             `bson:"provider"`
+	Nonce    string             `bson:"nonce"`
+	Verifier string             `bson:"verifier"`
+	Link     primitive.ObjectID `bson:"link,omitempty"` // account that asked to link the identity, zero for logins
+	Browser  string             `bson:"browser"`        // hash of the token in the cookie of the browser that started the login
+	ExpireAt time.Time          `bson:"expireat"`
+}
+
+func (u *UsersCollection) federationStates() *mongo.Collection {
+	return u.DbColl.Database().Collection("federation_states")
+}
+
+// EnsureFederationIndexes : logins not completed are removed by mongo once they expire
+func (u *UsersCollection) EnsureFederationIndexes() error {
+	ctx, cancel := context.WithTimeout(u.ctx(), 60*time.Second)
+	defer cancel()
+	_, err := u.federationStates().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"expireat": 1},
+		Options: options.Index().SetName("expireat_ttl").SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create federation_states indexes: %s", err)
+	}
+	return nil
+}
+
+// BeginFederation : url of the provider to send the user agent to, for login or to link the identity to the account when link is set.
+// Browser token goes into a cookie of the user agent, callbacks that do not bring it back are refused so that nobody can land a victim in their own login
+//
+/*
+	redirect, browser, err := uc.BeginFederation("google", primitive.NilObjectID)
+	// cookie with browser, HttpOnly and for FederationStateTTL
+	c.Redirect(http.StatusFound, redirect)
+*/
+func (u *UsersCollection) BeginFederation(provider string, link primitive.ObjectID) (string, string, httperr.HttpErr) {
+	p, ok := IdentityProviders[provider]
+	if !ok {
+		return "", "", httperr.ErrResourceNotFound(fmt.Errorf("identity provider %s is not configured", provider))
+	}
+	meta, err := p.discover()
+	if err != nil {
+		return "", "", FederationErr(err)
+	}
+	state, hash, err := OneTimeToken()
+	if err != nil {
+		return "", "", AuthTokenErr(err)
+	}
+	browser, browserHash, err := OneTimeToken()
+	if err != nil {
+		return "", "", AuthTokenErr(err)
+	}
+	nonce, _, err := OneTimeToken()
+	if err != nil {
+		return "", "", AuthTokenErr(err)
+	}
+	verifier, _, err := OneTimeToken()
+	if err != nil {
+		return "", "", AuthTokenErr(err)
+	}
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	if _, err := u.federationStates().InsertOne(ctx, federationState{
+		Hash: hash, Provider: p.Name, Nonce: nonce, Verifier: verifier, Link: link, Browser: browserHash, ExpireAt: time.Now().Add(FederationStateTTL),
+	}); err != nil {
+		return "", "", httperr.ErrDBQuery(fmt.Errorf("failed BeginFederation : %s", err))
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.CallbackURL()},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.AuthorizationEndpoint + sep + q.Encode(), browser, nil
+}
+
+// CompleteFederation : callback from the provider, the account is found by the identity, linked or provisioned as the case may be.
+// Sends back the account with a token issued, and which of FederatedLogin, FederatedLinked, FederatedProvisioned it was.
+// browser is the token from the cookie set by BeginFederation, state is not taken up when it does not match
+//
+/*
+	usr, how, err := uc.CompleteFederation("google", c.Query("state"), browserCookie, c.Query("code"))
+*/
+func (u *UsersCollection) CompleteFederation(provider, state, browser, code string) (*User, string, httperr.HttpErr) {
+	p, ok := IdentityProviders[provider]
+	if !ok {
+		return nil, "", httperr.ErrResourceNotFound(fmt.Errorf("identity provider %s is not configured", provider))
+	}
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	st := federationState{}
+	err := u.federationStates().FindOneAndDelete(ctx, bson.M{"_id": TokenHash(state), "provider": p.Name, "browser": TokenHash(browser)}).Decode(&st)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, "", InvalidTokenErr(fmt.Errorf("login with %s is invalid, used, expired or was not started from this browser", p.Name))
+	} else if err != nil {
+		return nil, "", httperr.ErrDBQuery(fmt.Errorf("failed CompleteFederation : %s", err))
+	}
+	if st.ExpireAt.Before(time.Now()) {
+		return nil, "", InvalidTokenErr(fmt.Errorf("login with %s is invalid, used or expired", p.Name))
+	}
+	ext, err := p.exchange(code, st.Verifier, st.Nonce)
+	if err != nil {
+		return nil, "", FederationErr(err)
+	}
+	if email, err := ext.Email.Normalize(); err == nil {
+		ext.Email = email
+	}
+	identity := ExternalIdentity{Provider: p.Name, Issuer: ext.Issuer, Subject: ext.Subject, Email: ext.Email, LinkedAt: time.Now().Unix()}
+
+	usr, how := &User{}, FederatedLogin
+	err = u.DbColl.FindOne(ctx, notDeleted(bson.M{"identities": bson.M{"$elemMatch": bson.M{"issuer": ext.Issuer, "subject": ext.Subject}}})).Decode(usr)
+	switch {
+	case err == nil:
+		if !st.Link.IsZero() && st.Link != usr.Id {
+			return nil, "", httperr.DuplicateResourceErr(fmt.Errorf("identity at %s is linked to another account", p.Name))
+		}
+	case !errors.Is(err, mongo.ErrNoDocuments):
+		return nil, "", httperr.ErrDBQuery(fmt.Errorf("failed CompleteFederation : %s", err))
+	case !st.Link.IsZero():
+		if herr := u.FindUser(st.Link.Hex(), usr); herr != nil {
+			return nil, "", herr
+		}
+		how = FederatedLinked
+	case ext.EmailVerified && p.allowsDomain(ext.Email) && u.LookupUser(string(ext.Email), usr) == nil:
+		if usr.EmailVerifiedAt == 0 {
+			// anyone could have signed up with the email, linking it would hand the identity to them
+			return nil, "", httperr.ErrForbidden(fmt.Errorf("email %s of the account is not verified, login and link the identity at %s from the account", usr.Email, p.Name))
+		}
+		how = FederatedLinked // provider and the account both vouch for the email
+	case p.AutoProvision && p.allowsDomain(ext.Email):
+		if herr := u.provisionUser(p, ext, identity, usr); herr != nil {
+			return nil, "", herr
+		}
+		how = FederatedProvisioned
+	default:
+		return nil, "", httperr.ErrForbidden(fmt.Errorf("no account for the identity at %s, login and link it from the account", p.Name))
+	}
+	if how == FederatedLinked {
+		if herr := u.linkIdentity(usr, identity); herr != nil {
+			return nil, "", herr
+		}
+	}
+	if herr := AccountStatusErr(usr); herr != nil {
+		return nil, "", herr
+	}
+	u.touchLogin(usr)
+	if herr := u.IssueToken(usr); herr != nil {
+		return nil, "", herr
+	}
+	return usr, how, nil
+}
+
+// linkIdentity : adds the identity to the account, unique index on the identities stops it from being linked to two accounts
+func (u *UsersCollection) linkIdentity(usr *User, identity ExternalIdentity) httperr.HttpErr {
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	result, err := u.DbColl.UpdateOne(ctx, bson.M{"_id": usr.Id, "identities.provider": bson.M{"$ne": identity.Provider}}, bson.M{
+		"$push": bson.M{"identities": identity},
+		"$set":  bson.M{"updatedat": time.Now().Unix()},
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return httperr.DuplicateResourceErr(fmt.Errorf("identity at %s is linked to another account", identity.Provider))
+	} else if err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed to link identity : %s", err))
+	}
+	if result.MatchedCount == 0 {
+		return httperr.DuplicateResourceErr(fmt.Errorf("%s already has an identity linked at %s, unlink it first", usr.Email, identity.Provider))
+	}
+	usr.Identities = append(usr.Identities, identity)
+	return nil
+}
+
+var nonNameRegex = regexp.MustCompile(`[^a-zA-Z\s]+`)
+
+// provisionUser : account for the identity, with the default role of the provider and no password
+func (u *UsersCollection) provisionUser(p *IdentityProvider, ext *ExternalClaims, identity ExternalIdentity, result *User) httperr.HttpErr {
+	if !ext.Email.IsValid() {
+		return httperr.ErrForbidden(fmt.Errorf("identity at %s has no email, cannot provision an account", p.Name))
+	}
+	name := UserName(strings.TrimSpace(nonNameRegex.ReplaceAllString(ext.Name, " ")))
+	if !name.IsValid() { // name from the local part of the email ex: jane.doe -> jane doe
+		name = UserName(strings.TrimSpace(nonNameRegex.ReplaceAllString(strings.SplitN(string(ext.Email), "@", 2)[0], " ")))
+	}
+	if !name.IsValid() {
+		name = "Federated User"
+	}
+	now := time.Now().Unix()
+	*result = User{
+		Name: name, Email: ext.Email, Role: p.DefaultRole, Status: StatusActive,
+		CreatedAt: now, UpdatedAt: now, Identities: []ExternalIdentity{identity},
+	}
+	if ext.EmailVerified {
+		result.EmailVerifiedAt = now
+	}
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	insertResult, err := u.DbColl.InsertOne(ctx, result)
+	if mongo.IsDuplicateKeyError(err) {
+		return httperr.ErrForbidden(fmt.Errorf("email %s is registered, login and link the identity at %s from the account", ext.Email, p.Name))
+	} else if err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed to provision account : %s", err))
+	}
+	result.Id = insertResult.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// UnlinkIdentity : takes the identity at the provider off the account. Accounts without a password have to keep at least one
+func (u *UsersCollection) UnlinkIdentity(objIdHex, provider string) httperr.HttpErr {
+	usr := User{}
+	if err := u.FindUser(objIdHex, &usr); err != nil {
+		return err
+	}
+	found := false
+	for _, id := range usr.Identities {
+		found = found || id.Provider == provider
+	}
+	if !found {
+		return httperr.ErrResourceNotFound(fmt.Errorf("%s has no identity linked at %s", usr.Email, provider))
+	}
+	if usr.Auth == "" && len(usr.Identities) == 1 {
+		return httperr.ErrForbidden(fmt.Errorf("%s has no password, cannot unlink the only identity", usr.Email))
+	}
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	if _, err := u.DbColl.UpdateOne(ctx, bson.M{"_id": usr.Id}, bson.M{
+		"$pull": bson.M{"identities": bson.M{"provider": provider}},
+		"$set":  bson.M{"updatedat": time.Now().Unix()},
+	}); err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed UnlinkIdentity : %s", err))
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package models
+
+/* =========================
+project 		: ipatio-web
+date			: October 2026
+author			: kneerunjun@gmail.com
+Copyrights		: Eensy Machines
+About			: Forward authentication for the reverse proxies (Traefik forwardAuth, nginx auth_request) in front of the internal dashboards.
+Proxy asks before every request upstream, the policy from the config decides by host, path and method what role or permission the token needs.
+Requests that no rule matches are denied, a catch all rule at the end of the policy is how everything else is let through.
+============================*/
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/eensymachines-in/errx/httperr"
+)
+
+// ForwardAuthPolicy : rules in the order they are matched, first one that matches the request decides. Loaded from FORWARD_AUTH_POLICY
+var ForwardAuthPolicy = []PolicyRule{}
+
+// PolicyRule : who can make the request upstream, public rules let through without a token
+//
+/*
+	[
+		{"host": "grafana.internal", "path": "/public/*", "public": true},
+		{"host": "grafana.internal", "path": "/api/*", "methods": ["POST", "PUT", "DELETE"], "role": 1},
+		{"path": "/*", "role": 2, "permission": "dashboards:read"}
+	]
+*/
+type PolicyRule struct {
+	Host       string     `json:"host"`       // without the port, any host if empty
+	Path       string     `json:"path"`       // exact, or a prefix when it ends with *
+	Methods    []string   `json:"methods"`    // any method if empty
+	Public     bool       `json:"public"`     // no token needed
+	Role       *UserRole  `json:"role"`       // least privileged role that is let through, pointer since SuperUser is 0
+	Permission Permission `json:"permission"` // optional, needed over and above the role
+}
+
+// ForwardRequest : request the proxy is asking about, as from the X-Forwarded-* headers
+type ForwardRequest struct {
+	Host   string
+	Method string
+	URI    string
+	Token  string // Authorization header or the cookie, empty if neither
+}
+
+// LoadForwardAuthPolicy : policy from the json file, which is a list of PolicyRule
+func LoadForwardAuthPolicy(file string) error {
+	byt, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read forward auth policy: %s", err)
+	}
+	rules := []PolicyRule{}
+	if err := json.Unmarshal(byt, &rules); err != nil {
+		return fmt.Errorf("failed to read forward auth policy: %s", err)
+	}
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return fmt.Errorf("forward auth policy rule %d: %s", i, err)
+		}
+	}
+	ForwardAuthPolicy = rules
+	return nil
+}
+
+func (r *PolicyRule) validate() error {
+	if !strings.HasPrefix(r.Path, "/") {
+		return fmt.Errorf("path %s should start with /", r.Path)
+	}
+	for i, m := range r.Methods {
+		r.Methods[i] = strings.ToUpper(m)
+	}
+	r.Host = strings.ToLower(r.Host)
+	if r.Public {
+		if r.Role != nil || r.Permission != "" {
+			return fmt.Errorf("public rule for %s cannot need a role or permission", r.Path)
+		}
+		return nil
+	}
+	if r.Role == nil || !r.Role.IsValid() {
+		return fmt.Errorf("rule for %s needs a valid role", r.Path)
+	}
+	if r.Permission != "" && !r.Permission.IsValid() {
+		return fmt.Errorf("invalid permission %s for %s", r.Permission, r.Path)
+	}
+	return nil
+}
+
+// matches : uri is cleaned before matching so that /public/../admin is not taken for /public/*
+func (r *PolicyRule) matches(host, method, uri string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if r.Host != "" && r.Host != strings.ToLower(host) {
+		return false
+	}
+	if len(r.Methods) > 0 {
+		found := false
+		for _, m := range r.Methods {
+			found = found || m == method
+		}
+		if !found {
+			return false
+		}
+	}
+	if i := strings.IndexAny(uri, "?#"); i >= 0 {
+		uri = uri[:i]
+	}
+	uri = path.Clean("/" + uri)
+	if prefix := strings.TrimSuffix(r.Path, "*"); prefix != r.Path {
+		return strings.HasPrefix(uri, prefix) || uri+"/" == prefix
+	}
+	return uri == r.Path
+}
+
+// MatchPolicy : first rule of the policy that matches the request, nil if none does
+func MatchPolicy(host, method, uri string) *PolicyRule {
+	method = strings.ToUpper(method)
+	for i := range ForwardAuthPolicy {
+		if ForwardAuthPolicy[i].matches(host, method, uri) {
+			return &ForwardAuthPolicy[i]
+		}
+	}
+	return nil
+}
+
+// ForwardAuth : decides if the request can go upstream, claims and account are for the identity headers.
+// 401 when the token is missing or not valid, the proxy can send the browser to login. 403 when the token isnt enough for the rule
+// Account is nil for client credentials tokens, claims are nil too for public rules when there isnt a valid token
+//
+/*
+	claims, usr, err := uc.ForwardAuth(&models.ForwardRequest{Host: "grafana.internal", Method: "GET", URI: "/d/pond-levels", Token: tok})
+*/
+func (u *UsersCollection) ForwardAuth(req *ForwardRequest) (*CustomClaims, *User, httperr.HttpErr) {
+	rule := MatchPolicy(req.Host, req.Method, req.URI)
+	if rule == nil {
+		return nil, nil, httperr.ErrForbidden(fmt.Errorf("no forward auth rule for %s %s%s", req.Method, req.Host, req.URI))
+	}
+	if req.Token == "" {
+		if rule.Public {
+			return nil, nil, nil
+		}
+		return nil, nil, httperr.ErrAuthentication(fmt.Errorf("no token for %s %s%s", req.Method, req.Host, req.URI))
+	}
+	claims, usr, err := u.AuthorizeUser(req.Token)
+	if err != nil {
+		if rule.Public && err.HttpStatusCode() < http.StatusInternalServerError {
+			return nil, nil, nil // identity is only a nicety on public paths
+		}
+		if err.HttpStatusCode() < http.StatusInternalServerError {
+			return nil, nil, httperr.ErrAuthentication(fmt.Errorf("token for %s %s%s: %s", req.Method, req.Host, req.URI, err.ClientErrData()))
+		}
+		return nil, nil, err
+	}
+	if rule.Public {
+		return claims, usr, nil
+	}
+	if claims.UserRole > *rule.Role {
+		return nil, nil, httperr.ErrForbidden(fmt.Errorf("role %d cannot %s %s%s, requires %d", claims.UserRole, req.Method, req.Host, req.URI, *rule.Role))
+	}
+	if rule.Permission != "" {
+		allowed := false
+		if claims.ClientID != "" {
+			allowed = claims.ScopeGrants(rule.Permission)
+		} else {
+			ep, err := u.Effective(usr)
+			if err != nil {
+				return nil, nil, err
+			}
+			allowed = ep.Allows(rule.Permission)
+		}
+		if !allowed {
+			return nil, nil, httperr.ErrForbidden(fmt.Errorf("%s %s%s needs permission %s", req.Method, req.Host, req.URI, rule.Permission))
+		}
+	}
+	return claims, usr, nil
+}
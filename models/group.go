@@ -0,0 +1,339 @@
+package models
+
+/* =========================
+project 		: ipatio-web
+date			: October 2026
+author			: kneerunjun@gmail.com
+Copyrights		: Eensy Machines
+About			: Named groups of accounts for assigning permissions (and optionally a role) in bulk.
+Effective permissions of an account are the union of its direct grants and those of its groups.
+Effective role is the highest of its own role and the roles of its groups, its what the token carries.
+============================*/
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Permission : resource:action, either part can be * ex: devices:read, devices:*, reports:export
+type Permission string
+
+var permRegex = regexp.MustCompile(`^([a-z][a-z0-9_-]{0,31}|\*):([a-z][a-z0-9_-]{0,31}|\*)$`)
+
+func (p Permission) IsValid() bool {
+	return permRegex.MatchString(string(p))
+}
+
+// Grants : this permission covers the one asked for, accounting for the wildcards
+func (p Permission) Grants(asked Permission) bool {
+	have, want := strings.SplitN(string(p), ":", 2), strings.SplitN(string(asked), ":", 2)
+	if len(have) != 2 || len(want) != 2 {
+		return false
+	}
+	return (have[0] == "*" || have[0] == want[0]) && (have[1] == "*" || have[1] == want[1])
+}
+
+// validPermissions : de-duplicated and sorted, error on the first invalid one
+func validPermissions(perms []Permission) ([]Permission, error) {
+	set := map[Permission]bool{}
+	for _, p := range perms {
+		if !p.IsValid() {
+			return nil, fmt.Errorf("invalid permission %s, should be resource:action", p)
+		}
+		set[p] = true
+	}
+	result := []Permission{}
+	for p := range set {
+		result = append(result, p)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result, nil
+}
+
+// Group : role is optional, nil when the group grants only permissions
+type Group struct {
+	Id          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Name        string             `bson:"name" json:"name"`
+	Description string             `bson:"description,omitempty" json:"description,omitempty"`
+	Permissions []Permission       `bson:"permissions" json:"permissions"`
+	Role        *UserRole          `bson:"role,omitempty" json:"role,omitempty"`
+	CreatedAt   int64              `bson:"createdat" json:"created_at"`
+	UpdatedAt   int64              `bson:"updatedat" json:"updated_at"`
+}
+
+var groupNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9 _-]{1,63}$`)
+
+// GroupsCollection : the groups, membership is kept on the account
+type GroupsCollection struct {
+	DbColl *mongo.Collection
+}
+
+// EnsureIndexes : name is unique
+func (gc *GroupsCollection) EnsureIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	_, err := gc.DbColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"name": 1},
+		Options: options.Index().SetName("name_unique").SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create groups indexes: %s", err)
+	}
+	return nil
+}
+
+// validate : name, permissions and the role against that of the caller, the group cannot grant a role at or above the caller
+func (g *Group) validate(callerRole UserRole) httperr.HttpErr {
+	if !groupNameRegex.MatchString(g.Name) {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid group name %s", g.Name))
+	}
+	perms, err := validPermissions(g.Permissions)
+	if err != nil {
+		return httperr.ErrInvalidParam(err)
+	}
+	g.Permissions = perms
+	if g.Role != nil {
+		if !g.Role.IsValid() {
+			return httperr.ErrInvalidParam(fmt.Errorf("invalid role %d", *g.Role))
+		}
+		if *g.Role <= callerRole {
+			return httperr.ErrForbidden(fmt.Errorf("role %d cannot create group with role %d", callerRole, *g.Role))
+		}
+	}
+	return nil
+}
+
+// NewGroup : inserts the group, name has to be unique
+//
+/*
+	role := models.EndUser
+	g := models.Group{Name: "pond-operators", Permissions: []models.Permission{"devices:read", "devices:write"}, Role: &role}
+	err := gc.NewGroup(&g, claims.UserRole)
+*/
+func (gc *GroupsCollection) NewGroup(g *Group, callerRole UserRole) httperr.HttpErr {
+	if err := g.validate(callerRole); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	g.Id = primitive.NilObjectID
+	g.CreatedAt, g.UpdatedAt = time.Now().Unix(), time.Now().Unix()
+	result, err := gc.DbColl.InsertOne(ctx, g)
+	if mongo.IsDuplicateKeyError(err) {
+		return httperr.DuplicateResourceErr(fmt.Errorf("group %s already exists", g.Name))
+	} else if err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed NewGroup : %s", err))
+	}
+	g.Id = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// FindGroup : group from its hex object id
+func (gc *GroupsCollection) FindGroup(objIdHex string, result *Group) httperr.HttpErr {
+	oid, err := primitive.ObjectIDFromHex(objIdHex)
+	if err != nil {
+		return httperr.ErrInvalidParam(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = gc.DbColl.FindOne(ctx, bson.M{"_id": oid}).Decode(result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return httperr.ErrResourceNotFound(fmt.Errorf("group %s was not found", objIdHex))
+	} else if err != nil {
+		return httperr.ErrDBQuery(err)
+	}
+	return nil
+}
+
+// ListGroups : groups sorted by name, all of them when ids is nil
+func (gc *GroupsCollection) ListGroups(ids []primitive.ObjectID) ([]Group, httperr.HttpErr) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	flt := bson.M{}
+	if ids != nil {
+		flt["_id"] = bson.M{"$in": ids}
+	}
+	cur, err := gc.DbColl.Find(ctx, flt, options.Find().SetSort(bson.M{"name": 1}))
+	if err != nil {
+		return nil, httperr.ErrDBQuery(err)
+	}
+	result := []Group{}
+	if err := cur.All(ctx, &result); err != nil {
+		return nil, httperr.ErrDBQuery(err)
+	}
+	return result, nil
+}
+
+// UpdateGroup : replaces name, description, permissions and role of the group.
+// Groups with a role at or above the caller cannot be changed. Tokens of the members are revoked when the role changes
+func (gc *GroupsCollection) UpdateGroup(g *Group, callerRole UserRole, uc *UsersCollection) httperr.HttpErr {
+	existing := Group{}
+	if err := gc.FindGroup(g.Id.Hex(), &existing); err != nil {
+		return err
+	}
+	if existing.Role != nil && *existing.Role <= callerRole {
+		return httperr.ErrForbidden(fmt.Errorf("role %d cannot change group %s with role %d", callerRole, existing.Name, *existing.Role))
+	}
+	if err := g.validate(callerRole); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	g.CreatedAt, g.UpdatedAt = existing.CreatedAt, time.Now().Unix()
+	_, err := gc.DbColl.ReplaceOne(ctx, bson.M{"_id": g.Id}, g)
+	if mongo.IsDuplicateKeyError(err) {
+		return httperr.DuplicateResourceErr(fmt.Errorf("group %s already exists", g.Name))
+	} else if err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed UpdateGroup : %s", err))
+	}
+	if (existing.Role == nil) != (g.Role == nil) || (g.Role != nil && *g.Role != *existing.Role) {
+		return uc.revokeGroupTokens(g.Id)
+	}
+	return nil
+}
+
+// RemoveGroup : deletes the group and takes its members out of it, tokens of the members are revoked if the group had a role
+func (gc *GroupsCollection) RemoveGroup(objIdHex string, callerRole UserRole, uc *UsersCollection) httperr.HttpErr {
+	g := Group{}
+	if err := gc.FindGroup(objIdHex, &g); err != nil {
+		return err
+	}
+	if g.Role != nil && *g.Role <= callerRole {
+		return httperr.ErrForbidden(fmt.Errorf("role %d cannot remove group %s with role %d", callerRole, g.Name, *g.Role))
+	}
+	if g.Role != nil {
+		if err := uc.revokeGroupTokens(g.Id); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := uc.DbColl.UpdateMany(ctx, bson.M{"groups": g.Id}, bson.M{"$pull": bson.M{"groups": g.Id}}); err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed to remove members of group %s : %s", g.Name, err))
+	}
+	if _, err := gc.DbColl.DeleteOne(ctx, bson.M{"_id": g.Id}); err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed RemoveGroup : %s", err))
+	}
+	return nil
+}
+
+// revokeGroupTokens : role of the members may have changed, they have to login again
+func (u *UsersCollection) revokeGroupTokens(gid primitive.ObjectID) httperr.HttpErr {
+	ctx, cancel := context.WithTimeout(u.ctx(), 30*time.Second)
+	defer cancel()
+	if _, err := u.DbColl.UpdateMany(ctx, bson.M{"groups": gid}, bson.M{"$inc": bson.M{"tokgen": 1}}); err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed to revoke tokens of group members : %s", err))
+	}
+	return nil
+}
+
+// SetGroupMember : adds the account to the group or takes it out. Groups with a role at or above the caller are out of reach,
+// and so are accounts at or above the caller. Tokens of the account are revoked if the group has a role
+//
+/*
+	err := uc.SetGroupMember(groupIdHex, usrIdHex, true, &gc, claims.UserRole)
+*/
+func (u *UsersCollection) SetGroupMember(groupIdHex, objIdHex string, member bool, gc *GroupsCollection, callerRole UserRole) httperr.HttpErr {
+	g := Group{}
+	if err := gc.FindGroup(groupIdHex, &g); err != nil {
+		return err
+	}
+	target := User{}
+	if err := u.FindUser(objIdHex, &target); err != nil {
+		return err
+	}
+	if (g.Role != nil && *g.Role <= callerRole) || target.Role <= callerRole {
+		return httperr.ErrForbidden(fmt.Errorf("role %d cannot change membership of %s in group %s", callerRole, target.Email, g.Name))
+	}
+	update := bson.M{"$addToSet": bson.M{"groups": g.Id}}
+	if !member {
+		update = bson.M{"$pull": bson.M{"groups": g.Id}}
+	}
+	update["$set"] = bson.M{"updatedat": time.Now().Unix()}
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	if _, err := u.DbColl.UpdateOne(ctx, bson.M{"_id": target.Id}, update); err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed SetGroupMember : %s", err))
+	}
+	if g.Role != nil {
+		return u.RevokeTokens(objIdHex)
+	}
+	return nil
+}
+
+// SetPermissions : replaces the direct grants of the account, only for accounts strictly below the caller
+func (u *UsersCollection) SetPermissions(objIdHex string, perms []Permission, callerRole UserRole) httperr.HttpErr {
+	perms, err := validPermissions(perms)
+	if err != nil {
+		return httperr.ErrInvalidParam(err)
+	}
+	target := User{}
+	if err := u.FindUser(objIdHex, &target); err != nil {
+		return err
+	}
+	if target.Role <= callerRole {
+		return httperr.ErrForbidden(fmt.Errorf("role %d cannot grant permissions to %s", callerRole, target.Email))
+	}
+	return u.updateProfile(objIdHex, bson.M{"permissions": perms}, nil)
+}
+
+// EffectivePermissions : what the account can do and where it comes from, for debugging grants
+type EffectivePermissions struct {
+	User        string       `json:"user"`
+	Role        UserRole     `json:"role"` // own role of the account
+	EffRole     UserRole     `json:"effective_role"`
+	Direct      []Permission `json:"direct"`
+	Groups      []Group      `json:"groups"`
+	Permissions []Permission `json:"permissions"` // union of direct and group grants
+}
+
+// Allows : any of the permissions grants the one asked for
+func (ep *EffectivePermissions) Allows(asked Permission) bool {
+	for _, p := range ep.Permissions {
+		if p.Grants(asked) {
+			return true
+		}
+	}
+	return false
+}
+
+// Effective : effective role and permissions of the account from its own and those of its groups
+//
+/*
+	ep, err := uc.Effective(&usr)
+	if ep.Allows("devices:write") {
+	}
+*/
+func (u *UsersCollection) Effective(usr *User) (*EffectivePermissions, httperr.HttpErr) {
+	ep := &EffectivePermissions{User: usr.Id.Hex(), Role: usr.Role, EffRole: usr.Role, Direct: usr.Permissions, Groups: []Group{}}
+	if ep.Direct == nil {
+		ep.Direct = []Permission{}
+	}
+	all := append([]Permission{}, usr.Permissions...)
+	if len(usr.Groups) > 0 {
+		gc := GroupsCollection{DbColl: u.DbColl.Database().Collection("groups")}
+		groups, err := gc.ListGroups(usr.Groups)
+		if err != nil {
+			return nil, err
+		}
+		ep.Groups = groups
+		for _, g := range groups {
+			all = append(all, g.Permissions...)
+			if g.Role != nil && *g.Role < ep.EffRole {
+				ep.EffRole = *g.Role
+			}
+		}
+	}
+	ep.Permissions, _ = validPermissions(all) // stored ones are already valid
+	return ep, nil
+}
@@ -0,0 +1,62 @@
+package models
+
+/* =========================
+project 		: ipatio-web
+date			: October 2026
+author			: kneerunjun@gmail.com
+Copyrights		: Eensy Machines
+About			: Indexes on the users collection that the service relies on, created at startup.
+Email is unique irrespective of the case, which is what stops concurrent signups from registering the same email twice.
+============================*/
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// EmailCollation : case insensitive comparison of emails, queries that need the email index to be used should set this collation
+var EmailCollation = &options.Collation{Locale: "en", Strength: 2}
+
+// EnsureIndexes : idempotent, fails if the existing accounts violate the unique email index
+func (u *UsersCollection) EnsureIndexes() error {
+	ctx, cancel := context.WithTimeout(u.ctx(), 60*time.Second)
+	defer cancel()
+	_, err := u.DbColl.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "email", Value: 1}},
+			Options: options.Index().SetName("email_unique_ci").SetUnique(true).SetCollation(EmailCollation),
+		},
+		{
+			Keys:    bson.D{{Key: "telegid", Value: 1}},
+			Options: options.Index().SetName("telegid"),
+		},
+		{
+			Keys:    bson.D{{Key: "role", Value: 1}},
+			Options: options.Index().SetName("role"),
+		},
+		{
+			Keys:    bson.D{{Key: "orgs.org", Value: 1}},
+			Options: options.Index().SetName("orgs"),
+		},
+		{
+			Keys:    bson.D{{Key: "groups", Value: 1}},
+			Options: options.Index().SetName("groups"),
+		},
+		{
+			// an identity at a provider logs into only one account
+			Keys: bson.D{{Key: "identities.issuer", Value: 1}, {Key: "identities.subject", Value: 1}},
+			Options: options.Index().SetName("identities_unique").SetUnique(true).
+				SetPartialFilterExpression(bson.D{{Key: "identities.subject", Value: bson.D{{Key: "$exists", Value: true}}}}),
+		},
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("accounts with duplicate emails exist, resolve them before the unique email index can be created: %s", err)
+	} else if err != nil {
+		return fmt.Errorf("failed to create users indexes: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package models
+
+/* =========================
+project 		: ipatio-web
+date			: October 2026
+author			: kneerunjun@gmail.com
+Copyrights		: Eensy Machines
+About			: Token introspection as in RFC 7662, for the services that sit behind this one and need to know who a token belongs to.
+A token is active only when it would pass authorization right now, so revoked tokens, removed clients and suspended accounts all read as inactive.
+============================*/
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Introspection : response of the introspection endpoint, only active is sent for tokens that are not active
+type Introspection struct {
+	Active    bool      `json:"active"`
+	Scope     string    `json:"scope,omitempty"`
+	ClientID  string    `json:"client_id,omitempty"`
+	Username  string    `json:"username,omitempty"`
+	TokenType string    `json:"token_type,omitempty"`
+	Exp       int64     `json:"exp,omitempty"`
+	Iat       int64     `json:"iat,omitempty"`
+	Sub       string    `json:"sub,omitempty"`
+	Aud       string    `json:"aud,omitempty"`
+	Iss       string    `json:"iss,omitempty"`
+	Jti       string    `json:"jti,omitempty"`
+	Email     string    `json:"email,omitempty"`
+	Role      *UserRole `json:"role,omitempty"` // pointer since SuperUser is 0
+	Org       string    `json:"org,omitempty"`
+	OrgRole   *UserRole `json:"org_role,omitempty"`
+}
+
+// Introspect : state of an access token or an oauth refresh token, hint as in token_type_hint only decides what is tried first.
+// Tokens that fail authorization are inactive and not an error, error is only when the state cannot be known
+//
+/*
+	result, err := uc.Introspect(c.PostForm("token"), c.PostForm("token_type_hint"))
+	if err != nil {
+		// 500 - database is down
+	}
+	c.JSON(http.StatusOK, result) // {"active": false} for an expired token
+*/
+func (u *UsersCollection) Introspect(tok, hint string) (*Introspection, httperr.HttpErr) {
+	if hint == "refresh_token" {
+		if result, err := u.introspectRefresh(tok); err != nil || result.Active {
+			return result, err
+		}
+		return u.introspectAccess(tok)
+	}
+	if result, err := u.introspectAccess(tok); err != nil || result.Active {
+		return result, err
+	}
+	return u.introspectRefresh(tok)
+}
+
+// introspectAccess : access tokens are active as long as AuthorizeClaims lets them through
+func (u *UsersCollection) introspectAccess(tok string) (*Introspection, httperr.HttpErr) {
+	claims, err := u.AuthorizeClaims(tok)
+	if err != nil {
+		if err.HttpStatusCode() >= http.StatusInternalServerError {
+			return nil, err
+		}
+		return &Introspection{Active: false}, nil
+	}
+	role := claims.UserRole
+	result := &Introspection{
+		Active:    true,
+		Scope:     claims.Scope,
+		ClientID:  claims.ClientID,
+		TokenType: "Bearer",
+		Exp:       claims.ExpiresAt,
+		Iat:       claims.IssuedAt,
+		Aud:       claims.Audience,
+		Iss:       claims.Issuer,
+		Jti:       claims.Id,
+		Role:      &role,
+	}
+	if claims.User == "" {
+		result.Sub = claims.Subject // client credentials, the client is the subject
+		return result, nil
+	}
+	usr := User{}
+	if err := u.LookupUser(claims.User, &usr); err != nil {
+		if err.HttpStatusCode() == http.StatusNotFound {
+			return &Introspection{Active: false}, nil
+		}
+		return nil, err
+	}
+	result.Sub, result.Username, result.Email = usr.Id.Hex(), string(usr.Email), string(usr.Email)
+	if claims.Org != "" {
+		orgRole := claims.OrgRole
+		result.Org, result.OrgRole = claims.Org, &orgRole
+	}
+	return result, nil
+}
+
+// introspectRefresh : refresh tokens are active till they expire or are used, for an account that can still get tokens
+func (u *UsersCollection) introspectRefresh(tok string) (*Introspection, httperr.HttpErr) {
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	stored := oauthRefresh{}
+	err := u.oauthColl("oauth_tokens").FindOne(ctx, bson.M{"_id": TokenHash(tok)}).Decode(&stored)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return &Introspection{Active: false}, nil
+	} else if err != nil {
+		return nil, httperr.ErrDBQuery(fmt.Errorf("failed introspectRefresh : %s", err))
+	}
+	if stored.ExpireAt.Before(time.Now()) {
+		return &Introspection{Active: false}, nil
+	}
+	cl := OAuthClient{}
+	err = u.oauthColl("oauth_clients").FindOne(ctx, bson.M{"_id": stored.Client}).Decode(&cl)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return &Introspection{Active: false}, nil
+	} else if err != nil {
+		return nil, httperr.ErrDBQuery(fmt.Errorf("failed introspectRefresh : %s", err))
+	}
+	usr, herr := u.oauthAccount(stored.User, stored.Gen)
+	if herr != nil {
+		if herr.HttpStatusCode() >= http.StatusInternalServerError {
+			return nil, herr
+		}
+		return &Introspection{Active: false}, nil
+	}
+	scope, role, herr := u.regrantScopes(stored.Scope, &cl, usr)
+	if herr != nil {
+		if herr.HttpStatusCode() >= http.StatusInternalServerError {
+			return nil, herr
+		}
+		return &Introspection{Active: false}, nil // scopes are no longer registered for the client
+	}
+	return &Introspection{
+		Active:    true,
+		Scope:     scope,
+		ClientID:  cl.Id,
+		Username:  string(usr.Email),
+		TokenType: "refresh_token",
+		Exp:       stored.ExpireAt.Unix(),
+		Sub:       usr.Id.Hex(),
+		Aud:       cl.Id,
+		Iss:       "patio-web server",
+		Email:     string(usr.Email),
+		Role:      &role,
+	}, nil
+}
@@ -0,0 +1,124 @@
+package models
+
+/* =========================
+project 		: ipatio-web
+date			: October 2026
+author			: kneerunjun@gmail.com
+Copyrights		: Eensy Machines
+About			: Invitations - admin creates a pending account without a password, the account holder gets a one time link to set the password which activates the account.
+============================*/
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	InviteTTL = 72 * time.Hour // invitation links expire after this
+)
+
+// OneTimeToken : random token for links sent out to account holders, sends back the token and its hash. Only the hash is to be stored
+func OneTimeToken() (string, string, error) {
+	byt := make([]byte, 32)
+	if _, err := rand.Read(byt); err != nil {
+		return "", "", err
+	}
+	tok := hex.EncodeToString(byt)
+	return tok, TokenHash(tok), nil
+}
+
+// TokenHash : one time tokens are looked up by their hash
+func TokenHash(tok string) string {
+	h := sha256.Sum256([]byte(tok))
+	return hex.EncodeToString(h[:])
+}
+
+// InviteUser : inserts a pending account with no password, sends back the one time token that activates it.
+// Role of the user is as set by the caller, name and email are validated as for NewUser
+//
+/*
+	usr := User{Email:"johndoe@gmail.com", Name: "John Doe", Role: models.Admin}
+	tok, err := uc.InviteUser(&usr)
+	notifier.Notify(usr.Email, "You are invited", fmt.Sprintf("%s/%s", inviteURL, tok))
+*/
+func (u *UsersCollection) InviteUser(usr *User) (string, httperr.HttpErr) {
+	if !UserName(usr.Name).IsValid() {
+		return "", httperr.ErrInvalidParam(fmt.Errorf("invalid name of the user"))
+	}
+	email, err := usr.Email.Normalize()
+	if err != nil {
+		return "", httperr.ErrInvalidParam(fmt.Errorf("invalid email for user"))
+	}
+	usr.Email = email
+	if !usr.Role.IsValid() {
+		return "", httperr.ErrInvalidParam(fmt.Errorf("invalid role for user"))
+	}
+	tok, hash, err := OneTimeToken()
+	if err != nil {
+		return "", AuthTokenErr(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	usr.Auth = ""
+	usr.Status = StatusPending
+	usr.InviteHash = hash
+	usr.InviteExp = time.Now().Add(InviteTTL).Unix()
+	usr.CreatedAt, usr.UpdatedAt = time.Now().Unix(), time.Now().Unix()
+	insertResult, err := u.DbColl.InsertOne(ctx, usr)
+	if mongo.IsDuplicateKeyError(err) {
+		return "", httperr.DuplicateResourceErr(fmt.Errorf("User already registered"))
+	} else if err != nil {
+		return "", httperr.ErrDBQuery(fmt.Errorf("failed InviteUser : %s", err))
+	}
+	usr.Id = insertResult.InsertedID.(primitive.ObjectID)
+	return tok, nil
+}
+
+// AcceptInvite : sets the password of the invited account and activates it, the token cannot be used again
+func (u *UsersCollection) AcceptInvite(tok, passwd string, result *User) httperr.HttpErr {
+	up := UserPassword(passwd)
+	if !up.IsValid() {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid password for user"))
+	}
+	hashedPasswd, err := up.StringHash()
+	if err != nil {
+		return httperr.ErrInvalidParam(fmt.Errorf("error generating the hash of the password"))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	flt := notDeleted(bson.M{"invitehash": TokenHash(tok), "status": StatusPending, "inviteexp": bson.M{"$gt": time.Now().Unix()}})
+	err = u.DbColl.FindOneAndUpdate(ctx, flt, bson.M{
+		"$set":   bson.M{"auth": hashedPasswd, "status": StatusActive, "emailverifiedat": time.Now().Unix()},
+		"$unset": bson.M{"invitehash": "", "inviteexp": ""},
+	}).Decode(result)
+	if err == mongo.ErrNoDocuments {
+		return httperr.ErrResourceNotFound(fmt.Errorf("invitation is invalid, used or expired"))
+	} else if err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed AcceptInvite : %s", err))
+	}
+	return nil
+}
+
+// deletePendingInvite : accounts invited but never activated hold nothing worth restoring, they are removed outright so that the email can be invited again.
+// false when the filter does not match such an account
+func (u *UsersCollection) deletePendingInvite(flt bson.M) (bool, httperr.HttpErr) {
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	pending := bson.M{"status": StatusPending, "invitehash": bson.M{"$exists": true}}
+	for k, v := range flt {
+		pending[k] = v
+	}
+	result, err := u.DbColl.DeleteOne(ctx, u.inScope(notDeleted(pending)))
+	if err != nil {
+		return false, httperr.ErrDBQuery(fmt.Errorf("failed deletePendingInvite : %s", err))
+	}
+	return result.DeletedCount > 0, nil
+}
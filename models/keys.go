@@ -0,0 +1,173 @@
+package models
+
+/* =========================
+project 		: ipatio-web
+date			: October 2026
+author			: kneerunjun@gmail.com
+Copyrights		: Eensy Machines
+About			: Rotating keys for signing the jwt. Tokens carry the key id (kid) in the header, so tokens signed with a retired key
+are still verified till they expire, or RetiredKeyGrace after the key was retired. Without any key in the store, JWTSigningKey is used as before,
+once there is a key tokens without kid are rejected.
+============================*/
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"github.com/golang-jwt/jwt"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	TokenTTL        = 10 * time.Minute // tokens expire after this
+	RetiredKeyGrace = 24 * time.Hour   // retired keys are kept around for verification this long, well beyond TokenTTL
+)
+
+// SigningKey : secret for HS256 signing, only one is active at a time
+type SigningKey struct {
+	Kid       string `bson:"_id"`
+	Secret    string `bson:"secret"`
+	CreatedAt int64  `bson:"createdat"`
+	RetiredAt int64  `bson:"retiredat,omitempty"` // absent for the active key
+}
+
+func (u *UsersCollection) keys() *mongo.Collection {
+	return u.DbColl.Database().Collection("keys")
+}
+
+// activeKey : key for signing new tokens, kid is empty when falling back on JWTSigningKey
+func (u *UsersCollection) activeKey() (string, []byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	key := SigningKey{}
+	err := u.keys().FindOne(ctx, bson.M{"retiredat": bson.M{"$exists": false}}, options.FindOne().SetSort(bson.M{"createdat": -1})).Decode(&key)
+	if err == mongo.ErrNoDocuments {
+		return "", []byte(JWTSigningKey), nil
+	} else if err != nil {
+		return "", nil, err
+	}
+	return key.Kid, []byte(key.Secret), nil
+}
+
+// verificationKey : jwt.Keyfunc, picks the key by the kid in the token header
+func (u *UsersCollection) verificationKey(t *jwt.Token) (interface{}, error) {
+	if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("unexpected signing method %s", t.Header["alg"])
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	kid, _ := t.Header["kid"].(string)
+	if kid == "" {
+		// JWTSigningKey is only for deployments that never rotated, once a key is in the store tokens without kid are forged or stale
+		n, err := u.keys().CountDocuments(ctx, bson.M{})
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			return nil, fmt.Errorf("token without kid, signing keys are in the store")
+		}
+		return []byte(JWTSigningKey), nil
+	}
+	key := SigningKey{}
+	if err := u.keys().FindOne(ctx, bson.M{"_id": kid}).Decode(&key); err != nil {
+		return nil, fmt.Errorf("unknown signing key %s", kid)
+	}
+	if key.RetiredAt != 0 && key.RetiredAt < time.Now().Add(-RetiredKeyGrace).Unix() {
+		return nil, fmt.Errorf("signing key %s retired beyond the grace period", kid)
+	}
+	return []byte(key.Secret), nil
+}
+
+// userClaims : claims of the token for the account, with its effective role and the org it acts in.
+// Token acts in usr.ActiveOrg, or the first org of the account if not set
+func (u *UsersCollection) userClaims(usr *User) (*CustomClaims, httperr.HttpErr) {
+	claims := &CustomClaims{
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(TokenTTL).Unix(),
+			IssuedAt:  time.Now().Unix(),
+			Issuer:    "patio-web server",
+			Subject:   "User authorization request",
+		},
+		User:     string(usr.Email),
+		UserRole: usr.Role,
+		Gen:      usr.TokenGen,
+	}
+	if len(usr.Groups) > 0 {
+		ep, err := u.Effective(usr)
+		if err != nil {
+			return nil, err
+		}
+		claims.UserRole = ep.EffRole // groups can only raise the role
+	}
+	if usr.ActiveOrg == "" && len(usr.Orgs) > 0 {
+		usr.ActiveOrg = usr.Orgs[0].Org.Hex() // first org joined, unless asked for another
+	}
+	if usr.ActiveOrg != "" {
+		m := usr.Membership(usr.ActiveOrg)
+		if m == nil {
+			return nil, httperr.ErrForbidden(fmt.Errorf("%s is not a member of org %s", usr.Email, usr.ActiveOrg))
+		}
+		claims.Org, claims.OrgRole = usr.ActiveOrg, m.Role
+	}
+	return claims, nil
+}
+
+// signClaims : signs the claims with the active key, all the tokens of the service are signed here
+func (u *UsersCollection) signClaims(claims *CustomClaims) (string, httperr.HttpErr) {
+	kid, secret, err := u.activeKey()
+	if err != nil {
+		return "", AuthTokenErr(err)
+	}
+	tok := jwt.NewWithClaims(jwt.SigningMethodHS256, claims) // this signing method demands key of certain type
+	if kid != "" {
+		tok.Header["kid"] = kid
+	}
+	signed, err := tok.SignedString(secret) // []byte is ok since signing method is SigningMethodHS256
+	if e := AuthTokenErr(err); e != nil {
+		return "", e
+	}
+	return signed, nil
+}
+
+// IssueToken : signs a new token for the account with the active key, token is set on usr.AuthTok
+// Token carries the effective role of the account and acts in usr.ActiveOrg, or the first org of the account if not set
+func (u *UsersCollection) IssueToken(usr *User) httperr.HttpErr {
+	claims, err := u.userClaims(usr)
+	if err != nil {
+		return err
+	}
+	usr.AuthTok, err = u.signClaims(claims)
+	return err
+}
+
+// RotateSigningKey : new active key for signing, the earlier one is retired but still verifies tokens till RetiredKeyGrace.
+// Keys retired before the grace period are removed
+func (u *UsersCollection) RotateSigningKey() (string, httperr.HttpErr) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	byt := make([]byte, 32)
+	if _, err := rand.Read(byt); err != nil {
+		return "", AuthTokenErr(err)
+	}
+	kidByt := make([]byte, 8)
+	if _, err := rand.Read(kidByt); err != nil {
+		return "", AuthTokenErr(err)
+	}
+	now := time.Now().Unix()
+	key := SigningKey{Kid: hex.EncodeToString(kidByt), Secret: hex.EncodeToString(byt), CreatedAt: now}
+	if _, err := u.keys().UpdateMany(ctx, bson.M{"retiredat": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"retiredat": now}}); err != nil {
+		return "", httperr.ErrDBQuery(fmt.Errorf("failed to retire signing keys : %s", err))
+	}
+	if _, err := u.keys().InsertOne(ctx, key); err != nil {
+		return "", httperr.ErrDBQuery(fmt.Errorf("failed to insert signing key : %s", err))
+	}
+	if _, err := u.keys().DeleteMany(ctx, bson.M{"retiredat": bson.M{"$lt": time.Now().Add(-RetiredKeyGrace).Unix()}}); err != nil {
+		return "", httperr.ErrDBQuery(fmt.Errorf("failed to remove old signing keys : %s", err))
+	}
+	return key.Kid, nil
+}
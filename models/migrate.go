@@ -0,0 +1,304 @@
+package models
+
+/* =========================
+project 		: ipatio-web
+date			: October 2026
+author			: kneerunjun@gmail.com
+Copyrights		: Eensy Machines
+About			: Versioned schema migrations for the collections of the service.
+Migrations are registered in order of their version, applied versions are recorded in the migrations collection.
+Only one instance migrates at a time, the others wait on the lock till its done or they give up.
+============================*/
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	MigrationLockTTL = 10 * time.Minute // lock held longer than this is considered abandoned, migrations should finish well within it
+	migrationsColl   = "migrations"
+	migrationLock    = "migration_lock"
+)
+
+// MigrationFunc : applies (or reverts) a migration, or only counts the documents it would change when dry run
+type MigrationFunc func(ctx context.Context, db *mongo.Database, dryRun bool) (int64, error)
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      MigrationFunc
+	Down    MigrationFunc // nil when the migration cannot be reverted
+}
+
+// Migrations : registry of all the migrations, append only. Version of a migration never changes once released
+var Migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "user-status-default",
+		Up: func(ctx context.Context, db *mongo.Database, dryRun bool) (int64, error) {
+			return updateMany(ctx, db.Collection("users"), bson.M{"status": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"status": StatusActive}}, dryRun)
+		},
+		Down: func(ctx context.Context, db *mongo.Database, dryRun bool) (int64, error) {
+			// missing status is read as active, so unsetting is lossless
+			return updateMany(ctx, db.Collection("users"), bson.M{"status": StatusActive}, bson.M{"$unset": bson.M{"status": ""}}, dryRun)
+		},
+	},
+	{
+		Version: 2,
+		Name:    "user-email-normalize",
+		Up:      normalizeEmails, // cannot be reverted, emails as they were are not kept
+	},
+	{
+		Version: 3,
+		Name:    "user-createdat-backfill",
+		Up:      backfillCreatedAt,
+		Down: func(ctx context.Context, db *mongo.Database, dryRun bool) (int64, error) {
+			// time of creation is the same as that in the object id, can be backfilled again
+			return updateMany(ctx, db.Collection("users"), bson.M{"createdat": bson.M{"$exists": true}}, bson.M{"$unset": bson.M{"createdat": ""}}, dryRun)
+		},
+	},
+}
+
+// updateMany : helper for the migrations, counts the matching documents on dry run
+func updateMany(ctx context.Context, coll *mongo.Collection, flt, update bson.M, dryRun bool) (int64, error) {
+	if dryRun {
+		return coll.CountDocuments(ctx, flt)
+	}
+	result, err := coll.UpdateMany(ctx, flt, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+// MigrationRecord : applied migration as stored in the migrations collection
+type MigrationRecord struct {
+	Version   int    `bson:"_id" json:"version"`
+	Name      string `bson:"name" json:"name"`
+	AppliedAt int64  `bson:"appliedat" json:"applied_at"`
+	AppliedBy string `bson:"appliedby" json:"applied_by"`
+}
+
+type MigrationStatus struct {
+	Version   int    `json:"version"`
+	Name      string `json:"name"`
+	Applied   bool   `json:"applied"`
+	AppliedAt int64  `json:"applied_at,omitempty"`
+}
+
+// MigrationStep : outcome of one migration in a run, Affected is the count of documents changed or that would change on dry run
+type MigrationStep struct {
+	Version   int    `json:"version"`
+	Name      string `json:"name"`
+	Direction string `json:"direction"` // up|down
+	Affected  int64  `json:"affected"`
+	Error     string `json:"error,omitempty"`
+}
+
+type MigrationReport struct {
+	DryRun bool            `json:"dry_run"`
+	From   int             `json:"from"`
+	To     int             `json:"to"`
+	Steps  []MigrationStep `json:"steps"`
+}
+
+// Migrator : runs the registered migrations against the database
+//
+/*
+	m := models.Migrator{Db: db, Migrations: models.Migrations, Wait: time.Minute}
+	report, err := m.Up(0, false) // all the way to the latest
+*/
+type Migrator struct {
+	Db         *mongo.Database
+	Migrations []Migration
+	Owner      string        // identifies the instance holding the lock, hostname-pid if empty
+	Wait       time.Duration // how long to wait for the lock held by another instance, 0 fails right away
+}
+
+func (m *Migrator) owner() string {
+	if m.Owner == "" {
+		host, _ := os.Hostname()
+		m.Owner = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	return m.Owner
+}
+
+// validate : registry has to be in strictly increasing order of versions starting from 1
+func (m *Migrator) validate() httperr.HttpErr {
+	for i, mg := range m.Migrations {
+		if mg.Up == nil || mg.Version < 1 || (i > 0 && mg.Version <= m.Migrations[i-1].Version) {
+			return httperr.ErrValidation(fmt.Errorf("migration %d %s is out of order or incomplete", mg.Version, mg.Name))
+		}
+	}
+	return nil
+}
+
+// applied : records of the migrations applied, by version
+func (m *Migrator) applied(ctx context.Context) (map[int]MigrationRecord, httperr.HttpErr) {
+	cur, err := m.Db.Collection(migrationsColl).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, httperr.ErrDBQuery(err)
+	}
+	records := []MigrationRecord{}
+	if err := cur.All(ctx, &records); err != nil {
+		return nil, httperr.ErrDBQuery(err)
+	}
+	result := map[int]MigrationRecord{}
+	for _, r := range records {
+		result[r.Version] = r
+	}
+	return result, nil
+}
+
+// current : highest version applied, 0 if none
+func current(applied map[int]MigrationRecord) int {
+	v := 0
+	for version := range applied {
+		if version > v {
+			v = version
+		}
+	}
+	return v
+}
+
+// Status : all the registered migrations and if they are applied
+func (m *Migrator) Status() ([]MigrationStatus, httperr.HttpErr) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	result := []MigrationStatus{}
+	for _, mg := range m.Migrations {
+		r, ok := applied[mg.Version]
+		result = append(result, MigrationStatus{Version: mg.Version, Name: mg.Name, Applied: ok, AppliedAt: r.AppliedAt})
+	}
+	return result, nil
+}
+
+// lock : only one instance can hold the lock, lock of an instance that died midway expires after MigrationLockTTL
+func (m *Migrator) lock() httperr.HttpErr {
+	giveUp := time.Now().Add(m.Wait)
+	for {
+		now := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		_, err := m.Db.Collection(migrationLock).UpdateOne(ctx,
+			bson.M{"_id": "lock", "expires": bson.M{"$lt": now.Unix()}},
+			bson.M{"$set": bson.M{"owner": m.owner(), "expires": now.Add(MigrationLockTTL).Unix()}},
+			options.Update().SetUpsert(true)) // lock held by another wont match, and the upsert fails on the duplicate id
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return httperr.ErrDBQuery(err)
+		}
+		if !now.Before(giveUp) {
+			return MigrationLockedErr(fmt.Errorf("migration lock is held by another instance"))
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func (m *Migrator) unlock() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	m.Db.Collection(migrationLock).DeleteOne(ctx, bson.M{"_id": "lock", "owner": m.owner()})
+}
+
+// run : applies the plan of migrations in the direction, stops at the first that fails
+func (m *Migrator) run(target int, up, dryRun bool) (*MigrationReport, httperr.HttpErr) {
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	if !dryRun {
+		if err := m.lock(); err != nil {
+			return nil, err
+		}
+		defer m.unlock()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), MigrationLockTTL)
+	defer cancel()
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !up && target < 0 { // one step back
+		target = 0
+		for _, mg := range m.Migrations {
+			if _, ok := applied[mg.Version]; ok && mg.Version < current(applied) {
+				target = mg.Version
+			}
+		}
+	}
+	report := &MigrationReport{DryRun: dryRun, From: current(applied), To: target}
+	plan := []Migration{}
+	for _, mg := range m.Migrations {
+		_, ok := applied[mg.Version]
+		if up && !ok && mg.Version <= target {
+			plan = append(plan, mg)
+		} else if !up && ok && mg.Version > target {
+			plan = append(plan, mg)
+		}
+	}
+	direction := "up"
+	if !up {
+		direction = "down"
+		sort.Slice(plan, func(i, j int) bool { return plan[i].Version > plan[j].Version })
+	}
+	for _, mg := range plan {
+		step := MigrationStep{Version: mg.Version, Name: mg.Name, Direction: direction}
+		fn := mg.Up
+		if !up {
+			fn = mg.Down
+		}
+		if fn == nil {
+			step.Error = "migration cannot be reverted"
+			report.Steps = append(report.Steps, step)
+			return report, httperr.ErrValidation(fmt.Errorf("migration %d %s cannot be reverted", mg.Version, mg.Name))
+		}
+		affected, err := fn(ctx, m.Db, dryRun)
+		step.Affected = affected
+		if err != nil {
+			step.Error = err.Error()
+			report.Steps = append(report.Steps, step)
+			return report, httperr.ErrDBQuery(fmt.Errorf("migration %d %s failed %s: %s", mg.Version, mg.Name, direction, err))
+		}
+		report.Steps = append(report.Steps, step)
+		if dryRun {
+			continue
+		}
+		if up {
+			_, err = m.Db.Collection(migrationsColl).InsertOne(ctx, MigrationRecord{Version: mg.Version, Name: mg.Name, AppliedAt: time.Now().Unix(), AppliedBy: m.owner()})
+		} else {
+			_, err = m.Db.Collection(migrationsColl).DeleteOne(ctx, bson.M{"_id": mg.Version})
+		}
+		if err != nil {
+			return report, httperr.ErrDBQuery(fmt.Errorf("failed to record migration %d %s: %s", mg.Version, mg.Name, err))
+		}
+	}
+	return report, nil
+}
+
+// Up : applies the pending migrations upto and including the target version, 0 for the latest
+func (m *Migrator) Up(target int, dryRun bool) (*MigrationReport, httperr.HttpErr) {
+	if target <= 0 && len(m.Migrations) > 0 {
+		target = m.Migrations[len(m.Migrations)-1].Version
+	}
+	return m.run(target, true, dryRun)
+}
+
+// Down : reverts the applied migrations above the target version, latest first.
+// Target 0 reverts all of them, negative reverts only the latest
+func (m *Migrator) Down(target int, dryRun bool) (*MigrationReport, httperr.HttpErr) {
+	return m.run(target, false, dryRun)
+}
@@ -0,0 +1,43 @@
+package models
+
+/* Notifier sends out messages to account holders, invitation links, confirmations etc.
+Email is the address, Telegram or anything else can be plugged in behind the same interface */
+import (
+	"fmt"
+	"net/smtp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type Notifier interface {
+	Notify(to UserEmail, subject, body string) error
+}
+
+// LogNotifier : writes the message to the log, for development and for deployments without a mail server
+type LogNotifier struct{}
+
+func (ln *LogNotifier) Notify(to UserEmail, subject, body string) error {
+	log.WithFields(log.Fields{
+		"to":      to,
+		"subject": subject,
+	}).Info(body)
+	return nil
+}
+
+// SMTPNotifier : sends the message as plain text email
+type SMTPNotifier struct {
+	Host string // host:port
+	User string
+	Pass string
+	From string
+}
+
+func (sn *SMTPNotifier) Notify(to UserEmail, subject, body string) error {
+	host := strings.Split(sn.Host, ":")[0]
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n", sn.From, to, subject, body)
+	if err := smtp.SendMail(sn.Host, smtp.PlainAuth("", sn.User, sn.Pass, host), sn.From, []string{string(to)}, []byte(msg)); err != nil {
+		return fmt.Errorf("failed to send mail to %s: %s", to, err)
+	}
+	return nil
+}
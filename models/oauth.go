@@ -0,0 +1,738 @@
+package models
+
+/* =========================
+project 		: ipatio-web
+date			: October 2026
+author			: kneerunjun@gmail.com
+Copyrights		: Eensy Machines
+About			: OAuth 2.0 authorization server for third party integrations - authorization code (with PKCE), client credentials and refresh token grants.
+Clients are registered by the admins, only the hash of the client secret is stored. Scopes are either role scopes (role:enduser) that cap the role
+the token carries, or permissions (devices:read) that the account has to hold. Access tokens are signed with the same keys as the login tokens.
+Authorization codes and refresh tokens are stored by their hash, revoked access tokens by their jti - all of them expire on TTL indexes.
+============================*/
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"github.com/golang-jwt/jwt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantClientCredentials = "client_credentials"
+	GrantRefreshToken      = "refresh_token"
+)
+
+var (
+	OAuthCodeTTL    = 5 * time.Minute     // authorization codes have to be exchanged within this
+	RefreshTokenTTL = 30 * 24 * time.Hour // refresh tokens are rotated on every use, unused ones expire after this
+	// RoleScopes : scopes that cap the role of the token, token carries the highest role amongst the scopes granted, Guest if none
+	RoleScopes = map[string]UserRole{
+		"role:admin":   Admin,
+		"role:enduser": EndUser,
+		"role:guest":   Guest,
+	}
+)
+
+// IsValidScope : role scope, openid scope or a permission
+func IsValidScope(scope string) bool {
+	if _, ok := RoleScopes[scope]; ok || isOIDCScope(scope) {
+		return true
+	}
+	return !strings.HasPrefix(scope, "role:") && Permission(scope).IsValid()
+}
+
+// ParseScope : space delimited scope as in the requests, de-duplicated and sorted
+func ParseScope(scope string) []string {
+	set := map[string]bool{}
+	for _, s := range strings.Fields(scope) {
+		set[s] = true
+	}
+	result := []string{}
+	for s := range set {
+		result = append(result, s)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// OAuthClient : third party registered by the admins. Public clients (apps that cannot keep a secret) have no secret and have to use PKCE
+type OAuthClient struct {
+	Id           string   `bson:"_id" json:"client_id"`
+	Name         string   `bson:"name" json:"name"`
+	SecretHash   string   `bson:"secrethash,omitempty" json:"-"`
+	Public       bool     `bson:"public" json:"public"`
+	RedirectURIs []string `bson:"redirecturis" json:"redirect_uris"`
+	// where the end session endpoint can send the user agent back to
+	PostLogoutRedirectURIs []string `bson:"postlogouturis,omitempty" json:"post_logout_redirect_uris,omitempty"`
+	Grants                 []string `bson:"grants" json:"grants"`
+	Scopes                 []string `bson:"scopes" json:"scopes"` // most the client can ask for
+	Role                   UserRole `bson:"role" json:"role"`     // role of the client credentials tokens, capped further by the scopes
+	CreatedAt              int64    `bson:"createdat" json:"created_at"`
+	SecretAt               int64    `bson:"secretat" json:"secret_at"` // unix seconds, tokens of the client issued before this are revoked
+}
+
+// HasGrant : client is registered for the grant type
+func (oc OAuthClient) HasGrant(grant string) bool {
+	for _, g := range oc.Grants {
+		if g == grant {
+			return true
+		}
+	}
+	return false
+}
+
+func (oc OAuthClient) hasScope(scope string) bool {
+	for _, s := range oc.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// validRedirectURI : absolute, no fragment, https unless its a loopback address for native apps and development
+func validRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" || u.Fragment != "" {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		h := u.Hostname()
+		return h == "localhost" || h == "127.0.0.1" || h == "::1"
+	}
+	return false
+}
+
+// validate : grants, redirect uris and scopes. Caller cannot register a client that gets a role at or above its own
+func (oc *OAuthClient) validate(callerRole UserRole) httperr.HttpErr {
+	if len(oc.Name) < 2 || len(oc.Name) > 64 {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid client name, should be 2-64 characters"))
+	}
+	if len(oc.Grants) == 0 {
+		return httperr.ErrInvalidParam(fmt.Errorf("client needs at least one grant"))
+	}
+	oc.Grants = ParseScope(strings.Join(oc.Grants, " "))
+	for _, g := range oc.Grants {
+		if g != GrantAuthorizationCode && g != GrantClientCredentials && g != GrantRefreshToken {
+			return httperr.ErrInvalidParam(fmt.Errorf("unsupported grant %s", g))
+		}
+	}
+	if oc.Public && oc.HasGrant(GrantClientCredentials) {
+		return httperr.ErrInvalidParam(fmt.Errorf("public clients cannot use %s", GrantClientCredentials))
+	}
+	if oc.HasGrant(GrantAuthorizationCode) && len(oc.RedirectURIs) == 0 {
+		return httperr.ErrInvalidParam(fmt.Errorf("%s needs at least one redirect uri", GrantAuthorizationCode))
+	}
+	for _, uri := range append(append([]string{}, oc.RedirectURIs...), oc.PostLogoutRedirectURIs...) {
+		if !validRedirectURI(uri) {
+			return httperr.ErrInvalidParam(fmt.Errorf("invalid redirect uri %s, should be https without fragment", uri))
+		}
+	}
+	oc.Scopes = ParseScope(strings.Join(oc.Scopes, " "))
+	for _, s := range oc.Scopes {
+		if !IsValidScope(s) {
+			return httperr.ErrInvalidParam(fmt.Errorf("invalid scope %s", s))
+		}
+		if r, ok := RoleScopes[s]; ok && r <= callerRole {
+			return httperr.ErrForbidden(fmt.Errorf("role %d cannot register client with scope %s", callerRole, s))
+		}
+	}
+	if !oc.HasGrant(GrantClientCredentials) {
+		oc.Role = Guest // no tokens of its own
+	} else if !oc.Role.IsValid() || oc.Role <= callerRole {
+		return httperr.ErrForbidden(fmt.Errorf("role %d cannot register client with role %d", callerRole, oc.Role))
+	}
+	return nil
+}
+
+// OAuthClientsCollection : registered clients
+type OAuthClientsCollection struct {
+	DbColl *mongo.Collection
+}
+
+// EnsureIndexes : codes, refresh tokens and the revoked access tokens are removed by mongo once they expire
+func (oc *OAuthClientsCollection) EnsureIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	for _, coll := range []string{"oauth_codes", "oauth_tokens", "oauth_revoked"} {
+		_, err := oc.DbColl.Database().Collection(coll).Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.M{"expireat": 1},
+			Options: options.Index().SetName("expireat_ttl").SetExpireAfterSeconds(0),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create %s indexes: %s", coll, err)
+		}
+	}
+	_, err := oc.DbColl.Database().Collection("oauth_tokens").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"client": 1},
+		Options: options.Index().SetName("client"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create oauth_tokens indexes: %s", err)
+	}
+	return nil
+}
+
+// RegisterClient : inserts the client with a random id, sends back the client secret which is not stored and cannot be had again.
+// Secret is empty for public clients
+//
+/*
+	cl := models.OAuthClient{Name: "Pond analytics", RedirectURIs: []string{"https://vendor.example/cb"}, Grants: []string{"authorization_code", "refresh_token"}, Scopes: []string{"role:enduser", "devices:read"}}
+	secret, err := occ.RegisterClient(&cl, claims.UserRole)
+*/
+func (oc *OAuthClientsCollection) RegisterClient(cl *OAuthClient, callerRole UserRole) (string, httperr.HttpErr) {
+	if err := cl.validate(callerRole); err != nil {
+		return "", err
+	}
+	byt := make([]byte, 16)
+	if _, err := rand.Read(byt); err != nil {
+		return "", AuthTokenErr(err)
+	}
+	cl.Id, cl.SecretHash = hex.EncodeToString(byt), ""
+	secret := ""
+	if !cl.Public {
+		tok, hash, err := OneTimeToken()
+		if err != nil {
+			return "", AuthTokenErr(err)
+		}
+		secret, cl.SecretHash = tok, hash
+	}
+	cl.CreatedAt, cl.SecretAt = time.Now().Unix(), time.Now().Unix()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := oc.DbColl.InsertOne(ctx, cl); err != nil {
+		return "", httperr.ErrDBQuery(fmt.Errorf("failed RegisterClient : %s", err))
+	}
+	return secret, nil
+}
+
+// FindClient : client from its id
+func (oc *OAuthClientsCollection) FindClient(id string, result *OAuthClient) httperr.HttpErr {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := oc.DbColl.FindOne(ctx, bson.M{"_id": id}).Decode(result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return httperr.ErrResourceNotFound(fmt.Errorf("client %s was not found", id))
+	} else if err != nil {
+		return httperr.ErrDBQuery(err)
+	}
+	return nil
+}
+
+// ListClients : all the registered clients sorted by name
+func (oc *OAuthClientsCollection) ListClients() ([]OAuthClient, httperr.HttpErr) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	cur, err := oc.DbColl.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"name": 1}))
+	if err != nil {
+		return nil, httperr.ErrDBQuery(err)
+	}
+	result := []OAuthClient{}
+	if err := cur.All(ctx, &result); err != nil {
+		return nil, httperr.ErrDBQuery(err)
+	}
+	return result, nil
+}
+
+// RemoveClient : deletes the client along with its codes and refresh tokens, its access tokens are no longer authorized either
+func (oc *OAuthClientsCollection) RemoveClient(id string) httperr.HttpErr {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	result, err := oc.DbColl.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed RemoveClient : %s", err))
+	}
+	if result.DeletedCount == 0 {
+		return httperr.ErrResourceNotFound(fmt.Errorf("client %s was not found", id))
+	}
+	for _, coll := range []string{"oauth_codes", "oauth_tokens"} {
+		if _, err := oc.DbColl.Database().Collection(coll).DeleteMany(ctx, bson.M{"client": id}); err != nil {
+			return httperr.ErrDBQuery(fmt.Errorf("failed to remove %s of client %s : %s", coll, id, err))
+		}
+	}
+	return nil
+}
+
+// RotateSecret : new secret for the confidential client, the earlier one stops working right away and so do the tokens issued till now
+func (oc *OAuthClientsCollection) RotateSecret(id string) (string, httperr.HttpErr) {
+	cl := OAuthClient{}
+	if err := oc.FindClient(id, &cl); err != nil {
+		return "", err
+	}
+	if cl.Public {
+		return "", httperr.ErrInvalidParam(fmt.Errorf("public client %s has no secret", id))
+	}
+	tok, hash, err := OneTimeToken()
+	if err != nil {
+		return "", AuthTokenErr(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := oc.DbColl.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"secrethash": hash, "secretat": time.Now().Unix()}}); err != nil {
+		return "", httperr.ErrDBQuery(fmt.Errorf("failed RotateSecret : %s", err))
+	}
+	return tok, nil
+}
+
+// AuthenticateClient : client from its credentials, public clients authenticate with the id alone
+func (oc *OAuthClientsCollection) AuthenticateClient(id, secret string) (*OAuthClient, httperr.HttpErr) {
+	if id == "" {
+		return nil, OAuthErr("invalid_client", fmt.Errorf("missing client authentication"))
+	}
+	cl := &OAuthClient{}
+	if err := oc.FindClient(id, cl); err != nil {
+		if err.HttpStatusCode() == 404 {
+			return nil, OAuthErr("invalid_client", fmt.Errorf("unknown client %s", id))
+		}
+		return nil, err
+	}
+	if cl.Public {
+		if secret != "" {
+			return nil, OAuthErr("invalid_client", fmt.Errorf("public client %s has no secret", id))
+		}
+		return cl, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(TokenHash(secret)), []byte(cl.SecretHash)) != 1 {
+		return nil, OAuthErr("invalid_client", fmt.Errorf("client authentication failed for %s", id))
+	}
+	return cl, nil
+}
+
+// AuthorizeRequest : query of the authorization endpoint
+type AuthorizeRequest struct {
+	ResponseType        string `form:"response_type"`
+	ClientID            string `form:"client_id"`
+	RedirectURI         string `form:"redirect_uri"`
+	Scope               string `form:"scope"`
+	State               string `form:"state"`
+	CodeChallenge       string `form:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method"`
+	Nonce               string `form:"nonce"` // sent back in the ID token as is
+}
+
+// ResolveAuthorize : client and the redirect uri of the request. Errors here cannot be redirected back to the client, they are for the user agent.
+// Redirect uri can be left out when the client has only one registered
+func (oc *OAuthClientsCollection) ResolveAuthorize(req *AuthorizeRequest) (*OAuthClient, string, httperr.HttpErr) {
+	cl := &OAuthClient{}
+	if err := oc.FindClient(req.ClientID, cl); err != nil {
+		if err.HttpStatusCode() == 404 {
+			return nil, "", OAuthErr("invalid_request", fmt.Errorf("unknown client %s", req.ClientID))
+		}
+		return nil, "", err
+	}
+	if req.RedirectURI == "" {
+		if len(cl.RedirectURIs) != 1 {
+			return nil, "", OAuthErr("invalid_request", fmt.Errorf("missing redirect_uri"))
+		}
+		return cl, cl.RedirectURIs[0], nil
+	}
+	for _, uri := range cl.RedirectURIs {
+		if uri == req.RedirectURI { // exact match, no prefixes or wildcards
+			return cl, uri, nil
+		}
+	}
+	return nil, "", OAuthErr("invalid_request", fmt.Errorf("redirect_uri %s is not registered for client %s", req.RedirectURI, cl.Id))
+}
+
+// OAuthToken : response of the token endpoint
+type OAuthToken struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope"`
+	IDToken      string `json:"id_token,omitempty"` // when openid is in the scope
+}
+
+// oauthCode : authorization code as stored, by its hash
+type oauthCode struct {
+	Hash        string             `bson:"_id"`
+	Client      string             `bson:"client"`
+	User        primitive.ObjectID `bson:"user"`
+	RedirectURI string             `bson:"redirecturi"` // as sent in the authorization request, empty if left out
+	Scope       string             `bson:"scope"`
+	Challenge   string             `bson:"challenge,omitempty"`
+	Nonce       string             `bson:"nonce,omitempty"`
+	AuthTime    int64              `bson:"authtime"`
+	Gen         int64              `bson:"gen"` // TokenGen of the account when it approved
+	ExpireAt    time.Time          `bson:"expireat"`
+}
+
+// oauthRefresh : refresh token as stored, by its hash. AuthTime is when the account authorized the client
+type oauthRefresh struct {
+	Hash     string             `bson:"_id"`
+	Client   string             `bson:"client"`
+	User     primitive.ObjectID `bson:"user"`
+	Scope    string             `bson:"scope"`
+	AuthTime int64              `bson:"authtime"`
+	Gen      int64              `bson:"gen"` // TokenGen of the account when it authorized the client
+	ExpireAt time.Time          `bson:"expireat"`
+}
+
+func (u *UsersCollection) oauthColl(name string) *mongo.Collection {
+	return u.DbColl.Database().Collection(name)
+}
+
+// grantScopes : scopes the token gets and the role it carries. Scopes have to be registered for the client, none asked for means all of them.
+// For an account, role scopes above its effective role and permissions it does not hold are left out. usr is nil for client credentials
+func (u *UsersCollection) grantScopes(requested string, cl *OAuthClient, usr *User) (string, UserRole, httperr.HttpErr) {
+	asked := ParseScope(requested)
+	if len(asked) == 0 {
+		asked = cl.Scopes
+	}
+	var ep *EffectivePermissions
+	if usr != nil {
+		var err httperr.HttpErr
+		if ep, err = u.Effective(usr); err != nil {
+			return "", Guest, err
+		}
+	}
+	granted, role := []string{}, Guest
+	for _, s := range asked {
+		if !cl.hasScope(s) {
+			return "", Guest, OAuthErr("invalid_scope", fmt.Errorf("scope %s is not registered for client %s", s, cl.Id))
+		}
+		if isOIDCScope(s) {
+			granted = append(granted, s) // claims of the account, see OIDCClaims
+			continue
+		}
+		if r, ok := RoleScopes[s]; ok {
+			if (ep != nil && r < ep.EffRole) || (ep == nil && r < cl.Role) {
+				continue
+			}
+			if r < role {
+				role = r
+			}
+		} else if ep != nil && !ep.Allows(Permission(s)) {
+			continue
+		}
+		granted = append(granted, s)
+	}
+	return strings.Join(granted, " "), role, nil
+}
+
+// regrantScopes : scopes granted earlier, less those the account no longer holds. Nothing granted stays nothing, unlike grantScopes
+func (u *UsersCollection) regrantScopes(granted string, cl *OAuthClient, usr *User) (string, UserRole, httperr.HttpErr) {
+	if strings.TrimSpace(granted) == "" {
+		return "", Guest, nil
+	}
+	return u.grantScopes(granted, cl, usr)
+}
+
+// issueOAuthToken : access token signed as any other token of the service, with a refresh token if the client can use one
+// and an ID token if openid is in the scope. usr is nil for client credentials, the token then has no account and the client is the subject
+func (u *UsersCollection) issueOAuthToken(cl *OAuthClient, usr *User, scope string, role UserRole, authTime int64, nonce string) (*OAuthToken, httperr.HttpErr) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return nil, AuthTokenErr(err)
+	}
+	claims := &CustomClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        hex.EncodeToString(jti),
+			Audience:  cl.Id,
+			ExpiresAt: time.Now().Add(TokenTTL).Unix(),
+			IssuedAt:  time.Now().Unix(),
+			Issuer:    "patio-web server",
+			Subject:   cl.Id,
+		},
+		UserRole: role,
+		ClientID: cl.Id,
+		Scope:    scope,
+	}
+	if usr != nil {
+		claims.User, claims.Subject, claims.Gen = string(usr.Email), usr.Id.Hex(), usr.TokenGen
+		gen, err := u.clientGen(cl.Id, usr.Id.Hex())
+		if err != nil {
+			return nil, err
+		}
+		claims.ClientGen = gen
+	}
+	signed, err := u.signClaims(claims)
+	if err != nil {
+		return nil, err
+	}
+	result := &OAuthToken{AccessToken: signed, TokenType: "Bearer", ExpiresIn: int64(TokenTTL.Seconds()), Scope: scope}
+	if usr != nil && scopeHas(scope, "openid") {
+		if result.IDToken, err = u.issueIDToken(cl, usr, scope, nonce, authTime); err != nil {
+			return nil, err
+		}
+	}
+	if usr == nil || !cl.HasGrant(GrantRefreshToken) {
+		return result, nil
+	}
+	tok, hash, e := OneTimeToken()
+	if e != nil {
+		return nil, AuthTokenErr(e)
+	}
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	if _, e := u.oauthColl("oauth_tokens").InsertOne(ctx, oauthRefresh{
+		Hash: hash, Client: cl.Id, User: usr.Id, Scope: scope, AuthTime: authTime, Gen: usr.TokenGen, ExpireAt: time.Now().Add(RefreshTokenTTL),
+	}); e != nil {
+		return nil, httperr.ErrDBQuery(fmt.Errorf("failed to store refresh token : %s", e))
+	}
+	result.RefreshToken = tok
+	return result, nil
+}
+
+// oauthAccount : account the code or refresh token was issued for, has to be active and not have its tokens revoked since it authorized the client
+func (u *UsersCollection) oauthAccount(id primitive.ObjectID, gen int64) (*User, httperr.HttpErr) {
+	usr := &User{}
+	if err := u.FindUser(id.Hex(), usr); err != nil {
+		if err.HttpStatusCode() == 404 {
+			return nil, OAuthErr("invalid_grant", fmt.Errorf("account %s no longer exists", id.Hex()))
+		}
+		return nil, err
+	}
+	if err := AccountStatusErr(usr); err != nil {
+		return nil, OAuthErr("invalid_grant", fmt.Errorf("account %s is %s", usr.Email, usr.CurrentStatus()))
+	}
+	if gen < usr.TokenGen {
+		return nil, OAuthErr("invalid_grant", fmt.Errorf("tokens of %s were revoked", usr.Email))
+	}
+	return usr, nil
+}
+
+// IssueCode : authorization code for the account that approved the request, to be exchanged by the client within OAuthCodeTTL.
+// Public clients have to send a S256 code challenge (PKCE). Errors here are redirected back to the client
+//
+/*
+	cl, redirect, err := occ.ResolveAuthorize(&req)
+	code, err := uc.IssueCode(&req, cl, &usr)
+	// redirect?code=<code>&state=<req.State>
+*/
+func (u *UsersCollection) IssueCode(req *AuthorizeRequest, cl *OAuthClient, usr *User) (string, httperr.HttpErr) {
+	if req.ResponseType != "code" {
+		return "", OAuthErr("unsupported_response_type", fmt.Errorf("response_type should be code"))
+	}
+	if !cl.HasGrant(GrantAuthorizationCode) {
+		return "", OAuthErr("unauthorized_client", fmt.Errorf("client %s cannot use %s", cl.Id, GrantAuthorizationCode))
+	}
+	if req.CodeChallenge == "" && cl.Public {
+		return "", OAuthErr("invalid_request", fmt.Errorf("public clients have to send code_challenge"))
+	}
+	if req.CodeChallenge != "" && req.CodeChallengeMethod != "S256" {
+		return "", OAuthErr("invalid_request", fmt.Errorf("code_challenge_method should be S256"))
+	}
+	scope, _, err := u.grantScopes(req.Scope, cl, usr)
+	if err != nil {
+		return "", err
+	}
+	code, hash, e := OneTimeToken()
+	if e != nil {
+		return "", AuthTokenErr(e)
+	}
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	if _, e := u.oauthColl("oauth_codes").InsertOne(ctx, oauthCode{
+		Hash: hash, Client: cl.Id, User: usr.Id, RedirectURI: req.RedirectURI, Scope: scope, Challenge: req.CodeChallenge, Nonce: req.Nonce,
+		AuthTime: time.Now().Unix(), Gen: usr.TokenGen, ExpireAt: time.Now().Add(OAuthCodeTTL),
+	}); e != nil {
+		return "", httperr.ErrDBQuery(fmt.Errorf("failed IssueCode : %s", e))
+	}
+	return code, nil
+}
+
+// ExchangeCode : tokens for the authorization code, code works only once and only for the client it was issued to.
+// Redirect uri has to be the same as in the authorization request, verifier has to match the code challenge if one was sent
+func (u *UsersCollection) ExchangeCode(cl *OAuthClient, code, redirectURI, verifier string) (*OAuthToken, httperr.HttpErr) {
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	stored := oauthCode{}
+	err := u.oauthColl("oauth_codes").FindOneAndDelete(ctx, bson.M{"_id": TokenHash(code)}).Decode(&stored)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, OAuthErr("invalid_grant", fmt.Errorf("invalid or used authorization code"))
+	} else if err != nil {
+		return nil, httperr.ErrDBQuery(fmt.Errorf("failed ExchangeCode : %s", err))
+	}
+	if stored.Client != cl.Id || stored.ExpireAt.Before(time.Now()) {
+		return nil, OAuthErr("invalid_grant", fmt.Errorf("authorization code expired or issued to another client"))
+	}
+	if stored.RedirectURI != redirectURI {
+		return nil, OAuthErr("invalid_grant", fmt.Errorf("redirect_uri does not match the authorization request"))
+	}
+	if stored.Challenge != "" {
+		h := sha256.Sum256([]byte(verifier))
+		if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(h[:])), []byte(stored.Challenge)) != 1 {
+			return nil, OAuthErr("invalid_grant", fmt.Errorf("code_verifier does not match the code challenge"))
+		}
+	}
+	usr, herr := u.oauthAccount(stored.User, stored.Gen)
+	if herr != nil {
+		return nil, herr
+	}
+	// permissions of the account may have changed since it authorized the client
+	scope, role, herr := u.regrantScopes(stored.Scope, cl, usr)
+	if herr != nil {
+		return nil, herr
+	}
+	return u.issueOAuthToken(cl, usr, scope, role, stored.AuthTime, stored.Nonce)
+}
+
+// RefreshGrant : new tokens for the refresh token, which is rotated. Scope can be narrowed but not widened from what was granted
+func (u *UsersCollection) RefreshGrant(cl *OAuthClient, refresh, scope string) (*OAuthToken, httperr.HttpErr) {
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	stored := oauthRefresh{}
+	err := u.oauthColl("oauth_tokens").FindOneAndDelete(ctx, bson.M{"_id": TokenHash(refresh), "client": cl.Id}).Decode(&stored)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, OAuthErr("invalid_grant", fmt.Errorf("invalid or used refresh token"))
+	} else if err != nil {
+		return nil, httperr.ErrDBQuery(fmt.Errorf("failed RefreshGrant : %s", err))
+	}
+	if stored.ExpireAt.Before(time.Now()) {
+		return nil, OAuthErr("invalid_grant", fmt.Errorf("refresh token expired"))
+	}
+	if scope == "" {
+		scope = stored.Scope
+	}
+	granted := strings.Fields(stored.Scope)
+	for _, s := range ParseScope(scope) {
+		found := false
+		for _, g := range granted {
+			found = found || g == s
+		}
+		if !found {
+			return nil, OAuthErr("invalid_scope", fmt.Errorf("scope %s was not granted", s))
+		}
+	}
+	usr, herr := u.oauthAccount(stored.User, stored.Gen)
+	if herr != nil {
+		return nil, herr
+	}
+	scope, role, herr := u.regrantScopes(scope, cl, usr)
+	if herr != nil {
+		return nil, herr
+	}
+	return u.issueOAuthToken(cl, usr, scope, role, stored.AuthTime, "")
+}
+
+// ClientCredentialsGrant : token for the client itself, role of the token is capped by the role of the client
+func (u *UsersCollection) ClientCredentialsGrant(cl *OAuthClient, scope string) (*OAuthToken, httperr.HttpErr) {
+	if cl.Public || !cl.HasGrant(GrantClientCredentials) {
+		return nil, OAuthErr("unauthorized_client", fmt.Errorf("client %s cannot use %s", cl.Id, GrantClientCredentials))
+	}
+	scope, role, err := u.grantScopes(scope, cl, nil)
+	if err != nil {
+		return nil, err
+	}
+	return u.issueOAuthToken(cl, nil, scope, role, time.Now().Unix(), "")
+}
+
+// RevokeOAuthToken : revokes a refresh token or an access token of the client, RFC 7009.
+// Tokens that are invalid or not of the client are ignored, the client cannot tell them apart
+func (u *UsersCollection) RevokeOAuthToken(cl *OAuthClient, tok string) httperr.HttpErr {
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	result, err := u.oauthColl("oauth_tokens").DeleteOne(ctx, bson.M{"_id": TokenHash(tok), "client": cl.Id})
+	if err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed RevokeOAuthToken : %s", err))
+	}
+	if result.DeletedCount > 0 {
+		return nil
+	}
+	jTok, err := jwt.ParseWithClaims(tok, &CustomClaims{}, u.verificationKey)
+	if err != nil || !jTok.Valid {
+		return nil
+	}
+	claims, ok := jTok.Claims.(*CustomClaims)
+	if !ok || claims.ClientID != cl.Id || claims.Id == "" {
+		return nil
+	}
+	_, err = u.oauthColl("oauth_revoked").UpdateOne(ctx, bson.M{"_id": claims.Id}, bson.M{
+		"$set": bson.M{"expireat": time.Unix(claims.ExpiresAt, 0)},
+	}, options.Update().SetUpsert(true))
+	if err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed RevokeOAuthToken : %s", err))
+	}
+	return nil
+}
+
+// authorizeOAuthClaims : access tokens issued to a client are no longer authorized once revoked, the client is removed or its secret rotated
+func (u *UsersCollection) authorizeOAuthClaims(claims *CustomClaims) httperr.HttpErr {
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	n, err := u.oauthColl("oauth_revoked").CountDocuments(ctx, bson.M{"_id": claims.Id})
+	if err != nil {
+		return httperr.ErrDBQuery(err)
+	}
+	if n > 0 {
+		return InvalidTokenErr(fmt.Errorf("token %s was revoked", claims.Id))
+	}
+	if claims.User != "" {
+		gen, err := u.clientGen(claims.ClientID, claims.Subject)
+		if err != nil {
+			return err
+		}
+		if claims.ClientGen < gen {
+			return InvalidTokenErr(fmt.Errorf("%s has logged out of client %s", claims.User, claims.ClientID))
+		}
+	}
+	cl := OAuthClient{}
+	err = u.oauthColl("oauth_clients").FindOne(ctx, bson.M{"_id": claims.ClientID}).Decode(&cl)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return InvalidTokenErr(fmt.Errorf("client %s for the token no longer exists", claims.ClientID))
+	} else if err != nil {
+		return httperr.ErrDBQuery(err)
+	}
+	if claims.IssuedAt < cl.SecretAt {
+		return InvalidTokenErr(fmt.Errorf("tokens of client %s were revoked", claims.ClientID))
+	}
+	return nil
+}
+
+// clientGen : number of times the account has logged out of the client, access tokens carry it as of when they were issued
+func (u *UsersCollection) clientGen(client, userHex string) (int64, httperr.HttpErr) {
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	logout := struct {
+		Gen int64 `bson:"gen"`
+	}{}
+	err := u.oauthColl("oauth_logouts").FindOne(ctx, bson.M{"_id": client + ":" + userHex}).Decode(&logout)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, httperr.ErrDBQuery(fmt.Errorf("failed clientGen : %s", err))
+	}
+	return logout.Gen, nil
+}
+
+// LogoutClient : signs the account out of the client, its codes and refresh tokens are removed and the access tokens issued till now are no longer authorized.
+// Tokens of the account at the other clients are left as they are
+func (u *UsersCollection) LogoutClient(client, userHex string) httperr.HttpErr {
+	oid, err := primitive.ObjectIDFromHex(userHex)
+	if err != nil {
+		return httperr.ErrInvalidParam(err)
+	}
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	_, err = u.oauthColl("oauth_logouts").UpdateOne(ctx, bson.M{"_id": client + ":" + userHex}, bson.M{
+		"$inc": bson.M{"gen": 1},
+	}, options.Update().SetUpsert(true))
+	if err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed LogoutClient : %s", err))
+	}
+	for _, coll := range []string{"oauth_codes", "oauth_tokens"} {
+		if _, err := u.oauthColl(coll).DeleteMany(ctx, bson.M{"client": client, "user": oid}); err != nil {
+			return httperr.ErrDBQuery(fmt.Errorf("failed to remove %s of %s at client %s : %s", coll, userHex, client, err))
+		}
+	}
+	return nil
+}
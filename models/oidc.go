@@ -0,0 +1,321 @@
+package models
+
+/* =========================
+project 		: ipatio-web
+date			: October 2026
+author			: kneerunjun@gmail.com
+Copyrights		: Eensy Machines
+About			: OpenID Connect on top of the oauth authorization server, so that other tools can sign in against the accounts here.
+Token endpoint sends an ID token along when openid is in the scope, claims of the account are as the scopes (profile, email) allow.
+ID tokens are RS256 signed so that relying parties can verify them from the published JWKS, the keys are apart from the HS256 keys of the access tokens.
+============================*/
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"github.com/golang-jwt/jwt"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	OIDCIssuer = "http://localhost:8080/api" // base url of the api as seen by the relying parties, endpoints in the discovery are relative to this
+	IDTokenTTL = time.Hour
+	// IDTokenHintGrace : expired ID tokens are still taken as id_token_hint for this long, clients may log out with the last one they got
+	IDTokenHintGrace = 10 * time.Minute
+	// OIDCScopes : scopes of the openid standard, they grant no role or permission just the claims of the account
+	OIDCScopes = []string{"openid", "profile", "email"}
+)
+
+func isOIDCScope(scope string) bool {
+	for _, s := range OIDCScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// scopeHas : space delimited scope has the one asked for
+func scopeHas(scope, asked string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == asked {
+			return true
+		}
+	}
+	return false
+}
+
+// IDTokenKey : RSA key for signing the ID tokens, only one is active at a time. Retired ones are published in the JWKS till RetiredKeyGrace
+type IDTokenKey struct {
+	Kid       string `bson:"_id"`
+	PEM       string `bson:"pem"` // PKCS1 private key
+	CreatedAt int64  `bson:"createdat"`
+	RetiredAt int64  `bson:"retiredat,omitempty"`
+}
+
+func (k IDTokenKey) private() (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(k.PEM))
+	if block == nil {
+		return nil, fmt.Errorf("invalid pem for key %s", k.Kid)
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+func (u *UsersCollection) idKeys() *mongo.Collection {
+	return u.DbColl.Database().Collection("idkeys")
+}
+
+// activeIDKey : key for signing ID tokens, one is generated the first time its needed
+func (u *UsersCollection) activeIDKey() (string, *rsa.PrivateKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	key := IDTokenKey{}
+	err := u.idKeys().FindOne(ctx, bson.M{"retiredat": bson.M{"$exists": false}}, options.FindOne().SetSort(bson.M{"createdat": -1})).Decode(&key)
+	if err == mongo.ErrNoDocuments {
+		kid, herr := u.RotateIDTokenKey()
+		if herr != nil {
+			return "", nil, fmt.Errorf("failed to generate ID token key : %s", herr.ClientErrData())
+		}
+		return u.idKeyByKid(kid)
+	} else if err != nil {
+		return "", nil, err
+	}
+	priv, err := key.private()
+	return key.Kid, priv, err
+}
+
+func (u *UsersCollection) idKeyByKid(kid string) (string, *rsa.PrivateKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	key := IDTokenKey{}
+	if err := u.idKeys().FindOne(ctx, bson.M{"_id": kid}).Decode(&key); err != nil {
+		return "", nil, err
+	}
+	priv, err := key.private()
+	return key.Kid, priv, err
+}
+
+// RotateIDTokenKey : new RSA key for signing ID tokens, the earlier one is retired but stays in the JWKS till RetiredKeyGrace
+func (u *UsersCollection) RotateIDTokenKey() (string, httperr.HttpErr) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", AuthTokenErr(err)
+	}
+	kidByt := make([]byte, 8)
+	if _, err := rand.Read(kidByt); err != nil {
+		return "", AuthTokenErr(err)
+	}
+	now := time.Now().Unix()
+	key := IDTokenKey{
+		Kid:       hex.EncodeToString(kidByt),
+		PEM:       string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})),
+		CreatedAt: now,
+	}
+	if _, err := u.idKeys().UpdateMany(ctx, bson.M{"retiredat": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"retiredat": now}}); err != nil {
+		return "", httperr.ErrDBQuery(fmt.Errorf("failed to retire ID token keys : %s", err))
+	}
+	if _, err := u.idKeys().InsertOne(ctx, key); err != nil {
+		return "", httperr.ErrDBQuery(fmt.Errorf("failed to insert ID token key : %s", err))
+	}
+	if _, err := u.idKeys().DeleteMany(ctx, bson.M{"retiredat": bson.M{"$lt": time.Now().Add(-RetiredKeyGrace).Unix()}}); err != nil {
+		return "", httperr.ErrDBQuery(fmt.Errorf("failed to remove old ID token keys : %s", err))
+	}
+	return key.Kid, nil
+}
+
+// JWK : public part of an ID token key as published, RFC 7517
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// JWKS : public keys the ID tokens can be verified with, active and retired
+func (u *UsersCollection) JWKS() ([]JWK, httperr.HttpErr) {
+	if _, _, err := u.activeIDKey(); err != nil { // fresh deployment has no key yet
+		return nil, AuthTokenErr(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cur, err := u.idKeys().Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"createdat": -1}))
+	if err != nil {
+		return nil, httperr.ErrDBQuery(err)
+	}
+	keys := []IDTokenKey{}
+	if err := cur.All(ctx, &keys); err != nil {
+		return nil, httperr.ErrDBQuery(err)
+	}
+	result := []JWK{}
+	for _, k := range keys {
+		priv, err := k.private()
+		if err != nil {
+			return nil, AuthTokenErr(err)
+		}
+		result = append(result, JWK{
+			Kty: "RSA", Use: "sig", Alg: "RS256", Kid: k.Kid,
+			N: base64.RawURLEncoding.EncodeToString(priv.PublicKey.N.Bytes()),
+			E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(priv.PublicKey.E)).Bytes()),
+		})
+	}
+	return result, nil
+}
+
+// idVerificationKey : jwt.Keyfunc for the ID tokens, picks the key by the kid in the token header
+func (u *UsersCollection) idVerificationKey(t *jwt.Token) (interface{}, error) {
+	if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
+		return nil, fmt.Errorf("unexpected signing method %s", t.Header["alg"])
+	}
+	kid, _ := t.Header["kid"].(string)
+	_, priv, err := u.idKeyByKid(kid)
+	if err != nil {
+		return nil, fmt.Errorf("unknown ID token key %s", kid)
+	}
+	return &priv.PublicKey, nil
+}
+
+// OIDCClaims : standard claims of the account as the scope allows, sub is always there
+func OIDCClaims(usr *User, scope string) map[string]interface{} {
+	claims := map[string]interface{}{"sub": usr.Id.Hex()}
+	if scopeHas(scope, "email") {
+		claims["email"] = string(usr.Email)
+		claims["email_verified"] = usr.EmailVerifiedAt != 0
+	}
+	if scopeHas(scope, "profile") {
+		claims["name"] = string(usr.Name)
+		if usr.Locale != "" {
+			claims["locale"] = string(usr.Locale)
+		}
+		if usr.Timezone != "" {
+			claims["zoneinfo"] = string(usr.Timezone)
+		}
+		if usr.Avatar != "" {
+			claims["picture"] = absoluteURL(usr.Avatar)
+		}
+		if usr.UpdatedAt != 0 {
+			claims["updated_at"] = usr.UpdatedAt
+		}
+	}
+	return claims
+}
+
+// absoluteURL : urls of the service like the avatar are relative to the host the api is on, relying parties need them absolute
+func absoluteURL(ref string) string {
+	base, err := url.Parse(OIDCIssuer)
+	if err != nil {
+		return ref
+	}
+	r, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return base.ResolveReference(r).String()
+}
+
+// issueIDToken : ID token for the client, audience is the client and nonce is as sent in the authorization request
+func (u *UsersCollection) issueIDToken(cl *OAuthClient, usr *User, scope, nonce string, authTime int64) (string, httperr.HttpErr) {
+	kid, priv, err := u.activeIDKey()
+	if err != nil {
+		return "", AuthTokenErr(err)
+	}
+	claims := jwt.MapClaims{}
+	for k, v := range OIDCClaims(usr, scope) {
+		claims[k] = v
+	}
+	claims["iss"], claims["aud"], claims["azp"] = OIDCIssuer, cl.Id, cl.Id
+	claims["iat"], claims["exp"], claims["auth_time"] = time.Now().Unix(), time.Now().Add(IDTokenTTL).Unix(), authTime
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	tok.Header["kid"] = kid
+	signed, err := tok.SignedString(priv)
+	if err != nil {
+		return "", AuthTokenErr(err)
+	}
+	return signed, nil
+}
+
+// ParseIDTokenHint : account and client from an ID token issued here, as sent to the end session endpoint.
+// Expired tokens are accepted only within IDTokenHintGrace of their expiry
+func (u *UsersCollection) ParseIDTokenHint(hint string) (string, string, httperr.HttpErr) {
+	jTok, err := jwt.Parse(hint, u.idVerificationKey)
+	expired := false
+	if ve, ok := err.(*jwt.ValidationError); ok && ve.Errors == jwt.ValidationErrorExpired {
+		err, expired = nil, true
+	}
+	if err != nil || jTok == nil {
+		return "", "", OAuthErr("invalid_request", fmt.Errorf("invalid id_token_hint : %v", err))
+	}
+	claims, _ := jTok.Claims.(jwt.MapClaims)
+	sub, _ := claims["sub"].(string)
+	aud, _ := claims["aud"].(string)
+	if iss, _ := claims["iss"].(string); iss != OIDCIssuer || sub == "" {
+		return "", "", OAuthErr("invalid_request", fmt.Errorf("id_token_hint was not issued here"))
+	}
+	if exp, _ := claims["exp"].(float64); exp == 0 || (expired && time.Unix(int64(exp), 0).Add(IDTokenHintGrace).Before(time.Now())) {
+		return "", "", OAuthErr("invalid_request", fmt.Errorf("id_token_hint has expired"))
+	}
+	return sub, aud, nil
+}
+
+// UserInfo : claims of the account for an access token that has openid in the scope
+func (u *UsersCollection) UserInfo(claims *CustomClaims) (map[string]interface{}, httperr.HttpErr) {
+	if claims.ClientID == "" || claims.User == "" || !scopeHas(claims.Scope, "openid") {
+		return nil, OAuthErr("insufficient_scope", fmt.Errorf("token was not issued with the openid scope"))
+	}
+	usr := User{}
+	if err := u.FindUser(claims.Subject, &usr); err != nil {
+		if err.HttpStatusCode() == 404 {
+			return nil, OAuthErr("invalid_token", fmt.Errorf("account %s no longer exists", claims.Subject))
+		}
+		return nil, err
+	}
+	return OIDCClaims(&usr, claims.Scope), nil
+}
+
+// OIDCDiscovery : provider metadata as in OpenID Connect Discovery 1.0
+func OIDCDiscovery() map[string]interface{} {
+	roles := []string{}
+	for s := range RoleScopes {
+		roles = append(roles, s)
+	}
+	sort.Strings(roles)
+	scopes := append(append([]string{}, OIDCScopes...), roles...)
+	return map[string]interface{}{
+		"issuer":                                OIDCIssuer,
+		"authorization_endpoint":                OIDCIssuer + "/oauth/authorize",
+		"token_endpoint":                        OIDCIssuer + "/oauth/token",
+		"userinfo_endpoint":                     OIDCIssuer + "/oauth/userinfo",
+		"jwks_uri":                              OIDCIssuer + "/oauth/jwks",
+		"revocation_endpoint":                   OIDCIssuer + "/oauth/revoke",
+		"introspection_endpoint":                OIDCIssuer + "/oauth/introspect",
+		"end_session_endpoint":                  OIDCIssuer + "/oauth/logout",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{GrantAuthorizationCode, GrantRefreshToken, GrantClientCredentials},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      scopes,
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported":                      []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "email", "email_verified", "name", "locale", "zoneinfo", "picture", "updated_at"},
+	}
+}
@@ -0,0 +1,207 @@
+package models
+
+/* =========================
+project 		: ipatio-web
+date			: October 2026
+author			: kneerunjun@gmail.com
+Copyrights		: Eensy Machines
+About			: Organizations (farms) the accounts belong to. An account can be a member of many orgs, with a role in each.
+Memberships are kept on the account, the token carries the org the account is acting in (active org) and its role there.
+Org roles are Admin, EndUser, Guest - org admins manage only the members of their org, platform admins (role of the account) manage all.
+============================*/
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var orgSlugRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,31}$`)
+
+// Org : organization, slug is unique and is what humans refer to it by
+type Org struct {
+	Id        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Name      string             `bson:"name" json:"name"`
+	Slug      string             `bson:"slug" json:"slug"`
+	CreatedAt int64              `bson:"createdat" json:"created_at"`
+}
+
+func (o Org) IsValid() bool {
+	return len(o.Name) >= 2 && len(o.Name) <= 64 && orgSlugRegex.MatchString(o.Slug)
+}
+
+// OrgMember : membership of the account in an org
+type OrgMember struct {
+	Org  primitive.ObjectID `bson:"org" json:"org"`
+	Role UserRole           `bson:"role" json:"role"`
+}
+
+// IsValidOrgRole : superuser is a platform role and not one within an org
+func IsValidOrgRole(role UserRole) bool {
+	return role >= Admin && role <= Guest
+}
+
+// Membership : membership of the account in the org, nil if not a member
+func (u User) Membership(orgIdHex string) *OrgMember {
+	for _, m := range u.Orgs {
+		if m.Org.Hex() == orgIdHex {
+			return &m
+		}
+	}
+	return nil
+}
+
+// OrgsCollection : the orgs, membership is on the UsersCollection
+type OrgsCollection struct {
+	DbColl *mongo.Collection
+}
+
+// EnsureIndexes : slug is unique
+func (oc *OrgsCollection) EnsureIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	_, err := oc.DbColl.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"slug": 1},
+		Options: options.Index().SetName("slug_unique").SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create orgs indexes: %s", err)
+	}
+	return nil
+}
+
+// NewOrg : inserts the org, slug has to be unique
+//
+/*
+	org := models.Org{Name: "Green Acres", Slug: "green-acres"}
+	err := oc.NewOrg(&org)
+*/
+func (oc *OrgsCollection) NewOrg(org *Org) httperr.HttpErr {
+	if !org.IsValid() {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid org name or slug, slug is 2-32 lowercase letters, digits and -"))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	org.Id, org.CreatedAt = primitive.NilObjectID, time.Now().Unix()
+	result, err := oc.DbColl.InsertOne(ctx, org)
+	if mongo.IsDuplicateKeyError(err) {
+		return httperr.DuplicateResourceErr(fmt.Errorf("org %s already exists", org.Slug))
+	} else if err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed NewOrg : %s", err))
+	}
+	org.Id = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// FindOrg : org from its hex object id
+func (oc *OrgsCollection) FindOrg(objIdHex string, result *Org) httperr.HttpErr {
+	oid, err := primitive.ObjectIDFromHex(objIdHex)
+	if err != nil {
+		return httperr.ErrInvalidParam(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = oc.DbColl.FindOne(ctx, bson.M{"_id": oid}).Decode(result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return httperr.ErrResourceNotFound(fmt.Errorf("org %s was not found", objIdHex))
+	} else if err != nil {
+		return httperr.ErrDBQuery(err)
+	}
+	return nil
+}
+
+// ListOrgs : orgs sorted by slug, all of them when ids is nil
+func (oc *OrgsCollection) ListOrgs(ids []primitive.ObjectID) ([]Org, httperr.HttpErr) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	flt := bson.M{}
+	if ids != nil {
+		flt["_id"] = bson.M{"$in": ids}
+	}
+	cur, err := oc.DbColl.Find(ctx, flt, options.Find().SetSort(bson.M{"slug": 1}))
+	if err != nil {
+		return nil, httperr.ErrDBQuery(err)
+	}
+	result := []Org{}
+	if err := cur.All(ctx, &result); err != nil {
+		return nil, httperr.ErrDBQuery(err)
+	}
+	return result, nil
+}
+
+// inScope : adds the condition that limits the filter to the members of the org, when the collection is scoped to one
+func (u *UsersCollection) inScope(flt bson.M) bson.M {
+	if !u.Org.IsZero() {
+		flt["orgs.org"] = u.Org
+	}
+	return flt
+}
+
+// SetMembership : adds the account to the org or changes its role there. Caller can only grant org roles strictly below their own,
+// and only to accounts that are strictly below them in the org. Platform admins call with SuperUser as the caller role.
+// Tokens acting in the org with the earlier role are no longer authorized, see AuthorizeClaims
+//
+/*
+	err := uc.SetMembership(orgIdHex, usrIdHex, models.EndUser, claims.OrgRole)
+*/
+func (u *UsersCollection) SetMembership(orgIdHex, objIdHex string, role, callerRole UserRole) httperr.HttpErr {
+	if !IsValidOrgRole(role) {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid org role %d", role))
+	}
+	org, err := primitive.ObjectIDFromHex(orgIdHex)
+	if err != nil {
+		return httperr.ErrInvalidParam(err)
+	}
+	target := User{}
+	if err := u.FindUser(objIdHex, &target); err != nil {
+		return err
+	}
+	if m := target.Membership(orgIdHex); role <= callerRole || (m != nil && m.Role <= callerRole) {
+		return httperr.ErrForbidden(fmt.Errorf("org role %d cannot grant %s org role %d", callerRole, target.Email, role))
+	}
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	now := time.Now().Unix()
+	result, err := u.DbColl.UpdateOne(ctx, bson.M{"_id": target.Id, "orgs.org": org}, bson.M{"$set": bson.M{"orgs.$.role": role, "updatedat": now}})
+	if err == nil && result.MatchedCount == 0 {
+		_, err = u.DbColl.UpdateOne(ctx, bson.M{"_id": target.Id, "orgs.org": bson.M{"$ne": org}}, bson.M{
+			"$push": bson.M{"orgs": OrgMember{Org: org, Role: role}},
+			"$set":  bson.M{"updatedat": now},
+		})
+	}
+	if err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed SetMembership : %s", err))
+	}
+	return nil
+}
+
+// RemoveMembership : takes the account out of the org, only if its strictly below the caller in the org
+func (u *UsersCollection) RemoveMembership(orgIdHex, objIdHex string, callerRole UserRole) httperr.HttpErr {
+	target := User{}
+	if err := u.FindUser(objIdHex, &target); err != nil {
+		return err
+	}
+	m := target.Membership(orgIdHex)
+	if m == nil {
+		return httperr.ErrResourceNotFound(fmt.Errorf("%s is not a member of org %s", target.Email, orgIdHex))
+	}
+	if m.Role <= callerRole {
+		return httperr.ErrForbidden(fmt.Errorf("org role %d cannot remove %s with org role %d", callerRole, target.Email, m.Role))
+	}
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	if _, err := u.DbColl.UpdateOne(ctx, bson.M{"_id": target.Id}, bson.M{
+		"$pull": bson.M{"orgs": bson.M{"org": m.Org}},
+		"$set":  bson.M{"updatedat": time.Now().Unix()},
+	}); err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed RemoveMembership : %s", err))
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package models
+
+/* =========================
+project 		: ipatio-web
+date			: October 2026
+author			: kneerunjun@gmail.com
+Copyrights		: Eensy Machines
+About			: Data subject requests - export of all the personal data held against an account, and erasure of it.
+Erasure pseudonymizes the account in place rather than deleting it, so that audit records referring to the account id remain valid.
+============================*/
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	ErasedUserName   = "Erased User"
+	erasedEmailFmt   = "erased-%s@erased.invalid" // .invalid TLD is reserved, such an address can never be registered
+	erasedStatusNote = "personal data erased on request"
+)
+
+// PersonalDataExport : everything that is held against an account
+type PersonalDataExport struct {
+	ExportedAt int64              `json:"exported_at"`
+	Profile    AdminView          `json:"profile"`
+	Identities []ExternalIdentity `json:"identities,omitempty"` // linked at the identity providers
+	Audit      []AuditRecord      `json:"audit"`
+}
+
+// RecordsFor : all the audit records where any of the refs is the actor or the subject, oldest first
+func (ac *AuditCollection) RecordsFor(refs ...string) ([]AuditRecord, httperr.HttpErr) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	flt := bson.M{"$or": bson.A{bson.M{"actor": bson.M{"$in": refs}}, bson.M{"subject": bson.M{"$in": refs}}}}
+	cur, err := ac.DbColl.Find(ctx, flt, options.Find().SetSort(bson.D{{Key: "stream", Value: 1}, {Key: "seq", Value: 1}}))
+	if err != nil {
+		return nil, httperr.ErrDBQuery(err)
+	}
+	result := []AuditRecord{}
+	if err := cur.All(ctx, &result); err != nil {
+		return nil, httperr.ErrDBQuery(err)
+	}
+	return result, nil
+}
+
+// ExportPersonalData : collects the profile and the audit trail of the account
+//
+/*
+	export, err := uc.ExportPersonalData(usrIdHex, &models.AuditCollection{DbColl: db.Collection("audit")})
+	err = export.WriteZip(c.Writer)
+*/
+func (u *UsersCollection) ExportPersonalData(objIdHex string, ac *AuditCollection) (*PersonalDataExport, httperr.HttpErr) {
+	usr := User{}
+	if err := u.FindUser(objIdHex, &usr); err != nil {
+		return nil, err
+	}
+	records, err := ac.RecordsFor(usr.Id.Hex(), string(usr.Email))
+	if err != nil {
+		return nil, err
+	}
+	return &PersonalDataExport{ExportedAt: time.Now().Unix(), Profile: AdminView(usr), Identities: usr.Identities, Audit: records}, nil
+}
+
+// WriteZip : export as a zip archive with a json file for each of the sections
+func (pde *PersonalDataExport) WriteZip(w io.Writer) error {
+	zw := zip.NewWriter(w)
+	sections := map[string]interface{}{
+		"profile.json": pde.Profile,
+		"audit.json":   pde.Audit,
+	}
+	for name, section := range sections {
+		f, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(section); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// ErasePersonalData : removes the personal fields of the account but keeps the account id, so that references to it remain valid.
+// The account is disabled and can never login again, plain text references to its email in the audit trail are anonymized.
+// Last remaining SuperUser cannot be erased. Avatar thumbnails are deleted from the store first, a failure there leaves the account as it was.
+func (u *UsersCollection) ErasePersonalData(objIdHex string, ac *AuditCollection, store BlobStore) httperr.HttpErr {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	usr := User{}
+	if err := u.FindUser(objIdHex, &usr); err != nil {
+		return err
+	}
+	if err := u.guardLastSuperUser(map[string]interface{}{"_id": usr.Id}); err != nil {
+		return err
+	}
+	if err := DeleteAvatarBlobs(usr.Id.Hex(), store); err != nil {
+		return err
+	}
+	_, err := u.DbColl.UpdateOne(ctx, bson.M{"_id": usr.Id}, bson.M{
+		"$set": bson.M{
+			"name":         ErasedUserName,
+			"email":        fmt.Sprintf(erasedEmailFmt, usr.Id.Hex()),
+			"telegid":      0,
+			"auth":         "",
+			"status":       StatusDisabled,
+			"statusreason": erasedStatusNote,
+			"erasedat":     time.Now().Unix(),
+		},
+		"$unset": bson.M{"statusuntil": "", "pendingemail": "", "emailchghash": "", "emailchgexp": "", "avatar": "",
+			"phone": "", "locale": "", "timezone": "", "attributes": "", "identities": ""},
+	})
+	if err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed ErasePersonalData : %s", err))
+	}
+	if _, err := ac.Anonymize(string(usr.Email)); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package models
+
+/* =========================
+project 		: ipatio-web
+date			: October 2026
+author			: kneerunjun@gmail.com
+Copyrights		: Eensy Machines
+About			: Profile of the account beyond the identity - phone, locale, timezone and the free form attributes.
+Timestamps of creation, last update and last login are maintained here and not by the account holder.
+============================*/
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+	_ "time/tzdata" // timezones validate even where the host has no zoneinfo
+
+	"github.com/eensymachines-in/errx/httperr"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/text/language"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// UserPhone : phone number in E.164, +countrycode followed by the number without spaces
+type UserPhone string
+
+func (up UserPhone) IsValid() bool {
+	return regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`).MatchString(string(up))
+}
+
+// UserLocale : BCP 47 language tag, en-IN, mr, pt-BR
+type UserLocale string
+
+func (ul UserLocale) IsValid() bool {
+	_, err := language.Parse(string(ul))
+	return err == nil
+}
+
+// UserTimezone : IANA timezone name, Asia/Kolkata
+type UserTimezone string
+
+func (ut UserTimezone) IsValid() bool {
+	if ut == "" || ut == "Local" {
+		return false
+	}
+	_, err := time.LoadLocation(string(ut))
+	return err == nil
+}
+
+// ProfilePatch : fields of the profile to change, nil fields are left as is and empty ones are cleared
+type ProfilePatch struct {
+	Phone    *UserPhone    `json:"phone"`
+	Locale   *UserLocale   `json:"locale"`
+	Timezone *UserTimezone `json:"timezone"`
+}
+
+// EditProfile : changes phone, locale and timezone of the account, each is validated unless its being cleared
+//
+/*
+	phone := models.UserPhone("+919856321470")
+	err := uc.EditProfile(usrIdHex, models.ProfilePatch{Phone: &phone})
+*/
+func (u *UsersCollection) EditProfile(objIdHex string, patch ProfilePatch) httperr.HttpErr {
+	set, unset := bson.M{}, bson.M{}
+	field := func(key string, value string, valid bool) httperr.HttpErr {
+		if value == "" {
+			unset[key] = ""
+			return nil
+		}
+		if !valid {
+			return httperr.ErrInvalidParam(fmt.Errorf("invalid %s %s", key, value))
+		}
+		set[key] = value
+		return nil
+	}
+	if patch.Phone != nil {
+		if err := field("phone", string(*patch.Phone), patch.Phone.IsValid()); err != nil {
+			return err
+		}
+	}
+	if patch.Locale != nil {
+		if err := field("locale", string(*patch.Locale), patch.Locale.IsValid()); err != nil {
+			return err
+		}
+	}
+	if patch.Timezone != nil {
+		if err := field("timezone", string(*patch.Timezone), patch.Timezone.IsValid()); err != nil {
+			return err
+		}
+	}
+	return u.updateProfile(objIdHex, set, unset)
+}
+
+// updateProfile : applies the changes to the account along with the time of update
+func (u *UsersCollection) updateProfile(objIdHex string, set, unset bson.M) httperr.HttpErr {
+	oid, err := primitive.ObjectIDFromHex(objIdHex)
+	if err != nil {
+		return httperr.ErrInvalidParam(err)
+	}
+	set["updatedat"] = time.Now().Unix()
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	result, err := u.DbColl.UpdateOne(ctx, notDeleted(bson.M{"_id": oid}), update)
+	if err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed to update profile : %s", err))
+	}
+	if result.MatchedCount == 0 {
+		return httperr.ErrResourceNotFound(fmt.Errorf("user account %s was not found", objIdHex))
+	}
+	return nil
+}
+
+// touchLogin : records the time of a successful login, failure to record does not fail the login
+func (u *UsersCollection) touchLogin(usr *User) {
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	usr.LastLoginAt = time.Now().Unix()
+	u.DbColl.UpdateOne(ctx, bson.M{"_id": usr.Id}, bson.M{"$set": bson.M{"lastloginat": usr.LastLoginAt}})
+}
+
+// backfillCreatedAt : migration that sets the time of creation of accounts from before it was recorded, from their object id
+func backfillCreatedAt(ctx context.Context, db *mongo.Database, dryRun bool) (int64, error) {
+	coll := db.Collection("users")
+	flt := bson.M{"createdat": bson.M{"$exists": false}}
+	if dryRun {
+		return coll.CountDocuments(ctx, flt)
+	}
+	cur, err := coll.Find(ctx, flt)
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+	var changed int64
+	for cur.Next(ctx) {
+		usr := User{}
+		if err := cur.Decode(&usr); err != nil {
+			return changed, err
+		}
+		created := usr.Id.Timestamp().Unix()
+		if _, err := coll.UpdateOne(ctx, bson.M{"_id": usr.Id}, bson.M{"$set": bson.M{"createdat": created}}); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	return changed, cur.Err()
+}
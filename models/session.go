@@ -0,0 +1,213 @@
+package models
+
+/* =========================
+project 		: ipatio-web
+date			: October 2026
+author			: kneerunjun@gmail.com
+Copyrights		: Eensy Machines
+About			: Browser sessions that keep the tokens in HttpOnly cookies, out of the reach of scripts on the page.
+Access token is short lived as any other, the refresh token is kept only as a hash in sessions and is rotated on each use.
+Cookies are sent by the browser on their own, so state changing requests also need the CSRF token the session started with.
+Its hash is carried in the access token and kept with the session, nothing else is stored for it.
+============================*/
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/eensymachines-in/errx/httperr"
+	"github.com/golang-jwt/jwt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	SessionTTL = 14 * 24 * time.Hour // refresh token of the session, the session ends if not refreshed within this
+)
+
+// Session : refresh token of a browser session, only the hash is stored
+type Session struct {
+	Hash     string             `bson:"_id"`
+	User     primitive.ObjectID `bson:"user"`
+	Org      string             `bson:"org,omitempty"` // org the access tokens act in
+	CSRFHash string             `bson:"csrfhash"`
+	Gen      int64              `bson:"gen"` // TokenGen of the account on login, sessions from before the tokens were revoked cannot refresh
+	ExpireAt time.Time          `bson:"expireat"`
+}
+
+// SessionTokens : what goes into the cookies, the access token is on the User as AuthTok
+type SessionTokens struct {
+	Refresh string
+	CSRF    string
+}
+
+func (u *UsersCollection) sessions() *mongo.Collection {
+	return u.DbColl.Database().Collection("sessions")
+}
+
+// EnsureSessionIndexes : sessions not refreshed are removed by mongo once they expire
+func (u *UsersCollection) EnsureSessionIndexes() error {
+	ctx, cancel := context.WithTimeout(u.ctx(), 60*time.Second)
+	defer cancel()
+	_, err := u.sessions().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.M{"expireat": 1},
+		Options: options.Index().SetName("expireat_ttl").SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create sessions indexes: %s", err)
+	}
+	return nil
+}
+
+// issueSessionToken : access token as IssueToken, with the hash of the CSRF token of the session
+func (u *UsersCollection) issueSessionToken(usr *User, csrfHash string) httperr.HttpErr {
+	claims, err := u.userClaims(usr)
+	if err != nil {
+		return err
+	}
+	claims.CSRF = csrfHash
+	usr.AuthTok, err = u.signClaims(claims)
+	return err
+}
+
+// StartSession : session for the account that has just authenticated, usr.AuthTok is replaced by the access token of the session
+//
+/*
+	err := uc.Authenticate(&usr)
+	sess, err := uc.StartSession(&usr)
+	// cookies: usr.AuthTok, sess.Refresh, and sess.CSRF for the page to send back in X-CSRF-Token
+*/
+func (u *UsersCollection) StartSession(usr *User) (*SessionTokens, httperr.HttpErr) {
+	refresh, hash, e := OneTimeToken()
+	if e != nil {
+		return nil, AuthTokenErr(e)
+	}
+	csrf, csrfHash, e := OneTimeToken()
+	if e != nil {
+		return nil, AuthTokenErr(e)
+	}
+	if err := u.issueSessionToken(usr, csrfHash); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	if _, err := u.sessions().InsertOne(ctx, Session{
+		Hash: hash, User: usr.Id, Org: usr.ActiveOrg, CSRFHash: csrfHash, Gen: usr.TokenGen, ExpireAt: time.Now().Add(SessionTTL),
+	}); err != nil {
+		return nil, httperr.ErrDBQuery(fmt.Errorf("failed StartSession : %s", err))
+	}
+	return &SessionTokens{Refresh: refresh, CSRF: csrf}, nil
+}
+
+// takeSession : removes the session for the refresh token, which has to come with the CSRF token of the session. nil if there isnt such a session
+func (u *UsersCollection) takeSession(refresh, csrf string) (*Session, httperr.HttpErr) {
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	stored := Session{}
+	err := u.sessions().FindOne(ctx, bson.M{"_id": TokenHash(refresh)}).Decode(&stored)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	} else if err != nil {
+		return nil, httperr.ErrDBQuery(fmt.Errorf("failed takeSession : %s", err))
+	}
+	if subtle.ConstantTimeCompare([]byte(TokenHash(csrf)), []byte(stored.CSRFHash)) != 1 {
+		return nil, CSRFErr(fmt.Errorf("csrf token does not match the session of %s", stored.User.Hex()))
+	}
+	result, err := u.sessions().DeleteOne(ctx, bson.M{"_id": stored.Hash})
+	if err != nil {
+		return nil, httperr.ErrDBQuery(fmt.Errorf("failed takeSession : %s", err))
+	}
+	if result.DeletedCount == 0 {
+		return nil, nil // used concurrently
+	}
+	return &stored, nil
+}
+
+// RefreshSession : new access token and refresh token for the session, the refresh token sent in cannot be used again.
+// CSRF token stays as it was for the session
+//
+/*
+	usr, sess, err := uc.RefreshSession(refreshCookie, c.GetHeader("X-CSRF-Token"))
+*/
+func (u *UsersCollection) RefreshSession(refresh, csrf string) (*User, *SessionTokens, httperr.HttpErr) {
+	stored, err := u.takeSession(refresh, csrf)
+	if err != nil {
+		return nil, nil, err
+	}
+	if stored == nil || stored.ExpireAt.Before(time.Now()) {
+		return nil, nil, InvalidTokenErr(fmt.Errorf("invalid, used or expired session refresh token"))
+	}
+	usr := &User{}
+	if err := u.FindUser(stored.User.Hex(), usr); err != nil {
+		if err.HttpStatusCode() == 404 {
+			return nil, nil, InvalidTokenErr(fmt.Errorf("account %s of the session no longer exists", stored.User.Hex()))
+		}
+		return nil, nil, err
+	}
+	if err := AccountStatusErr(usr); err != nil {
+		return nil, nil, err
+	}
+	if stored.Gen < usr.TokenGen {
+		return nil, nil, InvalidTokenErr(fmt.Errorf("session of %s was revoked", usr.Email))
+	}
+	if stored.Org != "" && usr.Membership(stored.Org) == nil {
+		stored.Org = "" // no longer a member, acts in the first org as on login
+	}
+	usr.ActiveOrg = stored.Org
+	if err := u.issueSessionToken(usr, stored.CSRFHash); err != nil {
+		return nil, nil, err
+	}
+	next, hash, e := OneTimeToken()
+	if e != nil {
+		return nil, nil, AuthTokenErr(e)
+	}
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	stored.Hash, stored.Org, stored.ExpireAt = hash, usr.ActiveOrg, time.Now().Add(SessionTTL)
+	if _, err := u.sessions().InsertOne(ctx, stored); err != nil {
+		return nil, nil, httperr.ErrDBQuery(fmt.Errorf("failed RefreshSession : %s", err))
+	}
+	return usr, &SessionTokens{Refresh: next}, nil
+}
+
+// EndSession : logout, the refresh token can no longer be used. Access token of the session lasts till it expires.
+// Sessions that are already gone are not an error
+func (u *UsersCollection) EndSession(refresh, csrf string) httperr.HttpErr {
+	_, err := u.takeSession(refresh, csrf)
+	return err
+}
+
+// EndTokenSession : logout of the browser session the access token was issued in, for endpoints the refresh cookie is not sent to.
+// Tokens that are not of a browser session end nothing
+func (u *UsersCollection) EndTokenSession(claims *CustomClaims) httperr.HttpErr {
+	if claims.CSRF == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	if _, err := u.sessions().DeleteOne(ctx, bson.M{"csrfhash": claims.CSRF}); err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed EndTokenSession : %s", err))
+	}
+	return nil
+}
+
+// CheckCSRF : for requests that carry the session token in a cookie, csrf is as sent by the page.
+// false when tok isnt a valid session token at all, the cookie is then to be ignored and not honoured. Error when the csrf does not match
+func (u *UsersCollection) CheckCSRF(tok, csrf string) (bool, httperr.HttpErr) {
+	jTok, err := jwt.ParseWithClaims(tok, &CustomClaims{}, u.verificationKey)
+	if err != nil || !jTok.Valid {
+		return false, nil
+	}
+	claims, ok := jTok.Claims.(*CustomClaims)
+	if !ok || claims.CSRF == "" {
+		return false, nil // not a session token, cookies only ever carry session tokens
+	}
+	if subtle.ConstantTimeCompare([]byte(TokenHash(csrf)), []byte(claims.CSRF)) != 1 {
+		return true, CSRFErr(fmt.Errorf("csrf token missing or does not match for %s", claims.User))
+	}
+	return true, nil
+}
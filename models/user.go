@@ -1,8 +1,11 @@
 package models
 
 import (
+	"bytes"
 	"encoding/json"
 	"regexp"
+	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -11,6 +14,11 @@ import (
 
 type UserRole uint8
 
+// IsValid : role is one of the known roles
+func (ur UserRole) IsValid() bool {
+	return ur <= Guest
+}
+
 const (
 	SuperUser UserRole = iota
 	Admin
@@ -18,6 +26,41 @@ const (
 	Guest
 )
 
+// UserStatus : lifecycle state of the account, only active accounts can login
+type UserStatus string
+
+const (
+	StatusActive    UserStatus = "active"
+	StatusSuspended UserStatus = "suspended" // by an admin, optionally till a time after which its reactivated
+	StatusLocked    UserStatus = "locked"    // locked out, typically for security reasons
+	StatusPending   UserStatus = "pending"   // account created but not yet activated
+	StatusDisabled  UserStatus = "disabled"  // closed for good unless an admin activates it again
+)
+
+// statusTransitions : from status -> statuses it can move to
+var statusTransitions = map[UserStatus][]UserStatus{
+	StatusActive:    {StatusSuspended, StatusLocked, StatusDisabled},
+	StatusPending:   {StatusActive, StatusDisabled},
+	StatusSuspended: {StatusActive, StatusDisabled},
+	StatusLocked:    {StatusActive, StatusDisabled},
+	StatusDisabled:  {StatusActive},
+}
+
+func (us UserStatus) IsValid() bool {
+	_, ok := statusTransitions[us]
+	return ok
+}
+
+// CanTransition : checks if the account can move from this status to the one desired
+func (us UserStatus) CanTransition(to UserStatus) bool {
+	for _, allowed := range statusTransitions[us] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
 type UserPassword string
 
 func (up UserPassword) IsValid() bool {
@@ -42,12 +85,14 @@ func (un UserName) IsValid() bool {
 
 type UserEmail string
 
+// IsValid : email can be parsed and normalized, see Normalize
 func (ue UserEmail) IsValid() bool {
-	passRegex := regexp.MustCompile(`^[a-zA-Z0-9]+[_.-]*[a-zA-Z0-9]*@[a-zA-Z0-9]+[.]{1}[a-zA-Z0-9]{2,}$`) // password is 9-12 characters
-	return passRegex.MatchString(string(ue))
+	_, err := ue.Normalize()
+	return err == nil
 }
 
 // User : any user in the system, can be authenticated against database
+// Fields maintained by the server are json:"-", requests cannot bind them and MarshalJSON decides what is sent out
 type User struct {
 	Id      primitive.ObjectID `bson:"_id,omitempty"` // omit empty to indicate empty when marshalling and inserting
 	Name    UserName           `bson:"name" `
@@ -55,32 +100,143 @@ type User struct {
 	Role    UserRole           `bson:"role"`
 	TelegID int64              `bson:"telegid"`
 	Auth    string             `bson:"auth"`
-	AuthTok string             `bson:"-"` // has no significance in bson
+	AuthTok string             `bson:"-" json:"-"` // has no significance in bson
+	// unix seconds when the account was deleted, absent for live accounts
+	DeletedAt int64 `bson:"deletedat,omitempty" json:"-"`
+	// Status is empty for accounts that were created before statuses, which is the same as active
+	Status       UserStatus `bson:"status,omitempty" json:"-"`
+	StatusReason string     `bson:"statusreason,omitempty" json:"-"`
+	StatusUntil  int64      `bson:"statusuntil,omitempty" json:"-"` // unix seconds, suspended accounts are reactivated after this
+	// unix seconds when personal data of the account was erased, the account stays on as a pseudonymous shell
+	ErasedAt int64 `bson:"erasedat,omitempty" json:"-"`
+	// invited accounts are pending till the one time token is used to set the password, only the hash of the token is stored
+	InviteHash string `bson:"invitehash,omitempty" json:"-"`
+	InviteExp  int64  `bson:"inviteexp,omitempty" json:"-"`
+	// bumped each time the tokens of the account are revoked, tokens carrying an older generation are no longer valid
+	TokenGen int64 `bson:"tokgen,omitempty" json:"-"`
+	// new email waits till its confirmed with the one time token sent to it, only the hash of the token is stored
+	PendingEmail    UserEmail `bson:"pendingemail,omitempty" json:"-"`
+	EmailChangeHash string    `bson:"emailchghash,omitempty" json:"-"`
+	EmailChangeExp  int64     `bson:"emailchgexp,omitempty" json:"-"`
+	// unix seconds when the account holder last proved the email is theirs, by an invitation or email change link
+	EmailVerifiedAt int64 `bson:"emailverifiedat,omitempty" json:"-"`
+	// unix seconds, maintained by the collection and not set by the account holder
+	CreatedAt   int64 `bson:"createdat,omitempty" json:"-"`
+	UpdatedAt   int64 `bson:"updatedat,omitempty" json:"-"`
+	LastLoginAt int64 `bson:"lastloginat,omitempty" json:"-"`
+	// optional profile, validated as in UserPhone, UserLocale, UserTimezone
+	Phone    UserPhone    `bson:"phone,omitempty"`
+	Locale   UserLocale   `bson:"locale,omitempty"`
+	Timezone UserTimezone `bson:"timezone,omitempty"`
+	Avatar   string       `bson:"avatar,omitempty" json:"-"` // url of the profile picture
+	// free form attributes, keys and values as defined by the admins in the attribute schema
+	Attributes map[string]interface{} `bson:"attributes,omitempty" json:"-"`
+	// orgs the account is a member of, never bound from a request. ActiveOrg is the org the token is issued for, hex id
+	Orgs      []OrgMember `bson:"orgs,omitempty" json:"-"`
+	ActiveOrg string      `bson:"-" json:"-"`
+	// direct grants and the groups the account is in, see Effective
+	Permissions []Permission         `bson:"permissions,omitempty" json:"-"`
+	Groups      []primitive.ObjectID `bson:"groups,omitempty" json:"-"`
+	// accounts at the identity providers that can login to this one, see CompleteFederation
+	Identities []ExternalIdentity `bson:"identities,omitempty" json:"-"`
+}
+
+// CurrentStatus : status of the account as of now, accounts with an expired suspension are active
+func (u User) CurrentStatus() UserStatus {
+	if u.Status == "" {
+		return StatusActive
+	}
+	if u.Status == StatusSuspended && u.StatusUntil != 0 && u.StatusUntil < time.Now().Unix() {
+		return StatusActive
+	}
+	return u.Status
 }
 
 // MarshalJSON : Since we want to trim out certain fields before json is sent back over http
 // Since its implemented on USer and not *USer it suffices for both *User and USer
 func (u User) MarshalJSON() ([]byte, error) {
 	profile := struct {
-		ID      string   `json:"id"`
-		Name    string   `json:"name"`
-		Email   string   `json:"email"`
-		Role    UserRole `json:"role"`
-		TelegID int64    `json:"telegid"`
-		AuthTok string   `json:"authtok"`
+		ID          string                 `json:"id"`
+		Name        string                 `json:"name"`
+		Email       string                 `json:"email"`
+		Role        UserRole               `json:"role"`
+		TelegID     int64                  `json:"telegid"`
+		AuthTok     string                 `json:"authtok"`
+		CreatedAt   int64                  `json:"created_at,omitempty"`
+		UpdatedAt   int64                  `json:"updated_at,omitempty"`
+		LastLoginAt int64                  `json:"last_login_at,omitempty"`
+		Phone       UserPhone              `json:"phone,omitempty"`
+		Locale      UserLocale             `json:"locale,omitempty"`
+		Timezone    UserTimezone           `json:"timezone,omitempty"`
+		Avatar      string                 `json:"avatar,omitempty"`
+		Attributes  map[string]interface{} `json:"attributes,omitempty"`
+		Orgs        []OrgMember            `json:"orgs,omitempty"`
 	}{
-		ID:      u.Id.Hex(),
-		Name:    string(u.Name),
-		Email:   string(u.Email),
-		Role:    u.Role,
-		TelegID: u.TelegID,
-		AuthTok: u.AuthTok,
+		ID:          u.Id.Hex(),
+		Name:        string(u.Name),
+		Email:       string(u.Email),
+		Role:        u.Role,
+		TelegID:     u.TelegID,
+		AuthTok:     u.AuthTok,
+		CreatedAt:   u.CreatedAt,
+		UpdatedAt:   u.UpdatedAt,
+		LastLoginAt: u.LastLoginAt,
+		Phone:       u.Phone,
+		Locale:      u.Locale,
+		Timezone:    u.Timezone,
+		Avatar:      u.Avatar,
+		Attributes:  u.Attributes,
+		Orgs:        u.Orgs,
 	}
 	return json.Marshal(&profile)
 }
 
+// AdminView : User as seen by the admins, has the account status along with the profile
+// Use this in place of User when the caller is an admin
+type AdminView User
+
+func (av AdminView) MarshalJSON() ([]byte, error) {
+	byt, err := User(av).MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	view := map[string]interface{}{}
+	dec := json.NewDecoder(bytes.NewReader(byt))
+	dec.UseNumber() // telegid is int64 and shouldnt go through float64
+	if err := dec.Decode(&view); err != nil {
+		return nil, err
+	}
+	view["status"] = User(av).CurrentStatus()
+	view["status_reason"] = av.StatusReason
+	view["status_until"] = av.StatusUntil
+	return json.Marshal(view)
+}
+
 type CustomClaims struct {
 	jwt.StandardClaims
 	User     string   `json:"user"`
 	UserRole UserRole `json:"user-role"`
+	// org the token is acting in and the role there, empty for accounts that arent members of any org
+	Org     string   `json:"org,omitempty"`
+	OrgRole UserRole `json:"org-role,omitempty"`
+	// tokens issued to an oauth client, User is empty for client credentials. Role of the token is capped by the scope
+	ClientID string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+	// hash of the CSRF token for tokens of browser sessions, see StartSession
+	CSRF string `json:"csrf,omitempty"`
+	// TokenGen of the account when the token was issued, see RevokeTokens
+	Gen int64 `json:"gen,omitempty"`
+	// logouts of the account from the client till the token was issued, see LogoutClient
+	ClientGen int64 `json:"client_gen,omitempty"`
+}
+
+// ScopeGrants : for tokens issued to an oauth client, if any of the scopes granted holds the permission.
+// Client tokens hold only what the scope granted, even when acting for an account
+func (c *CustomClaims) ScopeGrants(perm Permission) bool {
+	for _, s := range strings.Fields(c.Scope) {
+		if Permission(s).Grants(perm) {
+			return true
+		}
+	}
+	return false
 }
@@ -11,6 +11,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/eensymachines-in/errx/httperr"
@@ -18,19 +19,51 @@ import (
 	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"golang.org/x/crypto/bcrypt"
 	"gopkg.in/mgo.v2/bson"
 )
 
 var (
-	JWTSigningKey string = "33n5ymach1ne5" // for key generation and parsing it back to token
+	JWTSigningKey   string        = "33n5ymach1ne5"     // for key generation and parsing it back to token
+	DeleteRetention time.Duration = 30 * 24 * time.Hour // deleted accounts can be restored within this window, after which they are purged
 )
 
+// userFilter : filter for the account addressed either by its email or hex object id, email is normalized
+func userFilter(emailOrID string) (bson.M, httperr.HttpErr) {
+	if email, err := UserEmail(emailOrID).Normalize(); err == nil {
+		return bson.M{"email": email}, nil
+	}
+	oid, err := primitive.ObjectIDFromHex(emailOrID)
+	if err != nil {
+		return nil, httperr.ErrInvalidParam(fmt.Errorf("user identifier %s is neither an email nor an id", emailOrID))
+	}
+	return bson.M{"_id": oid}, nil
+}
+
+// notDeleted : adds the condition that excludes soft deleted accounts to the filter
+func notDeleted(flt bson.M) bson.M {
+	flt["deletedat"] = bson.M{"$exists": false}
+	return flt
+}
+
 type UsersCollection struct {
 	DbColl *mongo.Collection
+	Ctx    context.Context // optional, queries run under this context when set, ex: session context of a transaction
+	// optional, accounts are looked up and listed only from the members of this org when set, ex: for org admins
+	Org primitive.ObjectID
+}
+
+// ctx : context under which the queries are fired, background unless Ctx is set
+func (u *UsersCollection) ctx() context.Context {
+	if u.Ctx != nil {
+		return u.Ctx
+	}
+	return context.Background()
 }
 
-// Authorize : Does not make any database connections - will but validate a token that was already generated from a prior login attempt
+// Authorize : validates a token that was already generated from a prior login attempt.
+// Also looks up the account the token belongs to, so that deleted accounts or accounts no longer active lose access before the token expires.
 //
 /*
 	tok := c.Request.Header.Get("Authorization")
@@ -51,15 +84,28 @@ type UsersCollection struct {
 	}
 */
 func (u *UsersCollection) Authorize(tok string) httperr.HttpErr {
-	jTok, err := jwt.ParseWithClaims(tok, &CustomClaims{}, func(t *jwt.Token) (interface{}, error) {
-		return []byte(JWTSigningKey), nil
-	})
+	_, err := u.AuthorizeClaims(tok)
+	return err
+}
+
+// AuthorizeClaims : same as Authorize but hands back the claims of the validated token, used by middleware that needs the caller's identity/role
+// Token can be sent bare or with the "Bearer " prefix
+func (u *UsersCollection) AuthorizeClaims(tok string) (*CustomClaims, httperr.HttpErr) {
+	claims, _, err := u.AuthorizeUser(tok)
+	return claims, err
+}
+
+// AuthorizeUser : same as AuthorizeClaims but also hands back the account the token belongs to, nil for client credentials tokens.
+// Saves the callers that need the profile from looking up the account again
+func (u *UsersCollection) AuthorizeUser(tok string) (*CustomClaims, *User, httperr.HttpErr) {
+	tok = strings.TrimPrefix(tok, "Bearer ")
+	jTok, err := jwt.ParseWithClaims(tok, &CustomClaims{}, u.verificationKey)
 	if err != nil {
-		return InvalidTokenErr(err)
+		return nil, nil, InvalidTokenErr(err)
 	}
 	claims, ok := jTok.Claims.(*CustomClaims)
 	if !ok || !jTok.Valid {
-		return InvalidTokenErr(fmt.Errorf("invalid token or claims"))
+		return nil, nil, InvalidTokenErr(fmt.Errorf("invalid token or claims"))
 	}
 	// NOTE: there isnt a need to check for ExpiredAt field since its already checked when we do ParsewithClaims
 	logrus.WithFields(logrus.Fields{
@@ -67,7 +113,36 @@ func (u *UsersCollection) Authorize(tok string) httperr.HttpErr {
 		"user":       claims.User,
 		"user_role":  claims.UserRole,
 	}).Debug("retreiving claims")
-	return nil
+	if claims.ClientID != "" {
+		if err := u.authorizeOAuthClaims(claims); err != nil {
+			return nil, nil, err
+		}
+		if claims.User == "" {
+			return claims, nil, nil // client credentials, there isnt an account behind the token
+		}
+	}
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	usr := User{}
+	if err := u.DbColl.FindOne(ctx, notDeleted(bson.M{"email": claims.User})).Decode(&usr); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil, InvalidTokenErr(fmt.Errorf("account %s for the token no longer exists", claims.User))
+		}
+		return nil, nil, httperr.ErrDBQuery(err)
+	}
+	if err := AccountStatusErr(&usr); err != nil {
+		return nil, nil, err
+	}
+	if claims.Gen < usr.TokenGen {
+		return nil, nil, InvalidTokenErr(fmt.Errorf("token for %s was revoked", claims.User))
+	}
+	if claims.Org != "" {
+		// removed from the org or role changed there since the token was issued
+		if m := usr.Membership(claims.Org); m == nil || m.Role != claims.OrgRole {
+			return nil, nil, InvalidTokenErr(fmt.Errorf("membership of %s in org %s has changed", claims.User, claims.Org))
+		}
+	}
+	return claims, &usr, nil
 }
 
 // Authenticate : will compare the email id against the hash of the password, upon success will sedn back the auth token.
@@ -92,8 +167,11 @@ func (u *UsersCollection) Authorize(tok string) httperr.HttpErr {
 
 */
 func (u *UsersCollection) Authenticate(usr *User) httperr.HttpErr {
-	ctx, _ := context.WithCancel(context.Background())
-	count, err := u.DbColl.CountDocuments(ctx, bson.M{"email": usr.Email})
+	ctx, _ := context.WithCancel(u.ctx())
+	if email, err := usr.Email.Normalize(); err == nil {
+		usr.Email = email // else is looked up as is, and wont be found
+	}
+	count, err := u.DbColl.CountDocuments(ctx, notDeleted(bson.M{"email": usr.Email}))
 	if dbe := httperr.ErrDBQuery(err); dbe != nil {
 		return dbe
 	}
@@ -101,29 +179,20 @@ func (u *UsersCollection) Authenticate(usr *User) httperr.HttpErr {
 		return httperr.ErrResourceNotFound(fmt.Errorf("failed to get user with email %s", usr.Email))
 	}
 	clearTextPass := usr.Auth // before unmarshalling the user from the database, getting the cleartext password
-	if err := httperr.ErrDBQuery(u.DbColl.FindOne(ctx, bson.M{"email": usr.Email}).Decode(usr)); err != nil {
+	if err := httperr.ErrDBQuery(u.DbColl.FindOne(ctx, notDeleted(bson.M{"email": usr.Email})).Decode(usr)); err != nil {
 		return err
 	}
 	hash := []byte(usr.Auth)
 	if err := MismatchPasswdErr(bcrypt.CompareHashAndPassword(hash, []byte(clearTextPass))); err != nil {
 		return err
 	}
-	// generate new jwt for this login
-	claims := CustomClaims{
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(10 * time.Minute).Unix(),
-			Issuer:    "patio-web server",
-			Subject:   "User authorization request",
-		},
-		User:     string(usr.Email),
-		UserRole: usr.Role,
-	}
-	tok := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)   // this signing method demands key of certain type
-	usr.AuthTok, err = tok.SignedString([]byte(JWTSigningKey)) // []byte is ok since signing method is SigningMethodHS256
-	if e := AuthTokenErr(err); e != nil {
-		return e
+	// status is checked only after the password, so as not to disclose it to anyone without the password
+	if err := AccountStatusErr(usr); err != nil {
+		return err
 	}
-	return nil
+	u.touchLogin(usr)
+	// generate new jwt for this login
+	return u.IssueToken(usr)
 }
 
 // EditUser: Can edit a few fields of the user in the database, except the email.
@@ -146,25 +215,13 @@ func (u *UsersCollection) Authenticate(usr *User) httperr.HttpErr {
 	c.AbortWithStatusJSON(http.StatusOK, usr) // no error - user authenticated
 */
 func (u *UsersCollection) EditUser(email string, name, passwd string, telegid int64) httperr.HttpErr {
-	ctx, _ := context.WithCancel(context.Background())
+	ctx, _ := context.WithCancel(u.ctx())
 	// Figuring out if the identifying param is email / id hex
-	var flt bson.M
-	if UserEmail(email).IsValid() {
-		flt = bson.M{"email": email}
-	} else {
-		hexID, err := primitive.ObjectIDFromHex(email)
-		if err != nil {
-			return httperr.ErrInvalidParam(fmt.Errorf("User identifier is invalid, check and send again"))
-		}
-		flt = bson.M{"_id": hexID}
-	}
-	cnt, err := u.DbColl.CountDocuments(ctx, flt)
-	if err != nil {
-		return httperr.ErrDBQuery(err) // no user for editing
-	}
-	if cnt == 0 {
-		return httperr.ErrResourceNotFound(fmt.Errorf("failed to get user %s", email))
+	flt, herr := userFilter(email)
+	if herr != nil {
+		return herr
 	}
+	flt = u.inScope(notDeleted(flt))
 	patch := bson.M{}
 	if passwd != "" { // if passwd is empty we dont want to change it
 		up := UserPassword(passwd)
@@ -187,12 +244,20 @@ func (u *UsersCollection) EditUser(email string, name, passwd string, telegid in
 	if telegid != int64(0) {
 		patch["telegid"] = telegid
 	}
-	ctx, _ = context.WithCancel(context.Background())            // if set withtimeout, 5 seconds isnt enough since generating the hash would take some time dependingon theccost
-	_, err = u.DbColl.UpdateOne(ctx, flt, bson.M{"$set": patch}) // user updated
-
-	if err != nil {
+	if len(patch) == 0 {
+		return httperr.ErrInvalidParam(fmt.Errorf("nothing to edit for user %s", email))
+	}
+	patch["updatedat"] = time.Now().Unix()
+	ctx, _ = context.WithCancel(u.ctx())                               // if set withtimeout, 5 seconds isnt enough since generating the hash would take some time dependingon theccost
+	result, err := u.DbColl.UpdateOne(ctx, flt, bson.M{"$set": patch}) // user updated
+	if mongo.IsDuplicateKeyError(err) {
+		return httperr.DuplicateResourceErr(fmt.Errorf("failed EditUser : %s", err))
+	} else if err != nil {
 		return httperr.ErrDBQuery(err)
 	}
+	if result.MatchedCount == 0 {
+		return httperr.ErrResourceNotFound(fmt.Errorf("failed to get user %s", email))
+	}
 	return nil
 }
 
@@ -221,6 +286,9 @@ func (u *UsersCollection) NewUser(usr *User) httperr.HttpErr {
 	if !UserName(usr.Name).IsValid() {
 		return httperr.ErrInvalidParam(fmt.Errorf("invalid name of the user"))
 	}
+	if !usr.Role.IsValid() {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid role for user"))
+	}
 	// Validation & hashing the password
 	up := UserPassword(usr.Auth)
 	if !up.IsValid() {
@@ -231,31 +299,44 @@ func (u *UsersCollection) NewUser(usr *User) httperr.HttpErr {
 		return httperr.ErrInvalidParam(fmt.Errorf("error generating the hash of the password"))
 	}
 	usr.Auth = hashedPasswd
+	if usr.Status == "" {
+		usr.Status = StatusActive
+	}
+	if (usr.Phone != "" && !usr.Phone.IsValid()) || (usr.Locale != "" && !usr.Locale.IsValid()) || (usr.Timezone != "" && !usr.Timezone.IsValid()) {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid phone, locale or timezone for user"))
+	}
+	// maintained by the collection, whatever the caller had set is overridden
+	now := time.Now().Unix()
+	usr.CreatedAt, usr.UpdatedAt, usr.LastLoginAt = now, now, 0
+	usr.Attributes, usr.Avatar = nil, "" // set once the account exists, attributes against the schema
+	usr.DeletedAt, usr.ErasedAt, usr.StatusReason, usr.StatusUntil = 0, 0, "", 0
+	usr.InviteHash, usr.InviteExp, usr.TokenGen = "", 0, 0
+	usr.PendingEmail, usr.EmailChangeHash, usr.EmailChangeExp, usr.EmailVerifiedAt = "", "", 0, 0 // email is proven only by a link sent to it
+	usr.Permissions, usr.Groups, usr.Identities = nil, nil, nil
 
-	if !UserEmail(usr.Email).IsValid() {
-		return httperr.ErrInvalidParam(fmt.Errorf("invalid email for user"))
-	}
-
-	// Checking for duplicates
-	ctx, _ := context.WithCancel(context.Background())
-	cnt, err := u.DbColl.CountDocuments(ctx, bson.M{"email": usr.Email}) // no 2 users can have the same email
+	email, err := usr.Email.Normalize()
 	if err != nil {
-		return httperr.ErrDBQuery(err)
-	}
-	if cnt != 0 {
-		return httperr.DuplicateResourceErr(fmt.Errorf("User already registered"))
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid email for user"))
 	}
+	usr.Email = email
 
-	// Finally inserting the new user details
+	// Unique email index rejects duplicates, soft deleted accounts still hold on to their email till purged
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
 	insertResult, err := u.DbColl.InsertOne(ctx, usr)
-	usr.Id = insertResult.InsertedID.(primitive.ObjectID) // newly inserted document id
-	if err != nil {
+	if mongo.IsDuplicateKeyError(err) {
+		return httperr.DuplicateResourceErr(fmt.Errorf("User already registered"))
+	} else if err != nil {
 		return httperr.ErrDBQuery(fmt.Errorf("failed NewUser : %s", err))
 	}
+	usr.Id = insertResult.InsertedID.(primitive.ObjectID) // newly inserted document id
 	return nil
 }
 
-// DeleteUser : given the email/id this can delete the account. Once deleted the account cannot be recovered.
+// DeleteUser : given the email/id this can delete the account. Deletion is soft, the account is only marked deleted
+// and can be restored with RestoreUser within DeleteRetention, after which PurgeDeleted removes it for good.
+// Accounts still pending on an invitation that was never used are removed right away, so that the email can be invited again.
+// Deleted accounts cannot authenticate and are not found by FindUser.
 // Incase the account isnt found throws NotFoundErr
 // It can figure out if the email or ID is used for addressing the account to be deleted
 //
@@ -274,36 +355,52 @@ func (u *UsersCollection) NewUser(usr *User) httperr.HttpErr {
 	c.AbortWithStatusJSON(http.StatusOK, usr) // no error - user authenticated
 */
 func (u *UsersCollection) DeleteUser(emailOrID string) httperr.HttpErr {
-	ctx, _ := context.WithCancel(context.Background())
-	var flt bson.M
-	if !UserEmail(emailOrID).IsValid() { // if its email or hex object id
-		// return httperr.ErrInvalidParam(fmt.Errorf("invalid email for user"))
-		oid, err := primitive.ObjectIDFromHex(emailOrID)
-		if err != nil {
-			return httperr.ErrInvalidParam(err) // id of the user is invalid
-		}
-		flt = bson.M{"_id": oid}
-	} else {
-		flt = bson.M{"email": emailOrID}
+	ctx, _ := context.WithCancel(u.ctx())
+	flt, herr := userFilter(emailOrID) // if its email or hex object id
+	if herr != nil {
+		return herr
 	}
-	delResult, err := u.DbColl.DeleteOne(ctx, flt)
+	if err := u.guardLastSuperUser(flt); err != nil {
+		return err
+	}
+	if removed, err := u.deletePendingInvite(flt); err != nil || removed {
+		return err
+	}
+	delResult, err := u.DbColl.UpdateOne(ctx, u.inScope(notDeleted(flt)), bson.M{"$set": bson.M{"deletedat": time.Now().Unix()}})
 	if err != nil {
 		return httperr.ErrDBQuery(fmt.Errorf("failed DeleteUser : %s", err))
 	}
-	if delResult.DeletedCount == 0 {
+	if delResult.MatchedCount == 0 {
 		return httperr.ErrResourceNotFound(fmt.Errorf("user account %s was not found", emailOrID))
 	}
 	return nil
 }
 
+// LookupUser : same as FindUser, but the account can be addressed either by email or hex object id
+func (u *UsersCollection) LookupUser(emailOrID string, result *User) httperr.HttpErr {
+	flt, herr := userFilter(emailOrID)
+	if herr != nil {
+		return herr
+	}
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	err := u.DbColl.FindOne(ctx, u.inScope(notDeleted(flt))).Decode(result)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return httperr.ErrResourceNotFound(err)
+	} else if err != nil {
+		return httperr.ErrDBQuery(err)
+	}
+	return nil
+}
+
 // FindUser : from the hex object id this shall get the user
 func (u *UsersCollection) FindUser(objIdHex string, result *User) httperr.HttpErr {
-	ctx, _ := context.WithCancel(context.Background())
+	ctx, _ := context.WithCancel(u.ctx())
 	oid, err := primitive.ObjectIDFromHex(objIdHex)
 	if err != nil {
 		return httperr.ErrInvalidParam(err)
 	}
-	sr := u.DbColl.FindOne(ctx, bson.M{"_id": oid})
+	sr := u.DbColl.FindOne(ctx, u.inScope(notDeleted(bson.M{"_id": oid})))
 	if sr.Err() != nil {
 		if errors.Is(sr.Err(), mongo.ErrNoDocuments) {
 			return httperr.ErrResourceNotFound(sr.Err())
@@ -316,3 +413,223 @@ func (u *UsersCollection) FindUser(objIdHex string, result *User) httperr.HttpEr
 	}
 	return nil
 }
+
+// RestoreUser : brings back a soft deleted account from its hex object id, provided its still within DeleteRetention
+// Accounts that arent deleted, or are past the window are NotFound
+func (u *UsersCollection) RestoreUser(objIdHex string) httperr.HttpErr {
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	oid, err := primitive.ObjectIDFromHex(objIdHex)
+	if err != nil {
+		return httperr.ErrInvalidParam(err)
+	}
+	flt := bson.M{"_id": oid, "deletedat": bson.M{"$gte": time.Now().Add(-DeleteRetention).Unix()}}
+	result, err := u.DbColl.UpdateOne(ctx, flt, bson.M{"$unset": bson.M{"deletedat": ""}})
+	if err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed RestoreUser : %s", err))
+	}
+	if result.MatchedCount == 0 {
+		return httperr.ErrResourceNotFound(fmt.Errorf("no deleted account %s within the restore window", objIdHex))
+	}
+	return nil
+}
+
+// PurgeDeleted : hard deletes accounts that were soft deleted before the DeleteRetention window.
+// Sends back the purged accounts so that the caller can clean up references to them elsewhere (audit)
+func (u *UsersCollection) PurgeDeleted() ([]User, httperr.HttpErr) {
+	ctx, cancel := context.WithTimeout(u.ctx(), 60*time.Second)
+	defer cancel()
+	flt := bson.M{"deletedat": bson.M{"$lt": time.Now().Add(-DeleteRetention).Unix()}}
+	cur, err := u.DbColl.Find(ctx, flt)
+	if err != nil {
+		return nil, httperr.ErrDBQuery(err)
+	}
+	expired := []User{}
+	if err := cur.All(ctx, &expired); err != nil {
+		return nil, httperr.ErrDBQuery(err)
+	}
+	purged := []User{}
+	for _, usr := range expired {
+		// one at a time, an account restored in the meantime wont match and is left alone
+		result, err := u.DbColl.DeleteOne(ctx, bson.M{"_id": usr.Id, "deletedat": usr.DeletedAt})
+		if err != nil {
+			return purged, httperr.ErrDBQuery(fmt.Errorf("failed PurgeDeleted : %s", err))
+		}
+		if result.DeletedCount == 1 {
+			purged = append(purged, usr)
+		}
+	}
+	return purged, nil
+}
+
+// SetStatus : moves the account from its current status to the one desired, if the transition is allowed.
+// Reason is recorded against the status, until (unix seconds) is honoured only for suspensions after which the account is active again.
+// Caller can only change the status of accounts that are strictly below their own role.
+//
+/*
+	err := uc.SetStatus(usrIdHex, models.StatusSuspended, "repeated abuse", time.Now().Add(72*time.Hour).Unix(), claims.UserRole)
+*/
+func (u *UsersCollection) SetStatus(objIdHex string, to UserStatus, reason string, until int64, callerRole UserRole) httperr.HttpErr {
+	target := User{}
+	if err := u.FindUser(objIdHex, &target); err != nil {
+		return err
+	}
+	if target.Role <= callerRole {
+		return httperr.ErrForbidden(fmt.Errorf("role %d cannot change status of %s with role %d", callerRole, target.Email, target.Role))
+	}
+	return u.AssignStatus(objIdHex, to, reason, until)
+}
+
+// AssignStatus : changes the status without regard to who is asking, for break-glass use from the command line.
+// Last remaining SuperUser still cannot be locked out.
+func (u *UsersCollection) AssignStatus(objIdHex string, to UserStatus, reason string, until int64) httperr.HttpErr {
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	if !to.IsValid() {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid account status %s", to))
+	}
+	usr := User{}
+	if err := u.FindUser(objIdHex, &usr); err != nil {
+		return err
+	}
+	from := usr.CurrentStatus()
+	if !from.CanTransition(to) {
+		return httperr.ErrInvalidParam(fmt.Errorf("account status cannot change from %s to %s", from, to))
+	}
+	if to != StatusActive {
+		if err := u.guardLastSuperUser(bson.M{"_id": usr.Id}); err != nil {
+			return err
+		}
+	}
+	patch := bson.M{"$set": bson.M{"status": to, "statusreason": reason}, "$unset": bson.M{"statusuntil": ""}}
+	if to == StatusSuspended && until != 0 {
+		if until <= time.Now().Unix() {
+			return httperr.ErrInvalidParam(fmt.Errorf("suspension cannot end in the past"))
+		}
+		patch = bson.M{"$set": bson.M{"status": to, "statusreason": reason, "statusuntil": until}}
+	}
+	if _, err := u.DbColl.UpdateOne(ctx, bson.M{"_id": usr.Id}, patch); err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed SetStatus : %s", err))
+	}
+	return nil
+}
+
+// ReactivateExpired : suspensions that are past their expiry are made active.
+// CurrentStatus already treats them as active, this only brings the database in line with it.
+func (u *UsersCollection) ReactivateExpired() (int64, httperr.HttpErr) {
+	ctx, cancel := context.WithTimeout(u.ctx(), 60*time.Second)
+	defer cancel()
+	flt := bson.M{"status": StatusSuspended, "statusuntil": bson.M{"$gt": 0, "$lt": time.Now().Unix()}}
+	result, err := u.DbColl.UpdateMany(ctx, flt, bson.M{
+		"$set":   bson.M{"status": StatusActive, "statusreason": "suspension expired"},
+		"$unset": bson.M{"statusuntil": ""},
+	})
+	if err != nil {
+		return 0, httperr.ErrDBQuery(fmt.Errorf("failed ReactivateExpired : %s", err))
+	}
+	return result.ModifiedCount, nil
+}
+
+// guardLastSuperUser : errors if the account that the filter matches is the only SuperUser left
+// NOTE: count followed by the change isnt atomic, two admins racing to demote the last 2 superusers could both succeed
+func (u *UsersCollection) guardLastSuperUser(flt bson.M) httperr.HttpErr {
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	target := User{}
+	err := u.DbColl.FindOne(ctx, notDeleted(flt)).Decode(&target)
+	if err == mongo.ErrNoDocuments {
+		return nil // nothing to guard, caller decides what to do with missing account
+	} else if err != nil {
+		return httperr.ErrDBQuery(err)
+	}
+	if target.Role != SuperUser {
+		return nil
+	}
+	count, err := u.DbColl.CountDocuments(ctx, notDeleted(bson.M{"role": SuperUser}))
+	if err != nil {
+		return httperr.ErrDBQuery(err)
+	}
+	if count <= 1 {
+		return LastSuperUserErr(fmt.Errorf("%s is the last superuser", target.Email))
+	}
+	return nil
+}
+
+// SetRole : changes the role of the account. Caller can only grant roles strictly below their own,
+// and only to accounts that are strictly below them. Last remaining SuperUser can never be demoted.
+// Tokens of the account are revoked so that the new role takes effect right away.
+//
+/*
+	claims := c.MustGet("claims").(*models.CustomClaims)
+	err := uc.SetRole(usrIdHex, models.Admin, claims.UserRole)
+*/
+func (u *UsersCollection) SetRole(objIdHex string, role, callerRole UserRole) httperr.HttpErr {
+	if !role.IsValid() {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid role %d", role))
+	}
+	target := User{}
+	if err := u.FindUser(objIdHex, &target); err != nil {
+		return err
+	}
+	if role <= callerRole || target.Role <= callerRole {
+		return httperr.ErrForbidden(fmt.Errorf("role %d cannot change role of %s from %d to %d", callerRole, target.Email, target.Role, role))
+	}
+	return u.AssignRole(objIdHex, role)
+}
+
+// AssignRole : changes the role without regard to who is asking, for break-glass use from the command line.
+// Last remaining SuperUser is still guarded, tokens of the account are revoked.
+func (u *UsersCollection) AssignRole(objIdHex string, role UserRole) httperr.HttpErr {
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	if !role.IsValid() {
+		return httperr.ErrInvalidParam(fmt.Errorf("invalid role %d", role))
+	}
+	target := User{}
+	if err := u.FindUser(objIdHex, &target); err != nil {
+		return err
+	}
+	if role != SuperUser {
+		if err := u.guardLastSuperUser(bson.M{"_id": target.Id}); err != nil {
+			return err
+		}
+	}
+	if _, err := u.DbColl.UpdateOne(ctx, bson.M{"_id": target.Id}, bson.M{"$set": bson.M{"role": role}}); err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed AssignRole : %s", err))
+	}
+	return u.RevokeTokens(objIdHex)
+}
+
+// ListUsers : accounts that arent deleted, sorted by email. limit of 0 is no limit. Only the members when scoped to an org
+func (u *UsersCollection) ListUsers(skip, limit int64) ([]User, httperr.HttpErr) {
+	ctx, cancel := context.WithTimeout(u.ctx(), 30*time.Second)
+	defer cancel()
+	cur, err := u.DbColl.Find(ctx, u.inScope(notDeleted(bson.M{})), options.Find().SetSort(bson.M{"email": 1}).SetSkip(skip).SetLimit(limit))
+	if err != nil {
+		return nil, httperr.ErrDBQuery(err)
+	}
+	result := []User{}
+	if err := cur.All(ctx, &result); err != nil {
+		return nil, httperr.ErrDBQuery(err)
+	}
+	return result, nil
+}
+
+// RevokeTokens : all the tokens issued to the account till now are invalid, account has to login again.
+// Bumps the generation of the account's tokens, tokens carry the generation they were issued in
+func (u *UsersCollection) RevokeTokens(objIdHex string) httperr.HttpErr {
+	ctx, cancel := context.WithTimeout(u.ctx(), 10*time.Second)
+	defer cancel()
+	oid, err := primitive.ObjectIDFromHex(objIdHex)
+	if err != nil {
+		return httperr.ErrInvalidParam(err)
+	}
+	result, err := u.DbColl.UpdateOne(ctx, notDeleted(bson.M{"_id": oid}), bson.M{"$inc": bson.M{"tokgen": 1}})
+	if err != nil {
+		return httperr.ErrDBQuery(fmt.Errorf("failed RevokeTokens : %s", err))
+	}
+	if result.MatchedCount == 0 {
+		return httperr.ErrResourceNotFound(fmt.Errorf("user account %s was not found", objIdHex))
+	}
+	return nil
+}
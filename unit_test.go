@@ -1,19 +1,35 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"image"
+	"image/color"
+	"image/png"
 	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/eensymachines-in/errx/httperr"
 	"github.com/eensymachines-in/webapi-userauth/models"
+	"github.com/golang-jwt/jwt"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
@@ -63,6 +79,9 @@ func testConnectDatabase() (*models.UsersCollection, error) {
 	db := client.Database(TESTDB_NAME)
 	coll := db.Collection(TESTCOLL_NAME)
 	uc := models.UsersCollection{DbColl: coll}
+	if err := uc.EnsureIndexes(); err != nil {
+		return nil, err
+	}
 	/* from dummy json we will insert all the data for the teest database
 	incase there is an error we report that back when before running the test */
 
@@ -235,3 +254,1392 @@ func TestUserInsert(t *testing.T) {
 // 		})
 // 	}
 // }
+
+// TestAuditChain : appends to a stream, verifies the chain and then tampers with it
+func TestAuditChain(t *testing.T) {
+	uc, err := testConnectDatabase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ac := models.AuditCollection{DbColl: uc.DbColl.Database().Collection("audit")}
+	assert.Nil(t, ac.EnsureIndexes(), "unexpected error creating audit indexes")
+	models.AuditCheckpointEvery = 3
+	for i := 0; i < 7; i++ {
+		got := ac.Append(&models.AuditRecord{Stream: "test", Action: "edit", Actor: "bsmewings1@storify.com", Subject: "pmosconi2@tiny.cc", Details: map[string]string{"index": fmt.Sprint(i)}})
+		assert.Nil(t, got, "unexpected error appending audit record")
+	}
+	report, got := ac.Verify("test")
+	assert.Nil(t, got, "unexpected error verifying chain")
+	assert.True(t, report.Intact, "untampered chain reported broken")
+	assert.Equal(t, int64(7), report.Records)
+	assert.Equal(t, int64(2), report.Checkpoints)
+	// altering a record
+	ac.DbColl.UpdateOne(context.Background(), bson.M{"stream": "test", "seq": 4}, bson.M{"$set": bson.M{"action": "delete"}})
+	report, _ = ac.Verify("test")
+	assert.False(t, report.Intact, "altered record not detected")
+	assert.Equal(t, int64(4), report.BrokenAt)
+	// deleting the tail past a checkpoint
+	ac.DbColl.UpdateOne(context.Background(), bson.M{"stream": "test", "seq": 4}, bson.M{"$set": bson.M{"action": "edit"}})
+	ac.DbColl.DeleteMany(context.Background(), bson.M{"stream": "test", "seq": bson.M{"$gte": 6}})
+	report, _ = ac.Verify("test")
+	assert.False(t, report.Intact, "truncated chain not detected")
+	assert.Equal(t, int64(6), report.BrokenAt)
+	// deleting only the records after the last checkpoint, the signed head still has them
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, ac.Append(&models.AuditRecord{Stream: "tail", Action: "edit", Actor: "bsmewings1@storify.com", Subject: "pmosconi2@tiny.cc"}))
+	}
+	report, _ = ac.Verify("tail")
+	assert.True(t, report.Intact, "untampered chain reported broken")
+	ac.DbColl.DeleteOne(context.Background(), bson.M{"stream": "tail", "seq": 3})
+	report, _ = ac.Verify("tail")
+	assert.False(t, report.Intact, "record deleted past the last checkpoint not detected")
+	assert.Equal(t, int64(3), report.BrokenAt)
+	t.Cleanup(func() {
+		ctx := context.Background()
+		ac.DbColl.Drop(ctx)
+		ac.DbColl.Database().Collection("audit_checkpoints").Drop(ctx)
+		ac.DbColl.Database().Collection("audit_heads").Drop(ctx)
+		uc.DbColl.DeleteMany(ctx, bson.M{})
+		uc.DbColl.Database().Client().Disconnect(ctx)
+	})
+}
+
+// TestSoftDelete : deleted accounts are hidden till restored, and purged only past the retention window
+func TestSoftDelete(t *testing.T) {
+	uc, err := testConnectDatabase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	usr := models.User{Name: "Belva Cutchie", Email: "bcutchie0@live.com", Role: models.EndUser, Auth: "xrqYOB165f8V"}
+	assert.Nil(t, uc.NewUser(&usr), "unexpected error creating user")
+	assert.Nil(t, uc.DeleteUser(string(usr.Email)), "unexpected error deleting user")
+	assert.NotNil(t, uc.DeleteUser(string(usr.Email)), "deleted user deleted again")
+	assert.NotNil(t, uc.FindUser(usr.Id.Hex(), &models.User{}), "deleted user was found")
+	assert.NotNil(t, uc.Authenticate(&models.User{Email: usr.Email, Auth: "xrqYOB165f8V"}), "deleted user authenticated")
+	purged, got := uc.PurgeDeleted()
+	assert.Nil(t, got)
+	assert.Equal(t, 0, len(purged), "account within retention was purged")
+	assert.Nil(t, uc.RestoreUser(usr.Id.Hex()), "unexpected error restoring user")
+	assert.Nil(t, uc.FindUser(usr.Id.Hex(), &models.User{}), "restored user not found")
+	// past the retention window
+	assert.Nil(t, uc.DeleteUser(usr.Id.Hex()))
+	uc.DbColl.UpdateOne(context.Background(), bson.M{"_id": usr.Id}, bson.M{"$set": bson.M{"deletedat": time.Now().Add(-models.DeleteRetention).Unix() - 1}})
+	assert.NotNil(t, uc.RestoreUser(usr.Id.Hex()), "account past retention was restored")
+	purged, got = uc.PurgeDeleted()
+	assert.Nil(t, got)
+	assert.Equal(t, 1, len(purged), "account past retention was not purged")
+	t.Cleanup(func() {
+		ctx := context.Background()
+		uc.DbColl.DeleteMany(ctx, bson.M{})
+		uc.DbColl.Database().Client().Disconnect(ctx)
+	})
+}
+
+// TestUserStatus : status transitions and their effect on authentication
+func TestUserStatus(t *testing.T) {
+	uc, err := testConnectDatabase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	usr := models.User{Name: "Laurie Kmietsc", Email: "lkmietsch0@mac.com", Role: models.EndUser, Auth: "lcxWLM5753Xo"}
+	assert.Nil(t, uc.NewUser(&usr), "unexpected error creating user")
+	login := func() httperr.HttpErr {
+		return uc.Authenticate(&models.User{Email: usr.Email, Auth: "lcxWLM5753Xo"})
+	}
+	assert.Nil(t, login(), "active user failed to login")
+	assert.NotNil(t, uc.SetStatus(usr.Id.Hex(), models.StatusSuspended, "testing", 0, models.EndUser), "status of a peer changed")
+	assert.Nil(t, uc.SetStatus(usr.Id.Hex(), models.StatusSuspended, "testing", time.Now().Add(time.Hour).Unix(), models.Admin))
+	got := login()
+	assert.NotNil(t, got, "suspended user could login")
+	assert.Equal(t, 403, got.HttpStatusCode())
+	assert.NotNil(t, uc.SetStatus(usr.Id.Hex(), models.StatusLocked, "testing", 0, models.Admin), "suspended -> locked isnt allowed")
+	assert.NotNil(t, uc.SetStatus(usr.Id.Hex(), models.UserStatus("frozen"), "testing", 0, models.Admin), "invalid status accepted")
+	assert.Nil(t, uc.SetStatus(usr.Id.Hex(), models.StatusActive, "testing", 0, models.Admin))
+	assert.Nil(t, uc.SetStatus(usr.Id.Hex(), models.StatusLocked, "testing", 0, models.Admin))
+	got = login()
+	assert.NotNil(t, got, "locked user could login")
+	assert.Equal(t, 423, got.HttpStatusCode())
+	// suspension that has expired
+	assert.Nil(t, uc.SetStatus(usr.Id.Hex(), models.StatusActive, "testing", 0, models.Admin))
+	assert.Nil(t, uc.SetStatus(usr.Id.Hex(), models.StatusSuspended, "testing", time.Now().Add(time.Hour).Unix(), models.Admin))
+	uc.DbColl.UpdateOne(context.Background(), bson.M{"_id": usr.Id}, bson.M{"$set": bson.M{"statusuntil": time.Now().Add(-time.Minute).Unix()}})
+	assert.Nil(t, login(), "user with expired suspension failed to login")
+	count, got := uc.ReactivateExpired()
+	assert.Nil(t, got)
+	assert.Equal(t, int64(1), count)
+	t.Cleanup(func() {
+		ctx := context.Background()
+		uc.DbColl.DeleteMany(ctx, bson.M{})
+		uc.DbColl.Database().Client().Disconnect(ctx)
+	})
+}
+
+// TestPersonalData : exporting and then erasing personal data of an account
+func TestPersonalData(t *testing.T) {
+	uc, err := testConnectDatabase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ac := models.AuditCollection{DbColl: uc.DbColl.Database().Collection("audit")}
+	usr := models.User{Name: "Wake Aaron", Email: "waaron1@merriamwebster.com", Role: models.EndUser, Auth: "feuTUC462GH"}
+	assert.Nil(t, uc.NewUser(&usr), "unexpected error creating user")
+	_, err = uc.DbColl.UpdateOne(context.Background(), bson.M{"_id": usr.Id}, bson.M{"$set": bson.M{
+		"phone": "+919823012345", "locale": "en-IN", "timezone": "Asia/Kolkata", "attributes": bson.M{"farm": "Kolhapur north"},
+	}})
+	assert.Nil(t, err)
+	assert.Nil(t, ac.Append(&models.AuditRecord{Stream: "test", Action: "login-failed", Actor: string(usr.Email), Subject: string(usr.Email)}))
+	assert.Nil(t, ac.Append(&models.AuditRecord{Stream: "test", Action: "login", Actor: usr.Id.Hex(), Subject: usr.Id.Hex()}))
+	export, got := uc.ExportPersonalData(usr.Id.Hex(), &ac)
+	assert.Nil(t, got, "unexpected error exporting personal data")
+	assert.Equal(t, 2, len(export.Audit))
+	store := &models.LocalBlobStore{Dir: t.TempDir()}
+	assert.Nil(t, store.Put(fmt.Sprintf("avatars/%s/%d", usr.Id.Hex(), models.AvatarSizes[0]), "image/png", []byte("thumbnail")))
+	assert.Nil(t, uc.ErasePersonalData(usr.Id.Hex(), &ac, store), "unexpected error erasing personal data")
+	_, got = models.AvatarBlob(usr.Id.Hex(), 0, store)
+	assert.NotNil(t, got, "avatar left after erasure")
+	erased := models.User{}
+	assert.Nil(t, uc.FindUser(usr.Id.Hex(), &erased), "erased account should still be there")
+	assert.Equal(t, models.UserName(models.ErasedUserName), erased.Name)
+	assert.Empty(t, erased.Phone, "phone left after erasure")
+	assert.Empty(t, erased.Locale)
+	assert.Empty(t, erased.Timezone)
+	assert.Empty(t, erased.Attributes, "attributes left after erasure")
+	assert.NotNil(t, uc.Authenticate(&models.User{Email: usr.Email, Auth: "feuTUC462GH"}), "erased account could login")
+	report, got := ac.Verify("test")
+	assert.Nil(t, got)
+	assert.True(t, report.Intact, "anonymizing broke the audit chain")
+	records, _ := ac.RecordsFor(usr.Id.Hex())
+	assert.Equal(t, 1, len(records), "audit records by account id should remain")
+	t.Cleanup(func() {
+		ctx := context.Background()
+		ac.DbColl.Drop(ctx)
+		uc.DbColl.DeleteMany(ctx, bson.M{})
+		uc.DbColl.Database().Client().Disconnect(ctx)
+	})
+}
+
+// TestInviteUser : invited account is pending till the one time token is used
+func TestInviteUser(t *testing.T) {
+	uc, err := testConnectDatabase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	usr := models.User{Name: "Kata Finnigan", Email: "kfinnigane@statcounter.com", Role: models.Admin}
+	tok, got := uc.InviteUser(&usr)
+	assert.Nil(t, got, "unexpected error inviting user")
+	_, got = uc.InviteUser(&models.User{Name: "Kata Finnigan", Email: "kfinnigane@statcounter.com", Role: models.Admin})
+	assert.NotNil(t, got, "duplicate invitation")
+	assert.Nil(t, uc.DeleteUser(usr.Id.Hex()))
+	_, got = uc.InviteUser(&models.User{Name: "Kata Finnigan", Email: "kfinnigane@statcounter.com", Role: models.Admin})
+	assert.Nil(t, got, "email of a withdrawn invitation could not be invited again")
+	assert.NotNil(t, uc.AcceptInvite(tok, "hodTTT912Ma", &models.User{}), "withdrawn invitation accepted")
+	tok, got = uc.InviteUser(&models.User{Name: "Kata Finnigan", Email: "kfinnigane@statcounter.com", Role: models.Admin})
+	assert.NotNil(t, got, "duplicate invitation")
+	got = uc.Authenticate(&models.User{Email: usr.Email, Auth: ""})
+	assert.NotNil(t, got, "pending account could login")
+	assert.NotNil(t, uc.AcceptInvite(tok, "54655", &models.User{}), "invalid password accepted")
+	assert.NotNil(t, uc.AcceptInvite("notthetoken", "hodTTT912Ma", &models.User{}), "invalid token accepted")
+	accepted := models.User{}
+	assert.Nil(t, uc.AcceptInvite(tok, "hodTTT912Ma", &accepted), "unexpected error accepting invite")
+	assert.Equal(t, models.Admin, accepted.Role)
+	assert.NotNil(t, uc.AcceptInvite(tok, "hodTTT912Ma", &models.User{}), "invitation used twice")
+	assert.Nil(t, uc.Authenticate(&models.User{Email: usr.Email, Auth: "hodTTT912Ma"}), "activated account failed to login")
+	t.Cleanup(func() {
+		ctx := context.Background()
+		uc.DbColl.DeleteMany(ctx, bson.M{})
+		uc.DbColl.Database().Client().Disconnect(ctx)
+	})
+}
+
+// TestUserRole : role changes are bound by the caller's own role and never leave the system without a superuser
+func TestUserRole(t *testing.T) {
+	uc, err := testConnectDatabase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	uc.DbColl.DeleteMany(context.Background(), bson.M{}) // dummy users are all superusers, none of them should count here
+	super := models.User{Name: "Nick Steinson", Email: "nsteinsong@squidoo.com", Role: models.SuperUser, Auth: "qbuOKI669ArE"}
+	assert.Nil(t, uc.NewUser(&super))
+	usr := models.User{Name: "Lissie Elman", Email: "lelmank@dell.com", Role: models.EndUser, Auth: "rzrXRI123"}
+	assert.Nil(t, uc.NewUser(&usr))
+	login := &models.User{Email: usr.Email, Auth: "rzrXRI123"}
+	assert.Nil(t, uc.Authenticate(login))
+	tok := login.AuthTok
+
+	assert.NotNil(t, uc.SetRole(usr.Id.Hex(), models.Admin, models.Admin), "admin granted admin")
+	assert.NotNil(t, uc.SetRole(usr.Id.Hex(), models.UserRole(9), models.SuperUser), "invalid role granted")
+	assert.Nil(t, uc.SetRole(usr.Id.Hex(), models.Admin, models.SuperUser), "superuser failed to grant admin")
+	assert.NotNil(t, uc.Authorize(tok), "token issued before role change still valid")
+	assert.NotNil(t, uc.SetRole(usr.Id.Hex(), models.EndUser, models.Admin), "admin demoted a peer")
+
+	got := uc.DeleteUser(super.Id.Hex())
+	assert.NotNil(t, got, "last superuser deleted")
+	assert.Equal(t, 409, got.HttpStatusCode())
+	t.Cleanup(func() {
+		ctx := context.Background()
+		uc.DbColl.DeleteMany(ctx, bson.M{})
+		uc.DbColl.Database().Client().Disconnect(ctx)
+	})
+}
+
+// TestBootstrap : setup token creates the first superuser exactly once
+func TestBootstrap(t *testing.T) {
+	uc, err := testConnectDatabase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	uc.DbColl.DeleteMany(context.Background(), bson.M{}) // dummy users are all superusers
+	has, got := uc.HasSuperUser()
+	assert.Nil(t, got)
+	assert.False(t, has, "test database should not have a superuser")
+	tok, got := uc.NewSetupToken()
+	assert.Nil(t, got, "unexpected error generating setup token")
+	assert.NotNil(t, uc.RedeemSetupToken("notthetoken", &models.User{Name: "Di Goney", Email: "dgoneym@msu.edu", Auth: "ynyCXI548"}), "invalid setup token accepted")
+	assert.NotNil(t, uc.RedeemSetupToken(tok, &models.User{Name: "Di Goney", Email: "dgoneym@msu.edu", Auth: "54655"}), "invalid password accepted")
+	usr := models.User{Name: "Di Goney", Email: "dgoneym@msu.edu", Auth: "ynyCXI548"}
+	assert.Nil(t, uc.RedeemSetupToken(tok, &usr), "token should be usable after a failed attempt")
+	assert.Equal(t, models.SuperUser, usr.Role)
+	assert.NotNil(t, uc.RedeemSetupToken(tok, &models.User{Name: "Berrie Borell", Email: "bborello@histats.com", Auth: "rccPJH583"}), "setup token used twice")
+	t.Cleanup(func() {
+		ctx := context.Background()
+		uc.DbColl.DeleteMany(ctx, bson.M{})
+		uc.DbColl.Database().Collection("setup").Drop(ctx)
+		uc.DbColl.Database().Client().Disconnect(ctx)
+	})
+}
+
+// TestSigningKeyRotation : tokens signed with a retired key stay valid till they expire or the grace period is over
+func TestSigningKeyRotation(t *testing.T) {
+	uc, err := testConnectDatabase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	usr := models.User{Email: "bsmewings1@storify.com", Auth: "oikTAF118*2No3K"}
+	assert.Nil(t, uc.Authenticate(&usr), "unexpected error authenticating without rotated keys")
+	legacy := usr.AuthTok
+	kid, got := uc.RotateSigningKey()
+	assert.Nil(t, got, "unexpected error rotating keys")
+	assert.NotEmpty(t, kid)
+	assert.Nil(t, uc.IssueToken(&usr))
+	first := usr.AuthTok
+	_, got = uc.RotateSigningKey()
+	assert.Nil(t, got)
+	assert.Nil(t, uc.IssueToken(&usr))
+	for _, tok := range []string{first, usr.AuthTok} {
+		assert.Nil(t, uc.Authorize(tok), "token failed authorization after rotation")
+	}
+	assert.NotNil(t, uc.Authorize(legacy), "token without kid authorized once keys are in the store")
+	uc.DbColl.Database().Collection("keys").UpdateOne(context.Background(), bson.M{"_id": kid}, bson.M{"$set": bson.M{"retiredat": time.Now().Add(-models.RetiredKeyGrace).Unix() - 1}})
+	assert.NotNil(t, uc.Authorize(first), "token of a key retired beyond the grace period authorized")
+	t.Cleanup(func() {
+		ctx := context.Background()
+		uc.DbColl.DeleteMany(ctx, bson.M{})
+		uc.DbColl.Database().Collection("keys").Drop(ctx)
+		uc.DbColl.Database().Client().Disconnect(ctx)
+	})
+}
+
+// TestBulkImport : rows are validated one by one, dry run writes nothing and duplicates follow the policy
+func TestBulkImport(t *testing.T) {
+	uc, err := testConnectDatabase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	uc.DbColl.DeleteMany(context.Background(), bson.M{})
+	csvIn := `name,email,role,telegid,auth
+Trudy Swafield,tswafield8@msn.com,2,324651,tvvEUI0700Jc
+Wynne Nussgen,wnussgen9,2,808767,bpaCQU989
+Shanta Brisco,sbrisco7@ning.com,0,373569,hexDWW999W
+Trudy Swafield,tswafield8@msn.com,2,111111,tvvEUI0700Jc
+`
+	opts := models.ImportOptions{Format: models.FormatCSV, Policy: models.PolicySkip, DryRun: true, CallerRole: models.Admin}
+	report, got := uc.ImportUsers(strings.NewReader(csvIn), opts)
+	assert.Nil(t, got, "unexpected error on dry run")
+	assert.Equal(t, 4, report.Total)
+	assert.Equal(t, 1, report.Created)
+	assert.Equal(t, 2, report.Invalid, "bad email and role above the importer should be invalid")
+	assert.Equal(t, 1, report.Skipped, "duplicate within the input should be skipped")
+	cnt, _ := uc.DbColl.CountDocuments(context.Background(), bson.M{})
+	assert.Equal(t, int64(0), cnt, "dry run wrote to the database")
+
+	opts.DryRun = false
+	report, got = uc.ImportUsers(strings.NewReader(csvIn), opts)
+	assert.Nil(t, got)
+	assert.Equal(t, 1, report.Created)
+	assert.Nil(t, uc.Authenticate(&models.User{Email: "tswafield8@msn.com", Auth: "tvvEUI0700Jc"}), "imported user failed to login")
+
+	hash, _ := models.UserPassword("rzrXRI123").StringHash()
+	ndjson := fmt.Sprintf("{\"name\": \"Trudy Swafield\", \"email\": \"tswafield8@msn.com\", \"telegid\": 999, \"role\": 2, \"auth\": %q}\n{\"name\": \"Lissie Elman\", \"email\": \"lelmank@dell.com\", \"role\": 2, \"auth\": %q, \"status\": \"disabled\"}\n", hash, hash)
+	report, got = uc.ImportUsers(strings.NewReader(ndjson), models.ImportOptions{Format: models.FormatNDJSON, Policy: models.PolicyUpsert, PreHashed: true, CallerRole: models.Admin})
+	assert.Nil(t, got)
+	assert.Equal(t, 1, report.Updated)
+	assert.Equal(t, 1, report.Created)
+	assert.Nil(t, uc.Authenticate(&models.User{Email: "lelmank@dell.com", Auth: "rzrXRI123"}), "status should not be imported")
+	updated := models.User{}
+	assert.Nil(t, uc.LookupUser("tswafield8@msn.com", &updated))
+	assert.NotZero(t, updated.TokenGen, "tokens not revoked when the password was imported")
+
+	out := &strings.Builder{}
+	assert.Nil(t, uc.ExportUsers(out, models.FormatCSV))
+	assert.NotContains(t, out.String(), "$2a$", "password hashes exported")
+	assert.Equal(t, 3, strings.Count(out.String(), "\n"))
+	t.Cleanup(func() {
+		ctx := context.Background()
+		uc.DbColl.DeleteMany(ctx, bson.M{})
+		uc.DbColl.Database().Client().Disconnect(ctx)
+	})
+}
+
+// TestBatchOps : operations are applied one by one, atomic batches roll back on the first failure
+func TestBatchOps(t *testing.T) {
+	uc, err := testConnectDatabase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	uc.DbColl.DeleteMany(context.Background(), bson.M{})
+	admin := models.User{Name: "Nick Steinson", Email: "nsteinsong@squidoo.com", Role: models.Admin, Auth: "qbuOKI669ArE"}
+	assert.Nil(t, uc.NewUser(&admin))
+	usr := models.User{Name: "Lissie Elman", Email: "lelmank@dell.com", Role: models.EndUser, Auth: "rzrXRI123"}
+	assert.Nil(t, uc.NewUser(&usr))
+	guest := models.User{Name: "Di Goney", Email: "dgoneym@msu.edu", Role: models.Guest, Auth: "ynyCXI548"}
+	assert.Nil(t, uc.NewUser(&guest))
+
+	_, got := uc.RunBatch([]models.BatchOp{}, models.Admin, false)
+	assert.NotNil(t, got, "empty batch accepted")
+
+	ops := []models.BatchOp{
+		{Op: models.BatchSetTelegID, Target: string(usr.Email), TelegID: 5435345},
+		{Op: models.BatchDelete, Target: string(admin.Email)}, // peer of the caller
+		{Op: models.BatchSuspend, Target: guest.Id.Hex(), Reason: "testing"},
+	}
+	report, got := uc.RunBatch(ops, models.Admin, false)
+	assert.Nil(t, got)
+	assert.Equal(t, 2, report.Done)
+	assert.Equal(t, 1, report.Failed)
+	assert.Equal(t, 403, report.Items[1].Status)
+	found := models.User{}
+	assert.Nil(t, uc.FindUser(guest.Id.Hex(), &found))
+	assert.Equal(t, models.StatusSuspended, found.CurrentStatus())
+
+	ops = []models.BatchOp{
+		{Op: models.BatchDelete, Target: string(usr.Email)},
+		{Op: "rename", Target: guest.Id.Hex()},
+		{Op: models.BatchDelete, Target: guest.Id.Hex()},
+	}
+	report, got = uc.RunBatch(ops, models.Admin, true)
+	if got != nil {
+		t.Log("atomic batch needs a replica set, skipping")
+	} else {
+		assert.False(t, report.Committed)
+		assert.Equal(t, []string{"rolledback", "failed", "skipped"}, []string{report.Items[0].Result, report.Items[1].Result, report.Items[2].Result})
+		assert.Nil(t, uc.FindUser(usr.Id.Hex(), &found), "rolled back delete still applied")
+	}
+	t.Cleanup(func() {
+		ctx := context.Background()
+		uc.DbColl.DeleteMany(ctx, bson.M{})
+		uc.DbColl.Database().Client().Disconnect(ctx)
+	})
+}
+
+// TestMigrations : migrations apply in order, dry run only counts, down reverts and the lock keeps out a second instance
+func TestMigrations(t *testing.T) {
+	uc, err := testConnectDatabase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	db := uc.DbColl.Database()
+	ctx := context.Background()
+	db.Collection("migrations").DeleteMany(ctx, bson.M{})
+	db.Collection("migration_lock").DeleteMany(ctx, bson.M{})
+	uc.DbColl.DeleteMany(ctx, bson.M{})
+	for _, usr := range []bson.M{{"name": "Wynne Nussgen", "email": "wnussgen9@pinterest.com"}, {"name": "Shanta Brisco", "email": "sbrisco7@ning.com", "status": "locked"}} {
+		uc.DbColl.InsertOne(ctx, usr) // documents from before status was introduced
+	}
+
+	m := models.Migrator{Db: db, Migrations: models.Migrations[:1], Owner: "test"}
+	report, got := m.Up(0, true)
+	assert.Nil(t, got, "unexpected error on dry run")
+	assert.Equal(t, int64(1), report.Steps[0].Affected)
+	status, _ := m.Status()
+	assert.False(t, status[0].Applied, "dry run applied the migration")
+
+	report, got = m.Up(0, false)
+	assert.Nil(t, got)
+	assert.Equal(t, int64(1), report.Steps[0].Affected)
+	cnt, _ := uc.DbColl.CountDocuments(ctx, bson.M{"status": bson.M{"$exists": false}})
+	assert.Equal(t, int64(0), cnt)
+	report, got = m.Up(0, false)
+	assert.Nil(t, got)
+	assert.Empty(t, report.Steps, "applied migration ran again")
+
+	other := models.Migrator{Db: db, Migrations: models.Migrations[:1], Owner: "other"}
+	db.Collection("migration_lock").InsertOne(ctx, bson.M{"_id": "lock", "owner": "other", "expires": time.Now().Add(time.Minute).Unix()})
+	_, got = m.Down(0, false)
+	assert.NotNil(t, got, "migrated while another held the lock")
+	assert.Equal(t, 409, got.HttpStatusCode())
+	db.Collection("migration_lock").DeleteMany(ctx, bson.M{})
+
+	_, got = other.Down(0, false)
+	assert.Nil(t, got)
+	status, _ = m.Status()
+	assert.False(t, status[0].Applied, "migration still applied after down")
+
+	broken := models.Migrator{Db: db, Migrations: []models.Migration{models.Migrations[0], models.Migrations[0]}}
+	_, got = broken.Up(0, true)
+	assert.NotNil(t, got, "out of order registry accepted")
+	t.Cleanup(func() {
+		db.Collection("migrations").DeleteMany(ctx, bson.M{})
+		uc.DbColl.DeleteMany(ctx, bson.M{})
+		db.Client().Disconnect(ctx)
+	})
+}
+
+// TestUniqueEmail : email is unique irrespective of case, even when signups race each other
+func TestUniqueEmail(t *testing.T) {
+	uc, err := testConnectDatabase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	uc.DbColl.DeleteMany(context.Background(), bson.M{})
+	usr := models.User{Name: "Nick Steinson", Email: "nsteinsong@squidoo.com", Role: models.EndUser, Auth: "qbuOKI669ArE"}
+	assert.Nil(t, uc.NewUser(&usr))
+	assert.False(t, usr.Id.IsZero(), "id of the new user not set")
+	got := uc.NewUser(&models.User{Name: "Nick Steinson", Email: "NSteinsong@squidoo.com", Role: models.EndUser, Auth: "qbuOKI669ArE"})
+	assert.NotNil(t, got, "email differing only in case registered twice")
+
+	var wg sync.WaitGroup
+	var created int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if uc.NewUser(&models.User{Name: "Lissie Elman", Email: "lelmank@dell.com", Role: models.EndUser, Auth: "rzrXRI123"}) == nil {
+				atomic.AddInt32(&created, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), created, "concurrent signups with the same email")
+	assert.NotNil(t, uc.EditUser(primitive.NewObjectID().Hex(), "Lissie Elman", "", 0), "edited an account that does not exist")
+	t.Cleanup(func() {
+		ctx := context.Background()
+		uc.DbColl.DeleteMany(ctx, bson.M{})
+		uc.DbColl.Database().Client().Disconnect(ctx)
+	})
+}
+
+// TestEmailNormalize : emails are validated and stored normalized, lookups work with any of the forms
+func TestEmailNormalize(t *testing.T) {
+	for in, want := range map[string]string{
+		"John@Gmail.com":                   "john@gmail.com",
+		"First.Last+News@GMail.com":        "first.last@gmail.com",
+		"first.last+tag@sub.example.co.uk": "first.last+tag@sub.example.co.uk",
+		"ivan@почта.рф":                    "ivan@xn--80a1acny.xn--p1ai",
+	} {
+		got, err := models.UserEmail(in).Normalize()
+		assert.Nil(t, err, "unexpected error normalizing %s", in)
+		assert.Equal(t, models.UserEmail(want), got)
+	}
+	for _, in := range []string{"John Doe <jdoe@gmail.com>", "jdoe", "jdoe@localhost", "5f1b2c3d4e5f6a7b8c9d0e1f", `"j doe"@gmail.com`} {
+		assert.False(t, models.UserEmail(in).IsValid(), "%s should be invalid", in)
+	}
+
+	uc, err := testConnectDatabase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ctx := context.Background()
+	db := uc.DbColl.Database()
+	uc.DbColl.DeleteMany(ctx, bson.M{})
+	usr := models.User{Name: "Nick Steinson", Email: "Nick.Steinson+signup@GMail.com", Role: models.EndUser, Auth: "qbuOKI669ArE"}
+	assert.Nil(t, uc.NewUser(&usr))
+	assert.Equal(t, models.UserEmail("nick.steinson@gmail.com"), usr.Email)
+	assert.Nil(t, uc.Authenticate(&models.User{Email: "NICK.STEINSON@gmail.com", Auth: "qbuOKI669ArE"}), "login with email in another case")
+	assert.NotNil(t, uc.NewUser(&models.User{Name: "Nick Steinson", Email: "nick.steinson+other@gmail.com", Role: models.EndUser, Auth: "qbuOKI669ArE"}), "plus address registered as another account")
+	assert.Nil(t, uc.EditUser("Nick.Steinson@gmail.com", "Nicky Steinson", "", 0))
+	assert.Nil(t, uc.DeleteUser("nick.steinson+x@gmail.com"))
+
+	// accounts from before normalization, two of which collide
+	uc.DbColl.DeleteMany(ctx, bson.M{})
+	db.Collection("migrations").DeleteMany(ctx, bson.M{})
+	db.Collection("migration_lock").DeleteMany(ctx, bson.M{})
+	for _, email := range []string{"Lissie.Elman@Dell.com", "JDoe@gmail.com", "jdoe+news@gmail.com"} {
+		uc.DbColl.InsertOne(ctx, bson.M{"name": "Legacy User", "email": email, "status": "active"})
+	}
+	m := models.Migrator{Db: db, Migrations: models.Migrations, Owner: "test"}
+	_, got := m.Up(0, true)
+	assert.NotNil(t, got, "collisions not detected")
+	uc.DbColl.DeleteOne(ctx, bson.M{"email": "jdoe+news@gmail.com"})
+	report, got := m.Up(0, false)
+	assert.Nil(t, got)
+	assert.Equal(t, int64(2), report.Steps[len(report.Steps)-1].Affected)
+	found := models.User{}
+	assert.Nil(t, uc.LookupUser("lissie.elman@dell.com", &found))
+	t.Cleanup(func() {
+		db.Collection("migrations").DeleteMany(ctx, bson.M{})
+		uc.DbColl.DeleteMany(ctx, bson.M{})
+		db.Client().Disconnect(ctx)
+	})
+}
+
+// TestEmailChange : email changes only on confirmation, tokens carrying the old email are revoked
+func TestEmailChange(t *testing.T) {
+	uc, err := testConnectDatabase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	uc.DbColl.DeleteMany(context.Background(), bson.M{})
+	usr := models.User{Name: "Lissie Elman", Email: "lelmank@dell.com", Role: models.EndUser, Auth: "rzrXRI123"}
+	assert.Nil(t, uc.NewUser(&usr))
+	other := models.User{Name: "Di Goney", Email: "dgoneym@msu.edu", Role: models.EndUser, Auth: "ynyCXI548"}
+	assert.Nil(t, uc.NewUser(&other))
+	login := &models.User{Email: usr.Email, Auth: "rzrXRI123"}
+	assert.Nil(t, uc.Authenticate(login))
+
+	found := models.User{}
+	_, got := uc.RequestEmailChange(usr.Id.Hex(), "DGoneym@msu.edu", &found)
+	assert.NotNil(t, got, "changed to an email already registered")
+	_, got = uc.RequestEmailChange(usr.Id.Hex(), "lelmank@dell.com", &found)
+	assert.NotNil(t, got, "changed to the same email")
+	tok, got := uc.RequestEmailChange(usr.Id.Hex(), "Lissie.Elman@Acme.io", &found)
+	assert.Nil(t, got)
+	assert.Equal(t, models.UserEmail("lissie.elman@acme.io"), found.PendingEmail)
+	assert.Nil(t, uc.LookupUser("lelmank@dell.com", &found), "email changed before confirmation")
+
+	assert.NotNil(t, uc.ConfirmEmailChange("notthetoken", &found), "confirmed with invalid token")
+	assert.Nil(t, uc.ConfirmEmailChange(tok, &found))
+	assert.Equal(t, models.UserEmail("lissie.elman@acme.io"), found.Email)
+	assert.NotNil(t, uc.ConfirmEmailChange(tok, &found), "email change token used twice")
+	assert.NotNil(t, uc.Authorize(login.AuthTok), "token with the old email still valid")
+	assert.Nil(t, uc.Authenticate(&models.User{Email: "lissie.elman@acme.io", Auth: "rzrXRI123"}))
+
+	// email taken by another account between request and confirmation
+	tok, got = uc.RequestEmailChange(other.Id.Hex(), "nsteinsong@squidoo.com", &found)
+	assert.Nil(t, got)
+	assert.Nil(t, uc.NewUser(&models.User{Name: "Nick Steinson", Email: "nsteinsong@squidoo.com", Role: models.EndUser, Auth: "qbuOKI669ArE"}))
+	assert.NotNil(t, uc.ConfirmEmailChange(tok, &found), "confirmed an email registered in the meantime")
+	t.Cleanup(func() {
+		ctx := context.Background()
+		uc.DbColl.DeleteMany(ctx, bson.M{})
+		uc.DbColl.Database().Client().Disconnect(ctx)
+	})
+}
+
+// TestProfile : timestamps are maintained by the collection, attributes are validated against the schema
+func TestProfile(t *testing.T) {
+	uc, err := testConnectDatabase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ctx := context.Background()
+	uc.DbColl.DeleteMany(ctx, bson.M{})
+	ac := models.AttributesCollection{DbColl: uc.DbColl.Database().Collection("attributes")}
+	ac.DbColl.DeleteMany(ctx, bson.M{})
+
+	usr := models.User{Name: "Lissie Elman", Email: "lelmank@dell.com", Role: models.EndUser, Auth: "rzrXRI123", CreatedAt: 1}
+	assert.Nil(t, uc.NewUser(&usr))
+	assert.NotEqual(t, int64(1), usr.CreatedAt, "time of creation set by the caller")
+	assert.Nil(t, uc.Authenticate(&models.User{Email: usr.Email, Auth: "rzrXRI123"}))
+	found := models.User{}
+	assert.Nil(t, uc.FindUser(usr.Id.Hex(), &found))
+	assert.NotZero(t, found.LastLoginAt, "last login not recorded")
+
+	phone, tz, badTz := models.UserPhone("+919856321470"), models.UserTimezone("Asia/Kolkata"), models.UserTimezone("Mars/Olympus")
+	assert.Nil(t, uc.EditProfile(usr.Id.Hex(), models.ProfilePatch{Phone: &phone, Timezone: &tz}))
+	assert.NotNil(t, uc.EditProfile(usr.Id.Hex(), models.ProfilePatch{Timezone: &badTz}), "invalid timezone accepted")
+
+	assert.NotNil(t, ac.DefineAttribute(models.AttributeDef{Key: "Farm ID", Type: models.AttrString}), "invalid key accepted")
+	assert.Nil(t, ac.DefineAttribute(models.AttributeDef{Key: "units", Type: models.AttrString, UserEditable: true, Enum: []string{"metric", "imperial"}}))
+	assert.Nil(t, ac.DefineAttribute(models.AttributeDef{Key: "farm_id", Type: models.AttrString}))
+	schema, got := ac.Schema()
+	assert.Nil(t, got)
+	assert.Nil(t, uc.SetAttributes(usr.Id.Hex(), map[string]interface{}{"units": "metric"}, schema, false))
+	assert.NotNil(t, uc.SetAttributes(usr.Id.Hex(), map[string]interface{}{"units": "furlongs"}, schema, false), "value outside enum accepted")
+	assert.NotNil(t, uc.SetAttributes(usr.Id.Hex(), map[string]interface{}{"farm_id": "FRM-0042"}, schema, false), "account holder set admin only attribute")
+	assert.NotNil(t, uc.SetAttributes(usr.Id.Hex(), map[string]interface{}{"colour": "green"}, schema, true), "undefined attribute accepted")
+	assert.Nil(t, uc.SetAttributes(usr.Id.Hex(), map[string]interface{}{"farm_id": "FRM-0042"}, schema, true))
+
+	assert.Nil(t, uc.FindUser(usr.Id.Hex(), &found))
+	byt, _ := json.Marshal(found)
+	assert.Contains(t, string(byt), `"farm_id":"FRM-0042"`)
+	assert.Contains(t, string(byt), `"timezone":"Asia/Kolkata"`)
+	assert.GreaterOrEqual(t, found.UpdatedAt, found.CreatedAt)
+	t.Cleanup(func() {
+		ac.DbColl.DeleteMany(ctx, bson.M{})
+		uc.DbColl.DeleteMany(ctx, bson.M{})
+		uc.DbColl.Database().Client().Disconnect(ctx)
+	})
+}
+
+func TestAvatar(t *testing.T) {
+	uc, err := testConnectDatabase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ctx := context.Background()
+	uc.DbColl.DeleteMany(ctx, bson.M{})
+	store := &models.LocalBlobStore{Dir: t.TempDir()}
+
+	// 300x200 png, thumbnails are cropped square from the center
+	img := image.NewRGBA(image.Rect(0, 0, 300, 200))
+	for x := 0; x < 300; x++ {
+		for y := 0; y < 200; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	buf := bytes.Buffer{}
+	assert.Nil(t, png.Encode(&buf, img))
+	thumbs, contentType, got := models.Thumbnails(buf.Bytes())
+	assert.Nil(t, got)
+	assert.Equal(t, "image/png", contentType)
+	for _, size := range models.AvatarSizes {
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(thumbs[size]))
+		assert.Nil(t, err)
+		assert.Equal(t, size, cfg.Width)
+		assert.Equal(t, size, cfg.Height)
+	}
+	_, _, got = models.Thumbnails([]byte("GIF89a not an image we take"))
+	assert.NotNil(t, got, "gif accepted")
+	_, _, got = models.Thumbnails(make([]byte, models.AvatarMaxBytes+1))
+	assert.NotNil(t, got, "oversized upload accepted")
+
+	usr := models.User{Name: "Ardys Pidgeley", Email: "apidgeley3@imdb.com", Role: models.EndUser, Auth: "qYfUCX987"}
+	assert.Nil(t, uc.NewUser(&usr))
+	_, notFound := models.AvatarBlob(usr.Id.Hex(), 64, store)
+	assert.Equal(t, 404, notFound.HttpStatusCode())
+	url, herr := uc.SetAvatar(usr.Id.Hex(), buf.Bytes(), store)
+	assert.Nil(t, herr)
+	found := models.User{}
+	assert.Nil(t, uc.FindUser(usr.Id.Hex(), &found))
+	assert.Equal(t, url, found.Avatar)
+	blob, herr := models.AvatarBlob(usr.Id.Hex(), 100, store) // next size up
+	assert.Nil(t, herr)
+	assert.Equal(t, thumbs[256], blob.Data)
+	assert.Equal(t, "image/png", blob.ContentType)
+
+	assert.Nil(t, uc.RemoveAvatar(usr.Id.Hex(), store))
+	found = models.User{}
+	assert.Nil(t, uc.FindUser(usr.Id.Hex(), &found))
+	assert.Empty(t, found.Avatar)
+	_, notFound = models.AvatarBlob(usr.Id.Hex(), 64, store)
+	assert.NotNil(t, notFound, "thumbnails left behind")
+	t.Cleanup(func() {
+		uc.DbColl.DeleteMany(ctx, bson.M{})
+		uc.DbColl.Database().Client().Disconnect(ctx)
+	})
+}
+
+// TestOrgs : memberships are scoped per org, the token acts in one org and loses it when the membership changes
+func TestOrgs(t *testing.T) {
+	uc, err := testConnectDatabase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ctx := context.Background()
+	uc.DbColl.DeleteMany(ctx, bson.M{})
+	oc := models.OrgsCollection{DbColl: uc.DbColl.Database().Collection("orgs")}
+	oc.DbColl.Drop(ctx)
+	assert.Nil(t, oc.EnsureIndexes())
+
+	farmA, farmB := models.Org{Name: "Green Acres", Slug: "green-acres"}, models.Org{Name: "Blue Ponds", Slug: "blue-ponds"}
+	assert.Nil(t, oc.NewOrg(&farmA))
+	assert.Nil(t, oc.NewOrg(&farmB))
+	assert.NotNil(t, oc.NewOrg(&models.Org{Name: "Green Acres Again", Slug: "green-acres"}), "duplicate slug accepted")
+	assert.NotNil(t, oc.NewOrg(&models.Org{Name: "Bad Slug", Slug: "Bad Slug"}), "invalid slug accepted")
+
+	orgAdmin := models.User{Name: "Cordie Bettison", Email: "cbettison0@furl.net", Role: models.EndUser, Auth: "tHq5zXp91"}
+	member := models.User{Name: "Nanine Rayer", Email: "nrayer1@ning.com", Role: models.EndUser, Auth: "kBv7mWq22"}
+	outsider := models.User{Name: "Dulcie Jurek", Email: "djurek2@ucoz.ru", Role: models.EndUser, Auth: "pLz3xNc33"}
+	for _, usr := range []*models.User{&orgAdmin, &member, &outsider} {
+		assert.Nil(t, uc.NewUser(usr))
+	}
+	assert.Nil(t, uc.SetMembership(farmA.Id.Hex(), orgAdmin.Id.Hex(), models.Admin, models.SuperUser))
+	assert.Nil(t, uc.SetMembership(farmA.Id.Hex(), member.Id.Hex(), models.Guest, models.Admin))
+	assert.Nil(t, uc.SetMembership(farmA.Id.Hex(), member.Id.Hex(), models.EndUser, models.Admin), "failed to change org role")
+	assert.Nil(t, uc.SetMembership(farmB.Id.Hex(), outsider.Id.Hex(), models.EndUser, models.SuperUser))
+	assert.NotNil(t, uc.SetMembership(farmA.Id.Hex(), member.Id.Hex(), models.Admin, models.Admin), "org admin granted own role")
+	assert.NotNil(t, uc.SetMembership(farmA.Id.Hex(), member.Id.Hex(), models.SuperUser, models.SuperUser), "superuser as org role")
+
+	// token acts in the first org unless asked otherwise
+	login := models.User{Email: orgAdmin.Email, Auth: "tHq5zXp91"}
+	assert.Nil(t, uc.Authenticate(&login))
+	claims, got := uc.AuthorizeClaims(login.AuthTok)
+	assert.Nil(t, got)
+	assert.Equal(t, farmA.Id.Hex(), claims.Org)
+	assert.Equal(t, models.Admin, claims.OrgRole)
+	login = models.User{Email: orgAdmin.Email, Auth: "tHq5zXp91", ActiveOrg: farmB.Id.Hex()}
+	assert.NotNil(t, uc.Authenticate(&login), "token issued for an org the account isnt a member of")
+
+	scoped := models.UsersCollection{DbColl: uc.DbColl, Org: farmA.Id}
+	usrs, got := scoped.ListUsers(0, 0)
+	assert.Nil(t, got)
+	assert.Len(t, usrs, 2)
+	found := models.User{}
+	assert.NotNil(t, scoped.FindUser(outsider.Id.Hex(), &found), "account outside the org found in scope")
+
+	login = models.User{Email: member.Email, Auth: "kBv7mWq22"}
+	assert.Nil(t, uc.Authenticate(&login))
+	assert.NotNil(t, uc.RemoveMembership(farmA.Id.Hex(), orgAdmin.Id.Hex(), models.Admin), "org admin removed a peer")
+	assert.Nil(t, uc.RemoveMembership(farmA.Id.Hex(), member.Id.Hex(), models.Admin))
+	assert.NotNil(t, uc.Authorize(login.AuthTok), "token authorized after removal from the org")
+	t.Cleanup(func() {
+		oc.DbColl.Drop(ctx)
+		uc.DbColl.DeleteMany(ctx, bson.M{})
+		uc.DbColl.Database().Client().Disconnect(ctx)
+	})
+}
+
+// TestGroups : effective permissions are the union of direct and group grants, group roles raise the role on the token
+func TestGroups(t *testing.T) {
+	uc, err := testConnectDatabase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ctx := context.Background()
+	uc.DbColl.DeleteMany(ctx, bson.M{})
+	gc := models.GroupsCollection{DbColl: uc.DbColl.Database().Collection("groups")}
+	gc.DbColl.Drop(ctx)
+	assert.Nil(t, gc.EnsureIndexes())
+
+	assert.True(t, models.Permission("devices:*").Grants("devices:write"))
+	assert.False(t, models.Permission("devices:read").Grants("devices:write"))
+	assert.False(t, models.Permission("devices").IsValid())
+
+	admin := models.Admin
+	operators := models.Group{Name: "pond-operators", Permissions: []models.Permission{"devices:read", "devices:write", "devices:read"}}
+	leads := models.Group{Name: "farm-leads", Permissions: []models.Permission{"reports:*"}, Role: &admin}
+	assert.Nil(t, gc.NewGroup(&operators, models.Admin))
+	assert.Len(t, operators.Permissions, 2, "duplicate permissions kept")
+	assert.NotNil(t, gc.NewGroup(&leads, models.Admin), "admin created a group with admin role")
+	assert.Nil(t, gc.NewGroup(&leads, models.SuperUser))
+	assert.NotNil(t, gc.NewGroup(&models.Group{Name: "pond-operators"}, models.Admin), "duplicate group name accepted")
+	assert.NotNil(t, gc.NewGroup(&models.Group{Name: "bad", Permissions: []models.Permission{"Devices Read"}}, models.Admin), "invalid permission accepted")
+
+	usr := models.User{Name: "Merry Gowlett", Email: "mgowlett5@hexun.com", Role: models.EndUser, Auth: "Wq8zRt5Lp"}
+	assert.Nil(t, uc.NewUser(&usr))
+	assert.Nil(t, uc.SetPermissions(usr.Id.Hex(), []models.Permission{"alerts:read"}, models.Admin))
+	assert.Nil(t, uc.SetGroupMember(operators.Id.Hex(), usr.Id.Hex(), true, &gc, models.Admin))
+	assert.NotNil(t, uc.SetGroupMember(leads.Id.Hex(), usr.Id.Hex(), true, &gc, models.Admin), "admin added member to group with admin role")
+	assert.Nil(t, uc.SetGroupMember(leads.Id.Hex(), usr.Id.Hex(), true, &gc, models.SuperUser))
+
+	found := models.User{}
+	assert.Nil(t, uc.FindUser(usr.Id.Hex(), &found))
+	ep, got := uc.Effective(&found)
+	assert.Nil(t, got)
+	assert.Equal(t, models.Admin, ep.EffRole)
+	assert.Len(t, ep.Groups, 2)
+	assert.True(t, ep.Allows("devices:write"))
+	assert.True(t, ep.Allows("reports:export"))
+	assert.True(t, ep.Allows("alerts:read"))
+	assert.False(t, ep.Allows("alerts:write"))
+
+	login := models.User{Email: usr.Email, Auth: "Wq8zRt5Lp"}
+	assert.Nil(t, uc.Authenticate(&login))
+	claims, got := uc.AuthorizeClaims(login.AuthTok)
+	assert.Nil(t, got)
+	assert.Equal(t, models.Admin, claims.UserRole, "group role not on the token")
+
+	assert.Nil(t, gc.RemoveGroup(leads.Id.Hex(), models.SuperUser, uc))
+	assert.NotNil(t, uc.Authorize(login.AuthTok), "token with the role of a removed group still authorized")
+	found = models.User{}
+	assert.Nil(t, uc.FindUser(usr.Id.Hex(), &found))
+	assert.Len(t, found.Groups, 1)
+	t.Cleanup(func() {
+		gc.DbColl.Drop(ctx)
+		uc.DbColl.DeleteMany(ctx, bson.M{})
+		uc.DbColl.Database().Client().Disconnect(ctx)
+	})
+}
+
+func TestOAuth(t *testing.T) {
+	uc, err := testConnectDatabase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ctx := context.Background()
+	uc.DbColl.DeleteMany(ctx, bson.M{})
+	db := uc.DbColl.Database()
+	occ := models.OAuthClientsCollection{DbColl: db.Collection("oauth_clients")}
+	for _, coll := range []string{"oauth_clients", "oauth_codes", "oauth_tokens", "oauth_revoked"} {
+		db.Collection(coll).Drop(ctx)
+	}
+	assert.Nil(t, occ.EnsureIndexes())
+
+	web := models.OAuthClient{Name: "Pond analytics", RedirectURIs: []string{"https://vendor.example/cb"},
+		Grants: []string{models.GrantAuthorizationCode, models.GrantRefreshToken}, Scopes: []string{"role:enduser", "role:guest", "devices:read"}}
+	secret, got := occ.RegisterClient(&web, models.Admin)
+	assert.Nil(t, got)
+	assert.NotEmpty(t, secret)
+	_, got = occ.RegisterClient(&models.OAuthClient{Name: "Bad", RedirectURIs: []string{"http://vendor.example/cb"}, Grants: []string{models.GrantAuthorizationCode}}, models.Admin)
+	assert.NotNil(t, got, "http redirect uri accepted")
+	_, got = occ.RegisterClient(&models.OAuthClient{Name: "Bad", Public: true, Grants: []string{models.GrantClientCredentials}, Role: models.Guest}, models.Admin)
+	assert.NotNil(t, got, "public client with client credentials accepted")
+	_, got = occ.RegisterClient(&models.OAuthClient{Name: "Bad", Grants: []string{models.GrantClientCredentials}, Role: models.Admin}, models.Admin)
+	assert.NotNil(t, got, "admin registered client with admin role")
+	_, got = occ.AuthenticateClient(web.Id, "wrong")
+	assert.NotNil(t, got)
+	cl, got := occ.AuthenticateClient(web.Id, secret)
+	assert.Nil(t, got)
+
+	usr := models.User{Name: "Viki Jankowski", Email: "vjankowski6@ucoz.ru", Role: models.EndUser, Auth: "Hj5nTq9Wx"}
+	assert.Nil(t, uc.NewUser(&usr))
+	assert.Nil(t, uc.SetPermissions(usr.Id.Hex(), []models.Permission{"devices:*"}, models.Admin))
+	assert.Nil(t, uc.FindUser(usr.Id.Hex(), &usr))
+
+	req := models.AuthorizeRequest{ResponseType: "code", ClientID: web.Id, RedirectURI: "https://vendor.example/other", State: "xyz"}
+	_, _, got = occ.ResolveAuthorize(&req)
+	assert.NotNil(t, got, "unregistered redirect uri accepted")
+	req.RedirectURI = "https://vendor.example/cb"
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	req.CodeChallenge, req.CodeChallengeMethod = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", "S256"
+	req.Scope = "role:enduser devices:read"
+	cl, _, got = occ.ResolveAuthorize(&req)
+	assert.Nil(t, got)
+	code, got := uc.IssueCode(&req, cl, &usr)
+	assert.Nil(t, got)
+	_, got = uc.ExchangeCode(cl, code, req.RedirectURI, "wrong-verifier")
+	assert.NotNil(t, got, "code exchanged without the right verifier")
+	code, _ = uc.IssueCode(&req, cl, &usr)
+	tok, got := uc.ExchangeCode(cl, code, req.RedirectURI, verifier)
+	assert.Nil(t, got)
+	assert.Equal(t, "devices:read role:enduser", tok.Scope)
+	assert.NotEmpty(t, tok.RefreshToken)
+	_, got = uc.ExchangeCode(cl, code, req.RedirectURI, verifier)
+	assert.NotNil(t, got, "code exchanged twice")
+	claims, got := uc.AuthorizeClaims(tok.AccessToken)
+	assert.Nil(t, got)
+	assert.Equal(t, models.EndUser, claims.UserRole)
+	assert.Equal(t, web.Id, claims.ClientID)
+
+	_, got = uc.RefreshGrant(cl, tok.RefreshToken, "devices:read devices:write")
+	assert.NotNil(t, got, "refresh widened the scope")
+	refreshed, got := uc.RefreshGrant(cl, tok.RefreshToken, "role:guest")
+	assert.NotNil(t, got, "refresh token reused after a failed refresh")
+	assert.Nil(t, refreshed)
+
+	code, _ = uc.IssueCode(&req, cl, &usr)
+	tok, _ = uc.ExchangeCode(cl, code, req.RedirectURI, verifier)
+	refreshed, got = uc.RefreshGrant(cl, tok.RefreshToken, "devices:read")
+	assert.Nil(t, got)
+	assert.Equal(t, "devices:read", refreshed.Scope)
+	claims, _ = uc.AuthorizeClaims(refreshed.AccessToken)
+	assert.Equal(t, models.Guest, claims.UserRole, "role scope dropped but token kept the role")
+	assert.Nil(t, uc.RevokeOAuthToken(cl, refreshed.AccessToken))
+	assert.NotNil(t, uc.Authorize(refreshed.AccessToken), "revoked access token still authorized")
+	assert.Nil(t, uc.RevokeOAuthToken(cl, "not-a-token"))
+
+	svc := models.OAuthClient{Name: "Weather feed", Grants: []string{models.GrantClientCredentials}, Role: models.EndUser, Scopes: []string{"role:enduser", "readings:write"}}
+	svcSecret, got := occ.RegisterClient(&svc, models.Admin)
+	assert.Nil(t, got)
+	scl, _ := occ.AuthenticateClient(svc.Id, svcSecret)
+	ctok, got := uc.ClientCredentialsGrant(scl, "")
+	assert.Nil(t, got)
+	assert.Empty(t, ctok.RefreshToken)
+	claims, got = uc.AuthorizeClaims(ctok.AccessToken)
+	assert.Nil(t, got)
+	assert.Empty(t, claims.User)
+	assert.Equal(t, models.EndUser, claims.UserRole)
+	_, got = occ.RotateSecret(svc.Id)
+	assert.Nil(t, got)
+	assert.NotNil(t, uc.Authorize(ctok.AccessToken), "token still authorized after the secret was rotated")
+	_, got = uc.ClientCredentialsGrant(cl, "")
+	assert.NotNil(t, got, "client without the grant got a token")
+	t.Cleanup(func() {
+		for _, coll := range []string{"oauth_clients", "oauth_codes", "oauth_tokens", "oauth_revoked"} {
+			db.Collection(coll).Drop(ctx)
+		}
+		uc.DbColl.DeleteMany(ctx, bson.M{})
+		uc.DbColl.Database().Client().Disconnect(ctx)
+	})
+}
+
+func TestScopeGrants(t *testing.T) {
+	claims := models.CustomClaims{ClientID: "pond-analytics", UserRole: models.Guest, Scope: "openid role:enduser devices:*"}
+	assert.True(t, claims.ScopeGrants("devices:read"))
+	assert.False(t, claims.ScopeGrants("orgs:read"), "scope granted what the client never got")
+	claims.Scope = ""
+	assert.False(t, claims.ScopeGrants("devices:read"))
+}
+
+func TestOIDC(t *testing.T) {
+	uc, err := testConnectDatabase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ctx := context.Background()
+	uc.DbColl.DeleteMany(ctx, bson.M{})
+	db := uc.DbColl.Database()
+	occ := models.OAuthClientsCollection{DbColl: db.Collection("oauth_clients")}
+	for _, coll := range []string{"oauth_clients", "oauth_codes", "oauth_tokens", "idkeys"} {
+		db.Collection(coll).Drop(ctx)
+	}
+
+	grafana := models.OAuthClient{Name: "Grafana", RedirectURIs: []string{"https://grafana.example/login/generic_oauth"},
+		PostLogoutRedirectURIs: []string{"https://grafana.example/login"},
+		Grants:                 []string{models.GrantAuthorizationCode}, Scopes: []string{"openid", "profile", "email"}}
+	_, got := occ.RegisterClient(&grafana, models.Admin)
+	assert.Nil(t, got)
+
+	usr := models.User{Name: "Ode Pettingall", Email: "opettingall7@vk.com", Role: models.EndUser, Auth: "Lm3vCx8Rt"}
+	assert.Nil(t, uc.NewUser(&usr))
+	assert.Nil(t, uc.FindUser(usr.Id.Hex(), &usr))
+	req := models.AuthorizeRequest{ResponseType: "code", ClientID: grafana.Id, Scope: "openid email", Nonce: "n-0S6_WzA2Mj"}
+	cl, redirect, got := occ.ResolveAuthorize(&req)
+	assert.Nil(t, got)
+	assert.Equal(t, "https://grafana.example/login/generic_oauth", redirect, "only registered redirect uri not picked")
+	code, got := uc.IssueCode(&req, cl, &usr)
+	assert.Nil(t, got)
+	tok, got := uc.ExchangeCode(cl, code, "", "")
+	assert.Nil(t, got)
+	assert.NotEmpty(t, tok.IDToken)
+
+	sub, aud, got := uc.ParseIDTokenHint(tok.IDToken)
+	assert.Nil(t, got)
+	assert.Equal(t, usr.Id.Hex(), sub)
+	assert.Equal(t, grafana.Id, aud)
+	idClaims := jwt.MapClaims{}
+	_, _, err = new(jwt.Parser).ParseUnverified(tok.IDToken, idClaims)
+	assert.Nil(t, err)
+	assert.Equal(t, req.Nonce, idClaims["nonce"])
+	assert.Equal(t, string(usr.Email), idClaims["email"])
+	assert.Equal(t, false, idClaims["email_verified"], "self registered email reported verified")
+	assert.Nil(t, idClaims["name"], "name without the profile scope")
+
+	keys, got := uc.JWKS()
+	assert.Nil(t, got)
+	assert.Len(t, keys, 1)
+
+	claims, got := uc.AuthorizeClaims(tok.AccessToken)
+	assert.Nil(t, got)
+	info, got := uc.UserInfo(claims)
+	assert.Nil(t, got)
+	assert.Equal(t, usr.Id.Hex(), info["sub"])
+	login := models.User{Email: usr.Email, Auth: "Lm3vCx8Rt"}
+	assert.Nil(t, uc.Authenticate(&login))
+	claims, _ = uc.AuthorizeClaims(login.AuthTok)
+	_, got = uc.UserInfo(claims)
+	assert.NotNil(t, got, "userinfo for a token that is not from oauth")
+
+	models.IDTokenTTL = -time.Hour // stale hints are refused, recently expired ones are still taken
+	stale, got := uc.ExchangeCode(cl, mustIssueCode(t, uc, &req, cl, &usr), "", "")
+	assert.Nil(t, got)
+	_, _, got = uc.ParseIDTokenHint(stale.IDToken)
+	assert.NotNil(t, got, "id_token_hint expired an hour ago was accepted")
+	models.IDTokenTTL = -time.Minute
+	recent, got := uc.ExchangeCode(cl, mustIssueCode(t, uc, &req, cl, &usr), "", "")
+	assert.Nil(t, got)
+	_, _, got = uc.ParseIDTokenHint(recent.IDToken)
+	assert.Nil(t, got, "id_token_hint expired a minute ago was refused")
+	models.IDTokenTTL = time.Hour
+
+	// logout from the client revokes its tokens right away, the login token of the account is left as it is
+	assert.Nil(t, uc.LogoutClient(grafana.Id, usr.Id.Hex()))
+	_, got = uc.AuthorizeClaims(tok.AccessToken)
+	assert.NotNil(t, got, "access token of the client authorized after logout")
+	_, got = uc.AuthorizeClaims(login.AuthTok)
+	assert.Nil(t, got, "logout from the client revoked the login token of the account")
+	after, got := uc.ExchangeCode(cl, mustIssueCode(t, uc, &req, cl, &usr), "", "")
+	assert.Nil(t, got)
+	_, got = uc.AuthorizeClaims(after.AccessToken)
+	assert.Nil(t, got, "token issued after logout not authorized")
+	t.Cleanup(func() {
+		for _, coll := range []string{"oauth_clients", "oauth_codes", "oauth_tokens", "oauth_logouts", "idkeys"} {
+			db.Collection(coll).Drop(ctx)
+		}
+		uc.DbColl.DeleteMany(ctx, bson.M{})
+		uc.DbColl.Database().Client().Disconnect(ctx)
+	})
+}
+
+func mustIssueCode(t *testing.T, uc *models.UsersCollection, req *models.AuthorizeRequest, cl *models.OAuthClient, usr *models.User) string {
+	code, err := uc.IssueCode(req, cl, usr)
+	assert.Nil(t, err)
+	return code
+}
+
+// fakeOIDCProvider : local identity provider for the federation tests, codes are handed out by the test along with the claims they stand for
+type fakeOIDCProvider struct {
+	srv   *httptest.Server
+	key   *rsa.PrivateKey
+	codes map[string]jwt.MapClaims
+}
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := &fakeOIDCProvider{key: key, codes: map[string]jwt.MapClaims{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 fp.srv.URL,
+			"authorization_endpoint": fp.srv.URL + "/authorize",
+			"token_endpoint":         fp.srv.URL + "/token",
+			"jwks_uri":               fp.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []models.JWK{{
+			Kty: "RSA", Use: "sig", Alg: "RS256", Kid: "fake-1",
+			N: base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+			E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := fp.codes[r.PostFormValue("code")]
+		if !ok || r.PostFormValue("client_id") != "fake-client" || r.PostFormValue("code_verifier") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		delete(fp.codes, r.PostFormValue("code"))
+		tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		tok.Header["kid"] = "fake-1"
+		signed, _ := tok.SignedString(key)
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "opaque", "token_type": "Bearer", "id_token": signed})
+	})
+	fp.srv = httptest.NewServer(mux)
+	return fp
+}
+
+// login : goes through the provider as the account with the claims, sends back what the callback got
+func (fp *fakeOIDCProvider) login(uc *models.UsersCollection, link primitive.ObjectID, claims jwt.MapClaims) (*models.User, string, httperr.HttpErr) {
+	redirect, browser, err := uc.BeginFederation("fake", link)
+	if err != nil {
+		return nil, "", err
+	}
+	u, _ := url.Parse(redirect)
+	code := fmt.Sprintf("code-%d", time.Now().UnixNano())
+	full := jwt.MapClaims{"iss": fp.srv.URL, "aud": "fake-client", "exp": time.Now().Add(time.Minute).Unix(), "iat": time.Now().Unix(), "nonce": u.Query().Get("nonce")}
+	for k, v := range claims {
+		full[k] = v
+	}
+	fp.codes[code] = full
+	return uc.CompleteFederation("fake", u.Query().Get("state"), browser, code)
+}
+
+func TestFederation(t *testing.T) {
+	uc, err := testConnectDatabase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ctx := context.Background()
+	uc.DbColl.DeleteMany(ctx, bson.M{})
+	uc.DbColl.Database().Collection("federation_states").Drop(ctx)
+	assert.Nil(t, uc.EnsureIndexes())
+	fp := newFakeOIDCProvider(t)
+	defer fp.srv.Close()
+	cfg := filepath.Join(t.TempDir(), "idp.json")
+	byt, _ := json.Marshal([]map[string]interface{}{{
+		"name": "fake", "issuer": fp.srv.URL, "client_id": "fake-client", "client_secret": "fake-secret",
+		"auto_provision": true, "default_role": models.Guest, "domains": []string{"example.com"},
+	}})
+	assert.Nil(t, os.WriteFile(cfg, byt, 0600))
+	assert.Nil(t, models.LoadIdentityProviders(cfg))
+
+	usr := models.User{Name: "Dora Whitewood", Email: "dora@example.com", Role: models.EndUser, Auth: "Tr6nWq3Zk"}
+	assert.Nil(t, uc.NewUser(&usr))
+
+	_, _, herr := fp.login(uc, primitive.NilObjectID, jwt.MapClaims{"sub": "fake-1001", "email": "Dora@example.com", "email_verified": true})
+	assert.NotNil(t, herr, "identity linked to an account that never verified the email")
+	_, err = uc.DbColl.UpdateOne(ctx, bson.M{"_id": usr.Id}, bson.M{"$set": bson.M{"emailverifiedat": time.Now().Unix()}})
+	assert.Nil(t, err)
+	got, how, herr := fp.login(uc, primitive.NilObjectID, jwt.MapClaims{"sub": "fake-1001", "email": "Dora@example.com", "email_verified": true})
+	assert.Nil(t, herr)
+	assert.Equal(t, models.FederatedLinked, how, "verified email not linked to the account")
+	assert.Equal(t, usr.Id, got.Id)
+	assert.NotEmpty(t, got.AuthTok)
+	_, how, herr = fp.login(uc, primitive.NilObjectID, jwt.MapClaims{"sub": "fake-1001", "email": "dora@example.com"})
+	assert.Nil(t, herr)
+	assert.Equal(t, models.FederatedLogin, how)
+
+	prov, how, herr := fp.login(uc, primitive.NilObjectID, jwt.MapClaims{"sub": "fake-1002", "email": "ravi.menon@example.com", "email_verified": true})
+	assert.Nil(t, herr)
+	assert.Equal(t, models.FederatedProvisioned, how)
+	assert.Equal(t, models.Guest, prov.Role)
+	assert.Equal(t, models.UserName("ravi menon"), prov.Name)
+	assert.NotNil(t, uc.UnlinkIdentity(prov.Id.Hex(), "fake"), "only identity of an account without password unlinked")
+
+	_, _, herr = fp.login(uc, primitive.NilObjectID, jwt.MapClaims{"sub": "fake-1003", "email": "someone@elsewhere.com", "email_verified": true})
+	assert.NotNil(t, herr, "account provisioned outside the domains")
+	_, _, herr = fp.login(uc, primitive.NilObjectID, jwt.MapClaims{"sub": "fake-1004", "email": "dora@example.com"})
+	assert.NotNil(t, herr, "unverified email took over the account")
+
+	_, _, herr = fp.login(uc, prov.Id, jwt.MapClaims{"sub": "fake-1001"})
+	assert.NotNil(t, herr, "identity linked to two accounts")
+	assert.Nil(t, uc.UnlinkIdentity(usr.Id.Hex(), "fake"))
+	got, how, herr = fp.login(uc, usr.Id, jwt.MapClaims{"sub": "fake-1005", "email": "dora.w@partner.org"})
+	assert.Nil(t, herr)
+	assert.Equal(t, models.FederatedLinked, how, "explicit link failed")
+	assert.Equal(t, usr.Id, got.Id)
+
+	redirect, browser, herr := uc.BeginFederation("fake", primitive.NilObjectID)
+	assert.Nil(t, herr)
+	u, _ := url.Parse(redirect)
+	fp.codes["forged"] = jwt.MapClaims{"iss": fp.srv.URL, "aud": "fake-client", "exp": time.Now().Add(time.Minute).Unix(), "sub": "fake-1001", "nonce": "not-the-one"}
+	_, _, herr = uc.CompleteFederation("fake", u.Query().Get("state"), "", "forged")
+	assert.NotNil(t, herr, "callback accepted without the cookie of the browser that started the login")
+	_, _, herr = uc.CompleteFederation("fake", u.Query().Get("state"), browser, "forged")
+	assert.NotNil(t, herr, "ID token with the wrong nonce accepted")
+	assert.Equal(t, 502, herr.HttpStatusCode(), "state taken up by a callback from another browser")
+	_, _, herr = uc.CompleteFederation("fake", u.Query().Get("state"), browser, "forged")
+	assert.NotNil(t, herr, "state used twice")
+	t.Cleanup(func() {
+		models.IdentityProviders = map[string]*models.IdentityProvider{}
+		uc.DbColl.Database().Collection("federation_states").Drop(ctx)
+		uc.DbColl.DeleteMany(ctx, bson.M{})
+		uc.DbColl.Database().Client().Disconnect(ctx)
+	})
+}
+
+func TestIntrospect(t *testing.T) {
+	uc, err := testConnectDatabase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ctx := context.Background()
+	uc.DbColl.DeleteMany(ctx, bson.M{})
+	db := uc.DbColl.Database()
+	occ := models.OAuthClientsCollection{DbColl: db.Collection("oauth_clients")}
+	for _, coll := range []string{"oauth_clients", "oauth_codes", "oauth_tokens", "oauth_revoked"} {
+		db.Collection(coll).Drop(ctx)
+	}
+	assert.Nil(t, occ.EnsureIndexes())
+
+	usr := models.User{Name: "Corliss Zuker", Email: "czuker7@hexun.com", Role: models.EndUser, Auth: "Wq3Lp8Zr2"}
+	assert.Nil(t, uc.NewUser(&usr))
+	login := models.User{Email: usr.Email, Auth: "Wq3Lp8Zr2"}
+	assert.Nil(t, uc.Authenticate(&login))
+	result, got := uc.Introspect(login.AuthTok, "")
+	assert.Nil(t, got)
+	assert.True(t, result.Active)
+	assert.Equal(t, usr.Id.Hex(), result.Sub)
+	assert.Equal(t, "czuker7@hexun.com", result.Email)
+	assert.Equal(t, models.EndUser, *result.Role)
+	result, got = uc.Introspect("not-a-token", "")
+	assert.Nil(t, got)
+	assert.False(t, result.Active)
+
+	web := models.OAuthClient{Name: "Pond analytics", RedirectURIs: []string{"https://vendor.example/cb"},
+		Grants: []string{models.GrantAuthorizationCode, models.GrantRefreshToken}, Scopes: []string{"role:enduser"}}
+	secret, got := occ.RegisterClient(&web, models.Admin)
+	assert.Nil(t, got)
+	cl, _ := occ.AuthenticateClient(web.Id, secret)
+	req := models.AuthorizeRequest{ResponseType: "code", ClientID: web.Id, RedirectURI: "https://vendor.example/cb", Scope: "role:enduser"}
+	code, got := uc.IssueCode(&req, cl, &usr)
+	assert.Nil(t, got)
+	tok, got := uc.ExchangeCode(cl, code, req.RedirectURI, "")
+	assert.Nil(t, got)
+	result, _ = uc.Introspect(tok.AccessToken, "")
+	assert.True(t, result.Active)
+	assert.Equal(t, web.Id, result.ClientID)
+	assert.Equal(t, "role:enduser", result.Scope)
+	result, _ = uc.Introspect(tok.RefreshToken, "refresh_token")
+	assert.True(t, result.Active)
+	assert.Equal(t, "refresh_token", result.TokenType)
+
+	assert.Nil(t, uc.RevokeOAuthToken(cl, tok.AccessToken))
+	result, _ = uc.Introspect(tok.AccessToken, "")
+	assert.False(t, result.Active, "revoked access token is active")
+	assert.Nil(t, uc.RevokeTokens(usr.Id.Hex()))
+	result, _ = uc.Introspect(login.AuthTok, "")
+	assert.False(t, result.Active, "token of the account is active after it was revoked")
+	result, _ = uc.Introspect(tok.RefreshToken, "")
+	assert.False(t, result.Active, "refresh token is active after the tokens of the account were revoked")
+	t.Cleanup(func() {
+		for _, coll := range []string{"oauth_clients", "oauth_codes", "oauth_tokens", "oauth_revoked"} {
+			db.Collection(coll).Drop(ctx)
+		}
+		uc.DbColl.DeleteMany(ctx, bson.M{})
+		uc.DbColl.Database().Client().Disconnect(ctx)
+	})
+}
+
+func TestAuthorizeUser(t *testing.T) {
+	uc, err := testConnectDatabase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ctx := context.Background()
+	uc.DbColl.DeleteMany(ctx, bson.M{})
+	usr := models.User{Name: "Ludovika Brind", Email: "lbrind8@google.it", Role: models.EndUser, Auth: "Rt6Kv2Nb9"}
+	assert.Nil(t, uc.NewUser(&usr))
+	login := models.User{Email: usr.Email, Auth: "Rt6Kv2Nb9"}
+	assert.Nil(t, uc.Authenticate(&login))
+	claims, found, got := uc.AuthorizeUser("Bearer " + login.AuthTok)
+	assert.Nil(t, got)
+	assert.Equal(t, models.EndUser, claims.UserRole)
+	assert.Equal(t, usr.Id, found.Id)
+	assert.Equal(t, "Ludovika Brind", string(found.Name))
+	assert.Nil(t, uc.RevokeTokens(usr.Id.Hex()))
+	_, found, got = uc.AuthorizeUser(login.AuthTok)
+	assert.NotNil(t, got, "revoked token authorized")
+	assert.Nil(t, found)
+	t.Cleanup(func() {
+		uc.DbColl.DeleteMany(ctx, bson.M{})
+		uc.DbColl.Database().Client().Disconnect(ctx)
+	})
+}
+
+func TestForwardAuth(t *testing.T) {
+	uc, err := testConnectDatabase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ctx := context.Background()
+	uc.DbColl.DeleteMany(ctx, bson.M{})
+	admin, enduser := models.Admin, models.EndUser
+	models.ForwardAuthPolicy = []models.PolicyRule{
+		{Path: "/public/*", Public: true},
+		{Path: "/admin/*", Role: &admin},
+		{Path: "/reports/*", Role: &enduser, Permission: "reports:read"},
+		{Path: "/*", Role: &enduser},
+	}
+	usr := models.User{Name: "Tobit Gregoretti", Email: "tgregoretti9@wikia.com", Role: models.EndUser, Auth: "Yp4Cx7Ws1"}
+	assert.Nil(t, uc.NewUser(&usr))
+	login := models.User{Email: usr.Email, Auth: "Yp4Cx7Ws1"}
+	assert.Nil(t, uc.Authenticate(&login))
+
+	req := func(uri, tok string) *models.ForwardRequest {
+		return &models.ForwardRequest{Host: "grafana.internal", Method: "GET", URI: uri, Token: tok}
+	}
+	claims, _, got := uc.ForwardAuth(req("/public/logo.png", ""))
+	assert.Nil(t, got)
+	assert.Nil(t, claims)
+	_, _, got = uc.ForwardAuth(req("/d/pond-levels", ""))
+	assert.Equal(t, 401, got.HttpStatusCode(), "request without token not unauthenticated")
+	_, _, got = uc.ForwardAuth(req("/d/pond-levels", "not-a-token"))
+	assert.Equal(t, 401, got.HttpStatusCode(), "request with invalid token not unauthenticated")
+	claims, found, got := uc.ForwardAuth(req("/d/pond-levels", login.AuthTok))
+	assert.Nil(t, got)
+	assert.Equal(t, models.EndUser, claims.UserRole)
+	assert.Equal(t, usr.Id, found.Id)
+	_, _, got = uc.ForwardAuth(req("/admin/users", login.AuthTok))
+	assert.Equal(t, 403, got.HttpStatusCode(), "enduser let through to an admin path")
+	_, _, got = uc.ForwardAuth(req("/public/../admin/users", login.AuthTok))
+	assert.Equal(t, 403, got.HttpStatusCode(), "dot segments got around the policy")
+	_, _, got = uc.ForwardAuth(req("/reports/daily", login.AuthTok))
+	assert.Equal(t, 403, got.HttpStatusCode(), "let through without the permission")
+	assert.Nil(t, uc.SetPermissions(usr.Id.Hex(), []models.Permission{"reports:*"}, models.Admin))
+	_, _, got = uc.ForwardAuth(req("/reports/daily", login.AuthTok))
+	assert.Nil(t, got)
+	t.Cleanup(func() {
+		models.ForwardAuthPolicy = []models.PolicyRule{}
+		uc.DbColl.DeleteMany(ctx, bson.M{})
+		uc.DbColl.Database().Client().Disconnect(ctx)
+	})
+}
+
+func TestSessions(t *testing.T) {
+	uc, err := testConnectDatabase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ctx := context.Background()
+	uc.DbColl.DeleteMany(ctx, bson.M{})
+	db := uc.DbColl.Database()
+	db.Collection("sessions").Drop(ctx)
+	assert.Nil(t, uc.EnsureSessionIndexes())
+
+	usr := models.User{Name: "Hermia Lorkins", Email: "hlorkinsa@cnet.com", Role: models.EndUser, Auth: "Gk8Jd3Fs5"}
+	assert.Nil(t, uc.NewUser(&usr))
+	login := models.User{Email: usr.Email, Auth: "Gk8Jd3Fs5"}
+	assert.Nil(t, uc.Authenticate(&login))
+	valid, got := uc.CheckCSRF(login.AuthTok, "")
+	assert.False(t, valid, "token without a session taken for a session token")
+	assert.Nil(t, got)
+	sess, got := uc.StartSession(&login)
+	assert.Nil(t, got)
+	assert.NotEmpty(t, sess.Refresh)
+	assert.NotEmpty(t, sess.CSRF)
+	valid, got = uc.CheckCSRF(login.AuthTok, sess.CSRF)
+	assert.True(t, valid)
+	assert.Nil(t, got)
+	valid, got = uc.CheckCSRF(login.AuthTok, "forged")
+	assert.True(t, valid)
+	assert.NotNil(t, got, "session token let through with the wrong csrf token")
+	assert.Nil(t, uc.Authorize(login.AuthTok))
+
+	_, _, got = uc.RefreshSession(sess.Refresh, "forged")
+	assert.NotNil(t, got, "session refreshed without the csrf token")
+	refreshed, next, got := uc.RefreshSession(sess.Refresh, sess.CSRF)
+	assert.Nil(t, got)
+	assert.Equal(t, usr.Id, refreshed.Id)
+	valid, got = uc.CheckCSRF(refreshed.AuthTok, sess.CSRF)
+	assert.True(t, valid)
+	assert.Nil(t, got, "csrf token of the session changed on refresh")
+	_, _, got = uc.RefreshSession(sess.Refresh, sess.CSRF)
+	assert.NotNil(t, got, "refresh token of the session used twice")
+
+	assert.Nil(t, uc.RevokeTokens(usr.Id.Hex()))
+	_, _, got = uc.RefreshSession(next.Refresh, sess.CSRF)
+	assert.NotNil(t, got, "session refreshed after the tokens of the account were revoked")
+
+	login = models.User{Email: usr.Email, Auth: "Gk8Jd3Fs5"}
+	assert.Nil(t, uc.Authenticate(&login))
+	sess, _ = uc.StartSession(&login)
+	assert.NotNil(t, uc.EndSession(sess.Refresh, "forged"), "session ended without the csrf token")
+	assert.Nil(t, uc.EndSession(sess.Refresh, sess.CSRF))
+	assert.Nil(t, uc.EndSession(sess.Refresh, sess.CSRF), "ending a session that is gone is an error")
+	_, _, got = uc.RefreshSession(sess.Refresh, sess.CSRF)
+	assert.NotNil(t, got, "session refreshed after logout")
+	t.Cleanup(func() {
+		db.Collection("sessions").Drop(ctx)
+		uc.DbColl.DeleteMany(ctx, bson.M{})
+		uc.DbColl.Database().Client().Disconnect(ctx)
+	})
+}
+
+// TestServerMaintainedFields : fields the server maintains cannot be bound from the request nor carried into a new account
+func TestServerMaintainedFields(t *testing.T) {
+	uc, err := testConnectDatabase()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ctx := context.Background()
+	uc.DbColl.DeleteMany(ctx, bson.M{})
+	usr := models.User{}
+	payload := `{"name": "Ailbert Sproat", "email": "asproatb@ehow.com", "auth": "Mn5Bv8Cx2", "emailverifiedat": 1, "tokgen": 1, "invitehash": "x", "pendingemail": "a@b.com", "emailchghash": "x"}`
+	assert.Nil(t, json.Unmarshal([]byte(payload), &usr))
+	assert.Equal(t, int64(0), usr.EmailVerifiedAt, "emailverifiedat bound from the request")
+	assert.Empty(t, usr.InviteHash)
+	assert.Empty(t, usr.PendingEmail)
+	usr.Role, usr.EmailVerifiedAt, usr.TokenGen, usr.EmailChangeHash = models.EndUser, 1, 1, "x"
+	assert.Nil(t, uc.NewUser(&usr))
+	stored := models.User{}
+	assert.Nil(t, uc.FindUser(usr.Id.Hex(), &stored))
+	assert.Equal(t, int64(0), stored.EmailVerifiedAt, "new account has its email verified")
+	assert.Equal(t, int64(0), stored.TokenGen)
+	assert.Empty(t, stored.EmailChangeHash)
+	t.Cleanup(func() {
+		uc.DbColl.DeleteMany(ctx, bson.M{})
+		uc.DbColl.Database().Client().Disconnect(ctx)
+	})
+}